@@ -1,6 +1,717 @@
 package godata
 
+import (
+	"regexp"
+	"strings"
+)
+
+// A transformation in the pipeline of an $apply, e.g. filter(Amount gt 5) or
+// groupby((Country),aggregate(Amount with sum as Total)). Each transformation
+// is applied to the set produced by the one before it.
+type ApplyTransformation interface {
+	// The name of the transformation, e.g. groupby.
+	Kind() string
+}
+
+// Aggregates the whole input set into a single instance, e.g.
+// aggregate(Amount with sum as Total,$count as Count).
+type ApplyAggregate struct {
+	Aggregates []*ApplyAggregateExpression
+}
+
+type ApplyAggregateExpression struct {
+	// The aggregated value, e.g. Amount or Price mul Quantity. Nil for $count.
+	Expression *GoDataFilterQuery
+	// sum, min, max, average, countdistinct, $count, or the qualified name of
+	// a custom aggregation method.
+	Method string
+	// The name of the property the aggregate is stored in.
+	Alias string
+	// The Edm type of the aggregate, set when the query is semanticized.
+	Type string
+}
+
+// Splits the input set into groups of instances with the same values of the
+// grouping properties, applies the transformations to each group, and merges
+// the results, e.g. groupby((Country),aggregate(Amount with sum as Total)).
+type ApplyGroupBy struct {
+	Paths []*GoDataFilterQuery
+	// The transformations applied to each group. Empty if the groups are only
+	// collapsed into their grouping properties.
+	Transformations []ApplyTransformation
+}
+
+// Keeps the instances of the input set that satisfy the filter.
+type ApplyFilter struct {
+	Filter *GoDataFilterQuery
+}
+
+// Adds computed properties to each instance of the input set, e.g.
+// compute(Price mul Quantity as Total).
+type ApplyCompute struct {
+	ComputeItems []*ComputeItem
+}
+
+// A computed property, e.g. Price mul Quantity as Total.
+type ComputeItem struct {
+	Expression *GoDataFilterQuery
+	Alias      string
+	// The Edm type of the computed value, and the property it is stored in,
+	// set when the query is semanticized.
+	Type     string
+	Property *GoDataProperty
+}
+
+// Keeps the instances with the highest or lowest values, e.g.
+// topcount(5,Amount).
+type ApplyTop struct {
+	// topcount, bottomcount, topsum, bottomsum, toppercent or bottompercent.
+	Method string
+	// The number of instances, or the sum or percentage of the values, to keep.
+	Amount *GoDataFilterQuery
+	Value  *GoDataFilterQuery
+}
+
+// Applies each sequence of transformations to the input set, and
+// concatenates the results.
+type ApplyConcat struct {
+	Sequences [][]ApplyTransformation
+}
+
+// Expands a navigation property of each instance, e.g.
+// expand(Sales,filter(Amount gt 5)).
+type ApplyExpand struct {
+	Path string
+	// The navigation property expanded, set when the query is semanticized.
+	NavigationProperty *GoDataNavigationProperty
+	Filter             *GoDataFilterQuery
+	Expand             []*ApplyExpand
+}
+
+// Keeps the instances that match the search.
+type ApplySearch struct {
+	Search *GoDataSearchQuery
+}
+
+// Leaves the input set as it is.
+type ApplyIdentity struct{}
+
+func (t *ApplyAggregate) Kind() string { return "aggregate" }
+func (t *ApplyGroupBy) Kind() string   { return "groupby" }
+func (t *ApplyFilter) Kind() string    { return "filter" }
+func (t *ApplyCompute) Kind() string   { return "compute" }
+func (t *ApplyTop) Kind() string       { return t.Method }
+func (t *ApplyConcat) Kind() string    { return "concat" }
+func (t *ApplyExpand) Kind() string    { return "expand" }
+func (t *ApplySearch) Kind() string    { return "search" }
+func (t *ApplyIdentity) Kind() string  { return "identity" }
+
+var applyAliasRegexp = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+// The aggregation methods defined by OData. Custom methods have qualified
+// names.
+var applyAggregationMethods = map[string]bool{
+	"sum":           true,
+	"min":           true,
+	"max":           true,
+	"average":       true,
+	"countdistinct": true,
+}
+
+var applyTopMethods = map[string]bool{
+	"topcount":      true,
+	"bottomcount":   true,
+	"topsum":        true,
+	"bottomsum":     true,
+	"toppercent":    true,
+	"bottompercent": true,
+}
+
 func ParseApplyString(apply string) (*GoDataApplyQuery, error) {
-	result := GoDataApplyQuery(apply)
-	return &result, nil
+	return ParseApplyStringWithFunctions(apply, nil, GlobalFilterFunctions)
+}
+
+// Parse an $apply whose expressions may refer to parameter aliases and call
+// the functions in the given table.
+func ParseApplyStringWithFunctions(apply string, aliases map[string]string, functions *FilterFunctionTable) (*GoDataApplyQuery, error) {
+	p := &applyParser{aliases, functions}
+	transformations, err := p.parseSequence(apply)
+	if err != nil {
+		return nil, err
+	}
+	return &GoDataApplyQuery{Transformations: transformations}, nil
+}
+
+type applyParser struct {
+	aliases   map[string]string
+	functions *FilterFunctionTable
+}
+
+// Parse transformations separated by slashes.
+func (p *applyParser) parseSequence(sequence string) ([]ApplyTransformation, error) {
+	parts, err := splitTopLevel(sequence, '/')
+	if err != nil {
+		return nil, err
+	}
+	result := []ApplyTransformation{}
+	for _, part := range parts {
+		transformation, err := p.parseTransformation(strings.TrimSpace(part))
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, transformation)
+	}
+	return result, nil
+}
+
+func (p *applyParser) parseTransformation(s string) (ApplyTransformation, error) {
+	if s == "identity" {
+		return &ApplyIdentity{}, nil
+	}
+	name, body, ok := splitCall(s)
+	if !ok {
+		return nil, BadRequestError("Invalid transformation '" + s + "' in $apply.")
+	}
+	args, err := splitTopLevel(body, ',')
+	if err != nil {
+		return nil, err
+	}
+
+	switch name {
+	case "aggregate":
+		result := &ApplyAggregate{}
+		for _, arg := range args {
+			aggregate, err := p.parseAggregate(strings.TrimSpace(arg))
+			if err != nil {
+				return nil, err
+			}
+			result.Aggregates = append(result.Aggregates, aggregate)
+		}
+		return result, nil
+	case "groupby":
+		return p.parseGroupBy(s, args)
+	case "filter":
+		filter, err := p.functions.ParseFilter(body, p.aliases)
+		if err != nil {
+			return nil, err
+		}
+		return &ApplyFilter{Filter: filter}, nil
+	case "compute":
+		result := &ApplyCompute{}
+		for _, arg := range args {
+			item, err := p.parseComputeItem(strings.TrimSpace(arg))
+			if err != nil {
+				return nil, err
+			}
+			result.ComputeItems = append(result.ComputeItems, item)
+		}
+		return result, nil
+	case "concat":
+		if len(args) < 2 {
+			return nil, BadRequestError("concat takes at least 2 sequences of transformations in '" + s + "'.")
+		}
+		result := &ApplyConcat{}
+		for _, arg := range args {
+			sequence, err := p.parseSequence(arg)
+			if err != nil {
+				return nil, err
+			}
+			result.Sequences = append(result.Sequences, sequence)
+		}
+		return result, nil
+	case "expand":
+		return p.parseExpand(s, args)
+	case "search":
+		search, err := ParseSearchString(body)
+		if err != nil {
+			return nil, err
+		}
+		return &ApplySearch{Search: search}, nil
+	}
+
+	if applyTopMethods[name] {
+		if len(args) != 2 {
+			return nil, BadRequestError(name + " takes 2 arguments in '" + s + "'.")
+		}
+		amount, err := p.functions.ParseFilter(args[0], p.aliases)
+		if err != nil {
+			return nil, err
+		}
+		value, err := p.functions.ParseFilter(args[1], p.aliases)
+		if err != nil {
+			return nil, err
+		}
+		return &ApplyTop{Method: name, Amount: amount, Value: value}, nil
+	}
+
+	return nil, BadRequestError("Unknown transformation " + name + " in $apply.")
+}
+
+// Parse an aggregate expression, e.g. Amount with sum as Total or $count as
+// Count.
+func (p *applyParser) parseAggregate(s string) (*ApplyAggregateExpression, error) {
+	expression, alias, err := splitAlias(s)
+	if err != nil {
+		return nil, err
+	}
+	if expression == "$count" {
+		return &ApplyAggregateExpression{Method: "$count", Alias: alias}, nil
+	}
+
+	with := indexTopLevelWord(expression, "with")
+	if with < 0 {
+		return nil, BadRequestError("Expected an aggregation method, e.g. 'with sum', in '" + s + "'.")
+	}
+	method := strings.TrimSpace(expression[with+len("with"):])
+	if !applyAggregationMethods[method] && !(strings.Contains(method, ".") && filterFunctionNameRegexp.MatchString(method)) {
+		return nil, BadRequestError("Unknown aggregation method " + method + " in '" + s + "'.")
+	}
+	filter, err := p.functions.ParseFilter(expression[:with], p.aliases)
+	if err != nil {
+		return nil, err
+	}
+	return &ApplyAggregateExpression{Expression: filter, Method: method, Alias: alias}, nil
+}
+
+// Parse a computed property, e.g. Price mul Quantity as Total.
+func (p *applyParser) parseComputeItem(s string) (*ComputeItem, error) {
+	expression, alias, err := splitAlias(s)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := p.functions.ParseFilter(expression, p.aliases)
+	if err != nil {
+		return nil, err
+	}
+	return &ComputeItem{Expression: filter, Alias: alias}, nil
+}
+
+func (p *applyParser) parseGroupBy(s string, args []string) (ApplyTransformation, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, BadRequestError("groupby takes the grouping properties and optionally a sequence of " +
+			"transformations in '" + s + "'.")
+	}
+	paths := strings.TrimSpace(args[0])
+	if !strings.HasPrefix(paths, "(") || !strings.HasSuffix(paths, ")") {
+		return nil, BadRequestError("The grouping properties must be in parentheses in '" + s + "'.")
+	}
+	parts, err := splitTopLevel(paths[1:len(paths)-1], ',')
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ApplyGroupBy{}
+	for _, part := range parts {
+		if strings.HasPrefix(strings.TrimSpace(part), "rollup(") {
+			return nil, NotImplementedError("rollup is not supported in groupby.")
+		}
+		path, err := p.functions.ParseFilter(part, p.aliases)
+		if err != nil {
+			return nil, err
+		}
+		result.Paths = append(result.Paths, path)
+	}
+	if len(args) == 2 {
+		result.Transformations, err = p.parseSequence(args[1])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// Parse an expand transformation, e.g. expand(Sales,filter(Amount gt 5)).
+func (p *applyParser) parseExpand(s string, args []string) (*ApplyExpand, error) {
+	result := &ApplyExpand{Path: strings.TrimSpace(args[0])}
+	for _, arg := range args[1:] {
+		name, body, ok := splitCall(strings.TrimSpace(arg))
+		if !ok {
+			return nil, BadRequestError("Expected filter or expand in '" + s + "'.")
+		}
+		switch name {
+		case "filter":
+			filter, err := p.functions.ParseFilter(body, p.aliases)
+			if err != nil {
+				return nil, err
+			}
+			result.Filter = filter
+		case "expand":
+			nestedArgs, err := splitTopLevel(body, ',')
+			if err != nil {
+				return nil, err
+			}
+			nested, err := p.parseExpand(arg, nestedArgs)
+			if err != nil {
+				return nil, err
+			}
+			result.Expand = append(result.Expand, nested)
+		default:
+			return nil, BadRequestError("Expected filter or expand in '" + s + "'.")
+		}
+	}
+	return result, nil
+}
+
+// Split a call, e.g. filter(Amount gt 5), into its name and the text between
+// its parentheses.
+func splitCall(s string) (string, string, bool) {
+	open := strings.Index(s, "(")
+	if open < 1 || !strings.HasSuffix(s, ")") {
+		return "", "", false
+	}
+	return strings.TrimSpace(s[:open]), s[open+1 : len(s)-1], true
+}
+
+// Split an expression followed by an alias, e.g. Price mul 2 as Total.
+func splitAlias(s string) (string, string, error) {
+	as := indexTopLevelWord(s, "as")
+	if as < 0 {
+		return "", "", BadRequestError("Expected 'as' and an alias in '" + s + "'.")
+	}
+	alias := strings.TrimSpace(s[as+len("as"):])
+	if !applyAliasRegexp.MatchString(alias) {
+		return "", "", BadRequestError("Invalid alias '" + alias + "' in '" + s + "'.")
+	}
+	return strings.TrimSpace(s[:as]), alias, nil
+}
+
+// Split s at each occurrence of sep outside of parentheses and quotes.
+func splitTopLevel(s string, sep byte) ([]string, error) {
+	result := []string{}
+	depth := 0
+	start := 0
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+			if depth < 0 {
+				return nil, BadRequestError("Mismatched parentheses in '" + s + "'.")
+			}
+		case c == sep && depth == 0:
+			result = append(result, s[start:i])
+			start = i + 1
+		}
+	}
+	if depth != 0 || quote != 0 {
+		return nil, BadRequestError("Mismatched parentheses or quotes in '" + s + "'.")
+	}
+	return append(result, s[start:]), nil
+}
+
+// Find a word surrounded by spaces, outside of parentheses and quotes, e.g.
+// the as of Price mul 2 as Total. Returns -1 if there is none.
+func indexTopLevelWord(s, word string) int {
+	depth := 0
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ' ' && depth == 0 && strings.HasPrefix(s[i+1:], word+" "):
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// The properties of the set a transformation is applied to, beyond those of
+// the entity type.
+type applyScope struct {
+	computed  map[string]*GoDataProperty
+	remaining map[string]bool
+}
+
+// Check each transformation of an $apply against the entity type it is
+// applied to. The expressions in the transformations are typed, and may
+// refer to the aliases of the transformations before them. After
+// aggregating, only the grouping properties and the aggregates are left.
+func SemanticizeApplyQuery(
+	apply *GoDataApplyQuery,
+	service *GoDataService,
+	entity *GoDataEntityType,
+) error {
+
+	_, err := semanticizeApply(apply, service, entity)
+	return err
+}
+
+// Check an $apply, and return the scope of the set it produces. The other
+// query options of the request are applied to that set.
+func semanticizeApply(apply *GoDataApplyQuery, service *GoDataService, entity *GoDataEntityType) (*applyScope, error) {
+	if apply == nil {
+		return &applyScope{}, nil
+	}
+	return semanticizeTransformations(apply.Transformations, service, entity, &applyScope{})
+}
+
+func semanticizeTransformations(
+	transformations []ApplyTransformation,
+	service *GoDataService,
+	entity *GoDataEntityType,
+	scope *applyScope,
+) (*applyScope, error) {
+
+	var err error
+	for _, transformation := range transformations {
+		scope, err = semanticizeTransformation(transformation, service, entity, scope)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return scope, nil
+}
+
+func semanticizeTransformation(
+	transformation ApplyTransformation,
+	service *GoDataService,
+	entity *GoDataEntityType,
+	scope *applyScope,
+) (*applyScope, error) {
+
+	switch t := transformation.(type) {
+	case *ApplyAggregate:
+		return scope.aggregate(t.Aggregates, service, entity)
+	case *ApplyGroupBy:
+		grouped := map[string]bool{}
+		for _, path := range t.Paths {
+			expr, err := scope.check(path, service, entity)
+			if err != nil {
+				return nil, err
+			}
+			property, ok := expr.(*FilterPropertyExpression)
+			if !ok || property.Variable != "" {
+				return nil, BadRequestError("'" + filterNodeString(path.Tree) + "' is not a property path.")
+			}
+			grouped[property.Segments[0].Name] = true
+		}
+		result := &applyScope{computed: map[string]*GoDataProperty{}, remaining: grouped}
+		for name := range grouped {
+			if computed, ok := scope.computed[name]; ok {
+				result.computed[name] = computed
+			}
+		}
+		inner, err := semanticizeTransformations(t.Transformations, service, entity, scope)
+		if err != nil {
+			return nil, err
+		}
+		// the aliases added by the transformations are left with the groups
+		for name, prop := range inner.computed {
+			if _, ok := scope.computed[name]; !ok {
+				result.computed[name] = prop
+				result.remaining[name] = true
+			}
+		}
+		return result, nil
+	case *ApplyFilter:
+		expr, err := scope.check(t.Filter, service, entity)
+		if err != nil {
+			return nil, err
+		}
+		if typ := expr.EdmType(); typ != GoDataBoolean && typ != GoDataUntyped {
+			return nil, BadRequestError("The filter must be a boolean expression, but '" +
+				filterNodeString(t.Filter.Tree) + "' is " + describeType(typ) + ".")
+		}
+		return scope, nil
+	case *ApplyCompute:
+		result := scope.extend()
+		for _, item := range t.ComputeItems {
+			expr, err := scope.check(item.Expression, service, entity)
+			if err != nil {
+				return nil, err
+			}
+			item.Type = expr.EdmType()
+			if err := result.add(item.Alias, item.Type, service, entity); err != nil {
+				return nil, err
+			}
+			item.Property = result.computed[item.Alias]
+		}
+		return result, nil
+	case *ApplyTop:
+		amount, err := scope.check(t.Amount, service, entity)
+		if err != nil {
+			return nil, err
+		}
+		if !isNumericType(amount.EdmType()) {
+			return nil, BadRequestError("The first argument of " + t.Method + " must be a number, but '" +
+				filterNodeString(t.Amount.Tree) + "' is " + describeType(amount.EdmType()) + ".")
+		}
+		value, err := scope.check(t.Value, service, entity)
+		if err != nil {
+			return nil, err
+		}
+		if typ := value.EdmType(); !isNumericType(typ) && typ != GoDataUntyped {
+			return nil, BadRequestError("The second argument of " + t.Method + " must be a number, but '" +
+				filterNodeString(t.Value.Tree) + "' is " + describeType(typ) + ".")
+		}
+		return scope, nil
+	case *ApplyConcat:
+		var result *applyScope
+		for i, sequence := range t.Sequences {
+			sequenceScope, err := semanticizeTransformations(sequence, service, entity, scope)
+			if err != nil {
+				return nil, err
+			}
+			if i == 0 {
+				result = sequenceScope.extend()
+			} else {
+				result.merge(sequenceScope)
+			}
+		}
+		return result, nil
+	case *ApplyExpand:
+		return scope, semanticizeApplyExpand(t, service, entity)
+	}
+	return scope, nil
+}
+
+// Check the navigation property and the options of an expand
+// transformation.
+func semanticizeApplyExpand(expand *ApplyExpand, service *GoDataService, entity *GoDataEntityType) error {
+	nav, ok := service.NavigationPropertyLookup[entity][expand.Path]
+	if !ok {
+		return BadRequestError("Entity type " + entity.Name + " has no navigational property " + expand.Path)
+	}
+	expand.NavigationProperty = nav
+	target, err := service.LookupEntityType(nav.Type)
+	if err != nil {
+		return err
+	}
+	if err := SemanticizeFilterQuery(expand.Filter, service, target); err != nil {
+		return err
+	}
+	for _, nested := range expand.Expand {
+		if err := semanticizeApplyExpand(nested, service, target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check an expression of a transformation, and store its typed expression.
+func (scope *applyScope) check(query *GoDataFilterQuery, service *GoDataService, entity *GoDataEntityType) (FilterExpression, error) {
+	checker := &filterChecker{
+		service:   service,
+		entity:    entity,
+		open:      service.IsOpenType(entity),
+		computed:  scope.computed,
+		remaining: scope.remaining,
+	}
+	expr, err := checker.check(query.Tree)
+	if err != nil {
+		return nil, err
+	}
+	query.Expression = expr
+	return expr, nil
+}
+
+// Type the aggregates, and return the scope of the aggregated set, which only
+// has the aggregates.
+func (scope *applyScope) aggregate(
+	aggregates []*ApplyAggregateExpression,
+	service *GoDataService,
+	entity *GoDataEntityType,
+) (*applyScope, error) {
+
+	result := &applyScope{computed: map[string]*GoDataProperty{}, remaining: map[string]bool{}}
+	for _, aggregate := range aggregates {
+		aggregate.Type = GoDataDecimal
+		if aggregate.Expression != nil {
+			expr, err := scope.check(aggregate.Expression, service, entity)
+			if err != nil {
+				return nil, err
+			}
+			typ := expr.EdmType()
+			switch aggregate.Method {
+			case "sum", "average":
+				if !isNumericType(typ) && typ != GoDataUntyped {
+					return nil, BadRequestError("Can not " + aggregate.Method + " '" +
+						filterNodeString(aggregate.Expression.Tree) + "' of type " + describeType(typ) + ".")
+				}
+				if aggregate.Method == "sum" || typ == GoDataDecimal {
+					aggregate.Type = typ
+				} else {
+					aggregate.Type = GoDataDouble
+				}
+			case "min", "max":
+				if isUnorderedType(typ) || strings.HasPrefix(typ, "Collection(") {
+					return nil, BadRequestError("Can not take the " + aggregate.Method + " of '" +
+						filterNodeString(aggregate.Expression.Tree) + "' of type " + describeType(typ) + ".")
+				}
+				aggregate.Type = typ
+			case "countdistinct":
+			default:
+				// custom aggregation methods
+				aggregate.Type = GoDataUntyped
+			}
+		}
+		if err := result.add(aggregate.Alias, aggregate.Type, service, entity); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// A copy of the scope, to add computed properties to.
+func (scope *applyScope) extend() *applyScope {
+	result := &applyScope{computed: map[string]*GoDataProperty{}}
+	for name, prop := range scope.computed {
+		result.computed[name] = prop
+	}
+	if scope.remaining != nil {
+		result.remaining = map[string]bool{}
+		for name := range scope.remaining {
+			result.remaining[name] = true
+		}
+	}
+	return result
+}
+
+// Add a computed property, which must not hide a property of the entity type
+// or another computed property.
+func (scope *applyScope) add(alias, typ string, service *GoDataService, entity *GoDataEntityType) error {
+	_, isProperty := service.PropertyLookup[entity][alias]
+	_, isNavigation := service.NavigationPropertyLookup[entity][alias]
+	if _, isComputed := scope.computed[alias]; isProperty || isNavigation || isComputed {
+		return BadRequestError("The alias " + alias + " is already a property of " + entity.Name + ".")
+	}
+	scope.computed[alias] = &GoDataProperty{Name: alias, Type: typ}
+	if scope.remaining != nil {
+		scope.remaining[alias] = true
+	}
+	return nil
+}
+
+// Add the properties of the result of another sequence of transformations
+// to the scope, as concat does.
+func (scope *applyScope) merge(other *applyScope) {
+	for name, prop := range other.computed {
+		scope.computed[name] = prop
+	}
+	if scope.remaining == nil || other.remaining == nil {
+		// a sequence that is not aggregated leaves every property
+		scope.remaining = nil
+		return
+	}
+	for name := range other.remaining {
+		scope.remaining[name] = true
+	}
 }
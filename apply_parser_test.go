@@ -0,0 +1,176 @@
+package godata
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func checkTestApply(apply string) (*GoDataApplyQuery, error) {
+	service, err := BuildService(&DummyProvider{}, "http://localhost")
+	if err != nil {
+		return nil, err
+	}
+	entity, err := service.LookupEntityType("Customer")
+	if err != nil {
+		return nil, err
+	}
+	query, err := ParseApplyString(apply)
+	if err != nil {
+		return nil, err
+	}
+	return query, SemanticizeApplyQuery(query, service, entity)
+}
+
+func TestApplyPipeline(t *testing.T) {
+	input := "filter(Name ne 'x' and contains(Name,'/'))/groupby((Name),aggregate(Age with sum as Total," +
+		"$count as Count))/filter(Total gt 10)/topcount(3,Total)"
+
+	output, err := checkTestApply(input)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(output.Transformations) != 4 {
+		t.Error("Expected 4 transformations, got", len(output.Transformations))
+		return
+	}
+	if output.Transformations[0].(*ApplyFilter).Filter.Tree.Token.Value != "and" {
+		t.Error("Filter not parsed correctly")
+	}
+
+	groupby, ok := output.Transformations[1].(*ApplyGroupBy)
+	if !ok || len(groupby.Paths) != 1 || len(groupby.Transformations) != 1 {
+		t.Error("groupby not parsed correctly")
+		return
+	}
+	if groupby.Paths[0].Expression.(*FilterPropertyExpression).Segments[0].Property.Name != "Name" {
+		t.Error("Grouping property not resolved")
+	}
+	aggregate := groupby.Transformations[0].(*ApplyAggregate)
+	sum, count := aggregate.Aggregates[0], aggregate.Aggregates[1]
+	if sum.Method != "sum" || sum.Alias != "Total" || sum.Type != GoDataInt32 {
+		t.Error("sum not parsed correctly", sum.Method, sum.Alias, sum.Type)
+	}
+	if count.Method != "$count" || count.Alias != "Count" || count.Expression != nil || count.Type != GoDataDecimal {
+		t.Error("$count not parsed correctly")
+	}
+
+	top := output.Transformations[3].(*ApplyTop)
+	if top.Kind() != "topcount" || top.Value.Expression.EdmType() != GoDataInt32 {
+		t.Error("topcount not parsed correctly")
+	}
+}
+
+func TestApplyTransformations(t *testing.T) {
+	input := "compute(Age mul 2 as Double)/aggregate(Double with average as Mean,Name with max as Last)"
+
+	output, err := checkTestApply(input)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	compute := output.Transformations[0].(*ApplyCompute)
+	if compute.ComputeItems[0].Alias != "Double" || compute.ComputeItems[0].Type != GoDataInt32 {
+		t.Error("compute not parsed correctly")
+	}
+	aggregate := output.Transformations[1].(*ApplyAggregate)
+	if aggregate.Aggregates[0].Type != GoDataDouble || aggregate.Aggregates[1].Type != GoDataString {
+		t.Error("Aggregate types not inferred")
+	}
+
+	inputs := []string{
+		"identity",
+		"search(blue OR green)",
+		"expand(Orders,filter(Id eq '1'),expand(Customer))",
+		"concat(aggregate($count as Count),topcount(2,Age))",
+		"groupby((Name))/filter(Name eq 'x')",
+		"groupby((Name),aggregate(Age with Custom.median as Median))",
+	}
+	for _, input := range inputs {
+		if _, err := checkTestApply(input); err != nil {
+			t.Error("Failed to check " + input + ": " + err.Error())
+		}
+	}
+}
+
+func TestApplyErrors(t *testing.T) {
+	testCases := []struct {
+		apply   string
+		message string
+	}{
+		{"aggregate(Name with sum as Total)", "Can not sum 'Name' of type Edm.String"},
+		{"aggregate(Age with median as Total)", "Unknown aggregation method median"},
+		{"aggregate(Age with sum)", "Expected 'as' and an alias"},
+		{"aggregate(Age as Total)", "Expected an aggregation method"},
+		{"aggregate(Age with sum as Name)", "The alias Name is already a property of Customer"},
+		{"aggregate($count as Count)/filter(Age gt 1)", "Age is neither grouped nor aggregated"},
+		{"groupby((Name))/filter(Age gt 1)", "Age is neither grouped nor aggregated"},
+		{"groupby(Name)", "The grouping properties must be in parentheses"},
+		{"filter(Age)", "The filter must be a boolean expression"},
+		{"topcount('a',Age)", "The first argument of topcount must be a number"},
+		{"pivot(Age)", "Unknown transformation pivot"},
+		{"filter(Age gt 1", "Mismatched parentheses"},
+		{"expand(Missing)", "has no navigational property Missing"},
+		{"concat(identity)", "concat takes at least 2 sequences"},
+	}
+
+	for _, testCase := range testCases {
+		_, err := checkTestApply(testCase.apply)
+
+		if err == nil {
+			t.Error("$apply " + testCase.apply + " was accepted")
+			continue
+		}
+		if !strings.Contains(err.Error(), testCase.message) {
+			t.Error("Expected \"" + testCase.message + "\", got \"" + err.Error() + "\"")
+		}
+	}
+}
+
+func TestApplyScopeOfOtherOptions(t *testing.T) {
+	service, err := BuildService(&DummyProvider{}, "http://localhost")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	apply := "groupby((Name),aggregate(Age with sum as Total))"
+	testCases := []struct {
+		query   string
+		message string
+	}{
+		{"$orderby=Total desc", ""},
+		{"$filter=Total gt 5", ""},
+		{"$select=Name,Total", ""},
+		{"$select=*", ""},
+		{"$compute=Total mul 2 as Double&$filter=Double gt 10&$orderby=Double", ""},
+		{"$filter=Age gt 5", "Age is neither grouped nor aggregated"},
+		{"$orderby=Age", "Age is neither grouped nor aggregated"},
+		{"$select=Age", "Age is neither grouped nor aggregated"},
+		{"$compute=Age mul 2 as Double", "Age is neither grouped nor aggregated"},
+		{"$compute=Age mul 2 as Total", "Age is neither grouped nor aggregated"},
+	}
+
+	for _, testCase := range testCases {
+		values, err := url.ParseQuery("$apply=" + url.QueryEscape(apply) + "&" + testCase.query)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		req, err := ParseRequest("Customers", values)
+		if err == nil {
+			err = SemanticizeRequest(req, service)
+		}
+
+		if testCase.message == "" && err != nil {
+			t.Error(testCase.query+" was rejected:", err)
+		} else if testCase.message != "" && (err == nil || !strings.Contains(err.Error(), testCase.message)) {
+			t.Error(testCase.query+" was not rejected with \""+testCase.message+"\":", err)
+		}
+	}
+}
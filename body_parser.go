@@ -0,0 +1,146 @@
+package godata
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The payload of a POST, PUT or PATCH request. Each property in the body is
+// linked to its metadata once the body is semanticized, so providers can
+// tell declared properties, navigation properties and the dynamic properties
+// of open types apart.
+type GoDataEntityBody struct {
+	Properties []*GoDataBodyProperty
+	// Instance and property annotations sent by the client, keyed by their
+	// full name, e.g. "@odata.type" or "Customer@odata.bind".
+	Annotations map[string]interface{}
+}
+
+type GoDataBodyProperty struct {
+	Name string
+	// The decoded JSON value. Numbers are kept as json.Number so providers
+	// can convert them to the property type without losing precision.
+	Value interface{}
+	// SemanticTypeProperty, SemanticTypeDynamicProperty or SemanticTypeEntity
+	// for navigation properties.
+	SemanticType int
+	// The *GoDataProperty or *GoDataNavigationProperty this value is for. For
+	// dynamic properties the type is taken from the property's @odata.type
+	// annotation, or inferred from the JSON value.
+	SemanticReference interface{}
+}
+
+// Parse the JSON body of a request that creates or updates an entity.
+func ParseEntityBody(body []byte) (*GoDataEntityBody, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+
+	raw := map[string]interface{}{}
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, BadRequestError("Request body is not a valid JSON object: " + err.Error())
+	}
+
+	result := &GoDataEntityBody{
+		Properties:  []*GoDataBodyProperty{},
+		Annotations: map[string]interface{}{},
+	}
+
+	names := make([]string, 0, len(raw))
+	for name := range raw {
+		names = append(names, name)
+	}
+	// keep the properties in a stable order for providers
+	sort.Strings(names)
+
+	for _, name := range names {
+		if strings.Contains(name, "@") {
+			result.Annotations[name] = raw[name]
+		} else {
+			result.Properties = append(result.Properties, &GoDataBodyProperty{
+				Name:  name,
+				Value: raw[name],
+			})
+		}
+	}
+
+	return result, nil
+}
+
+// Compare an entity body to the entity type it is written to. Properties that
+// are not declared are rejected, unless the entity type is open, in which
+// case they are kept as dynamic properties.
+func SemanticizeEntityBody(
+	body *GoDataEntityBody,
+	service *GoDataService,
+	entity *GoDataEntityType,
+) error {
+
+	if body == nil {
+		return nil
+	}
+
+	open := service.IsOpenType(entity)
+
+	for _, prop := range body.Properties {
+		if p, ok := service.PropertyLookup[entity][prop.Name]; ok {
+			prop.SemanticType = SemanticTypeProperty
+			prop.SemanticReference = p
+		} else if p, ok := service.NavigationPropertyLookup[entity][prop.Name]; ok {
+			prop.SemanticType = SemanticTypeEntity
+			prop.SemanticReference = p
+		} else if open {
+			t := jsonValueEdmType(prop.Value)
+			if annotation, ok := body.Annotations[prop.Name+ODataFieldType].(string); ok {
+				t = parseTypeAnnotation(annotation)
+			}
+			prop.SemanticType = SemanticTypeDynamicProperty
+			prop.SemanticReference = &GoDataProperty{Name: prop.Name, Type: t}
+		} else {
+			return BadRequestError("Entity " + entity.Name + " has no property " + prop.Name)
+		}
+	}
+
+	return nil
+}
+
+// Convert the value of an @odata.type annotation, e.g. "#Int32" or
+// "#Namespace.Type", to a qualified type name.
+func parseTypeAnnotation(annotation string) string {
+	t := strings.TrimPrefix(annotation, "#")
+	if strings.HasPrefix(t, "Collection(") {
+		return t
+	}
+	if !strings.Contains(t, ".") {
+		// primitive types may be given without the Edm namespace
+		return "Edm." + t
+	}
+	return t
+}
+
+// Infer the Edm type of a value decoded from a JSON body.
+func jsonValueEdmType(value interface{}) string {
+	switch value.(type) {
+	case string:
+		return GoDataString
+	case bool:
+		return GoDataBoolean
+	case json.Number:
+		number := string(value.(json.Number))
+		if strings.ContainsAny(number, ".eE") {
+			return GoDataDouble
+		}
+		if _, err := strconv.ParseInt(number, 10, 32); err == nil {
+			return GoDataInt32
+		}
+		if _, err := strconv.ParseInt(number, 10, 64); err == nil {
+			return GoDataInt64
+		}
+		return GoDataDecimal
+	case []interface{}:
+		return "Collection(" + GoDataUntyped + ")"
+	}
+	return GoDataUntyped
+}
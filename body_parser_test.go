@@ -0,0 +1,96 @@
+package godata
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestOpenEntityBody(t *testing.T) {
+	service, err := BuildService(&DummyProvider{}, "http://localhost")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	entity, err := service.LookupEntityType("Product")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	input := `{"Name":"Lamp","Color":"Red","Stock":40,"Price":9.5,"Code":"12","Code@odata.type":"#Int64"}`
+
+	body, err := ParseEntityBody([]byte(input))
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = SemanticizeEntityBody(body, service, entity)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	expect := map[string]string{
+		"Code":  GoDataInt64,
+		"Color": GoDataString,
+		"Price": GoDataDouble,
+		"Stock": GoDataInt32,
+	}
+
+	for _, prop := range body.Properties {
+		if prop.Name == "Name" {
+			if prop.SemanticType != SemanticTypeProperty {
+				t.Error("Name is not a declared property")
+			}
+			continue
+		}
+		if prop.SemanticType != SemanticTypeDynamicProperty {
+			t.Error(prop.Name + " is not a dynamic property")
+			continue
+		}
+		actual := prop.SemanticReference.(*GoDataProperty).Type
+		if actual != expect[prop.Name] {
+			t.Error(prop.Name + " has type " + actual + " not " + expect[prop.Name])
+		}
+	}
+
+	// properties are sorted by name, Stock is last
+	if stock, ok := body.Properties[4].Value.(json.Number); !ok || stock.String() != "40" {
+		t.Error("Stock value was not kept as a JSON number")
+	}
+}
+
+func TestClosedEntityBody(t *testing.T) {
+	service, err := BuildService(&DummyProvider{}, "http://localhost")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	entity, err := service.LookupEntityType("Customer")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	body, err := ParseEntityBody([]byte(`{"Name":"Bob","Color":"Red"}`))
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = SemanticizeEntityBody(body, service, entity)
+
+	if err == nil {
+		t.Error("Undeclared property on a closed type was accepted")
+	}
+}
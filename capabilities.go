@@ -0,0 +1,567 @@
+package godata
+
+import (
+	"strconv"
+	"strings"
+)
+
+// The namespace of the Capabilities vocabulary, whose terms describe what
+// the clients of an entity set may do with it.
+const CapabilitiesNamespace = "Org.OData.Capabilities.V1"
+
+// The location of the Capabilities vocabulary, referenced by the metadata of
+// services that annotate their entity sets with it.
+const CapabilitiesVocabularyUri = "https://oasis-tcs.github.io/odata-vocabularies/vocabularies/Org.OData.Capabilities.V1.xml"
+
+// Restrictions of an entity set that are published as an annotation of the
+// Capabilities vocabulary, and enforced by the service. The zero value of
+// each restriction allows everything.
+type GoDataRestrictions interface {
+	Annotation() *GoDataAnnotation
+}
+
+// Restrictions on $filter, published as Capabilities.FilterRestrictions.
+type GoDataFilterRestrictions struct {
+	// Reject every $filter, i.e. Filterable is false.
+	NotFilterable bool
+	// Reject requests for the collection without a $filter.
+	RequiresFilter bool
+	// The properties a $filter must refer to.
+	RequiredProperties []string
+	// The properties a $filter can not refer to.
+	NonFilterableProperties []string
+}
+
+// Restrictions on $orderby, published as Capabilities.SortRestrictions.
+type GoDataSortRestrictions struct {
+	// Reject every $orderby, i.e. Sortable is false.
+	NotSortable              bool
+	AscendingOnlyProperties  []string
+	DescendingOnlyProperties []string
+	NonSortableProperties    []string
+}
+
+// Restrictions on $count, published as Capabilities.CountRestrictions.
+type GoDataCountRestrictions struct {
+	// Reject $count=true, i.e. Countable is false.
+	NotCountable bool
+	// The collection-valued properties that can not be counted in a $filter.
+	NonCountableProperties           []string
+	NonCountableNavigationProperties []string
+}
+
+// Restrictions on $expand, published as Capabilities.ExpandRestrictions.
+type GoDataExpandRestrictions struct {
+	// Reject every $expand, i.e. Expandable is false.
+	NotExpandable           bool
+	NonExpandableProperties []string
+	// The deepest nesting of $expand, or 0 for no limit.
+	MaxLevels int
+}
+
+// Restrictions on creating entities, published as
+// Capabilities.InsertRestrictions.
+type GoDataInsertRestrictions struct {
+	// Reject every POST, i.e. Insertable is false.
+	NotInsertable bool
+	// The properties that can not be given when an entity is created.
+	NonInsertableProperties           []string
+	NonInsertableNavigationProperties []string
+}
+
+// Restrictions on $search, published as Capabilities.SearchRestrictions.
+type GoDataSearchRestrictions struct {
+	// Reject every $search, i.e. Searchable is false.
+	NotSearchable bool
+}
+
+// The restrictions of an entity set, read from its annotations. A nil
+// restriction allows everything.
+type GoDataCapabilities struct {
+	Filter *GoDataFilterRestrictions
+	Sort   *GoDataSortRestrictions
+	Count  *GoDataCountRestrictions
+	Expand *GoDataExpandRestrictions
+	Insert *GoDataInsertRestrictions
+	Search *GoDataSearchRestrictions
+}
+
+func (r *GoDataFilterRestrictions) Annotation() *GoDataAnnotation {
+	return capabilitiesAnnotation("FilterRestrictions",
+		boolValue("Filterable", !r.NotFilterable),
+		boolValue("RequiresFilter", r.RequiresFilter),
+		pathsValue("RequiredProperties", GoDataExpressionPropertyPath, r.RequiredProperties),
+		pathsValue("NonFilterableProperties", GoDataExpressionPropertyPath, r.NonFilterableProperties))
+}
+
+func (r *GoDataSortRestrictions) Annotation() *GoDataAnnotation {
+	return capabilitiesAnnotation("SortRestrictions",
+		boolValue("Sortable", !r.NotSortable),
+		pathsValue("AscendingOnlyProperties", GoDataExpressionPropertyPath, r.AscendingOnlyProperties),
+		pathsValue("DescendingOnlyProperties", GoDataExpressionPropertyPath, r.DescendingOnlyProperties),
+		pathsValue("NonSortableProperties", GoDataExpressionPropertyPath, r.NonSortableProperties))
+}
+
+func (r *GoDataCountRestrictions) Annotation() *GoDataAnnotation {
+	return capabilitiesAnnotation("CountRestrictions",
+		boolValue("Countable", !r.NotCountable),
+		pathsValue("NonCountableProperties", GoDataExpressionPropertyPath, r.NonCountableProperties),
+		pathsValue("NonCountableNavigationProperties", GoDataExpressionNavigationPropertyPath,
+			r.NonCountableNavigationProperties))
+}
+
+func (r *GoDataExpandRestrictions) Annotation() *GoDataAnnotation {
+	annotation := capabilitiesAnnotation("ExpandRestrictions",
+		boolValue("Expandable", !r.NotExpandable),
+		pathsValue("NonExpandableProperties", GoDataExpressionNavigationPropertyPath, r.NonExpandableProperties))
+	if r.MaxLevels > 0 {
+		annotation.Value.PropertyValues = append(annotation.Value.PropertyValues, &GoDataPropertyValue{
+			Property: "MaxLevels",
+			Value:    NewExpression(GoDataExpressionInt, strconv.Itoa(r.MaxLevels)),
+		})
+	}
+	return annotation
+}
+
+func (r *GoDataInsertRestrictions) Annotation() *GoDataAnnotation {
+	return capabilitiesAnnotation("InsertRestrictions",
+		boolValue("Insertable", !r.NotInsertable),
+		pathsValue("NonInsertableProperties", GoDataExpressionPropertyPath, r.NonInsertableProperties),
+		pathsValue("NonInsertableNavigationProperties", GoDataExpressionNavigationPropertyPath,
+			r.NonInsertableNavigationProperties))
+}
+
+func (r *GoDataSearchRestrictions) Annotation() *GoDataAnnotation {
+	return capabilitiesAnnotation("SearchRestrictions", boolValue("Searchable", !r.NotSearchable))
+}
+
+func capabilitiesAnnotation(term string, values ...*GoDataPropertyValue) *GoDataAnnotation {
+	record := NewRecordExpression()
+	for _, value := range values {
+		if value != nil {
+			record.PropertyValues = append(record.PropertyValues, value)
+		}
+	}
+	return &GoDataAnnotation{Term: CapabilitiesNamespace + "." + term, Value: record}
+}
+
+func boolValue(property string, value bool) *GoDataPropertyValue {
+	return &GoDataPropertyValue{Property: property, Value: NewExpression(GoDataExpressionBool, strconv.FormatBool(value))}
+}
+
+// A collection of paths, or nil if there are no paths.
+func pathsValue(property, kind string, paths []string) *GoDataPropertyValue {
+	if len(paths) == 0 {
+		return nil
+	}
+	collection := NewCollectionExpression()
+	for _, path := range paths {
+		collection.Items = append(collection.Items, NewExpression(kind, path))
+	}
+	return &GoDataPropertyValue{Property: property, Value: collection}
+}
+
+// Read the restrictions of an entity set from the unqualified Capabilities
+// annotations of the set, including the annotations targeting it from
+// outside.
+func (service *GoDataService) Capabilities(set *GoDataEntitySet) *GoDataCapabilities {
+	capabilities := &GoDataCapabilities{}
+
+	for _, annotation := range service.entitySetAnnotations(set) {
+		if annotation.Qualifier != "" || annotation.Value == nil {
+			continue
+		}
+		record := annotation.Value
+		isFalse := func(property string) bool {
+			value := record.PropertyValue(property)
+			return value != nil && value.Value == "false"
+		}
+		isTrue := func(property string) bool {
+			value := record.PropertyValue(property)
+			return value != nil && value.Value == "true"
+		}
+		paths := func(property string) []string {
+			return record.PropertyValue(property).ItemValues()
+		}
+
+		switch service.capabilitiesTerm(annotation.Term) {
+		case "FilterRestrictions":
+			capabilities.Filter = &GoDataFilterRestrictions{
+				NotFilterable:           isFalse("Filterable"),
+				RequiresFilter:          isTrue("RequiresFilter"),
+				RequiredProperties:      paths("RequiredProperties"),
+				NonFilterableProperties: paths("NonFilterableProperties"),
+			}
+		case "SortRestrictions":
+			capabilities.Sort = &GoDataSortRestrictions{
+				NotSortable:              isFalse("Sortable"),
+				AscendingOnlyProperties:  paths("AscendingOnlyProperties"),
+				DescendingOnlyProperties: paths("DescendingOnlyProperties"),
+				NonSortableProperties:    paths("NonSortableProperties"),
+			}
+		case "CountRestrictions":
+			capabilities.Count = &GoDataCountRestrictions{
+				NotCountable:                     isFalse("Countable"),
+				NonCountableProperties:           paths("NonCountableProperties"),
+				NonCountableNavigationProperties: paths("NonCountableNavigationProperties"),
+			}
+		case "ExpandRestrictions":
+			capabilities.Expand = &GoDataExpandRestrictions{
+				NotExpandable:           isFalse("Expandable"),
+				NonExpandableProperties: paths("NonExpandableProperties"),
+			}
+			if maxLevels := record.PropertyValue("MaxLevels"); maxLevels != nil {
+				capabilities.Expand.MaxLevels, _ = strconv.Atoi(maxLevels.Value)
+			}
+		case "InsertRestrictions":
+			capabilities.Insert = &GoDataInsertRestrictions{
+				NotInsertable:                     isFalse("Insertable"),
+				NonInsertableProperties:           paths("NonInsertableProperties"),
+				NonInsertableNavigationProperties: paths("NonInsertableNavigationProperties"),
+			}
+		case "SearchRestrictions":
+			capabilities.Search = &GoDataSearchRestrictions{NotSearchable: isFalse("Searchable")}
+		}
+	}
+
+	return capabilities
+}
+
+// The annotations of an entity set, followed by the annotations that target
+// it from outside, e.g. <Annotations Target="Store.Container/Customers">.
+func (service *GoDataService) entitySetAnnotations(set *GoDataEntitySet) []*GoDataAnnotation {
+	if service.Metadata == nil || service.Metadata.DataServices == nil {
+		return set.Annotations
+	}
+	for _, schema := range service.Metadata.DataServices.Schemas {
+		for _, container := range schema.EntityContainers {
+			for _, s := range container.EntitySets {
+				if s == set {
+					return service.LookupAnnotations(schema.Namespace + "." + container.Name + "/" + set.Name)
+				}
+			}
+		}
+	}
+	return set.Annotations
+}
+
+// The name of a term of the Capabilities vocabulary, qualified with either
+// the namespace or an alias of the vocabulary, or an empty string for terms
+// of other vocabularies.
+func (service *GoDataService) capabilitiesTerm(term string) string {
+	term = service.normalizeTarget(term)
+	if !strings.HasPrefix(term, CapabilitiesNamespace+".") {
+		return ""
+	}
+	return strings.TrimPrefix(term, CapabilitiesNamespace+".")
+}
+
+// Reject the query options of a request to an entity set that its
+// Capabilities annotations restrict.
+func (service *GoDataService) checkCapabilities(req *GoDataRequest, set *GoDataEntitySet) error {
+	capabilities := service.Capabilities(set)
+	query := req.Query
+	collection := req.LastSegment.addressesCollection()
+
+	// the paths an expression refers to, with the aliases of $compute and
+	// $apply replaced by the paths they are computed from
+	collector := newCapabilityPaths(set, query)
+	filters := collector.filters()
+
+	if r := capabilities.Filter; r != nil {
+		if len(filters) > 0 && r.NotFilterable {
+			return BadRequestError("The entity set " + set.Name + " can not be filtered.")
+		}
+		if len(filters) == 0 && r.RequiresFilter && collection {
+			return BadRequestError("The entity set " + set.Name + " requires a $filter.")
+		}
+		paths := map[string]bool{}
+		for _, filter := range filters {
+			collector.collect(filter, paths)
+		}
+		// grouping by a property reveals its values just as filtering by it
+		grouped := map[string]bool{}
+		for _, path := range collector.groupings() {
+			collector.collect(path, grouped)
+		}
+		for _, path := range r.NonFilterableProperties {
+			if paths[path] || grouped[path] {
+				return BadRequestError("The property " + path + " of entity set " + set.Name +
+					" can not be used in $filter.")
+			}
+		}
+		if len(filters) > 0 || r.RequiresFilter && collection {
+			for _, path := range r.RequiredProperties {
+				if !paths[path] {
+					return BadRequestError("The $filter of entity set " + set.Name + " must refer to " + path + ".")
+				}
+			}
+		}
+	}
+
+	if r := capabilities.Sort; r != nil && query.OrderBy != nil {
+		if r.NotSortable {
+			return BadRequestError("The entity set " + set.Name + " can not be sorted.")
+		}
+		for _, item := range query.OrderBy.OrderByItems {
+			paths := map[string]bool{}
+			collector.collect(item.Expression, paths)
+			for _, path := range r.NonSortableProperties {
+				if paths[path] {
+					return BadRequestError("The property " + path + " of entity set " + set.Name +
+						" can not be used in $orderby.")
+				}
+			}
+			for _, path := range r.AscendingOnlyProperties {
+				if paths[path] && item.Order == DESC {
+					return BadRequestError("The property " + path + " of entity set " + set.Name +
+						" can only be sorted in ascending order.")
+				}
+			}
+			for _, path := range r.DescendingOnlyProperties {
+				if paths[path] && item.Order == ASC {
+					return BadRequestError("The property " + path + " of entity set " + set.Name +
+						" can only be sorted in descending order.")
+				}
+			}
+		}
+	}
+
+	if r := capabilities.Count; r != nil {
+		counted := query.Count != nil && bool(*query.Count) || req.LastSegment.SemanticType == SemanticTypeCount
+		if counted && r.NotCountable {
+			return BadRequestError("The entity set " + set.Name + " can not be counted.")
+		}
+		paths := map[string]bool{}
+		for _, filter := range filters {
+			collector.collect(filter, paths)
+		}
+		for _, path := range append(r.NonCountableProperties, r.NonCountableNavigationProperties...) {
+			if paths[path+"/$count"] {
+				return BadRequestError("The property " + path + " of entity set " + set.Name + " can not be counted.")
+			}
+		}
+	}
+
+	if r := capabilities.Expand; r != nil && query.Expand != nil {
+		if r.NotExpandable {
+			return BadRequestError("The entity set " + set.Name + " can not be expanded.")
+		}
+		for _, item := range query.Expand.ExpandItems {
+			path := expandPathString(item.Path)
+			for _, nonExpandable := range r.NonExpandableProperties {
+				if path == nonExpandable {
+					return BadRequestError("The property " + path + " of entity set " + set.Name +
+						" can not be expanded.")
+				}
+			}
+		}
+		if r.MaxLevels > 0 && expandDepth(query.Expand) > r.MaxLevels {
+			return BadRequestError("The $expand of entity set " + set.Name + " can be nested at most " +
+				strconv.Itoa(r.MaxLevels) + " levels deep.")
+		}
+	}
+
+	if r := capabilities.Search; r != nil && query.Search != nil && r.NotSearchable {
+		return BadRequestError("The entity set " + set.Name + " can not be searched.")
+	}
+
+	return nil
+}
+
+// Reject the creation of an entity that the Capabilities annotations of its
+// entity set restrict.
+func (service *GoDataService) checkInsertCapabilities(set *GoDataEntitySet, payload *GoDataEntityBody) error {
+	r := service.Capabilities(set).Insert
+	if r == nil {
+		return nil
+	}
+	if r.NotInsertable {
+		return MethodNotAllowedError("Entities can not be created in the entity set " + set.Name + ".")
+	}
+	for _, property := range payload.Properties {
+		for _, name := range append(r.NonInsertableProperties, r.NonInsertableNavigationProperties...) {
+			if property.Name == name {
+				return BadRequestError("The property " + name + " can not be given when an entity is created in " +
+					set.Name + ".")
+			}
+		}
+	}
+	for key := range payload.Annotations {
+		for _, name := range r.NonInsertableNavigationProperties {
+			if key == name+"@odata.bind" {
+				return BadRequestError("The property " + name + " can not be given when an entity is created in " +
+					set.Name + ".")
+			}
+		}
+	}
+	return nil
+}
+
+// Collects the paths of the properties the expressions of a request to an
+// entity set refer to.
+type capabilityPaths struct {
+	set   *GoDataEntitySet
+	query *GoDataQuery
+	// The expressions the aliases of $compute and $apply are computed from,
+	// by alias. Nil for the aggregate $count.
+	aliases map[string]FilterExpression
+}
+
+func newCapabilityPaths(set *GoDataEntitySet, query *GoDataQuery) *capabilityPaths {
+	c := &capabilityPaths{set: set, query: query, aliases: map[string]FilterExpression{}}
+	if query.Apply != nil {
+		c.addAliases(query.Apply.Transformations)
+	}
+	if query.Compute != nil {
+		for _, item := range query.Compute.ComputeItems {
+			c.aliases[item.Alias] = filterExpression(item.Expression)
+		}
+	}
+	return c
+}
+
+func (c *capabilityPaths) addAliases(transformations []ApplyTransformation) {
+	for _, transformation := range transformations {
+		switch t := transformation.(type) {
+		case *ApplyAggregate:
+			for _, aggregate := range t.Aggregates {
+				c.aliases[aggregate.Alias] = filterExpression(aggregate.Expression)
+			}
+		case *ApplyGroupBy:
+			c.addAliases(t.Transformations)
+		case *ApplyCompute:
+			for _, item := range t.ComputeItems {
+				c.aliases[item.Alias] = filterExpression(item.Expression)
+			}
+		case *ApplyConcat:
+			for _, sequence := range t.Sequences {
+				c.addAliases(sequence)
+			}
+		}
+	}
+}
+
+// The expressions that filter the entities: $filter, and the filter
+// transformations of $apply.
+func (c *capabilityPaths) filters() []FilterExpression {
+	filters := []FilterExpression{}
+	if c.query.Apply != nil {
+		c.visitTransformations(c.query.Apply.Transformations, func(t ApplyTransformation) {
+			if filter, ok := t.(*ApplyFilter); ok {
+				filters = append(filters, filterExpression(filter.Filter))
+			}
+		})
+	}
+	if c.query.Filter != nil {
+		filters = append(filters, c.query.Filter.Expression)
+	}
+	return filters
+}
+
+// The grouping properties of the groupby transformations of $apply.
+func (c *capabilityPaths) groupings() []FilterExpression {
+	paths := []FilterExpression{}
+	if c.query.Apply != nil {
+		c.visitTransformations(c.query.Apply.Transformations, func(t ApplyTransformation) {
+			if groupBy, ok := t.(*ApplyGroupBy); ok {
+				for _, path := range groupBy.Paths {
+					paths = append(paths, filterExpression(path))
+				}
+			}
+		})
+	}
+	return paths
+}
+
+func (c *capabilityPaths) visitTransformations(transformations []ApplyTransformation, visit func(ApplyTransformation)) {
+	for _, transformation := range transformations {
+		visit(transformation)
+		switch t := transformation.(type) {
+		case *ApplyGroupBy:
+			c.visitTransformations(t.Transformations, visit)
+		case *ApplyConcat:
+			for _, sequence := range t.Sequences {
+				c.visitTransformations(sequence, visit)
+			}
+		}
+	}
+}
+
+// Collect the paths of the properties an expression refers to, starting
+// from the entity, e.g. Address/City or Orders/$count. Paths starting with
+// $it, or with $root and the entity set itself, start from the entity too,
+// and a computed alias stands for the paths it is computed from.
+func (c *capabilityPaths) collect(expr FilterExpression, paths map[string]bool) {
+	switch e := expr.(type) {
+	case *FilterPropertyExpression:
+		segments := e.Segments
+		switch e.Variable {
+		case "":
+		case "$it":
+		case "$root":
+			if len(segments) == 0 || segments[0].EntitySet != c.set {
+				return
+			}
+			segments = segments[1:]
+		default:
+			// a lambda variable, whose paths start from a related entity
+			return
+		}
+		if len(segments) == 0 {
+			return
+		}
+		if source, ok := c.aliases[segments[0].Name]; ok && e.Variable != "$root" {
+			// the alias is removed so that an alias computed from a
+			// property of the same name is not expanded again
+			delete(c.aliases, segments[0].Name)
+			c.collect(source, paths)
+			c.aliases[segments[0].Name] = source
+			return
+		}
+		names := []string{}
+		for _, segment := range segments {
+			names = append(names, segment.Name)
+			paths[strings.Join(names, "/")] = true
+		}
+	case *FilterBinaryExpression:
+		c.collect(e.Left, paths)
+		c.collect(e.Right, paths)
+	case *FilterUnaryExpression:
+		c.collect(e.Operand, paths)
+	case *FilterFunctionExpression:
+		for _, argument := range e.Arguments {
+			c.collect(argument, paths)
+		}
+	case *FilterLambdaExpression:
+		c.collect(e.Collection, paths)
+		c.collect(e.Predicate, paths)
+	case *FilterListExpression:
+		for _, item := range e.Items {
+			c.collect(item, paths)
+		}
+	}
+}
+
+// The typed expression of a semanticized query, or nil.
+func filterExpression(query *GoDataFilterQuery) FilterExpression {
+	if query == nil {
+		return nil
+	}
+	return query.Expression
+}
+
+// The deepest nesting of an $expand, 1 for an $expand without nested ones.
+func expandDepth(expand *GoDataExpandQuery) int {
+	depth := 0
+	for _, item := range expand.ExpandItems {
+		d := 1
+		if item.Expand != nil {
+			d += expandDepth(item.Expand)
+		}
+		if d > depth {
+			depth = d
+		}
+	}
+	return depth
+}
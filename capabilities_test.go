@@ -0,0 +1,188 @@
+package godata
+
+import (
+	"bytes"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func restrictedMetadata() *GoDataMetadata {
+	schema := NewSchemaBuilder("Store", "Container")
+	customer := schema.EntityType("Customer").Key("Id", GoDataInt32).
+		Property("Name", GoDataString).
+		Property("Age", GoDataInt32).
+		Property("Secret", GoDataString)
+	order := schema.EntityType("Order").Key("Id", GoDataInt32)
+	customer.NavigationProperty("Orders", order, true)
+	customer.NavigationProperty("Referrer", customer, false)
+	order.NavigationProperty("Customer", customer, false)
+	schema.EntitySet("Customers", customer).Restrict(
+		&GoDataFilterRestrictions{RequiresFilter: true, RequiredProperties: []string{"Age"},
+			NonFilterableProperties: []string{"Secret"}},
+		&GoDataSortRestrictions{NonSortableProperties: []string{"Secret"},
+			AscendingOnlyProperties: []string{"Age"}},
+		&GoDataCountRestrictions{NotCountable: true, NonCountableNavigationProperties: []string{"Orders"}},
+		&GoDataExpandRestrictions{NonExpandableProperties: []string{"Referrer"}, MaxLevels: 1},
+		&GoDataInsertRestrictions{NonInsertableProperties: []string{"Age"}},
+		&GoDataSearchRestrictions{NotSearchable: true},
+	)
+	schema.EntitySet("Orders", order).Restrict(&GoDataInsertRestrictions{NotInsertable: true})
+	return schema.Metadata()
+}
+
+func checkTestCapabilities(testUrl string) error {
+	parsedUrl, err := url.Parse(testUrl)
+	if err != nil {
+		return err
+	}
+	request, err := ParseRequest(parsedUrl.Path, parsedUrl.Query())
+	if err != nil {
+		return err
+	}
+	service, err := BuildService(&builtProvider{restrictedMetadata()}, "http://localhost")
+	if err != nil {
+		return err
+	}
+	return SemanticizeRequest(request, service)
+}
+
+func TestCapabilitiesEnforced(t *testing.T) {
+	valid := []string{
+		"Customers?$filter=Age%20gt%2018&$orderby=Name%20desc,Age&$expand=Orders",
+		"Customers(1)?$expand=Orders",
+		"Customers?$filter=$it/Age%20gt%2018",
+		"Customers?$compute=Age%20add%201%20as%20Next&$filter=Next%20gt%2018",
+		"Customers?$apply=filter(Age%20gt%2018)/groupby((Name))",
+	}
+	for _, testUrl := range valid {
+		if err := checkTestCapabilities(testUrl); err != nil {
+			t.Error("Failed to check " + testUrl + ": " + err.Error())
+		}
+	}
+
+	testCases := []struct {
+		url     string
+		message string
+	}{
+		{"Customers", "The entity set Customers requires a $filter"},
+		{"Customers?$filter=Name%20eq%20'Bob'", "The $filter of entity set Customers must refer to Age"},
+		{"Customers?$filter=Age%20gt%201%20and%20Secret%20eq%20'x'", "Secret of entity set Customers can not be used in $filter"},
+		{"Customers?$filter=Age%20gt%201&$orderby=Secret", "Secret of entity set Customers can not be used in $orderby"},
+		{"Customers?$filter=Age%20gt%201&$orderby=Age%20desc", "Age of entity set Customers can only be sorted in ascending order"},
+		{"Customers?$filter=Age%20gt%201&$count=true", "The entity set Customers can not be counted"},
+		{"Customers?$filter=Age%20gt%201%20and%20Orders/$count%20gt%201", "The property Orders of entity set Customers can not be counted"},
+		{"Customers?$filter=Age%20gt%201&$expand=Referrer", "The property Referrer of entity set Customers can not be expanded"},
+		{"Customers?$filter=Age%20gt%201&$expand=Orders($expand=Customer)", "can be nested at most 1 levels deep"},
+		{"Customers?$filter=Age%20gt%201&$search=blue", "The entity set Customers can not be searched"},
+		{"Customers?$filter=Age%20gt%201%20and%20$it/Secret%20eq%20'x'", "Secret of entity set Customers can not be used in $filter"},
+		{"Customers?$filter=Age%20gt%201%20and%20$root/Customers(1)/Secret%20eq%20'x'",
+			"Secret of entity set Customers can not be used in $filter"},
+		{"Customers?$compute=Secret%20as%20Hint&$filter=Age%20gt%201%20and%20Hint%20eq%20'x'",
+			"Secret of entity set Customers can not be used in $filter"},
+		{"Customers?$compute=Secret%20as%20Hint&$filter=Age%20gt%201&$orderby=Hint",
+			"Secret of entity set Customers can not be used in $orderby"},
+		{"Customers?$apply=filter(Age%20gt%201%20and%20Secret%20eq%20'x')", "Secret of entity set Customers can not be used in $filter"},
+		{"Customers?$apply=filter(Age%20gt%201)/groupby((Secret))", "Secret of entity set Customers can not be used in $filter"},
+		{"Customers?$apply=groupby((Name))", "The entity set Customers requires a $filter"},
+		{"Customers/$count", "The entity set Customers requires a $filter"},
+		{"Customers/$count?$filter=Age%20gt%201%20and%20Secret%20eq%20'x'", "Secret of entity set Customers can not be used in $filter"},
+		{"Customers/$count?$filter=Age%20gt%201", "The entity set Customers can not be counted"},
+	}
+	for _, testCase := range testCases {
+		err := checkTestCapabilities(testCase.url)
+
+		if err == nil {
+			t.Error(testCase.url + " was accepted")
+			continue
+		}
+		if !strings.Contains(err.Error(), testCase.message) {
+			t.Error("Expected \"" + testCase.message + "\", got \"" + err.Error() + "\"")
+		}
+	}
+}
+
+func TestCapabilitiesInsert(t *testing.T) {
+	service, err := BuildService(&builtProvider{restrictedMetadata()}, "http://localhost")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	customers, _ := service.LookupEntitySet("Customers")
+	orders, _ := service.LookupEntitySet("Orders")
+
+	payload := &GoDataEntityBody{Properties: []*GoDataBodyProperty{&GoDataBodyProperty{Name: "Name"}}}
+	if err := service.checkInsertCapabilities(customers, payload); err != nil {
+		t.Error(err)
+	}
+	payload.Properties = append(payload.Properties, &GoDataBodyProperty{Name: "Age"})
+	if err := service.checkInsertCapabilities(customers, payload); err == nil {
+		t.Error("A non-insertable property was accepted")
+	}
+	err = service.checkInsertCapabilities(orders, payload)
+	if goDataErr, ok := err.(*GoDataError); !ok || goDataErr.ResponseCode != 405 {
+		t.Error("Expected a 405 for a non-insertable entity set, got", err)
+	}
+}
+
+func TestCapabilitiesPublished(t *testing.T) {
+	metadata := restrictedMetadata()
+
+	xmlBytes, err := metadata.Bytes()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	xmlString := string(xmlBytes)
+	expected := []string{
+		`<edmx:Reference Uri="` + CapabilitiesVocabularyUri + `">`,
+		`<Annotation Term="Org.OData.Capabilities.V1.SortRestrictions">`,
+		`<PropertyValue Property="Sortable" Bool="true"></PropertyValue>`,
+		`<PropertyPath>Secret</PropertyPath>`,
+		`<PropertyValue Property="MaxLevels" Int="1"></PropertyValue>`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(xmlString, e) {
+			t.Error("Expected " + e + " in\n" + xmlString)
+		}
+	}
+
+	jsonBytes, err := metadata.Json()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !strings.Contains(string(jsonBytes), `"$PropertyPath": "Secret"`) {
+		t.Error("Restrictions not published in CSDL JSON:", string(jsonBytes))
+	}
+
+	// the restrictions read back from both documents are the ones published
+	built, _ := BuildService(&builtProvider{metadata}, "http://localhost")
+	builtSet, _ := built.LookupEntitySet("Customers")
+	want := built.Capabilities(builtSet)
+
+	fromXml, err := ParseMetadata(bytes.NewReader(xmlBytes))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	fromJson, err := ParseMetadataJson(bytes.NewReader(jsonBytes))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for _, parsed := range []*GoDataMetadata{fromXml, fromJson} {
+		service, err := BuildService(&builtProvider{parsed}, "http://localhost")
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		set, _ := service.LookupEntitySet("Customers")
+		if got := service.Capabilities(set); !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected %+v, got %+v", want.Filter, got.Filter)
+		}
+	}
+}
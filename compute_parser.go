@@ -0,0 +1,98 @@
+package godata
+
+import (
+	"strings"
+)
+
+func ParseComputeString(compute string) (*GoDataComputeQuery, error) {
+	return ParseComputeStringWithFunctions(compute, nil, GlobalFilterFunctions)
+}
+
+// Parse a $compute, e.g. Price mul Quantity as Total,tolower(Name) as Lower.
+// Each expression is parsed with the filter grammar, so it may refer to
+// parameter aliases and call the functions in the given table.
+func ParseComputeStringWithFunctions(compute string, aliases map[string]string, functions *FilterFunctionTable) (*GoDataComputeQuery, error) {
+	parts, err := splitTopLevel(compute, ',')
+	if err != nil {
+		return nil, err
+	}
+
+	p := &applyParser{aliases, functions}
+	result := &GoDataComputeQuery{}
+	for _, part := range parts {
+		item, err := p.parseComputeItem(strings.TrimSpace(part))
+		if err != nil {
+			return nil, err
+		}
+		result.ComputeItems = append(result.ComputeItems, item)
+	}
+	return result, nil
+}
+
+// A deep copy of an unsemanticized $compute.
+func cloneComputeQuery(compute *GoDataComputeQuery) *GoDataComputeQuery {
+	if compute == nil {
+		return nil
+	}
+	copied := &GoDataComputeQuery{ComputeItems: make([]*ComputeItem, len(compute.ComputeItems))}
+	for i, item := range compute.ComputeItems {
+		copied.ComputeItems[i] = &ComputeItem{Expression: cloneFilterQuery(item.Expression), Alias: item.Alias}
+	}
+	return copied
+}
+
+// Type each computed property against the entity type. The aliases must not
+// hide a property of the entity type, and can then be used in $filter,
+// $orderby and $select.
+func SemanticizeComputeQuery(
+	compute *GoDataComputeQuery,
+	service *GoDataService,
+	entity *GoDataEntityType,
+) error {
+
+	_, err := semanticizeCompute(compute, service, entity, &applyScope{})
+	return err
+}
+
+// Type each computed property against the set produced by an $apply, and
+// return the scope of that set with the computed properties added.
+func semanticizeCompute(
+	compute *GoDataComputeQuery,
+	service *GoDataService,
+	entity *GoDataEntityType,
+	input *applyScope,
+) (*applyScope, error) {
+
+	scope := input.extend()
+	if compute == nil {
+		return scope, nil
+	}
+
+	// the expressions can not refer to each other
+	for _, item := range compute.ComputeItems {
+		expr, err := input.check(item.Expression, service, entity)
+		if err != nil {
+			return nil, err
+		}
+		item.Type = expr.EdmType()
+		if err := scope.add(item.Alias, item.Type, service, entity); err != nil {
+			return nil, err
+		}
+		item.Property = scope.computed[item.Alias]
+	}
+	return scope, nil
+}
+
+// The computed properties by alias. Empty until the query is semanticized.
+func (compute *GoDataComputeQuery) properties() map[string]*GoDataProperty {
+	result := map[string]*GoDataProperty{}
+	if compute == nil {
+		return result
+	}
+	for _, item := range compute.ComputeItems {
+		if item.Property != nil {
+			result[item.Alias] = item.Property
+		}
+	}
+	return result
+}
@@ -21,6 +21,14 @@ func MethodNotAllowedError(message string) *GoDataError {
 	return &GoDataError{405, message}
 }
 
+func NotAcceptableError(message string) *GoDataError {
+	return &GoDataError{406, message}
+}
+
+func ConflictError(message string) *GoDataError {
+	return &GoDataError{409, message}
+}
+
 func GoneError(message string) *GoDataError {
 	return &GoDataError{410, message}
 }
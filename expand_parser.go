@@ -2,6 +2,7 @@ package godata
 
 import (
 	"strconv"
+	"strings"
 )
 
 const (
@@ -14,20 +15,39 @@ const (
 	ExpandTokenLiteral
 )
 
+// The value of ExpandItem.Levels for $levels=max, which expands as many
+// levels as the service allows.
+const ExpandLevelsMax = -1
+
+// The number of levels $levels=max expands to, unless the service sets
+// another limit.
+const DefaultMaxExpandLevels = 5
+
 var GlobalExpandTokenizer = ExpandTokenizer()
 
 // Represents an item to expand in an OData query. Tracks the path of the entity
 // to expand and also the filter, levels, and reference options, etc.
 type ExpandItem struct {
-	Path    []*Token
+	Path []*Token
+	// Set when the path ends in $ref, e.g. Category/$ref, to expand only the
+	// references to the related entities.
+	IsRef bool
+	// Set when the path ends in $count, e.g. Orders/$count, to expand only
+	// the number of related entities.
+	IsCount bool
 	Filter  *GoDataFilterQuery
 	Search  *GoDataSearchQuery
 	OrderBy *GoDataOrderByQuery
 	Skip    *GoDataSkipQuery
 	Top     *GoDataTopQuery
+	Count   *GoDataCountQuery
 	Select  *GoDataSelectQuery
 	Expand  *GoDataExpandQuery
+	Compute *GoDataComputeQuery
 	Levels  int
+	// The $levels the item was given, kept after Levels has been replaced
+	// with nested items, to check that the path leads back to its own type.
+	levels int
 }
 
 func ExpandTokenizer() *Tokenizer {
@@ -44,197 +64,128 @@ func ExpandTokenizer() *Tokenizer {
 }
 
 func ParseExpandString(expand string) (*GoDataExpandQuery, error) {
-	tokens, err := GlobalExpandTokenizer.Tokenize(expand)
+	return ParseExpandStringWithFunctions(expand, nil, GlobalFilterFunctions)
+}
 
+// Parse an $expand whose items are paths, e.g. Orders/Items or
+// Category/$ref, optionally followed by options in parentheses. The
+// expressions in the options may refer to parameter aliases and call the
+// functions in the given table.
+func ParseExpandStringWithFunctions(expand string, aliases map[string]string, functions *FilterFunctionTable) (*GoDataExpandQuery, error) {
+	parts, err := splitTopLevel(expand, ',')
 	if err != nil {
-		return nil, err
+		return nil, BadRequestError("Mismatched parentheses in expand clause.")
 	}
 
-	stack := tokenStack{}
-	queue := tokenQueue{}
 	items := make([]*ExpandItem, 0)
 
-	for len(tokens) > 0 {
-		token := tokens[0]
-		tokens = tokens[1:]
-
-		if token.Value == "(" {
-			queue.Enqueue(token)
-			stack.Push(token)
-		} else if token.Value == ")" {
-			queue.Enqueue(token)
-			stack.Pop()
-		} else if token.Value == "," {
-			if stack.Empty() {
-				// no paren on the stack, parse this item and start a new queue
-				item, err := ParseExpandItem(queue)
-				if err != nil {
-					return nil, err
-				}
-				items = append(items, item)
-				queue = tokenQueue{}
-			} else {
-				// this comma is inside a nested expression, keep it in the queue
-				queue.Enqueue(token)
-			}
-		} else {
-			queue.Enqueue(token)
+	for _, part := range parts {
+		item, err := parseExpandItem(strings.TrimSpace(part), aliases, functions)
+		if err != nil {
+			return nil, err
 		}
+		items = append(items, item)
 	}
 
-	if !stack.Empty() {
-		return nil, BadRequestError("Mismatched parentheses in expand clause.")
-	}
-
-	item, err := ParseExpandItem(queue)
-	if err != nil {
-		return nil, err
-	}
-	items = append(items, item)
-
 	return &GoDataExpandQuery{ExpandItems: items}, nil
 }
 
-func ParseExpandItem(input tokenQueue) (*ExpandItem, error) {
-
-	item := &ExpandItem{}
-	item.Path = []*Token{}
-
-	stack := &tokenStack{}
-	queue := &tokenQueue{}
-
-	for !input.Empty() {
-		token := input.Dequeue()
-		if token.Value == "(" {
-			if !stack.Empty() {
-				// this is a nested slash, it belongs on the queue
-				queue.Enqueue(token)
-			} else {
-				// top level slash means we're done parsing the path
-				item.Path = append(item.Path, queue.Dequeue())
-			}
-			stack.Push(token)
-		} else if token.Value == ")" {
-			stack.Pop()
-			if !stack.Empty() {
-				// this is a nested slash, it belongs on the queue
-				queue.Enqueue(token)
-			} else {
-				// top level slash means we're done parsing the options
-				err := ParseExpandOption(queue, item)
-				if err != nil {
-					return nil, err
-				}
-				// reset the queue
-				queue = &tokenQueue{}
-			}
-		} else if token.Value == "/" && stack.Empty() {
-			// at root level, slashes separate path segments
-			item.Path = append(item.Path, queue.Dequeue())
-		} else if token.Value == ";" && stack.Size == 1 {
-			// semicolons only split expand options at the first level
-			err := ParseExpandOption(queue, item)
-			if err != nil {
-				return nil, err
-			}
-			// reset the queue
-			queue = &tokenQueue{}
-		} else {
-			queue.Enqueue(token)
+func parseExpandItem(input string, aliases map[string]string, functions *FilterFunctionTable) (*ExpandItem, error) {
+	path := input
+	options := ""
+	if open := strings.Index(input, "("); open >= 0 {
+		if !strings.HasSuffix(input, ")") {
+			return nil, BadRequestError("Invalid expand item '" + input + "'.")
 		}
+		path, options = input[:open], input[open+1:len(input)-1]
 	}
 
-	if !stack.Empty() {
-		return nil, BadRequestError("Mismatched parentheses in expand clause.")
+	item := &ExpandItem{Path: []*Token{}}
+	for _, val := range strings.Split(path, "/") {
+		val = strings.TrimSpace(val)
+		if val == "" {
+			return nil, BadRequestError("Invalid expand item '" + input + "'.")
+		}
+		item.Path = append(item.Path, &Token{Value: val, Type: ExpandTokenLiteral})
 	}
 
-	if !queue.Empty() {
-		item.Path = append(item.Path, queue.Dequeue())
+	if n := len(item.Path); n > 1 {
+		switch item.Path[n-1].Value {
+		case "$ref":
+			item.IsRef = true
+			item.Path = item.Path[:n-1]
+		case "$count":
+			item.IsCount = true
+			item.Path = item.Path[:n-1]
+		}
 	}
 
-	return item, nil
-}
-
-func ParseExpandOption(queue *tokenQueue, item *ExpandItem) error {
-	head := queue.Dequeue().Value
-	if queue.Head == nil {
-		return BadRequestError("Invalid expand clause.")
+	if options == "" {
+		return item, nil
 	}
-	queue.Dequeue() // drop the '=' from the front of the queue
-	body := queue.String()
 
-	if head == "$filter" {
-		filter, err := ParseFilterString(body)
-		if err == nil {
-			item.Filter = filter
-		} else {
-			return err
-		}
+	parts, err := splitTopLevel(options, ';')
+	if err != nil {
+		return nil, err
 	}
-
-	if head == "$search" {
-		search, err := ParseSearchString(body)
-		if err == nil {
-			item.Search = search
-		} else {
-			return err
+	for _, part := range parts {
+		err := parseExpandOption(part, item, aliases, functions)
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	if head == "$orderby" {
-		orderby, err := ParseOrderByString(body)
-		if err == nil {
-			item.OrderBy = orderby
-		} else {
-			return err
-		}
-	}
+	return item, nil
+}
 
-	if head == "$skip" {
-		skip, err := ParseSkipString(body)
-		if err == nil {
-			item.Skip = skip
-		} else {
-			return err
-		}
+// Parse one option of an expand item, e.g. $filter=Price gt @p.
+func parseExpandOption(option string, item *ExpandItem, aliases map[string]string, functions *FilterFunctionTable) error {
+	eq := strings.Index(option, "=")
+	if eq < 0 {
+		return BadRequestError("Invalid expand clause.")
 	}
-
-	if head == "$top" {
-		top, err := ParseTopString(body)
-		if err == nil {
-			item.Top = top
-		} else {
-			return err
-		}
+	head, body := strings.TrimSpace(option[:eq]), option[eq+1:]
+
+	var err error
+	switch head {
+	case "$filter":
+		item.Filter, err = functions.ParseFilter(body, aliases)
+	case "$search":
+		item.Search, err = ParseSearchString(body)
+	case "$orderby":
+		item.OrderBy, err = ParseOrderByStringWithFunctions(body, aliases, functions)
+	case "$skip":
+		item.Skip, err = ParseSkipString(body)
+	case "$top":
+		item.Top, err = ParseTopString(body)
+	case "$count":
+		item.Count, err = ParseCountString(body)
+	case "$select":
+		item.Select, err = ParseSelectStringWithFunctions(body, aliases, functions)
+	case "$expand":
+		item.Expand, err = ParseExpandStringWithFunctions(body, aliases, functions)
+	case "$compute":
+		item.Compute, err = ParseComputeStringWithFunctions(body, aliases, functions)
+	case "$levels":
+		item.Levels, err = parseExpandLevels(body)
+	default:
+		return BadRequestError("Unknown expand option " + head + ".")
 	}
 
-	if head == "$select" {
-		sel, err := ParseSelectString(body)
-		if err == nil {
-			item.Select = sel
-		} else {
-			return err
-		}
-	}
+	return err
+}
 
-	if head == "$expand" {
-		expand, err := ParseExpandString(body)
-		if err == nil {
-			item.Expand = expand
-		} else {
-			return err
-		}
+// Parse the value of $levels, which is either a positive integer or max.
+func parseExpandLevels(levels string) (int, error) {
+	levels = strings.TrimSpace(levels)
+	if levels == "max" {
+		return ExpandLevelsMax, nil
 	}
-
-	if head == "$levels" {
-		i, err := strconv.Atoi(body)
-		if err != nil {
-			return err
-		}
-		item.Levels = i
+	i, err := strconv.Atoi(levels)
+	if err != nil || i < 1 {
+		return 0, BadRequestError("$levels must be a positive integer or max, not '" + levels + "'.")
 	}
-
-	return nil
+	return i, nil
 }
 
 func SemanticizeExpandQuery(
@@ -247,23 +198,35 @@ func SemanticizeExpandQuery(
 		return nil
 	}
 
+	maxLevels := service.MaxExpandLevels
+	if maxLevels <= 0 {
+		maxLevels = DefaultMaxExpandLevels
+	}
+
 	// Replace $levels with a nested expand clause
 	for _, item := range expand.ExpandItems {
+		item.levels = item.Levels
+		if item.Levels != 0 && (item.IsRef || item.IsCount) {
+			return BadRequestError("$levels can not be applied to a $ref or $count in $expand.")
+		}
+		if item.Levels == ExpandLevelsMax {
+			item.Levels = maxLevels
+		} else if item.Levels > maxLevels {
+			return BadRequestError("$levels of " + strconv.Itoa(item.Levels) + " exceeds the maximum of " +
+				strconv.Itoa(maxLevels) + ".")
+		}
 		if item.Levels > 0 {
+			// the nested item repeats the path with the same options, and
+			// future recursive calls to SemanticizeExpandQuery() will build
+			// out this expand tree completely
+			nested := item.clone()
+			nested.Levels = item.Levels - 1
 			if item.Expand == nil {
 				item.Expand = &GoDataExpandQuery{[]*ExpandItem{}}
 			}
-			// Future recursive calls to SemanticizeExpandQuery() will build out
-			// this expand tree completely
-			item.Expand.ExpandItems = append(
-				item.Expand.ExpandItems,
-				&ExpandItem{
-					Path:   item.Path,
-					Levels: item.Levels - 1,
-				},
-			)
-			item.Levels = 0
+			item.Expand.ExpandItems = append(item.Expand.ExpandItems, nested)
 		}
+		item.Levels = 0
 	}
 
 	// we're gonna rebuild the items list, replacing wildcards where possible
@@ -272,14 +235,16 @@ func SemanticizeExpandQuery(
 
 	for _, item := range expand.ExpandItems {
 		if item.Path[0].Value == "*" {
-			// replace wildcard with a copy of every navigation property
+			// replace wildcard with a copy of every navigation property, each
+			// with its own copy of the options, since they are checked
+			// against the entity type the property leads to
 			for _, navProp := range service.NavigationPropertyLookup[entity] {
-				path := []*Token{&Token{Value: navProp.Name, Type: ExpandTokenLiteral}}
-				newItem := &ExpandItem{
-					Path:   append(path, item.Path[1:]...),
-					Levels: item.Levels,
-					Expand: item.Expand,
-				}
+				newItem := item.clone()
+				newItem.Path[0] = &Token{Value: navProp.Name, Type: ExpandTokenLiteral}
+				// the nested wildcard of $levels expands the navigation
+				// properties of the type it is applied to, so the path does
+				// not have to lead back
+				newItem.levels = 0
 				newItems = append(newItems, newItem)
 			}
 			// TODO: check for duplicates?
@@ -300,36 +265,182 @@ func SemanticizeExpandQuery(
 	return nil
 }
 
+// Resolve each segment of an expand item, and check its options against the
+// entity type it expands to. Segments before the last navigation property
+// may be complex properties, other navigation properties, or casts to a
+// derived type, e.g. Address/Country or Orders/Store.SpecialOrder/Items.
 func semanticizeExpandItem(
 	item *ExpandItem,
 	service *GoDataService,
 	entity *GoDataEntityType,
 ) error {
 
-	// TODO: allow multiple path segments in expand clause
-	// TODO: handle $ref
-	if len(item.Path) > 1 {
-		return NotImplementedError("Multiple path segments not currently supported in expand clauses.")
+	source := entity
+	var complexType *GoDataComplexType
+	// whether the path so far ends in a navigation property, possibly
+	// followed by a cast
+	endsInNav := false
+	collection := false
+
+	for _, segment := range item.Path {
+		name := segment.Value
+
+		if strings.Contains(name, ".") {
+			if entity == nil {
+				derived := service.LookupComplexType(name)
+				if derived == nil || !service.derivesFromComplexType(derived, complexType) {
+					return BadRequestError("Complex type " + name + " does not derive from " + complexType.Name + ".")
+				}
+				segment.SemanticType = SemanticTypeDerivedComplex
+				segment.SemanticReference = derived
+				complexType = derived
+				continue
+			}
+			derived, err := service.LookupEntityType(name)
+			if err != nil || !service.derivesFromEntityType(derived, entity) {
+				return BadRequestError("Entity type " + name + " does not derive from " + entity.Name + ".")
+			}
+			segment.SemanticType = SemanticTypeDerivedEntity
+			segment.SemanticReference = derived
+			entity = derived
+			continue
+		}
+
+		var prop *GoDataProperty
+		var nav *GoDataNavigationProperty
+		if entity != nil {
+			prop = service.PropertyLookup[entity][name]
+			nav = service.NavigationPropertyLookup[entity][name]
+		} else {
+			for _, p := range complexType.Properties {
+				if p.Name == name {
+					prop = p
+				}
+			}
+			for _, p := range complexType.NavigationProperties {
+				if p.Name == name {
+					nav = p
+				}
+			}
+		}
+
+		if nav != nil {
+			target, err := service.LookupEntityType(nav.Type)
+			if err != nil {
+				return err
+			}
+			segment.SemanticType = SemanticTypeEntity
+			segment.SemanticReference = target
+			entity, complexType, endsInNav = target, nil, true
+			collection = strings.HasPrefix(nav.Type, "Collection(")
+			continue
+		}
+
+		if prop != nil {
+			propType := service.LookupComplexType(strings.TrimSuffix(strings.TrimPrefix(prop.Type, "Collection("), ")"))
+			if propType != nil {
+				segment.SemanticType = SemanticTypeProperty
+				segment.SemanticReference = prop
+				entity, complexType, endsInNav = nil, propType, false
+				continue
+			}
+		}
+
+		if entity != nil {
+			return BadRequestError("Entity type " + entity.Name + " has no navigational property " + name)
+		}
+		return BadRequestError("Complex type " + complexType.Name + " has no navigational property " + name)
 	}
 
-	navProps := service.NavigationPropertyLookup[entity]
-	target := item.Path[len(item.Path)-1]
-	if prop, ok := navProps[target.Value]; ok {
-		target.SemanticType = SemanticTypeEntity
-		entityType, err := service.LookupEntityType(prop.Type)
-		if err != nil {
-			return err
+	if !endsInNav {
+		return BadRequestError("The $expand path " + expandPathString(item.Path) +
+			" must end with a navigational property.")
+	}
+
+	if item.levels != 0 && source != nil && entity != source && !service.derivesFromEntityType(entity, source) {
+		levels := strconv.Itoa(item.levels)
+		if item.levels == ExpandLevelsMax {
+			levels = "max"
 		}
-		target.SemanticReference = entityType
+		return BadRequestError("$levels=" + levels + " can only be applied to a navigation property that leads " +
+			"back to entity type " + source.Name + ", but " + expandPathString(item.Path) + " leads to " +
+			entity.Name + ".")
+	}
 
-		SemanticizeFilterQuery(item.Filter, service, entityType)
-		SemanticizeExpandQuery(item.Expand, service, entityType)
-		SemanticizeSelectQuery(item.Select, service, entityType)
-		SemanticizeOrderByQuery(item.OrderBy, service, entityType)
+	if item.IsCount {
+		if !collection {
+			return BadRequestError("$count must follow a collection in $expand, but " +
+				expandPathString(item.Path) + " is not a collection.")
+		}
+		if item.OrderBy != nil || item.Skip != nil || item.Top != nil || item.Count != nil ||
+			item.Select != nil || item.Expand != nil || item.Compute != nil {
+			return BadRequestError("Only $filter and $search can be applied to " +
+				expandPathString(item.Path) + "/$count.")
+		}
+	}
+	if item.IsRef && (item.Select != nil || item.Expand != nil || item.Compute != nil) {
+		return BadRequestError("$select, $expand and $compute can not be applied to " +
+			expandPathString(item.Path) + "/$ref.")
+	}
+	if !collection && (item.OrderBy != nil || item.Skip != nil || item.Top != nil || item.Count != nil) {
+		return BadRequestError("$orderby, $skip, $top and $count can only be applied to collections, but " +
+			expandPathString(item.Path) + " is not a collection.")
+	}
+
+	err := SemanticizeComputeQuery(item.Compute, service, entity)
+	if err != nil {
+		return err
+	}
+	err = SemanticizeFilterQueryWithCompute(item.Filter, service, entity, item.Compute)
+	if err != nil {
+		return err
+	}
+	err = SemanticizeExpandQuery(item.Expand, service, entity)
+	if err != nil {
+		return err
+	}
+	err = SemanticizeSelectQueryWithCompute(item.Select, service, entity, item.Compute)
+	if err != nil {
+		return err
+	}
+	return SemanticizeOrderByQueryWithCompute(item.OrderBy, service, entity, item.Compute)
+}
 
-	} else {
-		return BadRequestError("Entity type " + entity.Name + " has no navigational property " + target.Value)
+// A deep copy of an expand item and its options, which can be semanticized
+// on its own.
+func (item *ExpandItem) clone() *ExpandItem {
+	copied := *item
+	copied.Path = cloneTokens(item.Path)
+	copied.Filter = cloneFilterQuery(item.Filter)
+	copied.Search = cloneSearchQuery(item.Search)
+	copied.OrderBy = cloneOrderByQuery(item.OrderBy)
+	copied.Select = cloneSelectQuery(item.Select)
+	copied.Compute = cloneComputeQuery(item.Compute)
+	if item.Skip != nil {
+		skip := *item.Skip
+		copied.Skip = &skip
 	}
+	if item.Top != nil {
+		top := *item.Top
+		copied.Top = &top
+	}
+	if item.Count != nil {
+		count := *item.Count
+		copied.Count = &count
+	}
+	if item.Expand != nil {
+		copied.Expand = &GoDataExpandQuery{ExpandItems: make([]*ExpandItem, len(item.Expand.ExpandItems))}
+		for i, nested := range item.Expand.ExpandItems {
+			copied.Expand.ExpandItems[i] = nested.clone()
+		}
+	}
+	return &copied
+}
 
-	return nil
+func expandPathString(path []*Token) string {
+	values := make([]string, len(path))
+	for i, token := range path {
+		values[i] = token.Value
+	}
+	return strings.Join(values, "/")
 }
@@ -1,6 +1,7 @@
 package godata
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -120,3 +121,158 @@ func TestExpandNestedParens(t *testing.T) {
 		return
 	}
 }
+
+func checkTestExpand(expand string, maxLevels int) (*GoDataExpandQuery, error) {
+	schema := NewSchemaBuilder("Store", "Container")
+	customer := schema.EntityType("Customer").Key("Id", GoDataInt32).Property("Address", "Store.Address")
+	order := schema.EntityType("Order").Key("Id", GoDataInt32).Property("Total", GoDataDecimal)
+	special := schema.EntityType("SpecialOrder").BaseType(order)
+	item := schema.EntityType("Item").Key("Id", GoDataInt32)
+	schema.EntityType("Country").Key("Code", GoDataString)
+	customer.NavigationProperty("Orders", order, true)
+	customer.NavigationProperty("Referrer", customer, false)
+	order.NavigationProperty("Customer", customer, false)
+	special.NavigationProperty("Items", item, true)
+	schema.EntitySet("Customers", customer)
+
+	metadata := schema.Metadata()
+	metadata.DataServices.Schemas[0].ComplexTypes = []*GoDataComplexType{
+		&GoDataComplexType{
+			Name:                 "Address",
+			Properties:           []*GoDataProperty{&GoDataProperty{Name: "City", Type: GoDataString}},
+			NavigationProperties: []*GoDataNavigationProperty{&GoDataNavigationProperty{Name: "Country", Type: "Store.Country"}},
+		},
+	}
+
+	service, err := BuildService(&builtProvider{metadata}, "http://localhost")
+	if err != nil {
+		return nil, err
+	}
+	service.MaxExpandLevels = maxLevels
+	entity, err := service.LookupEntityType("Customer")
+	if err != nil {
+		return nil, err
+	}
+	query, err := ParseExpandStringWithFunctions(expand, map[string]string{"@min": "10"}, GlobalFilterFunctions)
+	if err != nil {
+		return nil, err
+	}
+	return query, SemanticizeExpandQuery(query, service, entity)
+}
+
+func TestExpandPaths(t *testing.T) {
+	input := "Orders/Store.SpecialOrder/Items,Address/Country/$ref,Orders/$count($filter=Total gt @min)," +
+		"Orders($filter=contains(Customer/Address/City,'a,b')),Referrer($levels=max)"
+
+	output, err := checkTestExpand(input, 2)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	items := output.ExpandItems
+	cast := items[0].Path[1]
+	if cast.SemanticType != SemanticTypeDerivedEntity || cast.SemanticReference.(*GoDataEntityType).Name != "SpecialOrder" {
+		t.Error("Type cast not resolved")
+	}
+	if items[0].Path[2].SemanticReference.(*GoDataEntityType).Name != "Item" {
+		t.Error("Navigation property of the derived type not resolved")
+	}
+
+	if !items[1].IsRef || len(items[1].Path) != 2 || items[1].Path[0].SemanticType != SemanticTypeProperty {
+		t.Error("Complex path with $ref not resolved")
+	}
+
+	if !items[2].IsCount || items[2].Filter.Tree.Children[1].Token.Value != "10" {
+		t.Error("$count with a filter not parsed correctly")
+	}
+
+	if items[3].Filter.Expression == nil {
+		t.Error("Nested filter not checked")
+	}
+
+	levels := 0
+	for expand := items[4].Expand; expand != nil; expand = expand.ExpandItems[0].Expand {
+		levels++
+	}
+	if levels != 2 {
+		t.Error("Expected $levels=max to expand 2 levels, got", levels)
+	}
+}
+
+func TestExpandWildcardOptions(t *testing.T) {
+	// the copies of the wildcard are checked against different entity types,
+	// which must give the same result every time
+	for i := 0; i < 10; i++ {
+		output, err := checkTestExpand("*($levels=2)", 2)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		for _, item := range output.ExpandItems {
+			if depth := expandDepth(item.Expand); depth != 2 {
+				t.Error("Expected 2 levels below "+expandPathString(item.Path)+", got", depth)
+			}
+		}
+		if len(output.ExpandItems) != 2 {
+			t.Error("Expected Orders and Referrer, got", len(output.ExpandItems))
+		}
+	}
+
+	output, err := checkTestExpand("*($select=Id;$filter=Id gt 1)", 2)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for _, item := range output.ExpandItems {
+		if item.Select == nil || item.Select.SelectItems[0].Segments[0].SemanticReference == nil {
+			t.Error("$select not applied to " + expandPathString(item.Path))
+		}
+		if item.Filter == nil || item.Filter.Expression == nil {
+			t.Error("$filter not applied to " + expandPathString(item.Path))
+		}
+	}
+	if output.ExpandItems[0].Select == output.ExpandItems[1].Select {
+		t.Error("The expanded items share their $select")
+	}
+}
+
+func TestExpandErrors(t *testing.T) {
+	testCases := []struct {
+		expand  string
+		message string
+	}{
+		{"Orders/Missing", "Entity type Order has no navigational property Missing"},
+		{"Address", "must end with a navigational property"},
+		{"Address/City", "Complex type Address has no navigational property City"},
+		{"Orders/Store.Customer", "Entity type Store.Customer does not derive from Order"},
+		{"Orders/Customer/$count", "$count must follow a collection"},
+		{"Orders/$count($top=1)", "Only $filter and $search can be applied"},
+		{"Orders/$ref($select=Id)", "can not be applied to Orders/$ref"},
+		{"Orders/$ref($levels=1)", "$levels can not be applied"},
+		{"Orders/Customer($top=1)", "can only be applied to collections"},
+		{"Referrer($levels=3)", "$levels of 3 exceeds the maximum of 2"},
+		{"Orders($levels=max)", "$levels=max can only be applied to a navigation property that leads back to " +
+			"entity type Customer, but Orders leads to Order"},
+		{"Orders($levels=none)", "$levels must be a positive integer or max"},
+		{"Orders($filter=Missing eq 1)", "Missing"},
+		{"Orders($orderby=Customer)", "Can not order by 'Customer'"},
+		{"Orders($select=Missing)", "has no property Missing"},
+		{"Orders($expand=Missing)", "has no navigational property Missing"},
+		{"Orders($format=json)", "Unknown expand option $format"},
+		{"Orders($filter=Total gt 1", "Mismatched parentheses"},
+	}
+
+	for _, testCase := range testCases {
+		_, err := checkTestExpand(testCase.expand, 2)
+
+		if err == nil {
+			t.Error("$expand " + testCase.expand + " was accepted")
+			continue
+		}
+		if !strings.Contains(err.Error(), testCase.message) {
+			t.Error("Expected \"" + testCase.message + "\", got \"" + err.Error() + "\"")
+		}
+	}
+}
@@ -0,0 +1,1002 @@
+package godata
+
+import (
+	"strings"
+)
+
+// A typed expression built from a $filter parse tree by
+// SemanticizeFilterQuery. Every expression knows the Edm type of the value it
+// evaluates to, so providers can translate the filter without inferring
+// types themselves.
+type FilterExpression interface {
+	// The Edm type of the value of the expression, e.g. Edm.Boolean. Empty
+	// for the null literal, which has no type.
+	EdmType() string
+	// The node of the parse tree the expression was built from.
+	Source() *ParseNode
+}
+
+// A literal value, e.g. 'Bob', 42 or null.
+type FilterLiteralExpression struct {
+	// The literal as it was written in the filter.
+	Value string
+	Type  string
+	Node  *ParseNode
+}
+
+// A path to a property or related entity, e.g. Name, Address/City or
+// Customer/Name.
+type FilterPropertyExpression struct {
+	// What the path starts from: a lambda range variable, $it or $root. Empty
+	// for paths starting from the entity being filtered.
+	Variable string
+	Segments []*FilterPathSegment
+	Type     string
+	Node     *ParseNode
+}
+
+type FilterPathSegment struct {
+	Name string
+	// The property the segment refers to, for structural and dynamic
+	// properties.
+	Property *GoDataProperty
+	// The navigation property the segment refers to, for navigation
+	// properties.
+	NavigationProperty *GoDataNavigationProperty
+	// The entity set and key, or the singleton, of a segment following $root.
+	EntitySet  *GoDataEntitySet
+	Identifier *GoDataIdentifier
+	Singleton  *GoDataSingleton
+	// The entity type the segment leads to, for navigation properties and
+	// segments following $root.
+	EntityType *GoDataEntityType
+}
+
+// A binary operator, e.g. Price add 5 or Name eq 'Bob'.
+type FilterBinaryExpression struct {
+	Operator string
+	Left     FilterExpression
+	Right    FilterExpression
+	Type     string
+	Node     *ParseNode
+}
+
+// A unary operator, i.e. not or the negation of a number.
+type FilterUnaryExpression struct {
+	Operator string
+	Operand  FilterExpression
+	Type     string
+	Node     *ParseNode
+}
+
+// A call to a built-in function, e.g. contains(Name,'Bob').
+type FilterFunctionExpression struct {
+	Name      string
+	Arguments []FilterExpression
+	Type      string
+	Node      *ParseNode
+	// The custom function that is called, or nil for built-in functions.
+	Function *GoDataFilterFunction
+}
+
+// A lambda operator applied to a collection, e.g.
+// Orders/any(o:o/Total gt 100).
+type FilterLambdaExpression struct {
+	// any or all
+	Operator   string
+	Collection FilterExpression
+	// The name of the range variable, empty for any() without arguments.
+	Variable  string
+	Predicate FilterExpression
+	Node      *ParseNode
+}
+
+// A list of values, the right operand of in, e.g. ('Milk','Cheese').
+type FilterListExpression struct {
+	Items []FilterExpression
+	// Collection(T), where T is the type all items can be promoted to.
+	Type string
+	Node *ParseNode
+}
+
+// The name of a type, used as an argument of cast and isof.
+type FilterTypeExpression struct {
+	Name string
+	Node *ParseNode
+}
+
+func (e *FilterLiteralExpression) EdmType() string  { return e.Type }
+func (e *FilterPropertyExpression) EdmType() string { return e.Type }
+func (e *FilterBinaryExpression) EdmType() string   { return e.Type }
+func (e *FilterUnaryExpression) EdmType() string    { return e.Type }
+func (e *FilterFunctionExpression) EdmType() string { return e.Type }
+func (e *FilterLambdaExpression) EdmType() string   { return GoDataBoolean }
+func (e *FilterListExpression) EdmType() string     { return e.Type }
+func (e *FilterTypeExpression) EdmType() string     { return e.Name }
+
+func (e *FilterLiteralExpression) Source() *ParseNode  { return e.Node }
+func (e *FilterPropertyExpression) Source() *ParseNode { return e.Node }
+func (e *FilterBinaryExpression) Source() *ParseNode   { return e.Node }
+func (e *FilterUnaryExpression) Source() *ParseNode    { return e.Node }
+func (e *FilterFunctionExpression) Source() *ParseNode { return e.Node }
+func (e *FilterLambdaExpression) Source() *ParseNode   { return e.Node }
+func (e *FilterListExpression) Source() *ParseNode     { return e.Node }
+func (e *FilterTypeExpression) Source() *ParseNode     { return e.Node }
+
+// A signature of a filter function. Functions with several signatures are
+// resolved to the first one whose parameters accept the arguments. The type
+// of the last parameter may end in ..., e.g. Edm.String..., in which case it
+// may be repeated.
+type FilterFunctionSignature struct {
+	Parameters []string
+	ReturnType string
+}
+
+// The signatures of the built-in filter functions. Edm.PrimitiveType accepts
+// an argument of any type.
+var FilterFunctionSignatures = map[string][]*FilterFunctionSignature{
+	"contains":   {{[]string{GoDataString, GoDataString}, GoDataBoolean}},
+	"endswith":   {{[]string{GoDataString, GoDataString}, GoDataBoolean}},
+	"startswith": {{[]string{GoDataString, GoDataString}, GoDataBoolean}},
+	"length":     {{[]string{GoDataString}, GoDataInt32}},
+	"indexof":    {{[]string{GoDataString, GoDataString}, GoDataInt32}},
+	"substring": {
+		{[]string{GoDataString, GoDataInt32}, GoDataString},
+		{[]string{GoDataString, GoDataInt32, GoDataInt32}, GoDataString},
+	},
+	"tolower": {{[]string{GoDataString}, GoDataString}},
+	"toupper": {{[]string{GoDataString}, GoDataString}},
+	"trim":    {{[]string{GoDataString}, GoDataString}},
+	"concat":  {{[]string{GoDataString, GoDataString + "..."}, GoDataString}},
+	"year": {
+		{[]string{GoDataDate}, GoDataInt32},
+		{[]string{GoDataDateTimeOffset}, GoDataInt32},
+	},
+	"month": {
+		{[]string{GoDataDate}, GoDataInt32},
+		{[]string{GoDataDateTimeOffset}, GoDataInt32},
+	},
+	"day": {
+		{[]string{GoDataDate}, GoDataInt32},
+		{[]string{GoDataDateTimeOffset}, GoDataInt32},
+	},
+	"hour": {
+		{[]string{GoDataTimeOfDay}, GoDataInt32},
+		{[]string{GoDataDateTimeOffset}, GoDataInt32},
+	},
+	"minute": {
+		{[]string{GoDataTimeOfDay}, GoDataInt32},
+		{[]string{GoDataDateTimeOffset}, GoDataInt32},
+	},
+	"second": {
+		{[]string{GoDataTimeOfDay}, GoDataInt32},
+		{[]string{GoDataDateTimeOffset}, GoDataInt32},
+	},
+	"fractionalseconds": {
+		{[]string{GoDataTimeOfDay}, GoDataDecimal},
+		{[]string{GoDataDateTimeOffset}, GoDataDecimal},
+	},
+	"date":               {{[]string{GoDataDateTimeOffset}, GoDataDate}},
+	"time":               {{[]string{GoDataDateTimeOffset}, GoDataTimeOfDay}},
+	"totaloffsetminutes": {{[]string{GoDataDateTimeOffset}, GoDataInt32}},
+	"now":                {{[]string{}, GoDataDateTimeOffset}},
+	"maxdatetime":        {{[]string{}, GoDataDateTimeOffset}},
+	"mindatetime":        {{[]string{}, GoDataDateTimeOffset}},
+	"totalseconds":       {{[]string{GoDataDuration}, GoDataDecimal}},
+	"round": {
+		{[]string{GoDataDecimal}, GoDataDecimal},
+		{[]string{GoDataDouble}, GoDataDouble},
+	},
+	"floor": {
+		{[]string{GoDataDecimal}, GoDataDecimal},
+		{[]string{GoDataDouble}, GoDataDouble},
+	},
+	"ceiling": {
+		{[]string{GoDataDecimal}, GoDataDecimal},
+		{[]string{GoDataDouble}, GoDataDouble},
+	},
+	"geo.distance": {
+		{[]string{"Edm.GeographyPoint", "Edm.GeographyPoint"}, GoDataDouble},
+		{[]string{"Edm.GeometryPoint", "Edm.GeometryPoint"}, GoDataDouble},
+	},
+	"geo.intersects": {
+		{[]string{"Edm.GeographyPoint", "Edm.GeographyPolygon"}, GoDataBoolean},
+		{[]string{"Edm.GeometryPoint", "Edm.GeometryPolygon"}, GoDataBoolean},
+	},
+	"geo.length": {
+		{[]string{"Edm.GeographyLineString"}, GoDataDouble},
+		{[]string{"Edm.GeometryLineString"}, GoDataDouble},
+	},
+}
+
+// The rank of each numeric type in binary numeric promotion. The operands of
+// an arithmetic operator are promoted to the type with the higher rank.
+var numericTypeRank = map[string]int{
+	GoDataByte:    1,
+	GoDataSByte:   1,
+	GoDataInt16:   2,
+	GoDataInt32:   3,
+	GoDataInt64:   4,
+	GoDataDecimal: 5,
+	GoDataSingle:  6,
+	GoDataDouble:  7,
+}
+
+func isNumericType(t string) bool {
+	_, ok := numericTypeRank[t]
+	return ok
+}
+
+// Apply binary numeric promotion to the types of two numeric operands.
+func promoteNumericTypes(a, b string) string {
+	if (a == GoDataByte && b == GoDataSByte) || (a == GoDataSByte && b == GoDataByte) {
+		return GoDataInt16
+	}
+	if numericTypeRank[a] >= numericTypeRank[b] {
+		return a
+	}
+	return b
+}
+
+// Checks a filter parse tree against the entity type it filters, building a
+// typed expression.
+type filterChecker struct {
+	service *GoDataService
+	entity  *GoDataEntityType
+	// The complex type of the instances being filtered, when they are not
+	// entities, e.g. the elements of a selected complex collection.
+	complexType *GoDataComplexType
+	open        bool
+	// The element types of the range variables of the lambda operators
+	// being checked, by variable name.
+	variables map[string]string
+	// The properties computed by transformations of $apply, by alias.
+	computed map[string]*GoDataProperty
+	// The names of the properties left after aggregating, or nil if the set
+	// is not aggregated and every property is left.
+	remaining map[string]bool
+}
+
+// Build the typed expression of a filter and check that it is a boolean
+// expression.
+func (c *filterChecker) checkFilter(node *ParseNode) (FilterExpression, error) {
+	expr, err := c.check(node)
+	if err != nil {
+		return nil, err
+	}
+	t := c.underlyingType(expr.EdmType())
+	if t != GoDataBoolean && t != GoDataUntyped {
+		return nil, BadRequestError("The filter must be a boolean expression, but '" +
+			filterNodeString(node) + "' is " + describeType(t) + ".")
+	}
+	c.inferType(expr, GoDataBoolean)
+	return expr, nil
+}
+
+func (c *filterChecker) check(node *ParseNode) (FilterExpression, error) {
+	// tokens that are not properties are values given by the client
+	node.Token.SemanticType = SemanticTypePropertyValue
+	node.Token.SemanticReference = &node.Token.Value
+
+	switch node.Token.Type {
+	case FilterTokenNav:
+		if len(node.Children) == 2 && node.Children[1].Token.Type == FilterTokenLambda {
+			return c.checkLambda(node)
+		}
+		return c.checkPath(node)
+	case FilterTokenFunc:
+		return c.checkFunction(node)
+	case FilterTokenLogical, FilterTokenOp:
+		if len(node.Children) == 1 {
+			return c.checkUnary(node)
+		}
+		return c.checkBinary(node)
+	case FilterTokenNull:
+		return &FilterLiteralExpression{Value: node.Token.Value, Node: node}, nil
+	case FilterTokenLiteral:
+		return c.checkPath(node)
+	case FilterTokenIt, FilterTokenRoot, FilterTokenCount:
+		return c.checkPath(node)
+	case FilterTokenList:
+		return c.checkList(node)
+	case FilterTokenLambda, FilterTokenColon:
+		return nil, BadRequestError("'" + filterNodeString(node) + "' is not supported in this position.")
+	}
+
+	if t := FilterLiteralType(node.Token); t != "" {
+		return &FilterLiteralExpression{Value: node.Token.Value, Type: t, Node: node}, nil
+	}
+	return nil, BadRequestError("Unexpected '" + node.Token.Value + "' in the filter.")
+}
+
+// Resolve a path, e.g. Name, Address/City or Customer/Orders, starting from
+// the entity being filtered, a lambda variable, $it or $root.
+func (c *filterChecker) checkPath(node *ParseNode) (FilterExpression, error) {
+	leaves := []*ParseNode{}
+	var flatten func(n *ParseNode) error
+	flatten = func(n *ParseNode) error {
+		if n.Token.Type == FilterTokenNav && len(n.Children) == 2 {
+			n.Token.SemanticType = SemanticTypePropertyValue
+			n.Token.SemanticReference = &n.Token.Value
+			if err := flatten(n.Children[0]); err != nil {
+				return err
+			}
+			return flatten(n.Children[1])
+		}
+		first := len(leaves) == 0 && (n.Token.Type == FilterTokenIt || n.Token.Type == FilterTokenRoot)
+		if n.Token.Type != FilterTokenLiteral && n.Token.Type != FilterTokenCount && !first {
+			return BadRequestError("'" + filterNodeString(node) + "' is not a property path.")
+		}
+		leaves = append(leaves, n)
+		return nil
+	}
+	if err := flatten(node); err != nil {
+		return nil, err
+	}
+
+	expr := &FilterPropertyExpression{Node: node}
+	entity := c.entity
+	complexType := c.complexType
+	open := c.open
+	start := 0
+
+	first := leaves[0]
+	first.Token.SemanticType = SemanticTypeEntity
+	if variable, ok := c.variables[first.Token.Value]; ok {
+		expr.Variable = first.Token.Value
+		expr.Type = variable
+		entity, complexType, open = c.lookupStructuredType(variable)
+		first.Token.SemanticReference = entity
+		start = 1
+	} else if first.Token.Type == FilterTokenIt {
+		expr.Variable = first.Token.Value
+		if c.entity != nil {
+			expr.Type = c.service.qualifiedEntityTypeName(c.entity)
+			first.Token.SemanticReference = c.entity
+		} else {
+			expr.Type = c.complexType.Name
+			first.Token.SemanticReference = c.complexType
+		}
+		start = 1
+	} else if first.Token.Type == FilterTokenRoot {
+		if len(leaves) < 2 {
+			return nil, BadRequestError("$root must be followed by an entity set and key, or a singleton in '" +
+				filterNodeString(node) + "'.")
+		}
+		expr.Variable = first.Token.Value
+		first.Token.SemanticReference = &first.Token.Value
+		segment, err := c.checkRootSegment(leaves[1], node)
+		if err != nil {
+			return nil, err
+		}
+		expr.Segments = append(expr.Segments, segment)
+		expr.Type = c.service.qualifiedEntityTypeName(segment.EntityType)
+		entity = segment.EntityType
+		open = c.service.IsOpenType(entity)
+		start = 2
+	}
+
+	for i := start; i < len(leaves); i++ {
+		leaf := leaves[i]
+		name := leaf.Token.Value
+		segment := &FilterPathSegment{Name: name}
+
+		if leaf.Token.Type == FilterTokenCount {
+			if i == 0 || i != len(leaves)-1 || !strings.HasPrefix(expr.Type, "Collection(") {
+				return nil, BadRequestError("$count must follow a collection at the end of '" +
+					filterNodeString(node) + "'.")
+			}
+			leaf.Token.SemanticType = SemanticTypeCount
+			expr.Segments = append(expr.Segments, segment)
+			expr.Type = GoDataInt64
+			continue
+		}
+
+		if strings.HasPrefix(expr.Type, "Collection(") {
+			return nil, BadRequestError(leaves[i-1].Token.Value + " is a collection, it can only be followed by " +
+				"any or all in '" + filterNodeString(node) + "'.")
+		}
+
+		var prop *GoDataProperty
+		var nav *GoDataNavigationProperty
+		if entity != nil {
+			prop = c.service.PropertyLookup[entity][name]
+			nav = c.service.NavigationPropertyLookup[entity][name]
+		} else if complexType != nil {
+			for _, p := range complexType.Properties {
+				if p.Name == name {
+					prop = p
+				}
+			}
+			for _, p := range complexType.NavigationProperties {
+				if p.Name == name {
+					nav = p
+				}
+			}
+		} else if expr.Type != GoDataUntyped {
+			return nil, BadRequestError("Property " + leaves[i-1].Token.Value + " of type " + expr.Type +
+				" has no property " + name + " in '" + filterNodeString(node) + "'.")
+		}
+
+		if i == 0 {
+			if computed, ok := c.computed[name]; ok {
+				prop, nav = computed, nil
+			} else if c.remaining != nil && !c.remaining[name] {
+				return nil, BadRequestError(name + " is neither grouped nor aggregated in '" +
+					filterNodeString(node) + "'.")
+			}
+		}
+
+		if nav != nil {
+			target, err := c.service.LookupEntityType(nav.Type)
+			if err != nil {
+				return nil, err
+			}
+			leaf.Token.SemanticType = SemanticTypeEntity
+			leaf.Token.SemanticReference = nav
+			segment.NavigationProperty = nav
+			segment.EntityType = target
+			expr.Segments = append(expr.Segments, segment)
+			expr.Type = nav.Type
+			entity, complexType, open = target, nil, c.service.IsOpenType(target)
+			continue
+		}
+
+		if prop != nil {
+			leaf.Token.SemanticType = SemanticTypeProperty
+			leaf.Token.SemanticReference = prop
+		} else if open || expr.Type == GoDataUntyped {
+			// open types accept any undeclared property, its type is inferred
+			// from the expression it is used in
+			prop = &GoDataProperty{Name: name, Type: GoDataUntyped}
+			leaf.Token.SemanticType = SemanticTypeDynamicProperty
+			leaf.Token.SemanticReference = prop
+		} else if entity != nil {
+			return nil, BadRequestError("No property found " + name + " on entity " + entity.Name)
+		} else {
+			return nil, BadRequestError("No property found " + name + " on type " + complexType.Name +
+				" in '" + filterNodeString(node) + "'.")
+		}
+
+		segment.Property = prop
+		expr.Segments = append(expr.Segments, segment)
+		expr.Type = prop.Type
+		entity = nil
+		complexType = c.service.LookupComplexType(prop.Type)
+		open = complexType != nil && complexType.IsOpenType()
+	}
+
+	return expr, nil
+}
+
+// Resolve the segment following $root, which is either an entity set with a
+// key predicate, e.g. People('x'), or a singleton.
+func (c *filterChecker) checkRootSegment(leaf, node *ParseNode) (*FilterPathSegment, error) {
+	name := ParseName(leaf.Token.Value)
+	segment := &FilterPathSegment{Name: name, Identifier: ParseIdentifiers(leaf.Token.Value)}
+
+	if set, err := c.service.LookupEntitySet(name); err == nil {
+		if segment.Identifier == nil {
+			return nil, BadRequestError("Entity set " + name + " must be followed by a key after $root in '" +
+				filterNodeString(node) + "'.")
+		}
+		entity, err := c.service.LookupEntityType(set.EntityType)
+		if err != nil {
+			return nil, err
+		}
+		segment.EntitySet = set
+		segment.EntityType = entity
+	} else if singleton := c.service.lookupSingleton(name); singleton != nil && segment.Identifier == nil {
+		entity, err := c.service.LookupEntityType(singleton.Type)
+		if err != nil {
+			return nil, err
+		}
+		segment.Singleton = singleton
+		segment.EntityType = entity
+	} else {
+		return nil, BadRequestError("No entity set or singleton found " + name + " in '" +
+			filterNodeString(node) + "'.")
+	}
+
+	leaf.Token.SemanticType = SemanticTypeEntity
+	leaf.Token.SemanticReference = segment.EntityType
+	return segment, nil
+}
+
+// Check a lambda operator, e.g. Orders/any(o:o/Total gt 100). The range
+// variable stands for an element of the collection within the predicate.
+func (c *filterChecker) checkLambda(node *ParseNode) (FilterExpression, error) {
+	lambda := node.Children[1]
+	lambda.Token.SemanticType = SemanticTypePropertyValue
+	lambda.Token.SemanticReference = &lambda.Token.Value
+
+	collection, err := c.checkPath(node.Children[0])
+	if err != nil {
+		return nil, err
+	}
+	t := collection.EdmType()
+	if !strings.HasPrefix(t, "Collection(") && t != GoDataUntyped {
+		return nil, BadRequestError("Operator " + lambda.Token.Value + " can not be applied to " +
+			describeType(t) + " in '" + filterNodeString(node) + "'.")
+	}
+
+	expr := &FilterLambdaExpression{Operator: lambda.Token.Value, Collection: collection, Node: node}
+	if len(lambda.Children) == 0 && lambda.Token.Value == "any" {
+		return expr, nil
+	}
+
+	if len(lambda.Children) == 0 || lambda.Children[0].Token.Type != FilterTokenColon ||
+		len(lambda.Children[0].Children) != 2 || lambda.Children[0].Children[0].Token.Type != FilterTokenLiteral {
+		return nil, BadRequestError("Operator " + lambda.Token.Value + " needs a range variable and a " +
+			"predicate, e.g. " + lambda.Token.Value + "(x:x eq 1), in '" + filterNodeString(node) + "'.")
+	}
+	colon := lambda.Children[0]
+	colon.Token.SemanticType = SemanticTypePropertyValue
+	colon.Token.SemanticReference = &colon.Token.Value
+
+	variable := colon.Children[0]
+	name := variable.Token.Value
+	if _, ok := c.variables[name]; ok {
+		return nil, BadRequestError("Range variable " + name + " is already defined in '" +
+			filterNodeString(node) + "'.")
+	}
+	element := GoDataUntyped
+	if t != GoDataUntyped {
+		element = t[len("Collection(") : len(t)-1]
+	}
+	entity, _, _ := c.lookupStructuredType(element)
+	variable.Token.SemanticType = SemanticTypeEntity
+	variable.Token.SemanticReference = entity
+
+	if c.variables == nil {
+		c.variables = map[string]string{}
+	}
+	c.variables[name] = element
+	predicate, err := c.check(colon.Children[1])
+	delete(c.variables, name)
+	if err != nil {
+		return nil, err
+	}
+
+	p := c.underlyingType(predicate.EdmType())
+	if p != GoDataBoolean && p != GoDataUntyped {
+		return nil, BadRequestError("The predicate of " + lambda.Token.Value + " must be a boolean " +
+			"expression, but '" + filterNodeString(colon.Children[1]) + "' is " + describeType(p) + ".")
+	}
+	c.inferType(predicate, GoDataBoolean)
+
+	expr.Variable = name
+	expr.Predicate = predicate
+	return expr, nil
+}
+
+// Find the entity or complex type with the given name, and whether it is
+// open. Both are nil for primitive types.
+func (c *filterChecker) lookupStructuredType(name string) (*GoDataEntityType, *GoDataComplexType, bool) {
+	if complexType := c.service.LookupComplexType(name); complexType != nil {
+		return nil, complexType, complexType.IsOpenType()
+	}
+	if strings.HasPrefix(name, "Edm.") {
+		return nil, nil, false
+	}
+	if entity, err := c.service.LookupEntityType(name); err == nil {
+		return entity, nil, c.service.IsOpenType(entity)
+	}
+	return nil, nil, false
+}
+
+func (c *filterChecker) checkUnary(node *ParseNode) (FilterExpression, error) {
+	operand, err := c.check(node.Children[0])
+	if err != nil {
+		return nil, err
+	}
+	op := node.Token.Value
+	t := c.underlyingType(operand.EdmType())
+
+	result := ""
+	switch op {
+	case "not":
+		if t == GoDataBoolean || t == GoDataUntyped || t == "" {
+			result = GoDataBoolean
+		}
+	case "-":
+		if isNumericType(t) || t == GoDataDuration || t == GoDataUntyped {
+			result = t
+		}
+	}
+
+	if result == "" {
+		return nil, BadRequestError("Operator " + op + " can not be applied to " + describeType(t) +
+			" in '" + filterNodeString(node) + "'.")
+	}
+	if op == "not" {
+		c.inferType(operand, GoDataBoolean)
+	}
+	return &FilterUnaryExpression{Operator: op, Operand: operand, Type: result, Node: node}, nil
+}
+
+func (c *filterChecker) checkBinary(node *ParseNode) (FilterExpression, error) {
+	if len(node.Children) != 2 {
+		return nil, BadRequestError("Operator " + node.Token.Value + " needs two operands in '" +
+			filterNodeString(node) + "'.")
+	}
+	left, err := c.check(node.Children[0])
+	if err != nil {
+		return nil, err
+	}
+	right, err := c.check(node.Children[1])
+	if err != nil {
+		return nil, err
+	}
+
+	op := node.Token.Value
+	if op == "in" {
+		return c.checkIn(node, left, right)
+	}
+	l := c.underlyingType(left.EdmType())
+	r := c.underlyingType(right.EdmType())
+
+	result, ok := c.binaryResultType(op, l, r)
+	if !ok {
+		return nil, BadRequestError("Operator " + op + " can not be applied to " + describeType(l) +
+			" and " + describeType(r) + " in '" + filterNodeString(node) + "'.")
+	}
+
+	// dynamic properties take the type of the operand they are used with
+	switch op {
+	case "and", "or":
+		c.inferType(left, GoDataBoolean)
+		c.inferType(right, GoDataBoolean)
+	default:
+		c.inferType(left, right.EdmType())
+		c.inferType(right, left.EdmType())
+	}
+
+	return &FilterBinaryExpression{Operator: op, Left: left, Right: right, Type: result, Node: node}, nil
+}
+
+// Check a list of values. Its type is a collection of the type all its items
+// can be promoted to, or of Edm.Untyped if they have no common type.
+func (c *filterChecker) checkList(node *ParseNode) (FilterExpression, error) {
+	expr := &FilterListExpression{Node: node}
+	element := ""
+	for _, child := range node.Children {
+		item, err := c.check(child)
+		if err != nil {
+			return nil, err
+		}
+		expr.Items = append(expr.Items, item)
+
+		t := c.underlyingType(item.EdmType())
+		switch {
+		case t == "" || t == element:
+		case element == "":
+			element = t
+		case isNumericType(element) && isNumericType(t):
+			element = promoteNumericTypes(element, t)
+		default:
+			element = GoDataUntyped
+		}
+	}
+	if element == "" {
+		element = GoDataUntyped
+	}
+	expr.Type = "Collection(" + element + ")"
+	return expr, nil
+}
+
+// Check the in operator. The right operand is a list or a collection, and each
+// of its values must be comparable with the left operand.
+func (c *filterChecker) checkIn(node *ParseNode, left, right FilterExpression) (FilterExpression, error) {
+	l := c.underlyingType(left.EdmType())
+	r := c.underlyingType(right.EdmType())
+
+	operands := []FilterExpression{right}
+	list, isList := right.(*FilterListExpression)
+	if isList {
+		operands = list.Items
+	} else if !strings.HasPrefix(r, "Collection(") && r != GoDataUntyped {
+		return nil, BadRequestError("Operator in can not be applied to " + describeType(l) + " and " +
+			describeType(r) + " in '" + filterNodeString(node) + "', expected a list or a collection.")
+	}
+
+	for _, operand := range operands {
+		t := c.underlyingType(operand.EdmType())
+		if !isList && strings.HasPrefix(t, "Collection(") {
+			t = t[len("Collection(") : len(t)-1]
+		}
+		if _, ok := c.binaryResultType("eq", l, t); !ok {
+			return nil, BadRequestError("Operator in can not be applied to " + describeType(l) + " and " +
+				describeType(t) + " in '" + filterNodeString(node) + "'.")
+		}
+		c.inferType(operand, left.EdmType())
+		c.inferType(left, t)
+	}
+
+	return &FilterBinaryExpression{Operator: "in", Left: left, Right: right, Type: GoDataBoolean, Node: node}, nil
+}
+
+// The result type of a binary operator applied to operands of the given
+// types, and whether the operator can be applied to them at all. Operands of
+// unknown type, i.e. dynamic properties and null, are accepted everywhere.
+func (c *filterChecker) binaryResultType(op, l, r string) (string, bool) {
+	untyped := l == GoDataUntyped || r == GoDataUntyped || l == "" || r == ""
+	known := l
+	if l == GoDataUntyped || l == "" {
+		known = r
+	}
+
+	switch op {
+	case "and", "or":
+		return GoDataBoolean, (l == GoDataBoolean || l == GoDataUntyped || l == "") &&
+			(r == GoDataBoolean || r == GoDataUntyped || r == "")
+	case "eq", "ne":
+		return GoDataBoolean, untyped || c.comparable(l, r)
+	case "gt", "ge", "lt", "le":
+		if untyped {
+			return GoDataBoolean, !isUnorderedType(known)
+		}
+		return GoDataBoolean, c.comparable(l, r) && !isUnorderedType(l) && !isUnorderedType(r)
+	case "has":
+		return GoDataBoolean, (c.isEnum(l) || l == GoDataUntyped) &&
+			(c.isEnum(r) || r == GoDataString || r == GoDataUntyped)
+	case "add", "sub", "mul", "div", "divby", "mod":
+		if untyped {
+			if known == GoDataUntyped || known == "" || isNumericType(known) ||
+				known == GoDataDuration || known == GoDataDate || known == GoDataDateTimeOffset {
+				return known, true
+			}
+			return "", false
+		}
+		if isNumericType(l) && isNumericType(r) {
+			if op == "divby" {
+				return GoDataDecimal, true
+			}
+			return promoteNumericTypes(l, r), true
+		}
+		switch {
+		case (op == "add" || op == "sub") && l == GoDataDuration && r == GoDataDuration:
+			return GoDataDuration, true
+		case (op == "add" || op == "sub") && (l == GoDataDateTimeOffset || l == GoDataDate) && r == GoDataDuration:
+			return l, true
+		case op == "sub" && l == r && (l == GoDataDateTimeOffset || l == GoDataDate):
+			return GoDataDuration, true
+		case (op == "mul" || op == "div") && l == GoDataDuration && isNumericType(r):
+			return GoDataDuration, true
+		case op == "mul" && isNumericType(l) && r == GoDataDuration:
+			return GoDataDuration, true
+		}
+		return "", false
+	}
+
+	return "", false
+}
+
+// Check if values of two types can be compared with each other.
+func (c *filterChecker) comparable(l, r string) bool {
+	if l == r {
+		return true
+	}
+	if isNumericType(l) && isNumericType(r) {
+		return true
+	}
+	// enum members may be given as strings
+	if (c.isEnum(l) && r == GoDataString) || (l == GoDataString && c.isEnum(r)) {
+		return true
+	}
+	return false
+}
+
+// Values of these types can only be compared for equality.
+func isUnorderedType(t string) bool {
+	return t == GoDataStream || t == GoDataBinary || strings.HasPrefix(t, "Edm.Geo") ||
+		strings.HasPrefix(t, "Collection(")
+}
+
+func (c *filterChecker) isEnum(t string) bool {
+	return c.service.LookupEnumType(t) != nil
+}
+
+// Resolve type definitions to the primitive type they are based on.
+func (c *filterChecker) underlyingType(t string) string {
+	if definition := c.service.LookupTypeDefinition(t); definition != nil {
+		return definition.UnderlyingType
+	}
+	return t
+}
+
+func (c *filterChecker) checkFunction(node *ParseNode) (FilterExpression, error) {
+	name := node.Token.Value
+
+	if name == "cast" || name == "isof" {
+		return c.checkTypeFunction(node)
+	}
+
+	args := []FilterExpression{}
+	types := []string{}
+	for _, child := range node.Children {
+		arg, err := c.check(child)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		types = append(types, c.underlyingType(arg.EdmType()))
+	}
+
+	signatures, ok := FilterFunctionSignatures[name]
+	var custom *GoDataFilterFunction
+	if c.service != nil && c.service.FilterFunctions != nil {
+		if fn, found := c.service.FilterFunctions.Functions[name]; found {
+			custom, signatures, ok = fn, fn.Signatures, true
+		}
+	}
+	if !ok {
+		return nil, BadRequestError("Unknown function " + name + " in '" + filterNodeString(node) + "'.")
+	}
+
+	for _, signature := range signatures {
+		if !signature.accepts(types) {
+			continue
+		}
+		for i, arg := range args {
+			c.inferType(arg, signature.parameterType(i))
+		}
+		if custom != nil {
+			node.Token.SemanticType = SemanticTypeFunction
+			node.Token.SemanticReference = custom
+		}
+		return &FilterFunctionExpression{Name: name, Arguments: args, Type: signature.ReturnType, Node: node,
+			Function: custom}, nil
+	}
+
+	expected := []string{}
+	for _, signature := range signatures {
+		expected = append(expected, name+"("+strings.Join(signature.Parameters, ",")+")")
+	}
+	got := []string{}
+	for _, t := range types {
+		got = append(got, describeType(t))
+	}
+	return nil, BadRequestError("Function " + name + " can not be called with (" + strings.Join(got, ",") +
+		") in '" + filterNodeString(node) + "', expected " + strings.Join(expected, " or ") + ".")
+}
+
+// Check if a signature accepts arguments of the given types.
+func (s *FilterFunctionSignature) accepts(types []string) bool {
+	if len(types) < len(s.Parameters) || (len(types) > len(s.Parameters) && !s.isVariadic()) {
+		return false
+	}
+	for i, t := range types {
+		if !isAssignableType(t, s.parameterType(i)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether the last parameter of the signature may be repeated.
+func (s *FilterFunctionSignature) isVariadic() bool {
+	return len(s.Parameters) > 0 && strings.HasSuffix(s.Parameters[len(s.Parameters)-1], "...")
+}
+
+// The type of the i-th argument of a call with this signature.
+func (s *FilterFunctionSignature) parameterType(i int) string {
+	if i >= len(s.Parameters) {
+		i = len(s.Parameters) - 1
+	}
+	return strings.TrimSuffix(s.Parameters[i], "...")
+}
+
+// Check if a value of type t can be passed as a parameter of type param.
+// Numeric values are promoted to wider numeric types.
+func isAssignableType(t, param string) bool {
+	if t == param || t == "" || t == GoDataUntyped || param == "Edm.PrimitiveType" {
+		return true
+	}
+	if isNumericType(t) && isNumericType(param) {
+		return numericTypeRank[t] <= numericTypeRank[param]
+	}
+	return false
+}
+
+// cast and isof take a type name as their last argument, and optionally an
+// expression to cast or check before it. Without the expression they apply to
+// the entity being filtered.
+func (c *filterChecker) checkTypeFunction(node *ParseNode) (FilterExpression, error) {
+	name := node.Token.Value
+	if len(node.Children) == 0 || len(node.Children) > 2 {
+		return nil, BadRequestError("Function " + name + " takes one or two arguments in '" +
+			filterNodeString(node) + "'.")
+	}
+
+	typeNode := node.Children[len(node.Children)-1]
+	typeName := strings.Trim(typeNode.Token.Value, "'")
+	if !strings.Contains(typeName, ".") {
+		return nil, BadRequestError("The last argument of " + name + " must be a qualified type name in '" +
+			filterNodeString(node) + "'.")
+	}
+	typeNode.Token.SemanticType = SemanticTypePropertyValue
+	typeNode.Token.SemanticReference = &typeNode.Token.Value
+
+	args := []FilterExpression{}
+	if len(node.Children) == 2 {
+		arg, err := c.check(node.Children[0])
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	args = append(args, &FilterTypeExpression{Name: typeName, Node: typeNode})
+
+	result := GoDataBoolean
+	if name == "cast" {
+		result = typeName
+	}
+	return &FilterFunctionExpression{Name: name, Arguments: args, Type: result, Node: node}, nil
+}
+
+// Give a dynamic property of unknown type the type it is used as.
+func (c *filterChecker) inferType(expr FilterExpression, t string) {
+	prop, ok := expr.(*FilterPropertyExpression)
+	if !ok || prop.Type != GoDataUntyped || t == "" || t == GoDataUntyped || len(prop.Segments) == 0 {
+		return
+	}
+	prop.Type = t
+	prop.Segments[len(prop.Segments)-1].Property.Type = t
+}
+
+// Describe a type in an error message.
+func describeType(t string) string {
+	if t == "" {
+		return "null"
+	}
+	return t
+}
+
+// Write a parse tree back as filter text, to show where an error is.
+// Operands that are operators themselves are put in parentheses.
+func filterNodeString(node *ParseNode) string {
+	if node == nil || node.Token == nil {
+		return ""
+	}
+
+	value := node.Token.Value
+	switch node.Token.Type {
+	case FilterTokenFunc, FilterTokenLambda:
+		args := []string{}
+		for _, child := range node.Children {
+			args = append(args, filterNodeString(child))
+		}
+		return value + "(" + strings.Join(args, ",") + ")"
+	case FilterTokenList:
+		items := []string{}
+		for _, child := range node.Children {
+			items = append(items, filterNodeString(child))
+		}
+		return "(" + strings.Join(items, ",") + ")"
+	case FilterTokenNav, FilterTokenColon:
+		if len(node.Children) == 2 {
+			return filterNodeString(node.Children[0]) + value + filterNodeString(node.Children[1])
+		}
+	case FilterTokenLogical, FilterTokenOp:
+		operands := []string{}
+		for _, child := range node.Children {
+			s := filterNodeString(child)
+			if (child.Token.Type == FilterTokenLogical || child.Token.Type == FilterTokenOp) &&
+				len(child.Children) > 1 {
+				s = "(" + s + ")"
+			}
+			operands = append(operands, s)
+		}
+		if len(operands) == 1 {
+			if value == "-" {
+				return value + operands[0]
+			}
+			return value + " " + operands[0]
+		}
+		if len(operands) == 2 {
+			return operands[0] + " " + value + " " + operands[1]
+		}
+	}
+	return value
+}
@@ -0,0 +1,361 @@
+package godata
+
+import (
+	"strings"
+	"testing"
+)
+
+func checkTestFilter(filter string) (*GoDataFilterQuery, error) {
+	service, err := BuildService(&DummyProvider{}, "http://localhost")
+	if err != nil {
+		return nil, err
+	}
+	entity, err := service.LookupEntityType("Customer")
+	if err != nil {
+		return nil, err
+	}
+	query, err := ParseFilterString(filter)
+	if err != nil {
+		return nil, err
+	}
+	return query, SemanticizeFilterQuery(query, service, entity)
+}
+
+func TestFilterExpressionTypes(t *testing.T) {
+	query, err := checkTestFilter("Age add 5 gt 2.5 and contains(Name,'Bob')")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	and, ok := query.Expression.(*FilterBinaryExpression)
+	if !ok || and.Operator != "and" || and.EdmType() != GoDataBoolean {
+		t.Error("Root is not a boolean and expression")
+		return
+	}
+
+	gt := and.Left.(*FilterBinaryExpression)
+	add := gt.Left.(*FilterBinaryExpression)
+	if add.EdmType() != GoDataInt32 {
+		t.Error("Age add 5 is", add.EdmType())
+	}
+	if gt.Right.EdmType() != GoDataDouble {
+		t.Error("2.5 is", gt.Right.EdmType())
+	}
+
+	age := add.Left.(*FilterPropertyExpression)
+	if age.Segments[0].Property.Name != "Age" || age.EdmType() != GoDataInt32 {
+		t.Error("Age property not resolved")
+	}
+
+	contains := and.Right.(*FilterFunctionExpression)
+	if contains.Name != "contains" || len(contains.Arguments) != 2 || contains.EdmType() != GoDataBoolean {
+		t.Error("contains not resolved")
+	}
+}
+
+func TestFilterNumericPromotion(t *testing.T) {
+	query, err := checkTestFilter("Age mul 1.5 eq 3")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	mul := query.Expression.(*FilterBinaryExpression).Left
+	if mul.EdmType() != GoDataDouble {
+		t.Error("Age mul 1.5 is", mul.EdmType())
+	}
+}
+
+func TestFilterTypeErrors(t *testing.T) {
+	testCases := []struct {
+		filter  string
+		message string
+	}{
+		{"Name add 5 eq 'x'", "Operator add can not be applied to Edm.String and Edm.Int32 in 'Name add 5'"},
+		{"contains(Age,'x')", "Function contains can not be called with (Edm.Int32,Edm.String) in 'contains(Age,'x')'"},
+		{"Name gt 5", "Operator gt can not be applied to Edm.String and Edm.Int32 in 'Name gt 5'"},
+		{"Age add 1", "The filter must be a boolean expression, but 'Age add 1' is Edm.Int32"},
+		{"not Age", "Operator not can not be applied to Edm.Int32 in 'not Age'"},
+		{"Nmae eq 'x'", "No property found Nmae on entity Customer"},
+	}
+
+	for _, testCase := range testCases {
+		_, err := checkTestFilter(testCase.filter)
+
+		if err == nil {
+			t.Error("Filter " + testCase.filter + " was accepted")
+			continue
+		}
+		if goDataErr, ok := err.(*GoDataError); !ok || goDataErr.ResponseCode != 400 {
+			t.Error("Filter "+testCase.filter+" did not fail with a 400:", err)
+		}
+		if !strings.Contains(err.Error(), testCase.message) {
+			t.Error("Expected \"" + testCase.message + "\", got \"" + err.Error() + "\"")
+		}
+	}
+}
+
+func TestFilterBooleanLiterals(t *testing.T) {
+	query, err := checkTestFilter("true eq not (Age eq 5)")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	literal, ok := query.Expression.(*FilterBinaryExpression).Left.(*FilterLiteralExpression)
+	if !ok || literal.EdmType() != GoDataBoolean {
+		t.Error("true is not a boolean literal")
+	}
+}
+
+func TestFilterLambda(t *testing.T) {
+	query, err := checkTestFilter("Orders/any(o:o/Customer/Name eq 'Bob' or o/Id eq '1')")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	lambda, ok := query.Expression.(*FilterLambdaExpression)
+	if !ok || lambda.Operator != "any" || lambda.Variable != "o" {
+		t.Error("Root is not an any lambda over o")
+		return
+	}
+	if lambda.Collection.EdmType() != "Collection(Store.Order)" {
+		t.Error("Orders is", lambda.Collection.EdmType())
+	}
+
+	or, ok := lambda.Predicate.(*FilterBinaryExpression)
+	if !ok || or.Operator != "or" {
+		t.Error("The whole predicate is not part of the lambda")
+		return
+	}
+
+	name := or.Left.(*FilterBinaryExpression).Left.(*FilterPropertyExpression)
+	if name.Variable != "o" || len(name.Segments) != 2 || name.EdmType() != GoDataString {
+		t.Error("o/Customer/Name not resolved")
+		return
+	}
+	if name.Segments[0].NavigationProperty == nil || name.Segments[0].EntityType.Name != "Customer" {
+		t.Error("Customer navigation property not resolved")
+	}
+}
+
+func TestFilterRootAndIt(t *testing.T) {
+	query, err := checkTestFilter("$it/Age gt $root/Customers('Bob')/Age")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	gt := query.Expression.(*FilterBinaryExpression)
+	it := gt.Left.(*FilterPropertyExpression)
+	if it.Variable != "$it" || it.EdmType() != GoDataInt32 {
+		t.Error("$it/Age not resolved")
+	}
+
+	root := gt.Right.(*FilterPropertyExpression)
+	if root.Variable != "$root" || len(root.Segments) != 2 || root.EdmType() != GoDataInt32 {
+		t.Error("$root/Customers('Bob')/Age not resolved")
+		return
+	}
+	if root.Segments[0].EntitySet == nil || (*root.Segments[0].Identifier)["'Bob'"] != "" {
+		t.Error("Customers('Bob') not resolved")
+	}
+}
+
+func TestFilterPathErrors(t *testing.T) {
+	testCases := []struct {
+		filter  string
+		message string
+	}{
+		{"Orders/any(o:x/Id eq '1')", "No property found x on entity Customer"},
+		{"Orders/any(o:o/Id)", "The predicate of any must be a boolean expression"},
+		{"Orders/any(o:Orders/any(o:o/Id eq '1'))", "Range variable o is already defined"},
+		{"Name/any(n:n eq 'x')", "Operator any can not be applied to Edm.String"},
+		{"Orders/Id eq '1'", "Orders is a collection, it can only be followed by any or all"},
+		{"$root/Customers/Age eq 1", "Entity set Customers must be followed by a key"},
+	}
+
+	for _, testCase := range testCases {
+		_, err := checkTestFilter(testCase.filter)
+
+		if err == nil {
+			t.Error("Filter " + testCase.filter + " was accepted")
+			continue
+		}
+		if !strings.Contains(err.Error(), testCase.message) {
+			t.Error("Expected \"" + testCase.message + "\", got \"" + err.Error() + "\"")
+		}
+	}
+}
+
+func TestFilterIn(t *testing.T) {
+	query, err := checkTestFilter("Age in (1, 2.5) and Name in ('Bob')")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	in := query.Expression.(*FilterBinaryExpression).Left.(*FilterBinaryExpression)
+	list, ok := in.Right.(*FilterListExpression)
+	if in.Operator != "in" || !ok || len(list.Items) != 2 {
+		t.Error("Age in (1, 2.5) not resolved")
+		return
+	}
+	if list.EdmType() != "Collection(Edm.Double)" {
+		t.Error("(1, 2.5) is", list.EdmType())
+	}
+
+	_, err = checkTestFilter("Age in (1, 'x')")
+	if err == nil || !strings.Contains(err.Error(), "Operator in can not be applied to Edm.Int32 and Edm.String") {
+		t.Error("Age in (1, 'x') was not rejected:", err)
+	}
+	_, err = checkTestFilter("Age in 1")
+	if err == nil || !strings.Contains(err.Error(), "expected a list or a collection") {
+		t.Error("Age in 1 was not rejected:", err)
+	}
+}
+
+func TestFilterFunctionArity(t *testing.T) {
+	query, err := checkTestFilter("substring(Name,1) eq substring(Name,1,2) and " +
+		"concat(Name,'-',Name) eq 'x' and Orders/any()")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	and := query.Expression.(*FilterBinaryExpression)
+	eq := and.Left.(*FilterBinaryExpression).Left.(*FilterBinaryExpression)
+	if len(eq.Left.(*FilterFunctionExpression).Arguments) != 2 ||
+		len(eq.Right.(*FilterFunctionExpression).Arguments) != 3 {
+		t.Error("substring overloads not resolved")
+	}
+	concat := and.Left.(*FilterBinaryExpression).Right.(*FilterBinaryExpression).Left.(*FilterFunctionExpression)
+	if len(concat.Arguments) != 3 || concat.EdmType() != GoDataString {
+		t.Error("concat with 3 arguments not resolved")
+	}
+	if lambda, ok := and.Right.(*FilterLambdaExpression); !ok || lambda.Predicate != nil {
+		t.Error("any() not resolved")
+	}
+
+	testCases := []struct {
+		filter  string
+		message string
+	}{
+		{"substring(Name) eq 'x'", "Function substring takes 2 or 3 arguments, but 1 was given at column 1"},
+		{"contains(Name,'x','y')", "Function contains takes 2 arguments, but 3 were given at column 1"},
+		{"concat(Name) eq 'x'", "Function concat takes at least 2 arguments, but 1 was given"},
+		{"now(1) eq now()", "Function now takes 0 arguments, but 1 was given"},
+		{"concat(Name,1) eq 'x'", "Function concat can not be called with (Edm.String,Edm.Int32)"},
+	}
+
+	for _, testCase := range testCases {
+		_, err := checkTestFilter(testCase.filter)
+
+		if err == nil {
+			t.Error("Filter " + testCase.filter + " was accepted")
+			continue
+		}
+		if !strings.Contains(err.Error(), testCase.message) {
+			t.Error("Expected \"" + testCase.message + "\", got \"" + err.Error() + "\"")
+		}
+	}
+}
+
+func TestFilterCustomFunctions(t *testing.T) {
+	service, err := BuildService(&DummyProvider{}, "http://localhost")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	other, err := BuildService(&DummyProvider{}, "http://localhost")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	entity, err := service.LookupEntityType("Customer")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	fuzzymatch := &GoDataFilterFunction{
+		Name:         "fuzzymatch",
+		Signatures:   []*FilterFunctionSignature{{[]string{GoDataString, GoDataString}, GoDataBoolean}},
+		Translations: map[string]string{"mysql": "(SOUNDEX(%s) = SOUNDEX(%s))"},
+	}
+	if err := service.RegisterFilterFunction(fuzzymatch); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := service.RegisterFilterFunction(&GoDataFilterFunction{
+		Name:       "geo.withinRegion",
+		Signatures: []*FilterFunctionSignature{{[]string{GoDataString}, GoDataBoolean}},
+	}); err != nil {
+		t.Error(err)
+		return
+	}
+
+	query, err := service.FilterFunctions.ParseFilter("fuzzymatch(Name,'bob') and geo.withinRegion('EU')", nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if err := SemanticizeFilterQuery(query, service, entity); err != nil {
+		t.Error(err)
+		return
+	}
+	call := query.Expression.(*FilterBinaryExpression).Left.(*FilterFunctionExpression)
+	if call.Function != fuzzymatch || call.EdmType() != GoDataBoolean {
+		t.Error("fuzzymatch not resolved to the registered function")
+	}
+	if call.Node.Token.SemanticReference != fuzzymatch {
+		t.Error("fuzzymatch token does not refer to the registered function")
+	}
+	if sql, ok := call.Function.Translate("mysql", "`name`", "?"); sql != "(SOUNDEX(`name`) = SOUNDEX(?))" || !ok {
+		t.Error("fuzzymatch is translated to", sql)
+	}
+	if _, ok := call.Function.Translate("mysql", "?"); ok {
+		t.Error("fuzzymatch translated with 1 argument")
+	}
+	if _, ok := call.Function.Translate("postgres", "`name`", "?"); ok {
+		t.Error("fuzzymatch translated for a provider without a translation")
+	}
+
+	// the functions are only known to the service they are registered on
+	query, err = other.FilterFunctions.ParseFilter("fuzzymatch(Name,'bob')", nil)
+	if err == nil {
+		otherEntity, _ := other.LookupEntityType("Customer")
+		err = SemanticizeFilterQuery(query, other, otherEntity)
+	}
+	if err == nil || !strings.Contains(err.Error(), "fuzzymatch") {
+		t.Error("fuzzymatch accepted by another service")
+	}
+	if _, err := checkTestFilter("fuzzymatch(Name,'bob')"); err == nil {
+		t.Error("fuzzymatch accepted without registering it")
+	}
+	if _, err := service.FilterFunctions.ParseFilter("fuzzymatch(Name)", nil); err == nil {
+		t.Error("fuzzymatch called with 1 argument")
+	}
+
+	invalid := []*GoDataFilterFunction{
+		{Name: "fuzzymatch", Signatures: fuzzymatch.Signatures},
+		{Name: "contains", Signatures: fuzzymatch.Signatures},
+		{Name: "eq", Signatures: fuzzymatch.Signatures},
+		{Name: "fuzzy match", Signatures: fuzzymatch.Signatures},
+		{Name: "nosignatures"},
+	}
+	for _, fn := range invalid {
+		if err := service.RegisterFilterFunction(fn); err == nil {
+			t.Error("Registered invalid function " + fn.Name)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package godata
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// A custom function that may be called in a $filter, e.g.
+// fuzzymatch(Name,'milk'). Custom functions are registered on a service, and
+// can only be called in requests to that service.
+type GoDataFilterFunction struct {
+	// The name of the function, optionally qualified, e.g. geo.withinRegion.
+	Name string
+	// The signatures of the function. Calls are resolved to the first one
+	// whose parameters accept the arguments.
+	Signatures []*FilterFunctionSignature
+	// Evaluates a call of the function with the decoded values of its
+	// arguments. Providers that evaluate filters in Go, instead of translating
+	// them to a query language, use this. May be nil.
+	Evaluate func(args ...interface{}) (interface{}, error)
+	// Format strings that translate a call of the function to an expression
+	// of a provider, by provider name, e.g. "mysql": "SOUNDEX(%s) = SOUNDEX(%s)".
+	// Each %s is replaced by an argument, see Translate.
+	Translations map[string]string
+}
+
+// Translate a call of the function for the named provider, given the already
+// translated arguments. Returns false if the function has no translation for
+// the provider, or the translation does not take that many arguments.
+func (fn *GoDataFilterFunction) Translate(provider string, args ...string) (string, bool) {
+	format, ok := fn.Translations[provider]
+	if !ok || strings.Count(format, "%s") != len(args) {
+		return "", false
+	}
+	values := make([]interface{}, len(args))
+	for i, arg := range args {
+		values[i] = arg
+	}
+	return fmt.Sprintf(format, values...), true
+}
+
+// The functions that may be called in filters, along with the lexer and
+// parser that know about them. Each service has its own table, so functions
+// registered on one service can not be called in requests to another.
+type FilterFunctionTable struct {
+	Lexer     *FilterLexer
+	Parser    *Parser
+	Functions map[string]*GoDataFilterFunction
+}
+
+var filterFunctionNameRegexp = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*(\\.[a-zA-Z_][a-zA-Z0-9_]*)*$")
+
+// Create a table of the built-in filter functions, to which custom functions
+// can be registered.
+func NewFilterFunctionTable() *FilterFunctionTable {
+	return &FilterFunctionTable{
+		Lexer:     FilterTokenizer(),
+		Parser:    FilterParser(),
+		Functions: map[string]*GoDataFilterFunction{},
+	}
+}
+
+// Add a custom function to the table. Fails if the name is not a valid
+// identifier, if it is taken by a built-in or registered function, or if the
+// function has no signatures.
+func (t *FilterFunctionTable) Register(fn *GoDataFilterFunction) error {
+	if !filterFunctionNameRegexp.MatchString(fn.Name) {
+		return errors.New("Invalid filter function name " + fn.Name)
+	}
+	if _, ok := filterKeywords[fn.Name]; ok {
+		return errors.New("Filter function " + fn.Name + " has the name of an operator")
+	}
+	if _, ok := t.Parser.Functions[fn.Name]; ok {
+		return errors.New("Filter function " + fn.Name + " is already defined")
+	}
+	if len(fn.Signatures) == 0 {
+		return errors.New("Filter function " + fn.Name + " has no signatures")
+	}
+
+	min, max := signatureArity(fn.Signatures)
+	t.Lexer.Functions[fn.Name] = true
+	t.Parser.DefineVariadicFunction(fn.Name, min, max)
+	t.Functions[fn.Name] = fn
+	return nil
+}
@@ -0,0 +1,296 @@
+package godata
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Splits a $filter into tokens. Words are read whole before they are
+// classified, so a property named order is not read as the operator or
+// followed by der, and a word is only a function if it is followed by its
+// arguments.
+type FilterLexer struct {
+	// The names of the functions that may be called in a filter.
+	Functions map[string]bool
+}
+
+// Create a lexer capable of tokenizing filter statements
+func FilterTokenizer() *FilterLexer {
+	lexer := &FilterLexer{Functions: map[string]bool{}}
+	for _, name := range []string{"contains", "endswith", "startswith", "length", "indexof",
+		"substring", "tolower", "toupper", "trim", "concat", "year", "month", "day", "hour",
+		"minute", "second", "fractionalseconds", "date", "time", "totaloffsetminutes", "now",
+		"maxdatetime", "mindatetime", "totalseconds", "round", "floor", "ceiling", "isof", "cast",
+		"geo.distance", "geo.intersects", "geo.length"} {
+		lexer.Functions[name] = true
+	}
+	return lexer
+}
+
+// The forms of literals that start with a digit, in the order they are tried.
+var filterNumberPatterns = []struct {
+	Re    *regexp.Regexp
+	Token int
+}{
+	{regexp.MustCompile("^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}"), FilterTokenGuid},
+	{regexp.MustCompile("^[0-9]{4}-[0-9]{2}-[0-9]{2}T[0-9]{2}:[0-9]{2}(:[0-9]{2}(\\.[0-9]+)?)?(Z|[+-][0-9]{2}:[0-9]{2})"), FilterTokenDateTime},
+	{regexp.MustCompile("^-?[0-9]{4}-[0-9]{2}-[0-9]{2}"), FilterTokenDate},
+	{regexp.MustCompile("^[0-9]{2}:[0-9]{2}(:[0-9]{2}(\\.[0-9]+)?)?"), FilterTokenTime},
+	{regexp.MustCompile("^-?[0-9]+(\\.[0-9]+)?[mM]"), FilterTokenDecimal},
+	{regexp.MustCompile("^-?[0-9]+(\\.[0-9]+)?[eE][+-]?[0-9]+"), FilterTokenFloat},
+	{regexp.MustCompile("^-?[0-9]+\\.[0-9]+"), FilterTokenFloat},
+	{regexp.MustCompile("^-?[0-9]+"), FilterTokenInteger},
+}
+
+// The words that are operators, and their token types.
+var filterKeywords = map[string]int{
+	"eq":    FilterTokenLogical,
+	"ne":    FilterTokenLogical,
+	"gt":    FilterTokenLogical,
+	"ge":    FilterTokenLogical,
+	"lt":    FilterTokenLogical,
+	"le":    FilterTokenLogical,
+	"and":   FilterTokenLogical,
+	"or":    FilterTokenLogical,
+	"not":   FilterTokenLogical,
+	"has":   FilterTokenLogical,
+	"in":    FilterTokenLogical,
+	"add":   FilterTokenOp,
+	"sub":   FilterTokenOp,
+	"mul":   FilterTokenOp,
+	"div":   FilterTokenOp,
+	"divby": FilterTokenOp,
+	"mod":   FilterTokenOp,
+	"null":  FilterTokenNull,
+	"true":  FilterTokenBoolean,
+	"false": FilterTokenBoolean,
+	"INF":   FilterTokenFloat,
+	"NaN":   FilterTokenFloat,
+}
+
+// Literals written as a prefix followed by a quoted value, e.g. duration'P1D'.
+var filterPrefixedLiterals = map[string]int{
+	"duration":  FilterTokenDuration,
+	"binary":    FilterTokenBinary,
+	"geography": FilterTokenGeography,
+	"geometry":  FilterTokenGeometry,
+}
+
+// Symbols clients often use in place of an operator, and the operator to use.
+var filterSymbolSuggestions = map[string]string{
+	"==": "eq",
+	"!=": "ne",
+	"<>": "ne",
+	">=": "ge",
+	"<=": "le",
+	"&&": "and",
+	"||": "or",
+	"=":  "eq",
+	">":  "gt",
+	"<":  "lt",
+	"&":  "and",
+	"|":  "or",
+	"!":  "not",
+	"+":  "add",
+	"*":  "mul",
+	"%":  "mod",
+	"\"": "'",
+}
+
+func (l *FilterLexer) TokenizeBytes(target []byte) ([]*Token, error) {
+	return l.Tokenize(string(target))
+}
+
+// Split a filter into tokens, recording the offset of each token. Fails with
+// a *ParseError if a part of the filter is not a token.
+func (l *FilterLexer) Tokenize(target string) ([]*Token, error) {
+	result := []*Token{}
+	emit := func(start, end, tokenType int) {
+		result = append(result, &Token{Value: target[start:end], Type: tokenType, Offset: start})
+	}
+
+	for i := 0; i < len(target); {
+		c := target[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '(':
+			emit(i, i+1, FilterTokenOpenParen)
+			i++
+		case c == ')':
+			emit(i, i+1, FilterTokenCloseParen)
+			i++
+		case c == '/':
+			emit(i, i+1, FilterTokenNav)
+			i++
+		case c == ':':
+			emit(i, i+1, FilterTokenColon)
+			i++
+		case c == ',':
+			emit(i, i+1, FilterTokenComma)
+			i++
+		case c == '\'':
+			end, err := scanQuoted(target, i)
+			if err != nil {
+				return nil, err
+			}
+			emit(i, end, FilterTokenString)
+			i = end
+		case c == '$':
+			end := scanWord(target, i+1)
+			switch target[i:end] {
+			case "$it":
+				emit(i, end, FilterTokenIt)
+			case "$root":
+				emit(i, end, FilterTokenRoot)
+			case "$count":
+				emit(i, end, FilterTokenCount)
+			default:
+				return nil, &ParseError{Offset: i, Message: "Unexpected '" + target[i:end] + "'",
+					Suggestions: []string{"$it", "$root"}}
+			}
+			i = end
+		case c == '@':
+			end := scanWord(target, i+1)
+			if end == i+1 {
+				return nil, &ParseError{Offset: i, Message: "Expected the name of a parameter alias after '@'"}
+			}
+			emit(i, end, FilterTokenAlias)
+			i = end
+		case isDigit(c) || (c == '-' && i+1 < len(target) && isDigit(target[i+1])):
+			end, tokenType, err := scanNumber(target, i)
+			if err != nil {
+				return nil, err
+			}
+			emit(i, end, tokenType)
+			i = end
+		case c == '-' && strings.HasPrefix(target[i:], "-INF") && scanWord(target, i+1) == i+4:
+			emit(i, i+4, FilterTokenFloat)
+			i += 4
+		case c == '-':
+			// unary minus
+			emit(i, i+1, FilterTokenOp)
+			i++
+		case isWordStart(c):
+			end, tokenType, err := l.scanIdentifier(target, i)
+			if err != nil {
+				return nil, err
+			}
+			emit(i, end, tokenType)
+			i = end
+		default:
+			symbol := target[i : i+1]
+			if i+1 < len(target) {
+				if _, ok := filterSymbolSuggestions[target[i:i+2]]; ok {
+					symbol = target[i : i+2]
+				}
+			}
+			err := &ParseError{Offset: i, Message: "Unexpected '" + symbol + "'"}
+			if suggestion, ok := filterSymbolSuggestions[symbol]; ok {
+				err.Suggestions = []string{suggestion}
+			}
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// Read a word starting at i, and classify it as an operator, a function, a
+// prefixed literal or a literal.
+func (l *FilterLexer) scanIdentifier(target string, i int) (int, int, error) {
+	end := scanWord(target, i)
+	// qualified names, e.g. Namespace.Type or geo.distance
+	for end+1 < len(target) && target[end] == '.' && isWordStart(target[end+1]) {
+		end = scanWord(target, end+1)
+	}
+	word := target[i:end]
+
+	// GUIDs may start with a letter
+	if end < len(target) && target[end] == '-' {
+		if match := filterNumberPatterns[0].Re.FindString(target[i:]); match != "" {
+			return i + len(match), FilterTokenGuid, nil
+		}
+	}
+
+	if tokenType, ok := filterPrefixedLiterals[strings.ToLower(word)]; ok && end < len(target) && target[end] == '\'' {
+		quoted, err := scanQuoted(target, end)
+		if err != nil {
+			return 0, 0, err
+		}
+		return quoted, tokenType, nil
+	}
+
+	if tokenType, ok := filterKeywords[word]; ok {
+		return end, tokenType, nil
+	}
+
+	if l.Functions[word] || word == "any" || word == "all" {
+		next := end
+		for next < len(target) && target[next] == ' ' {
+			next++
+		}
+		if next < len(target) && target[next] == '(' {
+			if word == "any" || word == "all" {
+				return end, FilterTokenLambda, nil
+			}
+			return end, FilterTokenFunc, nil
+		}
+	}
+
+	return end, FilterTokenLiteral, nil
+}
+
+// Read a number, date, time or GUID starting at i. It must not be followed
+// directly by a letter or digit.
+func scanNumber(target string, i int) (int, int, error) {
+	for _, pattern := range filterNumberPatterns {
+		match := pattern.Re.FindString(target[i:])
+		if match == "" {
+			continue
+		}
+		end := i + len(match)
+		if end < len(target) && isWordPart(target[end]) {
+			break
+		}
+		return end, pattern.Token, nil
+	}
+	end := scanWord(target, i+1)
+	return 0, 0, &ParseError{Offset: i, Message: "Invalid literal '" + target[i:end] + "'"}
+}
+
+// Read a quoted value starting at the quote at i, where ” stands for a
+// quote. Returns the offset after the closing quote.
+func scanQuoted(target string, i int) (int, error) {
+	for j := i + 1; j < len(target); j++ {
+		if target[j] != '\'' {
+			continue
+		}
+		if j+1 < len(target) && target[j+1] == '\'' {
+			j++
+			continue
+		}
+		return j + 1, nil
+	}
+	return 0, &ParseError{Offset: i, Message: "The quote is not closed"}
+}
+
+// Read the letters, digits and underscores starting at i.
+func scanWord(target string, i int) int {
+	for i < len(target) && isWordPart(target[i]) {
+		i++
+	}
+	return i
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isWordStart(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_'
+}
+
+func isWordPart(c byte) bool {
+	return isWordStart(c) || isDigit(c)
+}
@@ -0,0 +1,196 @@
+package godata
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"math"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A geography or geometry literal, e.g. geography'SRID=4326;Point(1 2)'.
+type GoDataGeoLiteral struct {
+	// True for geography literals, false for geometry literals.
+	Geography bool
+	// The spatial reference system of the coordinates. Defaults to 4326 for
+	// geography and 0 for geometry.
+	SRID int
+	// The kind of shape, e.g. Point or Polygon.
+	Kind string
+	// The shape as well-known text, e.g. Point(1 2).
+	WKT string
+}
+
+// The Edm type of the literal, e.g. Edm.GeographyPoint.
+func (g *GoDataGeoLiteral) EdmType() string {
+	if g.Geography {
+		return "Edm.Geography" + g.Kind
+	}
+	return "Edm.Geometry" + g.Kind
+}
+
+// The kinds of shapes of geo literals by their lower case name.
+var geoKinds = map[string]string{
+	"point":           "Point",
+	"linestring":      "LineString",
+	"polygon":         "Polygon",
+	"multipoint":      "MultiPoint",
+	"multilinestring": "MultiLineString",
+	"multipolygon":    "MultiPolygon",
+	"collection":      "Collection",
+}
+
+var durationRegexp = regexp.MustCompile("^(-)?P(?:([0-9]+)D)?(?:T(?:([0-9]+)H)?(?:([0-9]+)M)?(?:([0-9]+(?:\\.[0-9]+)?)S)?)?$")
+
+// Decode the value of a literal token into a Go value, and store it in the
+// Literal field of the token. Strings decode to string, integers to int64,
+// floats to float64, decimals to *big.Rat, booleans to bool, dates and
+// date-times to time.Time, times of day and durations to time.Duration,
+// GUIDs to [16]byte, binary to []byte and geo literals to *GoDataGeoLiteral.
+// Tokens that are not literals are left alone. Fails with a *ParseError if
+// the literal is not valid, e.g. the date 2017-13-45.
+func DecodeFilterLiteral(token *Token) error {
+	value, err := decodeFilterLiteral(token)
+	if err != nil {
+		return &ParseError{Offset: token.Offset, Message: "Invalid literal " + token.Value}
+	}
+	token.Literal = value
+	return nil
+}
+
+func decodeFilterLiteral(token *Token) (interface{}, error) {
+	v := token.Value
+	switch token.Type {
+	case FilterTokenString:
+		return strings.Replace(v[1:len(v)-1], "''", "'", -1), nil
+	case FilterTokenInteger:
+		return strconv.ParseInt(v, 10, 64)
+	case FilterTokenFloat:
+		switch v {
+		case "INF":
+			return math.Inf(1), nil
+		case "-INF":
+			return math.Inf(-1), nil
+		case "NaN":
+			return math.NaN(), nil
+		}
+		return strconv.ParseFloat(v, 64)
+	case FilterTokenDecimal:
+		rat, ok := new(big.Rat).SetString(strings.TrimRight(v, "mM"))
+		if !ok {
+			return nil, BadRequestError("not a decimal")
+		}
+		return rat, nil
+	case FilterTokenBoolean:
+		return v == "true", nil
+	case FilterTokenDate:
+		return time.Parse("2006-01-02", v)
+	case FilterTokenDateTime:
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return t, nil
+		}
+		return time.Parse("2006-01-02T15:04Z07:00", v)
+	case FilterTokenTime:
+		return decodeTimeOfDay(v)
+	case FilterTokenGuid:
+		var guid [16]byte
+		_, err := hex.Decode(guid[:], []byte(strings.Replace(v, "-", "", -1)))
+		return guid, err
+	case FilterTokenDuration:
+		return decodeDuration(quotedLiteral(v))
+	case FilterTokenBinary:
+		return base64.RawURLEncoding.DecodeString(strings.TrimRight(quotedLiteral(v), "="))
+	case FilterTokenGeography, FilterTokenGeometry:
+		return decodeGeoLiteral(token.Type == FilterTokenGeography, quotedLiteral(v))
+	}
+	return nil, nil
+}
+
+// The part of a prefixed literal between the quotes, e.g. P1D of
+// duration'P1D'.
+func quotedLiteral(v string) string {
+	return v[strings.Index(v, "'")+1 : len(v)-1]
+}
+
+func decodeTimeOfDay(v string) (time.Duration, error) {
+	layout := "15:04:05"
+	if strings.Count(v, ":") == 1 {
+		layout = "15:04"
+	}
+	t, err := time.Parse(layout, v)
+	if err != nil {
+		return 0, err
+	}
+	return t.Sub(time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())), nil
+}
+
+// Decode an ISO 8601 duration with days, hours, minutes and seconds, e.g.
+// P1DT2H30M.
+func decodeDuration(v string) (time.Duration, error) {
+	match := durationRegexp.FindStringSubmatch(v)
+	if match == nil || v == "P" || v == "-P" || strings.HasSuffix(v, "T") {
+		return 0, BadRequestError("not a duration")
+	}
+
+	result := time.Duration(0)
+	units := []time.Duration{24 * time.Hour, time.Hour, time.Minute}
+	for i, unit := range units {
+		if match[i+2] == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(match[i+2], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		result += time.Duration(n) * unit
+	}
+	if match[5] != "" {
+		seconds, err := strconv.ParseFloat(match[5], 64)
+		if err != nil {
+			return 0, err
+		}
+		result += time.Duration(seconds * float64(time.Second))
+	}
+
+	if match[1] == "-" {
+		result = -result
+	}
+	return result, nil
+}
+
+// Decode the well-known text of a geo literal, optionally preceded by its
+// SRID, e.g. SRID=4326;Point(1 2).
+func decodeGeoLiteral(geography bool, v string) (*GoDataGeoLiteral, error) {
+	result := &GoDataGeoLiteral{Geography: geography}
+	if geography {
+		result.SRID = 4326
+	}
+
+	if strings.HasPrefix(strings.ToUpper(v), "SRID=") {
+		end := strings.Index(v, ";")
+		if end < 0 {
+			return nil, BadRequestError("SRID must be followed by ;")
+		}
+		srid, err := strconv.Atoi(v[len("SRID="):end])
+		if err != nil {
+			return nil, err
+		}
+		result.SRID = srid
+		v = v[end+1:]
+	}
+
+	open := strings.Index(v, "(")
+	if open < 0 || !strings.HasSuffix(v, ")") {
+		return nil, BadRequestError("not well-known text")
+	}
+	kind, ok := geoKinds[strings.ToLower(v[:open])]
+	if !ok {
+		return nil, BadRequestError("unknown shape " + v[:open])
+	}
+	result.Kind = kind
+	result.WKT = v
+	return result, nil
+}
@@ -1,5 +1,10 @@
 package godata
 
+import (
+	"strconv"
+	"strings"
+)
+
 const (
 	FilterTokenOpenParen int = iota
 	FilterTokenCloseParen
@@ -22,69 +27,254 @@ const (
 	FilterTokenDateTime
 	FilterTokenBoolean
 	FilterTokenLiteral
+	FilterTokenList // a parenthesized list, e.g. ('Milk','Cheese'), after in
+	FilterTokenAlias
+	FilterTokenGuid
+	FilterTokenDuration
+	FilterTokenBinary
+	FilterTokenDecimal
+	FilterTokenGeography
+	FilterTokenGeometry
+	FilterTokenCount // the $count of a collection, e.g. Orders/$count
 )
 
 var GlobalFilterTokenizer = FilterTokenizer()
 var GlobalFilterParser = FilterParser()
 
+// The filter functions known to filters parsed without a service, i.e. the
+// built-in functions.
+var GlobalFilterFunctions = &FilterFunctionTable{
+	Lexer:     GlobalFilterTokenizer,
+	Parser:    GlobalFilterParser,
+	Functions: map[string]*GoDataFilterFunction{},
+}
+
 // Convert an input string from the $filter part of the URL into a parse
 // tree that can be used by providers to create a response.
 func ParseFilterString(filter string) (*GoDataFilterQuery, error) {
-	tokens, err := GlobalFilterTokenizer.Tokenize(filter)
+	return ParseFilterStringWithAliases(filter, nil)
+}
+
+// Parse a $filter that may refer to parameter aliases, e.g. Price gt @p. The
+// value of each alias, given by name including the @, is parsed in place of
+// the alias. Referring to an alias that is not given is an error.
+func ParseFilterStringWithAliases(filter string, aliases map[string]string) (*GoDataFilterQuery, error) {
+	return GlobalFilterFunctions.ParseFilter(filter, aliases)
+}
+
+// A deep copy of an unsemanticized filter.
+func cloneFilterQuery(filter *GoDataFilterQuery) *GoDataFilterQuery {
+	if filter == nil {
+		return nil
+	}
+	return &GoDataFilterQuery{Tree: cloneParseNode(filter.Tree)}
+}
+
+// Parse a $filter that may call the functions in the table, and refer to
+// parameter aliases.
+func (t *FilterFunctionTable) ParseFilter(filter string, aliases map[string]string) (*GoDataFilterQuery, error) {
+	tokens, err := t.Lexer.Tokenize(filter)
+	if err != nil {
+		return nil, DescribeParseError(filter, err)
+	}
+	tokens, err = t.substituteAliases(tokens, aliases)
+	if err != nil {
+		return nil, DescribeParseError(filter, err)
+	}
+	for _, token := range tokens {
+		if err := DecodeFilterLiteral(token); err != nil {
+			return nil, DescribeParseError(filter, err)
+		}
+	}
+	tree, err := t.parseFilterTokens(mergeKeyPredicates(tokens))
+	if err != nil {
+		return nil, DescribeParseError(filter, err)
+	}
+	return &GoDataFilterQuery{Tree: tree}, nil
+}
+
+// Build the parse tree of a list of filter tokens.
+func (t *FilterFunctionTable) parseFilterTokens(tokens []*Token) (*ParseNode, error) {
+	tokens, lists, err := t.extractListLiterals(tokens)
 	if err != nil {
 		return nil, err
 	}
 	// TODO: can we do this in one fell swoop?
-	postfix, err := GlobalFilterParser.InfixToPostfix(tokens)
+	postfix, err := t.Parser.InfixToPostfix(tokens)
 	if err != nil {
 		return nil, err
 	}
-	tree, err := GlobalFilterParser.PostfixToTree(postfix)
+	tree, err := t.Parser.PostfixToTree(postfix)
 	if err != nil {
 		return nil, err
 	}
-	return &GoDataFilterQuery{tree}, nil
-}
-
-// Create a tokenizer capable of tokenizing filter statements
-func FilterTokenizer() *Tokenizer {
-	t := Tokenizer{}
-	t.Add("^[0-9]{4,4}-[0-9]{2,2}-[0-9]{2,2}T[0-9]{2,2}:[0-9]{2,2}(:[0-9]{2,2}(.[0-9]+)?)?(Z|[+-][0-9]{2,2}:[0-9]{2,2})", FilterTokenDateTime)
-	t.Add("^-?[0-9]{4,4}-[0-9]{2,2}-[0-9]{2,2}", FilterTokenDate)
-	t.Add("^[0-9]{2,2}:[0-9]{2,2}(:[0-9]{2,2}(.[0-9]+)?)?", FilterTokenTime)
-	t.Add("^\\(", FilterTokenOpenParen)
-	t.Add("^\\)", FilterTokenCloseParen)
-	t.Add("^/", FilterTokenNav)
-	t.Add("^:", FilterTokenColon)
-	t.Add("^,", FilterTokenComma)
-	t.Add("^(eq|ne|gt|ge|lt|le|and|or|not|has)", FilterTokenLogical)
-	t.Add("^(add|sub|mul|div|mod)", FilterTokenOp)
-	t.Add("^(contains|endswith|startswith|length|indexof|substring|tolower|toupper|"+
-		"trim|concat|year|month|day|hour|minute|second|fractionalseconds|date|"+
-		"time|totaloffsetminutes|now|maxdatetime|mindatetime|totalseconds|round|"+
-		"floor|ceiling|isof|cast|geo.distance|geo.intersects|geo.length)", FilterTokenFunc)
-	t.Add("^(any|all)", FilterTokenLambda)
-	t.Add("^null", FilterTokenNull)
-	t.Add("^\\$it", FilterTokenIt)
-	t.Add("^\\$root", FilterTokenRoot)
-	t.Add("^-?[0-9]+\\.[0-9]+", FilterTokenFloat)
-	t.Add("^-?[0-9]+", FilterTokenInteger)
-	t.Add("^'(''|[^'])*'", FilterTokenString)
-	t.Add("^[a-zA-Z][a-zA-Z0-9_.]*", FilterTokenLiteral)
-	t.Ignore("^ ", FilterTokenWhitespace)
-
-	return &t
+	attachListItems(tree, lists)
+	return tree, nil
+}
+
+// Replace each list following the in operator with a single list token, so
+// the commas in it are not taken for function argument separators. The items
+// of each list are parsed on their own, and returned by list token.
+func (t *FilterFunctionTable) extractListLiterals(tokens []*Token) ([]*Token, map[*Token][]*ParseNode, error) {
+	result := []*Token{}
+	lists := map[*Token][]*ParseNode{}
+
+	for i := 0; i < len(tokens); i++ {
+		token := tokens[i]
+		result = append(result, token)
+		if token.Value != "in" || token.Type != FilterTokenLogical ||
+			i+1 >= len(tokens) || tokens[i+1].Type != FilterTokenOpenParen {
+			continue
+		}
+
+		list := &Token{Type: FilterTokenList, Offset: tokens[i+1].Offset}
+		values := []string{}
+		items := []*ParseNode{}
+		item := []*Token{}
+		depth := 0
+		for i++; i < len(tokens); i++ {
+			next := tokens[i]
+			values = append(values, next.Value)
+			if next.Type == FilterTokenOpenParen {
+				depth++
+				if depth == 1 {
+					continue
+				}
+			} else if next.Type == FilterTokenCloseParen {
+				depth--
+			}
+			if depth == 0 || (depth == 1 && next.Type == FilterTokenComma) {
+				if len(item) == 0 {
+					return nil, nil, &ParseError{Offset: next.Offset, Message: "Expected a value before '" + next.Value + "'"}
+				}
+				node, err := t.parseFilterTokens(item)
+				if err != nil {
+					return nil, nil, err
+				}
+				items = append(items, node)
+				item = []*Token{}
+				if depth == 0 {
+					break
+				}
+				continue
+			}
+			item = append(item, next)
+		}
+		if depth != 0 {
+			return nil, nil, &ParseError{Offset: list.Offset, Message: "'(' is not closed"}
+		}
+
+		list.Value = strings.Join(values, "")
+		lists[list] = items
+		result = append(result, list)
+	}
+
+	return result, lists, nil
+}
+
+// Make the items of each list children of its node in the parse tree.
+func attachListItems(node *ParseNode, lists map[*Token][]*ParseNode) {
+	if items, ok := lists[node.Token]; ok {
+		node.Children = items
+		return
+	}
+	for _, child := range node.Children {
+		attachListItems(child, lists)
+	}
+}
+
+// Replace each alias token with the tokens of its value. Values made of more
+// than one token are put in parentheses, so they are parsed as one operand.
+func (t *FilterFunctionTable) substituteAliases(tokens []*Token, aliases map[string]string) ([]*Token, error) {
+	result := []*Token{}
+	for _, token := range tokens {
+		if token.Type != FilterTokenAlias {
+			result = append(result, token)
+			continue
+		}
+		value, ok := aliases[token.Value]
+		if !ok {
+			return nil, &ParseError{Offset: token.Offset, Message: "Parameter alias " + token.Value + " is not defined"}
+		}
+		valueTokens, err := t.Lexer.Tokenize(value)
+		if err != nil {
+			return nil, DescribeParseError(value, err)
+		}
+		if len(valueTokens) == 0 {
+			return nil, &ParseError{Offset: token.Offset, Message: "Parameter alias " + token.Value + " has no value"}
+		}
+		for _, valueToken := range valueTokens {
+			if valueToken.Type == FilterTokenAlias {
+				return nil, &ParseError{Offset: token.Offset, Message: "The value of parameter alias " +
+					token.Value + " can not refer to another alias"}
+			}
+			// errors in the value are reported where the alias is used
+			valueToken.Offset = token.Offset
+		}
+		if len(valueTokens) > 1 && !isParenthesized(valueTokens) {
+			valueTokens = append(append([]*Token{&Token{Value: "(", Type: FilterTokenOpenParen, Offset: token.Offset}},
+				valueTokens...), &Token{Value: ")", Type: FilterTokenCloseParen, Offset: token.Offset})
+		}
+		result = append(result, valueTokens...)
+	}
+	return result, nil
+}
+
+// Check if the first token is a parenthesis that is closed by the last token.
+func isParenthesized(tokens []*Token) bool {
+	depth := 0
+	for i, t := range tokens {
+		if t.Type == FilterTokenOpenParen {
+			depth++
+		} else if t.Type == FilterTokenCloseParen {
+			depth--
+		}
+		if depth == 0 {
+			return i == len(tokens)-1 && tokens[0].Type == FilterTokenOpenParen
+		}
+	}
+	return false
+}
+
+// Join the tokens of a key predicate with the name before it, so that
+// $root/People('x') is a path segment People('x') rather than a call.
+func mergeKeyPredicates(tokens []*Token) []*Token {
+	result := []*Token{}
+	for i := 0; i < len(tokens); i++ {
+		token := tokens[i]
+		if token.Type != FilterTokenLiteral || i+1 >= len(tokens) || tokens[i+1].Type != FilterTokenOpenParen {
+			result = append(result, token)
+			continue
+		}
+		value := token.Value
+		depth := 0
+		for i++; i < len(tokens); i++ {
+			value += tokens[i].Value
+			if tokens[i].Type == FilterTokenOpenParen {
+				depth++
+			} else if tokens[i].Type == FilterTokenCloseParen {
+				depth--
+				if depth == 0 {
+					break
+				}
+			}
+		}
+		result = append(result, &Token{Value: value, Type: FilterTokenLiteral, Offset: token.Offset})
+	}
+	return result
 }
 
 func FilterParser() *Parser {
 	parser := EmptyParser()
 	parser.DefineOperator("/", 2, OpAssociationLeft, 8)
 	parser.DefineOperator("has", 2, OpAssociationLeft, 8)
+	parser.DefineOperator("in", 2, OpAssociationLeft, 8)
 	parser.DefineOperator("-", 1, OpAssociationNone, 7)
 	parser.DefineOperator("not", 1, OpAssociationLeft, 7)
 	parser.DefineOperator("cast", 2, OpAssociationNone, 7)
 	parser.DefineOperator("mul", 2, OpAssociationNone, 6)
 	parser.DefineOperator("div", 2, OpAssociationNone, 6)
+	parser.DefineOperator("divby", 2, OpAssociationNone, 6)
 	parser.DefineOperator("mod", 2, OpAssociationNone, 6)
 	parser.DefineOperator("add", 2, OpAssociationNone, 5)
 	parser.DefineOperator("sub", 2, OpAssociationNone, 5)
@@ -97,79 +287,125 @@ func FilterParser() *Parser {
 	parser.DefineOperator("ne", 2, OpAssociationLeft, 3)
 	parser.DefineOperator("and", 2, OpAssociationLeft, 2)
 	parser.DefineOperator("or", 2, OpAssociationLeft, 1)
-	parser.DefineOperator(":", 2, OpAssociationLeft, 1)
-	parser.DefineFunction("contains", 2)
-	parser.DefineFunction("endswith", 2)
-	parser.DefineFunction("startswith", 2)
-	parser.DefineFunction("length", 1)
-	parser.DefineFunction("indexof", 2)
-	parser.DefineFunction("substring", 2)
-	parser.DefineFunction("tolower", 1)
-	parser.DefineFunction("toupper", 1)
-	parser.DefineFunction("trim", 1)
-	parser.DefineFunction("concat", 2)
-	parser.DefineFunction("year", 1)
-	parser.DefineFunction("month", 1)
-	parser.DefineFunction("day", 1)
-	parser.DefineFunction("hour", 1)
-	parser.DefineFunction("minute", 1)
-	parser.DefineFunction("second", 1)
-	parser.DefineFunction("fractionalseconds", 1)
-	parser.DefineFunction("date", 1)
-	parser.DefineFunction("time", 1)
-	parser.DefineFunction("totaloffsetminutes", 1)
-	parser.DefineFunction("now", 0)
-	parser.DefineFunction("maxdatetime", 0)
-	parser.DefineFunction("mindatetime", 0)
-	parser.DefineFunction("totalseconds", 1)
-	parser.DefineFunction("round", 1)
-	parser.DefineFunction("floor", 1)
-	parser.DefineFunction("ceiling", 1)
-	parser.DefineFunction("isof", 2)
-	parser.DefineFunction("cast", 2)
-	parser.DefineFunction("geo.distance", 2)
-	parser.DefineFunction("geo.intesects", 2)
-	parser.DefineFunction("geo.length", 1)
-	parser.DefineFunction("any", 1)
+	// the predicate of a lambda extends as far right as possible
+	parser.DefineOperator(":", 2, OpAssociationLeft, 0)
+	for name, signatures := range FilterFunctionSignatures {
+		min, max := signatureArity(signatures)
+		parser.DefineVariadicFunction(name, min, max)
+	}
+	// the type argument of isof and cast may be preceded by an expression
+	parser.DefineVariadicFunction("isof", 1, 2)
+	parser.DefineVariadicFunction("cast", 1, 2)
+	// any without arguments checks that the collection is not empty
+	parser.DefineVariadicFunction("any", 0, 1)
 	parser.DefineFunction("all", 1)
 
 	return parser
 }
 
+// The least and the most number of arguments accepted by the signatures of a
+// function. The most is negative if a signature is variadic.
+func signatureArity(signatures []*FilterFunctionSignature) (int, int) {
+	min, max := -1, 0
+	for _, signature := range signatures {
+		n := len(signature.Parameters)
+		if min < 0 || n < min {
+			min = n
+		}
+		if signature.isVariadic() {
+			max = -1
+		} else if max >= 0 && n > max {
+			max = n
+		}
+	}
+	return min, max
+}
+
+// Check a filter against the entity type it filters. Each property in the
+// parse tree is linked to its metadata, and a typed expression is built from
+// the tree, so providers know the type of every operand. Filters that are
+// not well typed, e.g. "Name add 5", are rejected with a 400.
 func SemanticizeFilterQuery(
 	filter *GoDataFilterQuery,
 	service *GoDataService,
 	entity *GoDataEntityType,
 ) error {
+	return SemanticizeFilterQueryWithCompute(filter, service, entity, nil)
+}
+
+// Check a filter that may refer to the properties computed by a $compute.
+func SemanticizeFilterQueryWithCompute(
+	filter *GoDataFilterQuery,
+	service *GoDataService,
+	entity *GoDataEntityType,
+	compute *GoDataComputeQuery,
+) error {
+
+	return semanticizeFilterInScope(filter, service, entity, &applyScope{computed: compute.properties()})
+}
+
+// Check a filter of the set produced by an $apply.
+func semanticizeFilterInScope(
+	filter *GoDataFilterQuery,
+	service *GoDataService,
+	entity *GoDataEntityType,
+	scope *applyScope,
+) error {
 
 	if filter == nil || filter.Tree == nil {
 		return nil
 	}
 
-	var semanticizeFilterNode func(node *ParseNode) error
-	semanticizeFilterNode = func(node *ParseNode) error {
+	checker := &filterChecker{
+		service:   service,
+		entity:    entity,
+		open:      service.IsOpenType(entity),
+		computed:  scope.computed,
+		remaining: scope.remaining,
+	}
+
+	expr, err := checker.checkFilter(filter.Tree)
+	if err != nil {
+		return err
+	}
 
-		if node.Token.Type == FilterTokenLiteral {
-			prop, ok := service.PropertyLookup[entity][node.Token.Value]
-			if !ok {
-				return BadRequestError("No property found " + node.Token.Value + " on entity " + entity.Name)
-			}
-			node.Token.SemanticType = SemanticTypeProperty
-			node.Token.SemanticReference = prop
-		} else {
-			node.Token.SemanticType = SemanticTypePropertyValue
-			node.Token.SemanticReference = &node.Token.Value
-		}
+	filter.Expression = expr
+	return nil
+}
 
-		for _, child := range node.Children {
-			err := semanticizeFilterNode(child)
-			if err != nil {
-				return err
-			}
+// Return the Edm type of a literal token in a filter, or an empty string if
+// the token is not a typed literal.
+func FilterLiteralType(token *Token) string {
+	switch token.Type {
+	case FilterTokenString:
+		return GoDataString
+	case FilterTokenInteger:
+		if _, err := strconv.ParseInt(token.Value, 10, 32); err == nil {
+			return GoDataInt32
+		}
+		return GoDataInt64
+	case FilterTokenFloat:
+		return GoDataDouble
+	case FilterTokenDate:
+		return GoDataDate
+	case FilterTokenTime:
+		return GoDataTimeOfDay
+	case FilterTokenDateTime:
+		return GoDataDateTimeOffset
+	case FilterTokenBoolean:
+		return GoDataBoolean
+	case FilterTokenGuid:
+		return GoDataGuid
+	case FilterTokenDuration:
+		return GoDataDuration
+	case FilterTokenBinary:
+		return GoDataBinary
+	case FilterTokenDecimal:
+		return GoDataDecimal
+	case FilterTokenGeography, FilterTokenGeometry:
+		if geo, ok := token.Literal.(*GoDataGeoLiteral); ok {
+			return geo.EdmType()
 		}
-
-		return nil
 	}
-
-	return semanticizeFilterNode(filter.Tree)
+	return ""
 }
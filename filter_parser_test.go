@@ -3,8 +3,13 @@ package godata
 import (
 	"errors"
 	"fmt"
+	"math"
+	"math/big"
+	"reflect"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestFilterDateTime(t *testing.T) {
@@ -21,7 +26,7 @@ func TestFilterDateTime(t *testing.T) {
 		"21:58:33": FilterTokenTime,
 	}
 	for tokenValue, tokenType := range tokens {
-		input := "CreateTime gt" + tokenValue
+		input := "CreateTime gt " + tokenValue
 		expect := []*Token{
 			&Token{Value: "CreateTime", Type: FilterTokenLiteral},
 			&Token{Value: "gt", Type: FilterTokenLogical},
@@ -277,3 +282,165 @@ func TestLambda(t *testing.T) {
 		t.Error("First child is '" + tree.Children[1].Children[0].Token.Value + "' not ':'")
 	}
 }
+
+func TestFilterInList(t *testing.T) {
+	query, err := ParseFilterString("Name in ('Milk', concat('Ch','eese')) and indexof(Name,'x') eq 1")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	in := query.Tree.Children[0]
+	if in.Token.Value != "in" || in.Token.Type != FilterTokenLogical {
+		t.Error("First child is '" + in.Token.Value + "' not 'in'")
+		return
+	}
+	list := in.Children[1]
+	if list.Token.Type != FilterTokenList || len(list.Children) != 2 {
+		t.Error("Right operand of in is not a list of two items")
+		return
+	}
+	if list.Children[0].Token.Value != "'Milk'" || list.Children[1].Token.Value != "concat" {
+		t.Error("List items are '" + list.Children[0].Token.Value + "' and '" + list.Children[1].Token.Value + "'")
+	}
+	if query.Tree.Children[1].Children[0].Token.Value != "indexof" {
+		t.Error("indexof was taken for in")
+	}
+}
+
+func TestFilterLiterals(t *testing.T) {
+	testCases := []struct {
+		input   string
+		token   int
+		edmType string
+		literal interface{}
+	}{
+		{"'O''Neil'", FilterTokenString, GoDataString, "O'Neil"},
+		{"42", FilterTokenInteger, GoDataInt32, int64(42)},
+		{"3000000000", FilterTokenInteger, GoDataInt64, int64(3000000000)},
+		{"1.5e10", FilterTokenFloat, GoDataDouble, 1.5e10},
+		{"-INF", FilterTokenFloat, GoDataDouble, math.Inf(-1)},
+		{"true", FilterTokenBoolean, GoDataBoolean, true},
+		{"2017-05-04", FilterTokenDate, GoDataDate, time.Date(2017, 5, 4, 0, 0, 0, 0, time.UTC)},
+		{"10:30", FilterTokenTime, GoDataTimeOfDay, 10*time.Hour + 30*time.Minute},
+		{"duration'P1DT2H'", FilterTokenDuration, GoDataDuration, 26 * time.Hour},
+		{"binary'AQID'", FilterTokenBinary, GoDataBinary, []byte{1, 2, 3}},
+		{"01234567-89ab-cdef-0123-456789abcdef", FilterTokenGuid, GoDataGuid,
+			[16]byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}},
+		{"geography'SRID=0;Point(1 2)'", FilterTokenGeography, "Edm.GeographyPoint",
+			&GoDataGeoLiteral{Geography: true, SRID: 0, Kind: "Point", WKT: "Point(1 2)"}},
+	}
+
+	for _, testCase := range testCases {
+		tokens, err := GlobalFilterTokenizer.Tokenize(testCase.input)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if len(tokens) != 1 || tokens[0].Type != testCase.token {
+			t.Error("Literal " + testCase.input + " was not tokenized as one literal")
+			continue
+		}
+		if err := DecodeFilterLiteral(tokens[0]); err != nil {
+			t.Error(err)
+			continue
+		}
+		if FilterLiteralType(tokens[0]) != testCase.edmType {
+			t.Error("Literal " + testCase.input + " is " + FilterLiteralType(tokens[0]))
+		}
+		if !reflect.DeepEqual(tokens[0].Literal, testCase.literal) {
+			t.Error("Literal "+testCase.input+" was decoded to", tokens[0].Literal)
+		}
+	}
+
+	tokens, _ := GlobalFilterTokenizer.Tokenize("12.5m")
+	DecodeFilterLiteral(tokens[0])
+	if rat, ok := tokens[0].Literal.(*big.Rat); !ok || rat.RatString() != "25/2" {
+		t.Error("Decimal 12.5m was decoded to", tokens[0].Literal)
+	}
+
+	if _, err := ParseFilterString("Born eq 2017-13-45"); err == nil {
+		t.Error("Invalid date was accepted")
+	}
+}
+
+func TestFilterLexerIdentifiers(t *testing.T) {
+	tokenizer := FilterTokenizer()
+	input := "order eq nowhere and date eq date(Created) or anything ne -Count"
+	expect := []*Token{
+		&Token{Value: "order", Type: FilterTokenLiteral},
+		&Token{Value: "eq", Type: FilterTokenLogical},
+		&Token{Value: "nowhere", Type: FilterTokenLiteral},
+		&Token{Value: "and", Type: FilterTokenLogical},
+		&Token{Value: "date", Type: FilterTokenLiteral},
+		&Token{Value: "eq", Type: FilterTokenLogical},
+		&Token{Value: "date", Type: FilterTokenFunc},
+		&Token{Value: "(", Type: FilterTokenOpenParen},
+		&Token{Value: "Created", Type: FilterTokenLiteral},
+		&Token{Value: ")", Type: FilterTokenCloseParen},
+		&Token{Value: "or", Type: FilterTokenLogical},
+		&Token{Value: "anything", Type: FilterTokenLiteral},
+		&Token{Value: "ne", Type: FilterTokenLogical},
+		&Token{Value: "-", Type: FilterTokenOp},
+		&Token{Value: "Count", Type: FilterTokenLiteral},
+	}
+	output, err := tokenizer.Tokenize(input)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	result, err := CompareTokens(expect, output)
+	if !result {
+		t.Error(err)
+	}
+	if output[2].Offset != 9 || output[14].Offset != 59 {
+		t.Error("Offsets are", output[2].Offset, "and", output[14].Offset)
+	}
+
+	query, err := ParseFilterString(input)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	date := query.Tree.Children[0].Children[1]
+	if date.Token.Value != "eq" || date.Children[0].Token.Value != "date" || len(date.Children[0].Children) != 0 {
+		t.Error("The property date was taken for the function")
+	}
+}
+
+func TestFilterParseErrors(t *testing.T) {
+	testCases := []struct {
+		filter  string
+		message string
+	}{
+		{"Name eqq 'Bob'", "Expected an operator before 'eqq' at column 6 in \"Name eqq 'Bob'\". Did you mean eq?"},
+		{"Name = 'Bob'", "Unexpected '=' at column 6 in \"Name = 'Bob'\". Did you mean eq?"},
+		{"Price >= 5", "Unexpected '>=' at column 7 in \"Price >= 5\". Did you mean ge?"},
+		{"Name eq 'Bob", "The quote is not closed at column 9"},
+		{"$this/Name eq 'Bob'", "Did you mean $it or $root?"},
+		{"(Name eq 'Bob'", "'(' is not closed at column 1"},
+		{"Name eq 'Bob')", "Unexpected ')' without a matching '(' at column 14"},
+		{"Age eq 12abc", "Invalid literal '12abc' at column 8"},
+		{"contains(Name,'a',)", "Expected an expression before ')' at column 19"},
+		{"tolower(,) eq 'a'", "Expected an expression before ',' at column 9"},
+		{"concat(Name,,'a') eq 'a'", "Expected an expression before ',' at column 13"},
+		{"Description eq 'a long description' and Age gt 5 nd Name eq 'Bob'",
+			"Expected an operator before 'nd' at column 50 in \"...ption' and Age gt 5 nd Name eq 'Bob'\". Did you mean and or ne?"},
+	}
+
+	for _, testCase := range testCases {
+		_, err := ParseFilterString(testCase.filter)
+
+		if err == nil {
+			t.Error("Filter " + testCase.filter + " was accepted")
+			continue
+		}
+		if goDataErr, ok := err.(*GoDataError); !ok || goDataErr.ResponseCode != 400 {
+			t.Error("Filter "+testCase.filter+" did not fail with a 400:", err)
+		}
+		if !strings.Contains(err.Error(), testCase.message) {
+			t.Error("Expected \"" + testCase.message + "\", got \"" + err.Error() + "\"")
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package godata
+
+import (
+	"mime"
+	"strconv"
+	"strings"
+)
+
+const (
+	MediaTypeJson = "application/json"
+	MediaTypeXml  = "application/xml"
+	MediaTypeAtom = "application/atom+xml"
+)
+
+// Parse the $format query option, which is either one of the short names
+// json, xml and atom, or a full media type with parameters.
+func ParseFormatString(format string) (*GoDataFormatQuery, error) {
+	switch strings.ToLower(format) {
+	case "json":
+		return &GoDataFormatQuery{MediaTypeJson, map[string]string{}}, nil
+	case "xml":
+		return &GoDataFormatQuery{MediaTypeXml, map[string]string{}}, nil
+	case "atom":
+		return &GoDataFormatQuery{MediaTypeAtom, map[string]string{}}, nil
+	}
+
+	mediaType, params, err := mime.ParseMediaType(format)
+	if err != nil {
+		return nil, BadRequestError("Invalid format " + format)
+	}
+	return &GoDataFormatQuery{mediaType, params}, nil
+}
+
+// Choose a format from the media ranges of an Accept header, among the
+// supported media types given in order of preference. Each supported type
+// gets the quality of the most specific range that matches it, so wildcards
+// like */* and application/* accept every type they cover. The preferred type
+// wins a tie. Returns nil if the header accepts none of the supported types,
+// and the service default applies.
+func ParseAcceptHeader(header string, supported ...string) *GoDataFormatQuery {
+	type mediaRange struct {
+		mediaType string
+		params    map[string]string
+		quality   float64
+	}
+
+	ranges := []*mediaRange{}
+	for _, part := range strings.Split(header, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			quality, err = strconv.ParseFloat(q, 64)
+			if err != nil {
+				continue
+			}
+			delete(params, "q")
+		}
+		ranges = append(ranges, &mediaRange{mediaType, params, quality})
+	}
+
+	var best *GoDataFormatQuery
+	bestQuality := 0.0
+	for _, mediaType := range supported {
+		// 3 for an exact match, 2 for type/*, 1 for */*
+		specificity := 0
+		var match *mediaRange
+		for _, r := range ranges {
+			s := 0
+			if r.mediaType == mediaType {
+				s = 3
+			} else if r.mediaType == strings.SplitN(mediaType, "/", 2)[0]+"/*" {
+				s = 2
+			} else if r.mediaType == "*/*" {
+				s = 1
+			}
+			if s > specificity {
+				specificity, match = s, r
+			}
+		}
+		if match == nil || match.quality <= bestQuality {
+			continue
+		}
+		params := map[string]string{}
+		if specificity == 3 {
+			params = match.params
+		}
+		best, bestQuality = &GoDataFormatQuery{mediaType, params}, match.quality
+	}
+
+	return best
+}
+
+// Check if the response should be written as JSON.
+func (f *GoDataFormatQuery) IsJson() bool {
+	return f.MediaType == MediaTypeJson
+}
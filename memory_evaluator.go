@@ -0,0 +1,1067 @@
+package godata
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Evaluates typed filter expressions in Go, against the entities and complex
+// values of a memory provider. Null follows the rules of OData: it propagates
+// through arithmetic and functions, compares unequal to every other value,
+// and and/or use three-valued logic.
+type memoryEvaluator struct {
+	provider *GoDataMemoryProvider
+	// The instance being evaluated, which $it refers to: a *memoryEntity, a
+	// complex value or a primitive value.
+	it interface{}
+	// The values of the lambda range variables in scope, by name.
+	variables map[string]interface{}
+}
+
+func (p *GoDataMemoryProvider) evaluator(instance interface{}) *memoryEvaluator {
+	return &memoryEvaluator{provider: p, it: instance, variables: map[string]interface{}{}}
+}
+
+// Evaluate a boolean expression, where null does not match.
+func (e *memoryEvaluator) matches(expr FilterExpression) (bool, error) {
+	value, err := e.evaluate(expr)
+	if err != nil {
+		return false, err
+	}
+	match, _ := value.(bool)
+	return match, nil
+}
+
+func (e *memoryEvaluator) evaluate(expr FilterExpression) (interface{}, error) {
+	switch x := expr.(type) {
+	case *FilterLiteralExpression:
+		return literalValue(x.Node.Token), nil
+	case *FilterPropertyExpression:
+		return e.path(x)
+	case *FilterBinaryExpression:
+		return e.binary(x)
+	case *FilterUnaryExpression:
+		return e.unary(x)
+	case *FilterFunctionExpression:
+		return e.function(x)
+	case *FilterLambdaExpression:
+		return e.lambda(x)
+	case *FilterListExpression:
+		items := []interface{}{}
+		for _, item := range x.Items {
+			value, err := e.evaluate(item)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, value)
+		}
+		return items, nil
+	case *FilterTypeExpression:
+		return x.Name, nil
+	}
+	return nil, NotImplementedError("The memory provider can not evaluate '" + filterNodeString(expr.Source()) + "'.")
+}
+
+// The decoded value of a literal token, as the memory provider stores it.
+func literalValue(token *Token) interface{} {
+	switch v := token.Literal.(type) {
+	case *big.Rat:
+		f, _ := v.Float64()
+		return f
+	case [16]byte:
+		return formatGuid(v)
+	}
+	return token.Literal
+}
+
+func formatGuid(guid [16]byte) string {
+	s := hex.EncodeToString(guid[:])
+	return s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:]
+}
+
+// Follow a property path. Navigation properties lead to the related entities,
+// found through the entity the navigation property, or the complex property
+// containing it, belongs to.
+func (e *memoryEvaluator) path(x *FilterPropertyExpression) (interface{}, error) {
+	current := e.it
+	segments := x.Segments
+	switch x.Variable {
+	case "", "$it":
+	case "$root":
+		root, err := e.root(segments[0])
+		if err != nil {
+			return nil, err
+		}
+		current = root
+		segments = segments[1:]
+	default:
+		current = e.variables[x.Variable]
+	}
+
+	owner, _ := current.(*memoryEntity)
+	prefix := []string{}
+	for _, segment := range segments {
+		if current == nil {
+			return nil, nil
+		}
+
+		if segment.Name == "$count" && segment.Property == nil && segment.NavigationProperty == nil {
+			items, _ := current.([]interface{})
+			current = int64(len(items))
+			continue
+		}
+
+		if nav := segment.NavigationProperty; nav != nil {
+			if owner == nil {
+				return nil, NotImplementedError("The memory provider can not follow navigation property " +
+					nav.Name + " of a value that is not part of an entity.")
+			}
+			related, err := e.provider.related(owner, strings.Join(append(prefix, segment.Name), "/"), nav)
+			if err != nil {
+				return nil, err
+			}
+			if strings.HasPrefix(nav.Type, "Collection(") {
+				items := make([]interface{}, len(related))
+				for i, entity := range related {
+					items[i] = entity
+				}
+				current = items
+			} else if len(related) > 0 {
+				current, owner = related[0], related[0]
+			} else {
+				current = nil
+			}
+			prefix = []string{}
+			continue
+		}
+
+		current = propertyValue(current, segment.Name)
+		prefix = append(prefix, segment.Name)
+	}
+	return current, nil
+}
+
+// The entity a path starting with $root refers to, or nil if there is none.
+func (e *memoryEvaluator) root(segment *FilterPathSegment) (interface{}, error) {
+	if segment.EntitySet == nil {
+		return nil, NotImplementedError("The memory provider does not serve singleton " + segment.Name + ".")
+	}
+	set := e.provider.sets[segment.EntitySet.Name]
+	key, err := e.provider.decodeKey(set, segment.Identifier)
+	if err != nil {
+		return nil, err
+	}
+	if entity := e.provider.lookup(set, key); entity != nil {
+		return entity, nil
+	}
+	return nil, nil
+}
+
+func propertyValue(instance interface{}, name string) interface{} {
+	switch v := instance.(type) {
+	case *memoryEntity:
+		return v.values[name]
+	case map[string]interface{}:
+		return v[name]
+	}
+	return nil
+}
+
+func (e *memoryEvaluator) lambda(x *FilterLambdaExpression) (interface{}, error) {
+	collection, err := e.evaluate(x.Collection)
+	if err != nil {
+		return nil, err
+	}
+	items, _ := collection.([]interface{})
+	if x.Predicate == nil {
+		return len(items) > 0, nil
+	}
+
+	for _, item := range items {
+		variables := map[string]interface{}{}
+		for name, value := range e.variables {
+			variables[name] = value
+		}
+		variables[x.Variable] = item
+
+		inner := &memoryEvaluator{provider: e.provider, it: e.it, variables: variables}
+		match, err := inner.matches(x.Predicate)
+		if err != nil {
+			return nil, err
+		}
+		if match && x.Operator == "any" {
+			return true, nil
+		}
+		if !match && x.Operator == "all" {
+			return false, nil
+		}
+	}
+	return x.Operator == "all", nil
+}
+
+func (e *memoryEvaluator) unary(x *FilterUnaryExpression) (interface{}, error) {
+	value, err := e.evaluate(x.Operand)
+	if err != nil {
+		return nil, err
+	}
+	switch v := value.(type) {
+	case bool:
+		if x.Operator == "not" {
+			return !v, nil
+		}
+	case int64:
+		return -v, nil
+	case float64:
+		return -v, nil
+	case time.Duration:
+		return -v, nil
+	}
+	return nil, nil
+}
+
+func (e *memoryEvaluator) binary(x *FilterBinaryExpression) (interface{}, error) {
+	left, err := e.evaluate(x.Left)
+	if err != nil {
+		return nil, err
+	}
+	right, err := e.evaluate(x.Right)
+	if err != nil {
+		return nil, err
+	}
+
+	switch x.Operator {
+	case "and", "or":
+		l, lok := left.(bool)
+		r, rok := right.(bool)
+		// a known operand may decide the result on its own
+		decisive := x.Operator == "or"
+		if (lok && l == decisive) || (rok && r == decisive) {
+			return decisive, nil
+		}
+		if lok && rok {
+			return !decisive, nil
+		}
+		return nil, nil
+	case "eq":
+		return valuesEqual(left, right), nil
+	case "ne":
+		return !valuesEqual(left, right), nil
+	case "gt", "ge", "lt", "le":
+		if left == nil || right == nil {
+			return false, nil
+		}
+		c, ok := compareValues(left, right)
+		if !ok {
+			return false, nil
+		}
+		switch x.Operator {
+		case "gt":
+			return c > 0, nil
+		case "ge":
+			return c >= 0, nil
+		case "lt":
+			return c < 0, nil
+		}
+		return c <= 0, nil
+	case "in":
+		items, _ := right.([]interface{})
+		for _, item := range items {
+			if valuesEqual(left, item) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "has":
+		value, ok := left.(string)
+		flags, fok := right.(string)
+		if !ok || !fok {
+			return nil, nil
+		}
+		for _, flag := range strings.Split(flags, ",") {
+			if !containsFlag(value, strings.TrimSpace(flag)) {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+
+	if left == nil || right == nil {
+		return nil, nil
+	}
+	return arithmetic(x.Operator, left, right)
+}
+
+func containsFlag(value, flag string) bool {
+	for _, member := range strings.Split(value, ",") {
+		if strings.TrimSpace(member) == flag {
+			return true
+		}
+	}
+	return false
+}
+
+func arithmetic(op string, left, right interface{}) (interface{}, error) {
+	l, lint := left.(int64)
+	r, rint := right.(int64)
+	if lint && rint && op != "divby" {
+		switch op {
+		case "add":
+			return l + r, nil
+		case "sub":
+			return l - r, nil
+		case "mul":
+			return l * r, nil
+		}
+		if r == 0 {
+			return nil, BadRequestError("Division by zero.")
+		}
+		if op == "mod" {
+			return l % r, nil
+		}
+		return l / r, nil
+	}
+
+	lf, lnum := toFloat64(left)
+	rf, rnum := toFloat64(right)
+	if lnum && rnum {
+		switch op {
+		case "add":
+			return lf + rf, nil
+		case "sub":
+			return lf - rf, nil
+		case "mul":
+			return lf * rf, nil
+		}
+		if rf == 0 {
+			return nil, BadRequestError("Division by zero.")
+		}
+		if op == "mod" {
+			return math.Mod(lf, rf), nil
+		}
+		return lf / rf, nil
+	}
+
+	switch l := left.(type) {
+	case time.Time:
+		switch r := right.(type) {
+		case time.Duration:
+			if op == "add" {
+				return l.Add(r), nil
+			} else if op == "sub" {
+				return l.Add(-r), nil
+			}
+		case time.Time:
+			if op == "sub" {
+				return l.Sub(r), nil
+			}
+		}
+	case time.Duration:
+		if r, ok := right.(time.Duration); ok {
+			if op == "add" {
+				return l + r, nil
+			} else if op == "sub" {
+				return l - r, nil
+			}
+		}
+	}
+	return nil, BadRequestError("Operator " + op + " can not be applied to " + fmt.Sprint(left) + " and " +
+		fmt.Sprint(right) + ".")
+}
+
+// Check whether two values are equal. Numbers of different types are equal
+// if they have the same value, and null is only equal to null.
+func valuesEqual(a, b interface{}) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	if x, ok := a.([]byte); ok {
+		y, ok := b.([]byte)
+		return ok && bytes.Equal(x, y)
+	}
+	if c, ok := compareValues(a, b); ok {
+		return c == 0
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// Compare two values of the same kind. Returns false if they can not be
+// compared, which includes any comparison with NaN.
+func compareValues(a, b interface{}) (int, bool) {
+	if x, ok := a.(int64); ok {
+		if y, ok := b.(int64); ok {
+			switch {
+			case x < y:
+				return -1, true
+			case x > y:
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+	if x, ok := toFloat64(a); ok {
+		if y, ok := toFloat64(b); ok {
+			// NaN is neither equal to, less nor greater than any number
+			if math.IsNaN(x) || math.IsNaN(y) {
+				return 0, false
+			}
+			switch {
+			case x < y:
+				return -1, true
+			case x > y:
+				return 1, true
+			}
+			return 0, true
+		}
+		return 0, false
+	}
+
+	switch x := a.(type) {
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), true
+		}
+	case bool:
+		if y, ok := b.(bool); ok {
+			switch {
+			case x == y:
+				return 0, true
+			case y:
+				return -1, true
+			}
+			return 1, true
+		}
+	case time.Time:
+		if y, ok := b.(time.Time); ok {
+			switch {
+			case x.Before(y):
+				return -1, true
+			case x.After(y):
+				return 1, true
+			}
+			return 0, true
+		}
+	case time.Duration:
+		if y, ok := b.(time.Duration); ok {
+			switch {
+			case x < y:
+				return -1, true
+			case x > y:
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+	return 0, false
+}
+
+func (e *memoryEvaluator) function(x *FilterFunctionExpression) (interface{}, error) {
+	if x.Name == "cast" || x.Name == "isof" {
+		return e.typeFunction(x)
+	}
+
+	args := []interface{}{}
+	for _, arg := range x.Arguments {
+		value, err := e.evaluate(arg)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, value)
+	}
+
+	if x.Function != nil {
+		if x.Function.Evaluate == nil {
+			return nil, NotImplementedError("Function " + x.Name + " can not be evaluated by the memory provider.")
+		}
+		return x.Function.Evaluate(args...)
+	}
+	if strings.HasPrefix(x.Name, "geo.") {
+		return nil, NotImplementedError("The memory provider does not support function " + x.Name + ".")
+	}
+	for _, arg := range args {
+		if arg == nil {
+			return nil, nil
+		}
+	}
+
+	switch x.Name {
+	case "contains", "startswith", "endswith", "indexof", "length", "substring", "tolower", "toupper",
+		"trim", "concat":
+		return stringFunction(x.Name, args)
+	case "year", "month", "day", "hour", "minute", "second", "fractionalseconds", "date", "time",
+		"totaloffsetminutes", "totalseconds":
+		return dateFunction(x.Name, args[0])
+	case "now":
+		return time.Now(), nil
+	case "maxdatetime":
+		return time.Date(9999, 12, 31, 23, 59, 59, 999999999, time.UTC), nil
+	case "mindatetime":
+		return time.Date(1, 1, 1, 0, 0, 0, 0, time.UTC), nil
+	case "round", "floor", "ceiling":
+		if _, ok := args[0].(int64); ok {
+			return args[0], nil
+		}
+		f, ok := toFloat64(args[0])
+		if !ok {
+			return nil, nil
+		}
+		switch x.Name {
+		case "round":
+			return math.Round(f), nil
+		case "floor":
+			return math.Floor(f), nil
+		}
+		return math.Ceil(f), nil
+	}
+	return nil, NotImplementedError("The memory provider does not support function " + x.Name + ".")
+}
+
+func stringFunction(name string, args []interface{}) (interface{}, error) {
+	strs := make([]string, len(args))
+	for i, arg := range args {
+		if s, ok := arg.(string); ok {
+			strs[i] = s
+		}
+	}
+
+	switch name {
+	case "contains":
+		return strings.Contains(strs[0], strs[1]), nil
+	case "startswith":
+		return strings.HasPrefix(strs[0], strs[1]), nil
+	case "endswith":
+		return strings.HasSuffix(strs[0], strs[1]), nil
+	case "indexof":
+		i := strings.Index(strs[0], strs[1])
+		if i < 0 {
+			return int64(-1), nil
+		}
+		return int64(utf8.RuneCountInString(strs[0][:i])), nil
+	case "length":
+		return int64(utf8.RuneCountInString(strs[0])), nil
+	case "substring":
+		runes := []rune(strs[0])
+		start, _ := args[1].(int64)
+		if start < 0 {
+			start = 0
+		}
+		if start > int64(len(runes)) {
+			start = int64(len(runes))
+		}
+		end := int64(len(runes))
+		if len(args) > 2 {
+			length, _ := args[2].(int64)
+			if length < 0 {
+				length = 0
+			}
+			if start+length < end {
+				end = start + length
+			}
+		}
+		return string(runes[start:end]), nil
+	case "tolower":
+		return strings.ToLower(strs[0]), nil
+	case "toupper":
+		return strings.ToUpper(strs[0]), nil
+	case "trim":
+		return strings.TrimSpace(strs[0]), nil
+	}
+	return strings.Join(strs, ""), nil
+}
+
+func dateFunction(name string, arg interface{}) (interface{}, error) {
+	if d, ok := arg.(time.Duration); ok {
+		switch name {
+		case "hour":
+			return int64(d / time.Hour), nil
+		case "minute":
+			return int64(d % time.Hour / time.Minute), nil
+		case "second":
+			return int64(d % time.Minute / time.Second), nil
+		case "fractionalseconds":
+			return float64(d%time.Second) / float64(time.Second), nil
+		case "totalseconds":
+			return d.Seconds(), nil
+		}
+		return nil, nil
+	}
+
+	t, ok := arg.(time.Time)
+	if !ok {
+		return nil, nil
+	}
+	switch name {
+	case "year":
+		return int64(t.Year()), nil
+	case "month":
+		return int64(t.Month()), nil
+	case "day":
+		return int64(t.Day()), nil
+	case "hour":
+		return int64(t.Hour()), nil
+	case "minute":
+		return int64(t.Minute()), nil
+	case "second":
+		return int64(t.Second()), nil
+	case "fractionalseconds":
+		return float64(t.Nanosecond()) / float64(time.Second), nil
+	case "date":
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC), nil
+	case "time":
+		return t.Sub(time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())), nil
+	case "totaloffsetminutes":
+		_, offset := t.Zone()
+		return int64(offset / 60), nil
+	}
+	return nil, nil
+}
+
+// Evaluate cast and isof. With a single argument they apply to the instance
+// being evaluated.
+func (e *memoryEvaluator) typeFunction(x *FilterFunctionExpression) (interface{}, error) {
+	value := e.it
+	if len(x.Arguments) > 1 {
+		v, err := e.evaluate(x.Arguments[0])
+		if err != nil {
+			return nil, err
+		}
+		value = v
+	}
+	t := x.Arguments[len(x.Arguments)-1].EdmType()
+
+	if x.Name == "isof" {
+		return e.isOf(value, t), nil
+	}
+	if value == nil {
+		return nil, nil
+	}
+	if _, ok := value.(*memoryEntity); ok {
+		if e.isOf(value, t) {
+			return value, nil
+		}
+		return nil, nil
+	}
+	if t == GoDataString {
+		switch v := value.(type) {
+		case string:
+			return v, nil
+		case time.Time:
+			return v.Format(time.RFC3339Nano), nil
+		case time.Duration, []byte:
+			return e.provider.responseValue(v, ""), nil
+		}
+		return fmt.Sprint(value), nil
+	}
+	if converted, ok := e.provider.convertValue(value, t); ok {
+		return converted, nil
+	}
+	return nil, nil
+}
+
+// Check whether a value is of the given type. Integers are of every integer
+// type whose range they fit in.
+func (e *memoryEvaluator) isOf(value interface{}, t string) bool {
+	service := e.provider.service
+	switch v := value.(type) {
+	case nil:
+		return false
+	case *memoryEntity:
+		target, err := service.LookupEntityType(t)
+		return err == nil && service.derivesFromEntityType(e.provider.instanceType(v), target)
+	case map[string]interface{}:
+		target := service.LookupComplexType(t)
+		if name, ok := v[ODataFieldType].(string); ok && target != nil {
+			return service.derivesFromComplexType(service.LookupComplexType(strings.TrimPrefix(name, "#")), target)
+		}
+		return target != nil
+	case string:
+		return t == GoDataString
+	case bool:
+		return t == GoDataBoolean
+	case int64:
+		limits := map[string][2]int64{
+			GoDataByte:  {0, math.MaxUint8},
+			GoDataSByte: {math.MinInt8, math.MaxInt8},
+			GoDataInt16: {math.MinInt16, math.MaxInt16},
+			GoDataInt32: {math.MinInt32, math.MaxInt32},
+			GoDataInt64: {math.MinInt64, math.MaxInt64},
+		}
+		limit, ok := limits[t]
+		return ok && v >= limit[0] && v <= limit[1]
+	case float64:
+		return t == GoDataDouble || t == GoDataSingle || t == GoDataDecimal
+	case time.Time:
+		return t == GoDataDateTimeOffset || (t == GoDataDate && v.Equal(v.Truncate(24*time.Hour)))
+	case time.Duration:
+		return t == GoDataDuration || (t == GoDataTimeOfDay && v >= 0 && v < 24*time.Hour)
+	case []byte:
+		return t == GoDataBinary
+	}
+	return false
+}
+
+func toInt64(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case json.Number:
+		i, err := v.Int64()
+		return i, err == nil
+	case float64:
+		return int64(v), v == math.Trunc(v)
+	case float32:
+		return int64(v), float64(v) == math.Trunc(float64(v))
+	}
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if rv.Type() == reflect.TypeOf(time.Duration(0)) {
+			return 0, false
+		}
+		return rv.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(rv.Uint()), true
+	}
+	return 0, false
+}
+
+func toFloat64(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case *big.Rat:
+		f, _ := v.Float64()
+		return f, true
+	}
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+	if i, ok := toInt64(value); ok {
+		return float64(i), true
+	}
+	return 0, false
+}
+
+// Convert a value given by the client or to Add to the Go value the provider
+// stores for the given type: int64 for integers, float64 for other numbers,
+// time.Time for dates, time.Duration for times of day and durations, a lower
+// case string for GUIDs, the member name for enums, []interface{} for
+// collections and map[string]interface{} for complex values. Untyped values
+// of dynamic properties are normalized the same way where their Go type
+// tells what they are. Returns false if the value is not of the type.
+func (p *GoDataMemoryProvider) convertValue(value interface{}, t string) (interface{}, bool) {
+	if value == nil {
+		return nil, true
+	}
+	rv := reflect.ValueOf(value)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil, true
+		}
+		rv = rv.Elem()
+	}
+	if _, ok := value.(*big.Rat); !ok {
+		value = rv.Interface()
+	}
+
+	if strings.HasPrefix(t, "Collection(") {
+		if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+			return nil, false
+		}
+		result := make([]interface{}, rv.Len())
+		for i := range result {
+			item, ok := p.convertValue(rv.Index(i).Interface(), elementType(t))
+			if !ok {
+				return nil, false
+			}
+			result[i] = item
+		}
+		return result, true
+	}
+
+	if def := p.service.LookupTypeDefinition(t); def != nil {
+		t = def.UnderlyingType
+	}
+	if enum := p.service.LookupEnumType(t); enum != nil {
+		return convertEnum(value, enum)
+	}
+	if complexType := p.service.LookupComplexType(t); complexType != nil {
+		return p.convertComplex(value, complexType)
+	}
+
+	switch t {
+	case GoDataString:
+		if rv.Kind() == reflect.String {
+			return rv.String(), true
+		}
+	case GoDataBoolean:
+		if rv.Kind() == reflect.Bool {
+			return rv.Bool(), true
+		}
+	case GoDataByte, GoDataSByte, GoDataInt16, GoDataInt32, GoDataInt64:
+		return toInt64(value)
+	case GoDataSingle, GoDataDouble, GoDataDecimal:
+		return toFloat64(value)
+	case GoDataDate, GoDataDateTimeOffset:
+		switch v := value.(type) {
+		case time.Time:
+			return v, true
+		case string:
+			if parsed, err := time.Parse(time.RFC3339Nano, v); err == nil {
+				return parsed, true
+			}
+			parsed, err := time.Parse("2006-01-02", v)
+			return parsed, err == nil
+		}
+	case GoDataTimeOfDay, GoDataDuration:
+		switch v := value.(type) {
+		case time.Duration:
+			return v, true
+		case string:
+			var d time.Duration
+			var err error
+			if t == GoDataTimeOfDay {
+				d, err = decodeTimeOfDay(v)
+			} else {
+				d, err = decodeDuration(v)
+			}
+			return d, err == nil
+		}
+	case GoDataGuid:
+		switch v := value.(type) {
+		case string:
+			return strings.ToLower(v), true
+		case [16]byte:
+			return formatGuid(v), true
+		}
+	case GoDataBinary:
+		switch v := value.(type) {
+		case []byte:
+			return v, true
+		case string:
+			if decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(v, "=")); err == nil {
+				return decoded, true
+			}
+			decoded, err := base64.StdEncoding.DecodeString(v)
+			return decoded, err == nil
+		}
+	case "", GoDataUntyped:
+		return normalizeValue(value), true
+	default:
+		// streams, geo values and other types are stored as they are
+		return value, true
+	}
+	return nil, false
+}
+
+// Normalize a value of unknown type: numbers to int64 or float64, and the
+// items of maps and slices likewise.
+func normalizeValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		result := map[string]interface{}{}
+		for name, item := range v {
+			result[name] = normalizeValue(item)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			result[i] = normalizeValue(item)
+		}
+		return result
+	case string, bool, time.Time, time.Duration, []byte:
+		return v
+	}
+
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		i, _ := toInt64(value)
+		return i
+	case reflect.Float32, reflect.Float64:
+		return rv.Float()
+	case reflect.String:
+		return rv.String()
+	}
+	return value
+}
+
+// Convert an enum value, given as a member name, a comma separated list of
+// member names for flags, or a number, to the member names.
+func convertEnum(value interface{}, enum *GoDataEnumType) (interface{}, bool) {
+	values := map[string]int64{}
+	for i, member := range enum.Members {
+		values[member.Name] = int64(i)
+		if member.Value != "" {
+			values[member.Name], _ = strconv.ParseInt(member.Value, 10, 64)
+		}
+	}
+
+	if s, ok := value.(string); ok {
+		names := []string{}
+		for _, name := range strings.Split(s, ",") {
+			name = strings.TrimSpace(name)
+			if _, ok := values[name]; !ok {
+				return nil, false
+			}
+			names = append(names, name)
+		}
+		if len(names) > 1 && enum.IsFlags != "true" {
+			return nil, false
+		}
+		return strings.Join(names, ","), true
+	}
+
+	n, ok := toInt64(value)
+	if !ok {
+		return nil, false
+	}
+	for _, member := range enum.Members {
+		if values[member.Name] == n {
+			return member.Name, true
+		}
+	}
+	if enum.IsFlags != "true" {
+		return nil, false
+	}
+	names := []string{}
+	for _, member := range enum.Members {
+		if v := values[member.Name]; v != 0 && n&v == v {
+			names = append(names, member.Name)
+			n &^= v
+		}
+	}
+	if n != 0 || len(names) == 0 {
+		return nil, false
+	}
+	return strings.Join(names, ","), true
+}
+
+func (p *GoDataMemoryProvider) convertComplex(value interface{}, complexType *GoDataComplexType) (interface{}, bool) {
+	raw, err := structValues(value)
+	if err != nil {
+		return nil, false
+	}
+	if name, ok := raw[ODataFieldType].(string); ok {
+		if derived := p.service.LookupComplexType(strings.TrimPrefix(name, "#")); derived != nil {
+			complexType = derived
+		}
+	}
+
+	declared := p.complexProperties(complexType)
+	result := map[string]interface{}{}
+	for name, item := range raw {
+		t := ""
+		if prop, ok := declared[name]; ok {
+			t = prop.Type
+		} else if strings.Contains(name, "@") {
+			result[name] = item
+			continue
+		}
+		converted, ok := p.convertValue(item, t)
+		if !ok {
+			return nil, false
+		}
+		result[name] = converted
+	}
+	return result, true
+}
+
+// Build response fields from stored values, given the types of the
+// properties by name.
+func (p *GoDataMemoryProvider) responseFields(
+	values map[string]interface{},
+	types map[string]string,
+) map[string]*GoDataResponseField {
+
+	fields := map[string]*GoDataResponseField{}
+	for name, value := range values {
+		if strings.Contains(name, "@") {
+			fields[name] = &GoDataResponseField{Value: value}
+			continue
+		}
+		fields[name] = &GoDataResponseField{Value: p.responseValue(value, types[name])}
+	}
+	return fields
+}
+
+// Convert a stored value to the value of a response field, formatting the
+// values JSON has no type for the way OData writes them.
+func (p *GoDataMemoryProvider) responseValue(value interface{}, t string) interface{} {
+	if def := p.service.LookupTypeDefinition(t); def != nil {
+		t = def.UnderlyingType
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		types := map[string]string{}
+		for name, prop := range p.complexProperties(p.service.LookupComplexType(t)) {
+			types[name] = prop.Type
+		}
+		return p.responseFields(v, types)
+	case []interface{}:
+		items := []*GoDataResponseField{}
+		for _, item := range v {
+			items = append(items, &GoDataResponseField{Value: p.responseValue(item, elementType(t))})
+		}
+		return items
+	case time.Time:
+		if t == GoDataDate {
+			return v.Format("2006-01-02")
+		}
+	case time.Duration:
+		if t == GoDataTimeOfDay {
+			return time.Time{}.Add(v).Format("15:04:05.999999999")
+		}
+		return formatDuration(v)
+	case []byte:
+		return base64.URLEncoding.EncodeToString(v)
+	}
+	return value
+}
+
+// Format a duration the way OData writes it, e.g. P1DT2H30M.
+func formatDuration(d time.Duration) string {
+	result := "P"
+	if d < 0 {
+		result, d = "-P", -d
+	}
+	days := d / (24 * time.Hour)
+	d -= days * 24 * time.Hour
+	if days > 0 {
+		result += strconv.FormatInt(int64(days), 10) + "D"
+	}
+	if d == 0 && days > 0 {
+		return result
+	}
+
+	result += "T"
+	if h := d / time.Hour; h > 0 {
+		result += strconv.FormatInt(int64(h), 10) + "H"
+	}
+	if m := d % time.Hour / time.Minute; m > 0 {
+		result += strconv.FormatInt(int64(m), 10) + "M"
+	}
+	if s := d % time.Minute; s > 0 || d < time.Minute {
+		result += strconv.FormatFloat(s.Seconds(), 'f', -1, 64) + "S"
+	}
+	return result
+}
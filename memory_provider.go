@@ -0,0 +1,1339 @@
+package godata
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A provider that keeps the entities of every entity set in memory. It
+// answers reads and writes, and evaluates $filter, $search, $orderby, $top,
+// $skip, $count, $compute, $select and $expand itself, so it can be used for
+// prototyping, for tests, and as the reference behavior for other providers.
+//
+//	schema := NewSchemaBuilder("Store", "Container")
+//	customer := schema.EntityType("Customer").Key("Id", GoDataInt32).Property("Name", GoDataString)
+//	order := schema.EntityType("Order").Key("Id", GoDataInt32).Property("CustomerId", GoDataInt32)
+//	schema.ManyToOne(order, customer, "Customer", "Orders").Constraint("CustomerId", "Id")
+//	schema.BindProperty(schema.EntitySet("Orders", order), schema.EntitySet("Customers", customer),
+//		"Customer", "Orders")
+//	provider, err := NewMemoryProvider(schema.Metadata())
+//	err = provider.Add("Customers", map[string]interface{}{"Id": 1, "Name": "Bob"})
+//	err = provider.Add("Orders", &Order{Id: 7, CustomerId: 1})
+//
+// Requests address an entity set, or follow the navigation properties of
+// its entities, e.g. Orders(10)/Products or Orders(10)/Customer.
+//
+// Entities are given as maps from property names to values, or as structs
+// whose fields are named the way ReflectSchema names them. Navigation
+// properties are followed through the navigation property bindings of the
+// entity sets. The related entities are the ones matching the referential
+// constraints of the navigation property or of its partner, or, for
+// relationships without constraints, the ones related with Link.
+type GoDataMemoryProvider struct {
+	metadata *GoDataMetadata
+	// a service built from the metadata, to look the model up in
+	service *GoDataService
+	sets    map[string]*memoryEntitySet
+	// the keys of the entities related through navigation properties without
+	// referential constraints
+	links map[memoryLink][]string
+	lock  sync.RWMutex
+}
+
+type memoryEntitySet struct {
+	set      *GoDataEntitySet
+	entity   *GoDataEntityType
+	entities []*memoryEntity
+}
+
+type memoryEntity struct {
+	set    *memoryEntitySet
+	values map[string]interface{}
+}
+
+// The source of a link: an entity, given by its entity set and key, and the
+// path of the navigation property the link is for.
+type memoryLink struct {
+	set  string
+	path string
+	key  string
+}
+
+// The query options that apply to a collection, either the one addressed by
+// a request, an expanded navigation property or a selected collection of
+// complex values.
+type memoryQueryOptions struct {
+	compute *GoDataComputeQuery
+	filter  *GoDataFilterQuery
+	search  *GoDataSearchQuery
+	orderby *GoDataOrderByQuery
+	skip    *GoDataSkipQuery
+	top     *GoDataTopQuery
+	sel     *GoDataSelectQuery
+	expand  *GoDataExpandQuery
+}
+
+// Create a provider for the given metadata with empty entity sets. Fails
+// with a *GoDataMetadataError if the metadata is inconsistent.
+func NewMemoryProvider(metadata *GoDataMetadata) (*GoDataMemoryProvider, error) {
+	p := &GoDataMemoryProvider{
+		metadata: metadata,
+		sets:     map[string]*memoryEntitySet{},
+		links:    map[memoryLink][]string{},
+	}
+
+	service, err := BuildService(p, "http://localhost/")
+	if err != nil {
+		return nil, err
+	}
+	p.service = service
+
+	for _, schema := range metadata.DataServices.Schemas {
+		for _, container := range schema.EntityContainers {
+			for _, set := range container.EntitySets {
+				entity, err := service.LookupEntityType(set.EntityType)
+				if err != nil {
+					return nil, err
+				}
+				p.sets[set.Name] = &memoryEntitySet{set: set, entity: entity}
+			}
+		}
+	}
+
+	return p, nil
+}
+
+func (p *GoDataMemoryProvider) GetMetadata() *GoDataMetadata {
+	return p.metadata
+}
+
+// Add entities to an entity set. Each entity is a map[string]interface{} or
+// a struct, or a pointer to one. Values are converted to the types of the
+// properties they are stored in, and navigation properties are ignored.
+func (p *GoDataMemoryProvider) Add(set string, entities ...interface{}) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	entitySet, ok := p.sets[set]
+	if !ok {
+		return errors.New("No entity set " + set)
+	}
+
+	for _, entity := range entities {
+		raw, err := structValues(entity)
+		if err != nil {
+			return err
+		}
+		values := map[string]interface{}{}
+		if t, ok := raw[ODataFieldType]; ok {
+			values[ODataFieldType] = t
+		}
+		entityType := p.instanceType(&memoryEntity{set: entitySet, values: values})
+		declared := p.entityProperties(entityType)
+		open := p.service.IsOpenType(entityType)
+
+		for name, value := range raw {
+			if strings.Contains(name, "@") {
+				values[name] = value
+				continue
+			}
+			if p.navigationProperty(entityType, name) != nil {
+				continue
+			}
+			t := ""
+			if prop, ok := declared[name]; ok {
+				t = prop.Type
+			} else if !open {
+				return errors.New("Entity " + entityType.Name + " has no property " + name)
+			}
+			converted, err := p.convertProperty(name, value, t)
+			if err != nil {
+				return err
+			}
+			values[name] = converted
+		}
+
+		if err := p.insert(entitySet, values); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Relate an entity to another one through a navigation property, for
+// relationships without referential constraints, e.g. many-to-many
+// relationships. Both entities are given by their key: the value of the key
+// property, or a map from key property names to values for composite keys.
+// The navigation property must be bound to the entity set of the target,
+// and if it has a partner that is bound back, the target is related to the
+// entity as well.
+func (p *GoDataMemoryProvider) Link(set, nav string, key, target interface{}) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	source, ok := p.sets[set]
+	if !ok {
+		return errors.New("No entity set " + set)
+	}
+	navProp := p.navigationProperty(source.entity, nav)
+	if navProp == nil {
+		return errors.New("Entity " + source.entity.Name + " has no navigation property " + nav)
+	}
+	targetSet, err := p.bindingTarget(source, nav)
+	if err != nil {
+		return err
+	}
+
+	from, err := p.find(source, key)
+	if err != nil {
+		return err
+	}
+	to, err := p.find(targetSet, target)
+	if err != nil {
+		return err
+	}
+	p.addLink(from, nav, to)
+
+	if navProp.Partner == "" {
+		return nil
+	}
+	if back, err := p.bindingTarget(targetSet, navProp.Partner); err == nil && back == source {
+		p.addLink(to, navProp.Partner, from)
+	}
+	return nil
+}
+
+func (p *GoDataMemoryProvider) GetEntity(req *GoDataRequest) (*GoDataResponseField, error) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	entity, err := p.requestEntity(req)
+	if err != nil {
+		return nil, err
+	}
+	entity, err = p.computeEntity(entity, req.Query.Compute)
+	if err != nil {
+		return nil, err
+	}
+
+	fields, err := p.entityFields(entity, requestQueryOptions(req.Query))
+	if err != nil {
+		return nil, err
+	}
+	return &GoDataResponseField{Value: fields}, nil
+}
+
+func (p *GoDataMemoryProvider) GetEntityCollection(req *GoDataRequest) (*GoDataResponseField, error) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	if req.Query.Apply != nil {
+		return nil, NotImplementedError("The memory provider does not support $apply.")
+	}
+	_, entities, err := p.requestEntities(req)
+	if err != nil {
+		return nil, err
+	}
+
+	options := requestQueryOptions(req.Query)
+	matched, err := p.query(instances(entities), options)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []*GoDataResponseField{}
+	for _, instance := range page(matched, options.skip, options.top) {
+		fields, err := p.entityFields(instance.(*memoryEntity), options)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, &GoDataResponseField{Value: fields})
+	}
+	return &GoDataResponseField{Value: result}, nil
+}
+
+func (p *GoDataMemoryProvider) GetCount(req *GoDataRequest) (int, error) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	_, entities, err := p.requestEntities(req)
+	if err != nil {
+		return 0, err
+	}
+
+	matched, err := p.query(instances(entities), &memoryQueryOptions{
+		compute: req.Query.Compute,
+		filter:  req.Query.Filter,
+		search:  req.Query.Search,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(matched), nil
+}
+
+func (p *GoDataMemoryProvider) CreateEntity(req *GoDataRequest, body *GoDataEntityBody) (*GoDataResponseField, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	set, err := p.requestSet(req)
+	if err != nil {
+		return nil, err
+	}
+	values, err := p.bodyValues(body)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.insert(set, values); err != nil {
+		return nil, err
+	}
+
+	return p.writtenEntity(set.entities[len(set.entities)-1])
+}
+
+func (p *GoDataMemoryProvider) UpdateEntity(req *GoDataRequest, body *GoDataEntityBody) (*GoDataResponseField, error) {
+	return p.updateEntity(req, body, false)
+}
+
+func (p *GoDataMemoryProvider) ReplaceEntity(req *GoDataRequest, body *GoDataEntityBody) (*GoDataResponseField, error) {
+	return p.updateEntity(req, body, true)
+}
+
+func (p *GoDataMemoryProvider) DeleteEntity(req *GoDataRequest) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	entity, err := p.requestEntity(req)
+	if err != nil {
+		return err
+	}
+
+	set := entity.set
+	for i, e := range set.entities {
+		if e == entity {
+			set.entities = append(set.entities[:i], set.entities[i+1:]...)
+			break
+		}
+	}
+
+	// forget the links from and to the entity
+	key := p.keyString(entity)
+	for link, keys := range p.links {
+		if link.set == set.set.Name && link.key == key {
+			delete(p.links, link)
+			continue
+		}
+		if target, err := p.bindingTarget(p.sets[link.set], link.path); err != nil || target != set {
+			continue
+		}
+		remaining := []string{}
+		for _, k := range keys {
+			if k != key {
+				remaining = append(remaining, k)
+			}
+		}
+		p.links[link] = remaining
+	}
+	return nil
+}
+
+// Update an entity with the properties in the body, or replace it with the
+// body. The key of the entity can not be changed.
+func (p *GoDataMemoryProvider) updateEntity(
+	req *GoDataRequest,
+	body *GoDataEntityBody,
+	replace bool,
+) (*GoDataResponseField, error) {
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	entity, err := p.requestEntity(req)
+	if err != nil {
+		return nil, err
+	}
+	changes, err := p.bodyValues(body)
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]interface{}{}
+	if !replace {
+		for name, value := range entity.values {
+			values[name] = value
+		}
+	}
+	for _, key := range p.entityKey(entity.set.entity) {
+		if value, ok := changes[key]; ok && !valuesEqual(value, entity.values[key]) {
+			return nil, BadRequestError("The key property " + key + " can not be changed.")
+		}
+		values[key] = entity.values[key]
+	}
+	for name, value := range changes {
+		values[name] = value
+	}
+	entity.values = values
+
+	return p.writtenEntity(entity)
+}
+
+// The entity returned by a write, with all of its properties.
+func (p *GoDataMemoryProvider) writtenEntity(entity *memoryEntity) (*GoDataResponseField, error) {
+	fields, err := p.entityFields(entity, &memoryQueryOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return &GoDataResponseField{Value: fields}, nil
+}
+
+// Convert the properties of a request body to the values stored in an
+// entity.
+func (p *GoDataMemoryProvider) bodyValues(body *GoDataEntityBody) (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+	if t, ok := body.Annotations[ODataFieldType].(string); ok {
+		values[ODataFieldType] = t
+	}
+	for _, prop := range body.Properties {
+		if prop.SemanticType == SemanticTypeEntity {
+			return nil, NotImplementedError("The memory provider does not support navigation property " +
+				prop.Name + " in a request body.")
+		}
+		t := ""
+		if declared, ok := prop.SemanticReference.(*GoDataProperty); ok {
+			t = declared.Type
+		}
+		value, err := p.convertProperty(prop.Name, prop.Value, t)
+		if err != nil {
+			return nil, err
+		}
+		values[prop.Name] = value
+	}
+	return values, nil
+}
+
+func (p *GoDataMemoryProvider) convertProperty(name string, value interface{}, t string) (interface{}, error) {
+	converted, ok := p.convertValue(value, t)
+	if !ok {
+		return nil, BadRequestError("The value of property " + name + " is not a valid " + t + ".")
+	}
+	return converted, nil
+}
+
+// Add an entity to a set. Its key must be given and must not be taken.
+func (p *GoDataMemoryProvider) insert(set *memoryEntitySet, values map[string]interface{}) error {
+	entity := &memoryEntity{set: set, values: values}
+	for _, key := range p.entityKey(set.entity) {
+		if values[key] == nil {
+			return BadRequestError("The key property " + key + " of entity set " + set.set.Name + " is missing.")
+		}
+	}
+	key := p.keyString(entity)
+	for _, other := range set.entities {
+		if p.keyString(other) == key {
+			return ConflictError("An entity with the key " + key + " already exists in entity set " +
+				set.set.Name + ".")
+		}
+	}
+	set.entities = append(set.entities, entity)
+	return nil
+}
+
+func (p *GoDataMemoryProvider) addLink(from *memoryEntity, path string, to *memoryEntity) {
+	link := memoryLink{from.set.set.Name, path, p.keyString(from)}
+	key := p.keyString(to)
+	for _, k := range p.links[link] {
+		if k == key {
+			return
+		}
+	}
+	p.links[link] = append(p.links[link], key)
+}
+
+// The entity set new entities are created in by a request. Entities can
+// not be created through a navigation path.
+func (p *GoDataMemoryProvider) requestSet(req *GoDataRequest) (*memoryEntitySet, error) {
+	segment := req.LastSegment
+	set, ok := segment.SemanticReference.(*GoDataEntitySet)
+	if !ok || segment.Prev != nil {
+		return nil, NotImplementedError("The memory provider only creates entities in entity sets.")
+	}
+	return p.sets[set.Name], nil
+}
+
+// The entities addressed by the path of a request, or counted by a $count
+// request, and the entity set they are in. The path is an entity set, e.g.
+// Orders, or a navigation path from one of its entities, e.g.
+// Orders(10)/Customer or Customers(1)/Orders(10).
+func (p *GoDataMemoryProvider) requestEntities(req *GoDataRequest) (*memoryEntitySet, []*memoryEntity, error) {
+	last := req.LastSegment
+	if last.SemanticType == SemanticTypeCount {
+		last = last.Prev
+	}
+
+	var set *memoryEntitySet
+	var entities []*memoryEntity
+	for segment := req.FirstSegment; segment != nil; segment = segment.Next {
+		ref, ok := segment.SemanticReference.(*GoDataEntitySet)
+		if !ok {
+			return nil, nil, NotImplementedError("The memory provider only serves entity sets and the " +
+				"navigation properties of their entities.")
+		}
+		if set == nil {
+			set, entities = p.sets[ref.Name], p.sets[ref.Name].entities
+		} else {
+			// the segment follows a navigation property of the single
+			// entity addressed by the segment before it
+			if len(entities) == 0 {
+				return nil, nil, NotFoundError("No entity " + segment.Prev.RawValue + " in entity set " +
+					set.set.Name + ".")
+			}
+			related, err := p.related(entities[0], segment.NavigationProperty.Name, segment.NavigationProperty)
+			if err != nil {
+				return nil, nil, err
+			}
+			set, entities = p.sets[ref.Name], related
+		}
+
+		if segment.Identifier != nil {
+			key, err := p.decodeKey(set, segment.Identifier)
+			if err != nil {
+				return nil, nil, err
+			}
+			entity := p.lookup(set, key)
+			found := false
+			for _, e := range entities {
+				found = found || e == entity
+			}
+			if entity == nil || !found {
+				return nil, nil, NotFoundError("No entity " + segment.RawValue + " in entity set " +
+					set.set.Name + ".")
+			}
+			entities = []*memoryEntity{entity}
+		}
+		if segment == last {
+			break
+		}
+	}
+	return set, entities, nil
+}
+
+// The entity addressed by a request.
+func (p *GoDataMemoryProvider) requestEntity(req *GoDataRequest) (*memoryEntity, error) {
+	set, entities, err := p.requestEntities(req)
+	if err != nil {
+		return nil, err
+	}
+	if req.LastSegment.addressesCollection() {
+		return nil, BadRequestError("The request does not address a single entity.")
+	}
+	if len(entities) == 0 {
+		return nil, NotFoundError("No entity " + req.LastSegment.RawValue + " in entity set " + set.set.Name + ".")
+	}
+	return entities[0], nil
+}
+
+// Decode the key predicate of a URL segment, e.g. ('Bob') or
+// (OrderId=1,ItemId=2), to the values of the key properties.
+func (p *GoDataMemoryProvider) decodeKey(set *memoryEntitySet, id *GoDataIdentifier) (map[string]interface{}, error) {
+	keys := p.entityKey(set.entity)
+	literals := map[string]string{}
+	if !id.HasMultiple() && (*id)[id.Get()] == "" {
+		if len(keys) != 1 {
+			return nil, BadRequestError("Entity set " + set.set.Name + " has a key of " +
+				fmt.Sprint(len(keys)) + " properties, each must be named.")
+		}
+		literals[keys[0]] = id.Get()
+	} else {
+		for name, literal := range *id {
+			literals[name] = literal
+		}
+	}
+
+	declared := p.entityProperties(set.entity)
+	result := map[string]interface{}{}
+	for _, name := range keys {
+		literal, ok := literals[name]
+		if !ok {
+			return nil, BadRequestError("The key property " + name + " of entity set " + set.set.Name +
+				" is missing.")
+		}
+		tokens, err := GlobalFilterTokenizer.Tokenize(literal)
+		if err != nil || len(tokens) != 1 {
+			return nil, BadRequestError("Invalid key " + literal + ".")
+		}
+		if err := DecodeFilterLiteral(tokens[0]); err != nil {
+			return nil, BadRequestError("Invalid key " + literal + ".")
+		}
+		value, ok := p.convertValue(literalValue(tokens[0]), declared[name].Type)
+		if !ok {
+			return nil, BadRequestError("Invalid key " + literal + ", expected a " + declared[name].Type + ".")
+		}
+		result[name] = value
+	}
+	return result, nil
+}
+
+// Find an entity by the key given to Link.
+func (p *GoDataMemoryProvider) find(set *memoryEntitySet, key interface{}) (*memoryEntity, error) {
+	keys := p.entityKey(set.entity)
+	given, ok := key.(map[string]interface{})
+	if !ok && len(keys) == 1 {
+		given = map[string]interface{}{keys[0]: key}
+	}
+
+	declared := p.entityProperties(set.entity)
+	values := map[string]interface{}{}
+	for _, name := range keys {
+		value, ok := p.convertValue(given[name], declared[name].Type)
+		if !ok || value == nil {
+			return nil, errors.New("Invalid key " + fmt.Sprint(key) + " for entity set " + set.set.Name)
+		}
+		values[name] = value
+	}
+
+	entity := p.lookup(set, values)
+	if entity == nil {
+		return nil, errors.New("No entity with the key " + fmt.Sprint(key) + " in entity set " + set.set.Name)
+	}
+	return entity, nil
+}
+
+// Find the entity with the given key values in a set, or nil.
+func (p *GoDataMemoryProvider) lookup(set *memoryEntitySet, key map[string]interface{}) *memoryEntity {
+	wanted := p.keyString(&memoryEntity{set: set, values: key})
+	for _, entity := range set.entities {
+		if p.keyString(entity) == wanted {
+			return entity
+		}
+	}
+	return nil
+}
+
+// A string identifying an entity within its set, built from its key values.
+func (p *GoDataMemoryProvider) keyString(entity *memoryEntity) string {
+	values := []string{}
+	for _, name := range p.entityKey(entity.set.entity) {
+		value := entity.values[name]
+		if t, ok := value.(time.Time); ok {
+			value = t.UTC().Format(time.RFC3339Nano)
+		}
+		values = append(values, fmt.Sprintf("%#v", value))
+	}
+	return strings.Join(values, ",")
+}
+
+// The id of an entity relative to the service root, e.g. Customers('Bob').
+func (p *GoDataMemoryProvider) entityId(entity *memoryEntity) string {
+	keys := p.entityKey(entity.set.entity)
+	values := []string{}
+	for _, name := range keys {
+		var value string
+		switch v := entity.values[name].(type) {
+		case string:
+			value = "'" + strings.Replace(v, "'", "''", -1) + "'"
+		case time.Time:
+			value = v.Format(time.RFC3339Nano)
+		default:
+			value = fmt.Sprint(v)
+		}
+		if len(keys) > 1 {
+			value = name + "=" + value
+		}
+		values = append(values, value)
+	}
+	return entity.set.set.Name + "(" + strings.Join(values, ",") + ")"
+}
+
+func instances(entities []*memoryEntity) []interface{} {
+	result := make([]interface{}, len(entities))
+	for i, entity := range entities {
+		result[i] = entity
+	}
+	return result
+}
+
+func requestQueryOptions(query *GoDataQuery) *memoryQueryOptions {
+	return &memoryQueryOptions{
+		compute: query.Compute,
+		filter:  query.Filter,
+		search:  query.Search,
+		orderby: query.OrderBy,
+		skip:    query.Skip,
+		top:     query.Top,
+		sel:     query.Select,
+		expand:  query.Expand,
+	}
+}
+
+// Compute, filter, search and order a collection of entities or complex
+// values. $skip and $top are left to the caller, which may need the count of
+// all the matching instances.
+func (p *GoDataMemoryProvider) query(instances []interface{}, options *memoryQueryOptions) ([]interface{}, error) {
+	result := []interface{}{}
+	for _, instance := range instances {
+		if entity, ok := instance.(*memoryEntity); ok {
+			computed, err := p.computeEntity(entity, options.compute)
+			if err != nil {
+				return nil, err
+			}
+			instance = computed
+		}
+
+		if options.filter != nil {
+			if options.filter.Expression == nil {
+				return nil, InternalServerError("The $filter has not been semanticized.")
+			}
+			match, err := p.evaluator(instance).matches(options.filter.Expression)
+			if err != nil {
+				return nil, err
+			}
+			if !match {
+				continue
+			}
+		}
+		if options.search != nil && !matchesSearch(instance, options.search.Tree) {
+			continue
+		}
+		result = append(result, instance)
+	}
+
+	if options.orderby != nil {
+		if err := p.order(result, options.orderby); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// Apply $skip and $top to a collection.
+func page(instances []interface{}, skip *GoDataSkipQuery, top *GoDataTopQuery) []interface{} {
+	if skip != nil {
+		if int(*skip) >= len(instances) {
+			return []interface{}{}
+		}
+		instances = instances[int(*skip):]
+	}
+	if top != nil && int(*top) < len(instances) {
+		instances = instances[:int(*top)]
+	}
+	return instances
+}
+
+// Sort a collection by the items of an $orderby. Null sorts before every
+// other value.
+func (p *GoDataMemoryProvider) order(instances []interface{}, orderby *GoDataOrderByQuery) error {
+	keys := map[interface{}][]interface{}{}
+	for _, instance := range instances {
+		values := []interface{}{}
+		for _, item := range orderby.OrderByItems {
+			if item.Expression == nil {
+				return InternalServerError("The $orderby has not been semanticized.")
+			}
+			value, err := p.evaluator(instance).evaluate(item.Expression)
+			if err != nil {
+				return err
+			}
+			values = append(values, value)
+		}
+		keys[instance] = values
+	}
+
+	sort.SliceStable(instances, func(i, j int) bool {
+		a, b := keys[instances[i]], keys[instances[j]]
+		for k, item := range orderby.OrderByItems {
+			c := orderValues(a[k], b[k])
+			if item.Order == DESC {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+	return nil
+}
+
+func orderValues(a, b interface{}) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+	c, _ := compareValues(a, b)
+	return c
+}
+
+// A copy of an entity with the properties computed by a $compute.
+func (p *GoDataMemoryProvider) computeEntity(entity *memoryEntity, compute *GoDataComputeQuery) (*memoryEntity, error) {
+	if compute == nil {
+		return entity, nil
+	}
+
+	values := map[string]interface{}{}
+	for name, value := range entity.values {
+		values[name] = value
+	}
+	for _, item := range compute.ComputeItems {
+		if item.Expression.Expression == nil {
+			return nil, InternalServerError("The $compute has not been semanticized.")
+		}
+		value, err := p.evaluator(entity).evaluate(item.Expression.Expression)
+		if err != nil {
+			return nil, err
+		}
+		values[item.Alias] = value
+	}
+	return &memoryEntity{set: entity.set, values: values}, nil
+}
+
+// Check whether any string in a value matches a $search expression. Terms
+// match case-insensitively anywhere in a string.
+func matchesSearch(value interface{}, node *ParseNode) bool {
+	if node.Token.Type == SearchTokenOp {
+		switch node.Token.Value {
+		case "NOT":
+			return !matchesSearch(value, node.Children[0])
+		case "AND":
+			return matchesSearch(value, node.Children[0]) && matchesSearch(value, node.Children[1])
+		case "OR":
+			return matchesSearch(value, node.Children[0]) || matchesSearch(value, node.Children[1])
+		}
+	}
+	return containsTerm(value, strings.ToLower(strings.Trim(node.Token.Value, "\"")))
+}
+
+func containsTerm(value interface{}, term string) bool {
+	switch v := value.(type) {
+	case *memoryEntity:
+		return containsTerm(v.values, term)
+	case map[string]interface{}:
+		for name, item := range v {
+			if !strings.Contains(name, "@") && containsTerm(item, term) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if containsTerm(item, term) {
+				return true
+			}
+		}
+	case string:
+		return strings.Contains(strings.ToLower(v), term)
+	}
+	return false
+}
+
+// Build the response fields of an entity, with the properties selected by
+// the options and the navigation properties they expand.
+func (p *GoDataMemoryProvider) entityFields(
+	entity *memoryEntity,
+	options *memoryQueryOptions,
+) (map[string]*GoDataResponseField, error) {
+
+	entityType := p.instanceType(entity)
+	declared := p.entityProperties(entityType)
+	values, err := p.selectValues(entity.values, declared, p.entityKey(entityType), options.sel)
+	if err != nil {
+		return nil, err
+	}
+
+	types := map[string]string{}
+	for name, prop := range declared {
+		types[name] = prop.Type
+	}
+	if options.compute != nil {
+		for _, item := range options.compute.ComputeItems {
+			types[item.Alias] = item.Type
+		}
+	}
+	fields := p.responseFields(values, types)
+
+	if options.expand != nil {
+		for _, item := range options.expand.ExpandItems {
+			if err := p.expandItem(entity, entityType, fields, item); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return fields, nil
+}
+
+// Keep the properties of a structured value selected by a $select, or every
+// declared and dynamic property if nothing is selected. The keys of entities
+// are always kept, so the service can link to them.
+func (p *GoDataMemoryProvider) selectValues(
+	values map[string]interface{},
+	declared map[string]*GoDataProperty,
+	keys []string,
+	sel *GoDataSelectQuery,
+) (map[string]interface{}, error) {
+
+	result := map[string]interface{}{}
+	all := sel == nil
+	if sel != nil {
+		for _, item := range sel.SelectItems {
+			if len(item.Segments) == 1 && item.Segments[0].Value == "*" {
+				all = true
+			}
+		}
+	}
+
+	if all {
+		for name := range declared {
+			result[name] = values[name]
+		}
+		for name, value := range values {
+			result[name] = value
+		}
+	} else if t, ok := values[ODataFieldType]; ok {
+		result[ODataFieldType] = t
+	}
+	for _, key := range keys {
+		result[key] = values[key]
+	}
+
+	if sel == nil {
+		return result, nil
+	}
+	for _, item := range sel.SelectItems {
+		if err := p.selectPath(result, values, item.Segments, item); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// Copy the value at the end of a selected path from src to dst, applying the
+// options of the select item to it.
+func (p *GoDataMemoryProvider) selectPath(
+	dst, src map[string]interface{},
+	segments []*Token,
+	item *SelectItem,
+) error {
+
+	segment := segments[0]
+	name := segment.Value
+	switch segment.SemanticType {
+	case SemanticTypeAction, SemanticTypeFunction, SemanticTypeEntity:
+		// operations and navigation links are added by the service
+		return nil
+	}
+	if name == "*" {
+		for k, v := range src {
+			if _, ok := dst[k]; !ok {
+				dst[k] = v
+			}
+		}
+		return nil
+	}
+
+	value, ok := src[name]
+	if !ok && segment.SemanticType == SemanticTypeDynamicProperty {
+		return nil
+	}
+
+	if len(segments) > 1 {
+		child, ok := value.(map[string]interface{})
+		if !ok {
+			dst[name] = nil
+			return nil
+		}
+		// copy what is already selected, the stored value must not change
+		selected := map[string]interface{}{}
+		if existing, ok := dst[name].(map[string]interface{}); ok {
+			for k, v := range existing {
+				selected[k] = v
+			}
+		}
+		if t, ok := child[ODataFieldType]; ok {
+			selected[ODataFieldType] = t
+		}
+		dst[name] = selected
+		return p.selectPath(selected, child, segments[1:], item)
+	}
+
+	items, isCollection := value.([]interface{})
+	if !item.hasOptions() || !isCollection {
+		dst[name] = value
+		return nil
+	}
+
+	matched, err := p.query(items, &memoryQueryOptions{
+		filter:  item.Filter,
+		search:  item.Search,
+		orderby: item.OrderBy,
+	})
+	if err != nil {
+		return err
+	}
+	if item.Count != nil && bool(*item.Count) {
+		dst[name+ODataFieldCount] = len(matched)
+	}
+	matched = page(matched, item.Skip, item.Top)
+
+	if item.Select != nil {
+		var declared map[string]*GoDataProperty
+		if prop, ok := segment.SemanticReference.(*GoDataProperty); ok {
+			declared = p.complexProperties(p.service.LookupComplexType(elementType(prop.Type)))
+		}
+		for i, element := range matched {
+			if values, ok := element.(map[string]interface{}); ok {
+				if matched[i], err = p.selectValues(values, declared, nil, item.Select); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	dst[name] = matched
+	return nil
+}
+
+// Add the related entities of an expanded navigation property to the fields
+// of an entity. The path to the navigation property may pass through complex
+// properties and casts.
+func (p *GoDataMemoryProvider) expandItem(
+	entity *memoryEntity,
+	entityType *GoDataEntityType,
+	fields map[string]*GoDataResponseField,
+	item *ExpandItem,
+) error {
+
+	var complexType *GoDataComplexType
+	var nav *GoDataNavigationProperty
+	path := []string{}
+	for i, segment := range item.Path {
+		path = append(path, segment.Value)
+		switch segment.SemanticType {
+		case SemanticTypeDerivedEntity:
+			if !p.service.derivesFromEntityType(entityType, segment.SemanticReference.(*GoDataEntityType)) {
+				// the entity is not of the type the path is cast to
+				return nil
+			}
+		case SemanticTypeDerivedComplex:
+			complexType = segment.SemanticReference.(*GoDataComplexType)
+		case SemanticTypeProperty:
+			field, ok := fields[segment.Value]
+			if !ok || field.Value == nil {
+				return nil
+			}
+			nested, ok := field.Value.(map[string]*GoDataResponseField)
+			if !ok {
+				return NotImplementedError("The memory provider can not expand navigation properties of " +
+					"complex collection " + segment.Value + ".")
+			}
+			fields = nested
+			complexType = p.service.LookupComplexType(segment.SemanticReference.(*GoDataProperty).Type)
+		case SemanticTypeEntity:
+			if i != len(item.Path)-1 {
+				return NotImplementedError("The memory provider can not expand " + expandPathString(item.Path) +
+					", which passes through several navigation properties.")
+			}
+			if complexType != nil {
+				for _, prop := range complexType.NavigationProperties {
+					if prop.Name == segment.Value {
+						nav = prop
+					}
+				}
+			} else {
+				nav = p.navigationProperty(entityType, segment.Value)
+			}
+		}
+	}
+	if nav == nil {
+		return InternalServerError("The $expand has not been semanticized.")
+	}
+	name := nav.Name
+
+	related, err := p.related(entity, strings.Join(path, "/"), nav)
+	if err != nil {
+		return err
+	}
+	instances := make([]interface{}, len(related))
+	for i, e := range related {
+		instances[i] = e
+	}
+
+	options := &memoryQueryOptions{
+		compute: item.Compute,
+		filter:  item.Filter,
+		search:  item.Search,
+		orderby: item.OrderBy,
+		skip:    item.Skip,
+		top:     item.Top,
+		sel:     item.Select,
+		expand:  item.Expand,
+	}
+	matched, err := p.query(instances, options)
+	if err != nil {
+		return err
+	}
+	if item.IsCount {
+		fields[name+ODataFieldCount] = &GoDataResponseField{Value: len(matched)}
+		return nil
+	}
+	if item.Count != nil && bool(*item.Count) {
+		fields[name+ODataFieldCount] = &GoDataResponseField{Value: len(matched)}
+	}
+
+	values := []*GoDataResponseField{}
+	for _, instance := range page(matched, item.Skip, item.Top) {
+		e := instance.(*memoryEntity)
+		if item.IsRef {
+			values = append(values, &GoDataResponseField{Value: map[string]*GoDataResponseField{
+				ODataFieldId: &GoDataResponseField{Value: p.entityId(e)},
+			}})
+			continue
+		}
+		expanded, err := p.entityFields(e, options)
+		if err != nil {
+			return err
+		}
+		values = append(values, &GoDataResponseField{Value: expanded})
+	}
+
+	if strings.HasPrefix(nav.Type, "Collection(") {
+		fields[name] = &GoDataResponseField{Value: values}
+	} else if len(values) == 0 {
+		fields[name] = &GoDataResponseField{Value: nil}
+	} else {
+		fields[name] = values[0]
+	}
+	return nil
+}
+
+// Find the entities related to an entity through the navigation property at
+// the given path, e.g. Orders or Address/Country.
+func (p *GoDataMemoryProvider) related(
+	entity *memoryEntity,
+	path string,
+	nav *GoDataNavigationProperty,
+) ([]*memoryEntity, error) {
+
+	target, err := p.bindingTarget(entity.set, path)
+	if err != nil {
+		return nil, err
+	}
+
+	match := func(constraints []*GoDataReferentialConstraint, reverse bool) []*memoryEntity {
+		result := []*memoryEntity{}
+		for _, candidate := range target.entities {
+			matches := true
+			for _, c := range constraints {
+				own, other := entity.values[c.Property], candidate.values[c.ReferencedProperty]
+				if reverse {
+					own, other = entity.values[c.ReferencedProperty], candidate.values[c.Property]
+				}
+				if own == nil || !valuesEqual(own, other) {
+					matches = false
+					break
+				}
+			}
+			if matches {
+				result = append(result, candidate)
+			}
+		}
+		return result
+	}
+
+	if len(nav.ReferentialConstraints) > 0 {
+		return match(nav.ReferentialConstraints, false), nil
+	}
+	if nav.Partner != "" {
+		partner := p.navigationProperty(target.entity, nav.Partner)
+		if partner != nil && len(partner.ReferentialConstraints) > 0 {
+			return match(partner.ReferentialConstraints, true), nil
+		}
+	}
+
+	result := []*memoryEntity{}
+	for _, key := range p.links[memoryLink{entity.set.set.Name, path, p.keyString(entity)}] {
+		for _, candidate := range target.entities {
+			if p.keyString(candidate) == key {
+				result = append(result, candidate)
+			}
+		}
+	}
+	return result, nil
+}
+
+// The entity set a navigation property of the entities in a set is bound to.
+func (p *GoDataMemoryProvider) bindingTarget(set *memoryEntitySet, path string) (*memoryEntitySet, error) {
+	for _, binding := range set.set.NavigationPropertyBindings {
+		if binding.Path != path {
+			continue
+		}
+		name := binding.Target[strings.LastIndex(binding.Target, "/")+1:]
+		if target, ok := p.sets[name]; ok {
+			return target, nil
+		}
+	}
+	return nil, InternalServerError("Navigation property " + path + " of entity set " + set.set.Name +
+		" is not bound to an entity set.")
+}
+
+// The entity type of an entity, which is the type of its set unless the
+// entity says it is of a derived type with @odata.type.
+func (p *GoDataMemoryProvider) instanceType(entity *memoryEntity) *GoDataEntityType {
+	if t, ok := entity.values[ODataFieldType].(string); ok {
+		if derived, err := p.service.LookupEntityType(strings.TrimPrefix(t, "#")); err == nil {
+			return derived
+		}
+	}
+	return entity.set.entity
+}
+
+// The structural properties of an entity type, including the inherited
+// ones, by name.
+func (p *GoDataMemoryProvider) entityProperties(entity *GoDataEntityType) map[string]*GoDataProperty {
+	result := map[string]*GoDataProperty{}
+	for entity != nil {
+		for _, prop := range entity.Properties {
+			if _, ok := result[prop.Name]; !ok {
+				result[prop.Name] = prop
+			}
+		}
+		entity = p.baseEntityType(entity)
+	}
+	return result
+}
+
+// The structural properties of a complex type, including the inherited ones,
+// by name.
+func (p *GoDataMemoryProvider) complexProperties(complexType *GoDataComplexType) map[string]*GoDataProperty {
+	result := map[string]*GoDataProperty{}
+	for complexType != nil {
+		for _, prop := range complexType.Properties {
+			if _, ok := result[prop.Name]; !ok {
+				result[prop.Name] = prop
+			}
+		}
+		if complexType.BaseType == "" {
+			break
+		}
+		complexType = p.service.LookupComplexType(complexType.BaseType)
+	}
+	return result
+}
+
+// Find a navigation property of an entity type or of one of its base types.
+func (p *GoDataMemoryProvider) navigationProperty(entity *GoDataEntityType, name string) *GoDataNavigationProperty {
+	for entity != nil {
+		if nav, ok := p.service.NavigationPropertyLookup[entity][name]; ok {
+			return nav
+		}
+		entity = p.baseEntityType(entity)
+	}
+	return nil
+}
+
+// The names of the key properties of an entity type, which may be declared
+// by a base type.
+func (p *GoDataMemoryProvider) entityKey(entity *GoDataEntityType) []string {
+	for entity != nil {
+		if entity.Key != nil {
+			keys := []string{}
+			for _, ref := range entity.Key.Refs() {
+				keys = append(keys, ref.Name)
+			}
+			return keys
+		}
+		entity = p.baseEntityType(entity)
+	}
+	return nil
+}
+
+func (p *GoDataMemoryProvider) baseEntityType(entity *GoDataEntityType) *GoDataEntityType {
+	if entity.BaseType == "" {
+		return nil
+	}
+	base, err := p.service.LookupEntityType(entity.BaseType)
+	if err != nil {
+		return nil
+	}
+	return base
+}
+
+// The element type of a collection type, or the type itself.
+func elementType(t string) string {
+	if strings.HasPrefix(t, "Collection(") {
+		return t[len("Collection(") : len(t)-1]
+	}
+	return t
+}
+
+// The properties of an entity given to Add, by name.
+func structValues(value interface{}) (map[string]interface{}, error) {
+	if values, ok := value.(map[string]interface{}); ok {
+		return values, nil
+	}
+
+	v := reflect.ValueOf(value)
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil, errors.New("Entities can not be nil")
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil, errors.New("Entities must be maps or structs, not " + v.Type().String())
+	}
+
+	result := map[string]interface{}{}
+	if err := addStructFields(v, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Add the fields of a struct to a map of properties, named the way
+// ReflectSchema names them.
+func addStructFields(v reflect.Value, result map[string]interface{}) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		options, err := parseStructTag(field)
+		if err != nil {
+			return errors.New(t.String() + "." + field.Name + ": " + err.Error())
+		}
+		if options == nil {
+			continue
+		}
+
+		value := v.Field(i)
+		if field.Anonymous && derefType(field.Type).Kind() == reflect.Struct && derefType(field.Type) != timeType {
+			// the fields of the base type
+			for value.Kind() == reflect.Ptr {
+				if value.IsNil() {
+					break
+				}
+				value = value.Elem()
+			}
+			if value.Kind() == reflect.Struct {
+				if err := addStructFields(value, result); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if options.dynamic {
+			iter := value.MapRange()
+			for iter.Next() {
+				result[iter.Key().String()] = iter.Value().Interface()
+			}
+			continue
+		}
+		result[options.name] = value.Interface()
+	}
+	return nil
+}
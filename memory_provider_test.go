@@ -0,0 +1,415 @@
+package godata
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+type memoryTestCustomer struct {
+	Id      int `odata:"key"`
+	Name    string
+	Age     int
+	Address *memoryTestAddress
+	Tags    []string
+	Extra   map[string]interface{} `odata:"dynamic"`
+}
+
+type memoryTestAddress struct {
+	City string
+	Zip  string
+}
+
+func newMemoryTestService(t *testing.T) (*GoDataService, *GoDataMemoryProvider) {
+	schema := NewSchemaBuilder("Store", "Container")
+	schema.Schema().ComplexTypes = append(schema.Schema().ComplexTypes, &GoDataComplexType{
+		Name: "Address",
+		Properties: []*GoDataProperty{
+			&GoDataProperty{Name: "City", Type: GoDataString},
+			&GoDataProperty{Name: "Zip", Type: GoDataString},
+		},
+	})
+	customer := schema.EntityType("Customer").Open().
+		Key("Id", GoDataInt32).
+		Property("Name", GoDataString).
+		Property("Age", GoDataInt32).
+		Property("Address", "Store.Address").
+		Property("Tags", "Collection(Edm.String)")
+	order := schema.EntityType("Order").
+		Key("Id", GoDataInt32).
+		Property("CustomerId", GoDataInt32).
+		Property("Total", GoDataDecimal).
+		Property("Placed", GoDataDate)
+	product := schema.EntityType("Product").Key("Id", GoDataString).Property("Name", GoDataString)
+	schema.ManyToOne(order, customer, "Customer", "Orders").Constraint("CustomerId", "Id")
+	schema.ManyToMany(order, product, "Products", "Orders")
+
+	customers := schema.EntitySet("Customers", customer)
+	orders := schema.EntitySet("Orders", order)
+	products := schema.EntitySet("Products", product)
+	schema.BindProperty(orders, customers, "Customer", "Orders")
+	schema.BindProperty(orders, products, "Products", "Orders")
+
+	provider, err := NewMemoryProvider(schema.Metadata())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = provider.Add("Customers",
+		map[string]interface{}{"Id": 1, "Name": "Bob", "Age": 41, "Tags": []string{"vip"},
+			"Address": map[string]interface{}{"City": "Oslo", "Zip": "0150"}},
+		&memoryTestCustomer{Id: 2, Name: "Alice", Age: 29, Address: &memoryTestAddress{City: "Bergen"},
+			Extra: map[string]interface{}{"Nickname": "Al"}},
+		map[string]interface{}{"Id": 3, "Name": "Carol"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = provider.Add("Orders",
+		map[string]interface{}{"Id": 10, "CustomerId": 1, "Total": 25.5, "Placed": "2020-03-01"},
+		map[string]interface{}{"Id": 11, "CustomerId": 1, "Total": 100, "Placed": "2021-07-15"},
+		map[string]interface{}{"Id": 12, "CustomerId": 2, "Total": 7.25, "Placed": "2021-01-02"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = provider.Add("Products",
+		map[string]interface{}{"Id": "milk", "Name": "Milk"},
+		map[string]interface{}{"Id": "bread", "Name": "Bread"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, link := range [][]interface{}{{10, "milk"}, {10, "bread"}, {12, "bread"}} {
+		if err := provider.Link("Orders", "Products", link[0], link[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	service, err := BuildService(provider, "http://localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return service, provider
+}
+
+func memoryRequest(t *testing.T, service *GoDataService, method, url, body string) (int, map[string]interface{}) {
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(method, url, strings.NewReader(body))
+	if body != "" {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	service.GoDataHTTPHandler(recorder, request)
+
+	result := map[string]interface{}{}
+	if recorder.Body.Len() > 0 && strings.HasPrefix(recorder.Header().Get("Content-Type"), "application/json") {
+		if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil {
+			t.Error(url + ": " + err.Error() + ": " + recorder.Body.String())
+		}
+	}
+	return recorder.Code, result
+}
+
+// The values of a property of each entity in a collection response.
+func memoryValues(result map[string]interface{}, name string) string {
+	values := []string{}
+	entities, _ := result["value"].([]interface{})
+	for _, entity := range entities {
+		fields, _ := entity.(map[string]interface{})
+		values = append(values, memoryString(fields[name]))
+	}
+	return strings.Join(values, ",")
+}
+
+func memoryString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	b, _ := json.Marshal(value)
+	return string(b)
+}
+
+func TestMemoryProviderQueries(t *testing.T) {
+	service, _ := newMemoryTestService(t)
+
+	testCases := []struct {
+		url      string
+		property string
+		expected string
+	}{
+		{"/Customers", "Name", "Bob,Alice,Carol"},
+		{"/Customers?$filter=Age gt 30", "Name", "Bob"},
+		{"/Customers?$filter=Age eq null", "Name", "Carol"},
+		{"/Customers?$filter=not (Age gt 30)", "Name", "Alice,Carol"},
+		{"/Customers?$filter=startswith(tolower(Name),'a') or Id eq 3", "Name", "Alice,Carol"},
+		{"/Customers?$filter=Address/City eq 'Oslo'", "Name", "Bob"},
+		{"/Customers?$filter=Tags/any(t:t eq 'vip')", "Name", "Bob"},
+		{"/Customers?$filter=Orders/any(o:o/Total gt 50)", "Name", "Bob"},
+		{"/Customers?$filter=Orders/$count eq 1", "Name", "Alice"},
+		{"/Customers?$filter=Nickname eq 'Al'", "Name", "Alice"},
+		{"/Customers?$filter=Id in (1,3)", "Name", "Bob,Carol"},
+		{"/Orders?$filter=year(Placed) eq 2021", "Id", "11,12"},
+		{"/Orders?$filter=Customer/Name eq 'Bob'", "Id", "10,11"},
+		{"/Orders?$filter=Total mul 2 gt 50", "Id", "10,11"},
+		{"/Orders?$filter=Products/any(p:p/Id eq 'bread')", "Id", "10,12"},
+		{"/Orders?$filter=Placed lt 2021-01-01", "Id", "10"},
+		{"/Customers?$orderby=Name", "Name", "Alice,Bob,Carol"},
+		{"/Customers?$orderby=Age desc", "Name", "Bob,Alice,Carol"},
+		{"/Customers?$orderby=Age", "Name", "Carol,Alice,Bob"},
+		{"/Customers?$orderby=Name&$skip=1&$top=1", "Name", "Bob"},
+		{"/Customers?$search=ali OR car", "Name", "Alice,Carol"},
+		{"/Customers?$search=NOT bob", "Name", "Alice,Carol"},
+		{"/Customers?$compute=Age add 1 as Next&$filter=Next eq 42", "Name", "Bob"},
+		{"/Customers?$compute=Age add 1 as Next&$orderby=Next desc", "Next", "42,30,null"},
+	}
+
+	for _, testCase := range testCases {
+		code, result := memoryRequest(t, service, "GET", strings.Replace(testCase.url, " ", "%20", -1), "")
+		if code != http.StatusOK {
+			t.Error(testCase.url + " responded with " + strconv.Itoa(code) + ": " + memoryString(result))
+			continue
+		}
+		if actual := memoryValues(result, testCase.property); actual != testCase.expected {
+			t.Error(testCase.url + " returned " + actual + ", expected " + testCase.expected)
+		}
+	}
+}
+
+func TestMemoryProviderCount(t *testing.T) {
+	service, _ := newMemoryTestService(t)
+
+	_, result := memoryRequest(t, service, "GET", "/Customers?$count=true&$top=1&$filter=Id%20gt%201", "")
+	if result["@odata.count"] != 2.0 || memoryValues(result, "Id") != "2" {
+		t.Error("Unexpected count response", result)
+	}
+
+	recorder := httptest.NewRecorder()
+	service.GoDataHTTPHandler(recorder, httptest.NewRequest("GET", "/Customers/$count?$filter=Age%20lt%2040", nil))
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "1" {
+		t.Error("/Customers/$count returned " + strconv.Itoa(recorder.Code) + ": " + recorder.Body.String())
+	}
+}
+
+func TestMemoryProviderNavigation(t *testing.T) {
+	service, _ := newMemoryTestService(t)
+
+	testCases := []struct {
+		url      string
+		property string
+		expected string
+	}{
+		{"/Orders(10)/Products", "Name", "Milk,Bread"},
+		{"/Orders(10)/Products?$filter=Id eq 'bread'", "Name", "Bread"},
+		{"/Orders(11)/Products", "Name", ""},
+		{"/Customers(1)/Orders?$orderby=Total desc", "Id", "11,10"},
+		{"/Products('bread')/Orders", "Id", "10,12"},
+	}
+	for _, testCase := range testCases {
+		code, result := memoryRequest(t, service, "GET", strings.Replace(testCase.url, " ", "%20", -1), "")
+		if code != http.StatusOK {
+			t.Error(testCase.url + " responded with " + strconv.Itoa(code) + ": " + memoryString(result))
+			continue
+		}
+		if actual := memoryValues(result, testCase.property); actual != testCase.expected {
+			t.Error(testCase.url + " returned " + actual + ", expected " + testCase.expected)
+		}
+	}
+
+	code, result := memoryRequest(t, service, "GET", "/Customers(1)/Orders(11)", "")
+	if code != http.StatusOK || result["Id"] != 11.0 {
+		t.Error("/Customers(1)/Orders(11) responded with " + strconv.Itoa(code) + ": " + memoryString(result))
+	}
+	code, result = memoryRequest(t, service, "GET", "/Orders(12)/Customer", "")
+	if code != http.StatusOK || result["Name"] != "Alice" {
+		t.Error("/Orders(12)/Customer responded with " + strconv.Itoa(code) + ": " + memoryString(result))
+	}
+	code, result = memoryRequest(t, service, "GET", "/Orders(10)/Customer?$expand=Orders($select=Id)", "")
+	if code != http.StatusOK || memoryString(result["Orders"]) != `[{"Id":10},{"Id":11}]` {
+		t.Error("/Orders(10)/Customer responded with " + strconv.Itoa(code) + ": " + memoryString(result))
+	}
+	if code, _ := memoryRequest(t, service, "GET", "/Customers(1)/Orders(12)", ""); code != http.StatusNotFound {
+		t.Error("An unrelated entity responded with " + strconv.Itoa(code))
+	}
+
+	recorder := httptest.NewRecorder()
+	service.GoDataHTTPHandler(recorder, httptest.NewRequest("GET", "/Orders(10)/Products/$count", nil))
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "2" {
+		t.Error("/Orders(10)/Products/$count returned " + strconv.Itoa(recorder.Code) + ": " + recorder.Body.String())
+	}
+}
+
+func TestMemoryProviderDivisionByZero(t *testing.T) {
+	service, _ := newMemoryTestService(t)
+
+	for _, filter := range []string{"Age div 0 gt 1", "Total div 0 gt 1", "Total divby 0 gt 1", "Total mod 0 gt 1",
+		"Total div 0.0 gt 1"} {
+		url := "/Customers?$filter=" + strings.Replace(filter, " ", "%20", -1)
+		if strings.HasPrefix(filter, "Total") {
+			url = "/Orders?$filter=" + strings.Replace(filter, " ", "%20", -1)
+		}
+		code, result := memoryRequest(t, service, "GET", url, "")
+		if code != http.StatusBadRequest || !strings.Contains(memoryString(result), "Division by zero.") {
+			t.Error(filter + " responded with " + strconv.Itoa(code) + ": " + memoryString(result))
+		}
+	}
+}
+
+func TestMemoryProviderNaN(t *testing.T) {
+	service, _ := newMemoryTestService(t)
+
+	testCases := []struct {
+		filter   string
+		expected string
+	}{
+		{"Id eq NaN", ""},
+		{"Total eq NaN", ""},
+		{"Total ne NaN", "10,11,12"},
+		{"Total lt NaN", ""},
+		{"Total ge NaN", ""},
+	}
+	for _, testCase := range testCases {
+		url := "/Orders?$filter=" + strings.Replace(testCase.filter, " ", "%20", -1)
+		code, result := memoryRequest(t, service, "GET", url, "")
+		if code != http.StatusOK {
+			t.Error(testCase.filter + " responded with " + strconv.Itoa(code) + ": " + memoryString(result))
+			continue
+		}
+		if actual := memoryValues(result, "Id"); actual != testCase.expected {
+			t.Error(testCase.filter + " returned " + actual + ", expected " + testCase.expected)
+		}
+	}
+}
+
+func TestMemoryProviderEntity(t *testing.T) {
+	service, _ := newMemoryTestService(t)
+
+	code, result := memoryRequest(t, service, "GET", "/Orders(10)", "")
+	if code != http.StatusOK {
+		t.Fatal("Response code is " + strconv.Itoa(code))
+	}
+	if result["Total"] != 25.5 || result["Placed"] != "2020-03-01" || result["CustomerId"] != 1.0 {
+		t.Error("Unexpected entity", result)
+	}
+
+	if code, _ := memoryRequest(t, service, "GET", "/Orders(99)", ""); code != http.StatusNotFound {
+		t.Error("Missing entity responded with " + strconv.Itoa(code))
+	}
+
+	_, result = memoryRequest(t, service, "GET", "/Products('milk')", "")
+	if result["Name"] != "Milk" {
+		t.Error("Unexpected entity", result)
+	}
+}
+
+func TestMemoryProviderSelect(t *testing.T) {
+	service, _ := newMemoryTestService(t)
+
+	_, result := memoryRequest(t, service, "GET", "/Customers(1)?$select=Name,Address/City", "")
+	if result["Name"] != "Bob" || result["Id"] != 1.0 {
+		t.Error("Selected properties or the key are missing", result)
+	}
+	if _, ok := result["Age"]; ok {
+		t.Error("Age is not selected", result)
+	}
+	address, _ := result["Address"].(map[string]interface{})
+	if address["City"] != "Oslo" || address["Zip"] != nil {
+		t.Error("Only the city of the address is selected", result["Address"])
+	}
+
+	// the stored address is left alone
+	_, result = memoryRequest(t, service, "GET", "/Customers(1)", "")
+	address, _ = result["Address"].(map[string]interface{})
+	if address["Zip"] != "0150" {
+		t.Error("The stored address was changed by $select", result["Address"])
+	}
+}
+
+func TestMemoryProviderExpand(t *testing.T) {
+	service, _ := newMemoryTestService(t)
+
+	_, result := memoryRequest(t, service, "GET",
+		"/Customers(1)?$expand=Orders($filter=Total%20gt%2050%3B$select=Total%3B$count=true)", "")
+	orders, _ := result["Orders"].([]interface{})
+	if len(orders) != 1 || orders[0].(map[string]interface{})["Total"] != 100.0 {
+		t.Error("Unexpected expanded orders", result["Orders"])
+	}
+	if result["Orders@odata.count"] != 1.0 {
+		t.Error("Unexpected count of expanded orders", result["Orders@odata.count"])
+	}
+
+	_, result = memoryRequest(t, service, "GET", "/Orders?$expand=Customer,Products($orderby=Name)", "")
+	values := []string{}
+	for _, value := range result["value"].([]interface{}) {
+		order := value.(map[string]interface{})
+		customer, _ := order["Customer"].(map[string]interface{})
+		products := []string{}
+		for _, product := range order["Products"].([]interface{}) {
+			products = append(products, memoryString(product.(map[string]interface{})["Name"]))
+		}
+		values = append(values, memoryString(customer["Name"])+":"+strings.Join(products, "+"))
+	}
+	if actual := strings.Join(values, ","); actual != "Bob:Bread+Milk,Bob:,Alice:Bread" {
+		t.Error("Unexpected expansion " + actual)
+	}
+
+	_, result = memoryRequest(t, service, "GET", "/Products('bread')?$expand=Orders/$ref", "")
+	refs, _ := result["Orders"].([]interface{})
+	if len(refs) != 2 || refs[0].(map[string]interface{})["@odata.id"] != "Orders(10)" {
+		t.Error("Unexpected references", result["Orders"])
+	}
+}
+
+func TestMemoryProviderWrites(t *testing.T) {
+	service, provider := newMemoryTestService(t)
+
+	code, result := memoryRequest(t, service, "POST", "/Customers", `{"Id":4,"Name":"Dave","Age":50}`)
+	if code != http.StatusCreated || result["Name"] != "Dave" {
+		t.Error("Create responded with " + strconv.Itoa(code) + ": " + memoryString(result))
+	}
+	if code, _ := memoryRequest(t, service, "POST", "/Customers", `{"Id":4,"Name":"Eve"}`); code != http.StatusConflict {
+		t.Error("Creating a duplicate responded with " + strconv.Itoa(code))
+	}
+
+	memoryRequest(t, service, "PATCH", "/Customers(4)", `{"Age":51}`)
+	_, result = memoryRequest(t, service, "GET", "/Customers(4)", "")
+	if result["Age"] != 51.0 || result["Name"] != "Dave" {
+		t.Error("Unexpected entity after PATCH", result)
+	}
+
+	memoryRequest(t, service, "PUT", "/Customers(4)", `{"Name":"David"}`)
+	_, result = memoryRequest(t, service, "GET", "/Customers(4)", "")
+	if result["Age"] != nil || result["Name"] != "David" || result["Id"] != 4.0 {
+		t.Error("Unexpected entity after PUT", result)
+	}
+
+	if code, _ := memoryRequest(t, service, "PATCH", "/Customers(4)", `{"Id":5}`); code != http.StatusBadRequest {
+		t.Error("Changing the key responded with " + strconv.Itoa(code))
+	}
+
+	memoryRequest(t, service, "DELETE", "/Products('milk')", "")
+	if code, _ := memoryRequest(t, service, "GET", "/Products('milk')", ""); code != http.StatusNotFound {
+		t.Error("Deleted entity responded with " + strconv.Itoa(code))
+	}
+	_, result = memoryRequest(t, service, "GET", "/Orders(10)?$expand=Products", "")
+	if products, _ := result["Products"].([]interface{}); len(products) != 1 {
+		t.Error("Deleted entity is still linked", result["Products"])
+	}
+
+	if err := provider.Add("Customers", map[string]interface{}{"Name": "Nobody"}); err == nil {
+		t.Error("Adding an entity without a key should fail")
+	}
+	if err := provider.Add("Orders", map[string]interface{}{"Id": 20, "Size": 3}); err == nil {
+		t.Error("Adding an undeclared property to a closed type should fail")
+	}
+	if err := provider.Link("Orders", "Products", 10, "cheese"); err == nil {
+		t.Error("Linking to a missing entity should fail")
+	}
+}
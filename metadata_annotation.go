@@ -0,0 +1,418 @@
+package godata
+
+import (
+	"encoding/xml"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// The kinds of annotation value expressions, named after their CSDL
+// elements.
+const (
+	// constant expressions
+	GoDataExpressionBinary         = "Binary"
+	GoDataExpressionBool           = "Bool"
+	GoDataExpressionDate           = "Date"
+	GoDataExpressionDateTimeOffset = "DateTimeOffset"
+	GoDataExpressionDecimal        = "Decimal"
+	GoDataExpressionDuration       = "Duration"
+	GoDataExpressionEnumMember     = "EnumMember"
+	GoDataExpressionFloat          = "Float"
+	GoDataExpressionGuid           = "Guid"
+	GoDataExpressionInt            = "Int"
+	GoDataExpressionString         = "String"
+	GoDataExpressionTimeOfDay      = "TimeOfDay"
+
+	// path expressions
+	GoDataExpressionAnnotationPath         = "AnnotationPath"
+	GoDataExpressionModelElementPath       = "ModelElementPath"
+	GoDataExpressionNavigationPropertyPath = "NavigationPropertyPath"
+	GoDataExpressionPropertyPath           = "PropertyPath"
+	GoDataExpressionPath                   = "Path"
+
+	// logical, comparison and arithmetic operators
+	GoDataExpressionAnd   = "And"
+	GoDataExpressionOr    = "Or"
+	GoDataExpressionNot   = "Not"
+	GoDataExpressionEq    = "Eq"
+	GoDataExpressionNe    = "Ne"
+	GoDataExpressionGt    = "Gt"
+	GoDataExpressionGe    = "Ge"
+	GoDataExpressionLt    = "Lt"
+	GoDataExpressionLe    = "Le"
+	GoDataExpressionHas   = "Has"
+	GoDataExpressionIn    = "In"
+	GoDataExpressionNeg   = "Neg"
+	GoDataExpressionAdd   = "Add"
+	GoDataExpressionSub   = "Sub"
+	GoDataExpressionMul   = "Mul"
+	GoDataExpressionDiv   = "Div"
+	GoDataExpressionDivBy = "DivBy"
+	GoDataExpressionMod   = "Mod"
+
+	// other dynamic expressions
+	GoDataExpressionApply                   = "Apply"
+	GoDataExpressionCast                    = "Cast"
+	GoDataExpressionCollection              = "Collection"
+	GoDataExpressionIf                      = "If"
+	GoDataExpressionIsOf                    = "IsOf"
+	GoDataExpressionLabeledElement          = "LabeledElement"
+	GoDataExpressionLabeledElementReference = "LabeledElementReference"
+	GoDataExpressionNull                    = "Null"
+	GoDataExpressionRecord                  = "Record"
+	GoDataExpressionUrlRef                  = "UrlRef"
+)
+
+// The expressions whose value is a string in CSDL XML, which can also be
+// written as an attribute of an annotation or a property value, e.g.
+// <Annotation Term="Core.Computed" Bool="true" />.
+var inlineExpressionKinds = map[string]bool{
+	GoDataExpressionBinary:                 true,
+	GoDataExpressionBool:                   true,
+	GoDataExpressionDate:                   true,
+	GoDataExpressionDateTimeOffset:         true,
+	GoDataExpressionDecimal:                true,
+	GoDataExpressionDuration:               true,
+	GoDataExpressionEnumMember:             true,
+	GoDataExpressionFloat:                  true,
+	GoDataExpressionGuid:                   true,
+	GoDataExpressionInt:                    true,
+	GoDataExpressionString:                 true,
+	GoDataExpressionTimeOfDay:              true,
+	GoDataExpressionAnnotationPath:         true,
+	GoDataExpressionModelElementPath:       true,
+	GoDataExpressionNavigationPropertyPath: true,
+	GoDataExpressionPropertyPath:           true,
+	GoDataExpressionPath:                   true,
+}
+
+// The expressions with a single operand, which CSDL JSON writes as an object
+// with the operand as the value of the kind, e.g. {"$Not": {"$Path": "A"}}.
+var unaryExpressionKinds = map[string]bool{
+	GoDataExpressionNot:            true,
+	GoDataExpressionNeg:            true,
+	GoDataExpressionCast:           true,
+	GoDataExpressionIsOf:           true,
+	GoDataExpressionLabeledElement: true,
+	GoDataExpressionUrlRef:         true,
+}
+
+// The expressions with a list of operands, which CSDL JSON writes as an
+// object with the array of operands as the value of the kind, e.g.
+// {"$If": [...]}.
+var naryExpressionKinds = map[string]bool{
+	GoDataExpressionAnd:   true,
+	GoDataExpressionOr:    true,
+	GoDataExpressionEq:    true,
+	GoDataExpressionNe:    true,
+	GoDataExpressionGt:    true,
+	GoDataExpressionGe:    true,
+	GoDataExpressionLt:    true,
+	GoDataExpressionLe:    true,
+	GoDataExpressionHas:   true,
+	GoDataExpressionIn:    true,
+	GoDataExpressionAdd:   true,
+	GoDataExpressionSub:   true,
+	GoDataExpressionMul:   true,
+	GoDataExpressionDiv:   true,
+	GoDataExpressionDivBy: true,
+	GoDataExpressionMod:   true,
+	GoDataExpressionApply: true,
+	GoDataExpressionIf:    true,
+}
+
+// The value of an annotation: a constant, e.g. the string of a
+// Core.Description, or a dynamic expression, e.g. the record of a
+// Capabilities.FilterRestrictions or a path evaluated against the annotated
+// instance.
+type GoDataExpression struct {
+	// One of the GoDataExpression kinds.
+	Kind string
+	// The value of a constant, a path or a labeled element reference as it
+	// is written in CSDL XML, e.g. "true", "Address/City" or
+	// "Store.Size/Large".
+	Value string
+	// The items of a collection, or the operands of an operator, an If, an
+	// Apply, a Cast, an IsOf, a LabeledElement or an UrlRef.
+	Items []*GoDataExpression
+	// The qualified type of a record, a Cast or an IsOf.
+	Type string
+	// The property values of a record.
+	PropertyValues []*GoDataPropertyValue
+	// The qualified name of the function of an Apply, e.g. odata.concat.
+	Function string
+	// The name of a LabeledElement.
+	Name string
+}
+
+// A property of a record in an annotation value.
+type GoDataPropertyValue struct {
+	Property string
+	Value    *GoDataExpression
+}
+
+// Build a constant or path expression.
+func NewExpression(kind, value string) *GoDataExpression {
+	return &GoDataExpression{Kind: kind, Value: value}
+}
+
+// Build an operator, an If or another expression of the given operands.
+func NewOperatorExpression(kind string, operands ...*GoDataExpression) *GoDataExpression {
+	return &GoDataExpression{Kind: kind, Items: operands}
+}
+
+// Build the application of a client-side function, e.g. odata.concat.
+func NewApplyExpression(function string, arguments ...*GoDataExpression) *GoDataExpression {
+	return &GoDataExpression{Kind: GoDataExpressionApply, Function: function, Items: arguments}
+}
+
+// Build a collection of expressions.
+func NewCollectionExpression(items ...*GoDataExpression) *GoDataExpression {
+	return &GoDataExpression{Kind: GoDataExpressionCollection, Items: items}
+}
+
+// Build a record with the given property values.
+func NewRecordExpression(values ...*GoDataPropertyValue) *GoDataExpression {
+	return &GoDataExpression{Kind: GoDataExpressionRecord, PropertyValues: values}
+}
+
+// Return the value of a property of a record, or nil if the expression is
+// not a record or has no such property.
+func (e *GoDataExpression) PropertyValue(property string) *GoDataExpression {
+	if e == nil {
+		return nil
+	}
+	for _, value := range e.PropertyValues {
+		if value.Property == property {
+			return value.Value
+		}
+	}
+	return nil
+}
+
+// Return the values of the items of a collection, e.g. the paths of a
+// collection of property paths.
+func (e *GoDataExpression) ItemValues() []string {
+	if e == nil {
+		return nil
+	}
+	values := make([]string, 0, len(e.Items))
+	for _, item := range e.Items {
+		values = append(values, item.Value)
+	}
+	return values
+}
+
+// The value of a Bool constant.
+func (e *GoDataExpression) BoolValue() (bool, error) {
+	if e == nil || e.Kind != GoDataExpressionBool {
+		return false, errors.New("The expression is not a Bool constant.")
+	}
+	return strconv.ParseBool(e.Value)
+}
+
+// The value of an Int constant.
+func (e *GoDataExpression) IntValue() (int64, error) {
+	if e == nil || e.Kind != GoDataExpressionInt {
+		return 0, errors.New("The expression is not an Int constant.")
+	}
+	return strconv.ParseInt(e.Value, 10, 64)
+}
+
+// The value of a Float, Decimal or Int constant.
+func (e *GoDataExpression) FloatValue() (float64, error) {
+	if e == nil || e.Kind != GoDataExpressionFloat && e.Kind != GoDataExpressionDecimal && e.Kind != GoDataExpressionInt {
+		return 0, errors.New("The expression is not a numeric constant.")
+	}
+	return strconv.ParseFloat(e.Value, 64)
+}
+
+// Find the annotation with the given term and qualifier, or nil if there is
+// none. The term must be qualified with the namespace of its vocabulary;
+// use GoDataService.LookupAnnotation to also match terms qualified with an
+// alias.
+func FindAnnotation(annotations []*GoDataAnnotation, term, qualifier string) *GoDataAnnotation {
+	for _, annotation := range annotations {
+		if annotation.Term == term && annotation.Qualifier == qualifier {
+			return annotation
+		}
+	}
+	return nil
+}
+
+func (a *GoDataAnnotation) MarshalXML(enc *xml.Encoder, start xml.StartElement) error {
+	start = xml.StartElement{Name: xml.Name{Local: "Annotation"}}
+	start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "Term"}, Value: a.Term})
+	if a.Qualifier != "" {
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "Qualifier"}, Value: a.Qualifier})
+	}
+	return marshalExpressionHolder(enc, start, a.Value)
+}
+
+func (a *GoDataAnnotation) UnmarshalXML(dec *xml.Decoder, start xml.StartElement) error {
+	a.XMLName = start.Name
+	for _, attr := range start.Attr {
+		switch attr.Name.Local {
+		case "Term":
+			a.Term = attr.Value
+		case "Qualifier":
+			a.Qualifier = attr.Value
+		}
+	}
+	value, err := unmarshalExpressionHolder(dec, start)
+	a.Value = value
+	return err
+}
+
+func (v *GoDataPropertyValue) MarshalXML(enc *xml.Encoder, start xml.StartElement) error {
+	start = xml.StartElement{Name: xml.Name{Local: "PropertyValue"}}
+	start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "Property"}, Value: v.Property})
+	return marshalExpressionHolder(enc, start, v.Value)
+}
+
+func (v *GoDataPropertyValue) UnmarshalXML(dec *xml.Decoder, start xml.StartElement) error {
+	for _, attr := range start.Attr {
+		if attr.Name.Local == "Property" {
+			v.Property = attr.Value
+		}
+	}
+	value, err := unmarshalExpressionHolder(dec, start)
+	v.Value = value
+	return err
+}
+
+func (e *GoDataExpression) MarshalXML(enc *xml.Encoder, start xml.StartElement) error {
+	start = xml.StartElement{Name: xml.Name{Local: e.Kind}}
+	attr := func(name, value string) {
+		if value != "" {
+			start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: name}, Value: value})
+		}
+	}
+	attr("Type", e.Type)
+	attr("Function", e.Function)
+	attr("Name", e.Name)
+
+	if inlineExpressionKinds[e.Kind] || e.Kind == GoDataExpressionLabeledElementReference {
+		return enc.EncodeElement(e.Value, start)
+	}
+
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+	for _, value := range e.PropertyValues {
+		if err := enc.Encode(value); err != nil {
+			return err
+		}
+	}
+	for _, item := range e.Items {
+		if err := enc.Encode(item); err != nil {
+			return err
+		}
+	}
+	return enc.EncodeToken(start.End())
+}
+
+func (e *GoDataExpression) UnmarshalXML(dec *xml.Decoder, start xml.StartElement) error {
+	e.Kind = start.Name.Local
+	for _, attr := range start.Attr {
+		switch attr.Name.Local {
+		case "Type":
+			e.Type = attr.Value
+		case "Function":
+			e.Function = attr.Value
+		case "Name":
+			e.Name = attr.Value
+		default:
+			// e.g. <LabeledElement Name="Size" Int="4" />
+			if inlineExpressionKinds[attr.Name.Local] {
+				e.Items = append(e.Items, NewExpression(attr.Name.Local, attr.Value))
+			}
+		}
+	}
+
+	text := ""
+	for {
+		token, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			if t.Name.Local == "Annotation" {
+				// annotations of the expression are not kept
+				if err := dec.Skip(); err != nil {
+					return err
+				}
+			} else if t.Name.Local == "PropertyValue" {
+				value := &GoDataPropertyValue{}
+				if err := dec.DecodeElement(value, &t); err != nil {
+					return err
+				}
+				e.PropertyValues = append(e.PropertyValues, value)
+			} else {
+				item := &GoDataExpression{}
+				if err := dec.DecodeElement(item, &t); err != nil {
+					return err
+				}
+				e.Items = append(e.Items, item)
+			}
+		case xml.CharData:
+			text += string(t)
+		case xml.EndElement:
+			e.Value = strings.TrimSpace(text)
+			return nil
+		}
+	}
+}
+
+// Write an annotation or a property value, whose value is either an
+// attribute or a child element.
+func marshalExpressionHolder(enc *xml.Encoder, start xml.StartElement, value *GoDataExpression) error {
+	if value != nil && inlineExpressionKinds[value.Kind] {
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: value.Kind}, Value: value.Value})
+		value = nil
+	}
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+	if value != nil {
+		if err := enc.Encode(value); err != nil {
+			return err
+		}
+	}
+	return enc.EncodeToken(start.End())
+}
+
+// Read the value of an annotation or a property value from either its
+// attributes or its first child element other than an annotation.
+func unmarshalExpressionHolder(dec *xml.Decoder, start xml.StartElement) (*GoDataExpression, error) {
+	var value *GoDataExpression
+	for _, attr := range start.Attr {
+		if inlineExpressionKinds[attr.Name.Local] {
+			value = NewExpression(attr.Name.Local, attr.Value)
+		}
+	}
+
+	for {
+		token, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			if t.Name.Local == "Annotation" || value != nil {
+				if err := dec.Skip(); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			value = &GoDataExpression{}
+			if err := dec.DecodeElement(value, &t); err != nil {
+				return nil, err
+			}
+		case xml.EndElement:
+			return value, nil
+		}
+	}
+}
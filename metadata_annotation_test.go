@@ -0,0 +1,174 @@
+package godata
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+const testAnnotationDocument = `<?xml version="1.0" encoding="utf-8"?>
+<edmx:Edmx Version="4.0" xmlns:edmx="http://docs.oasis-open.org/odata/ns/edmx">
+  <edmx:Reference Uri="https://oasis-tcs.github.io/odata-vocabularies/vocabularies/Org.OData.Core.V1.xml">
+    <edmx:Include Namespace="Org.OData.Core.V1" Alias="Core" />
+  </edmx:Reference>
+  <edmx:DataServices>
+    <Schema Namespace="Store" Alias="self" xmlns="http://docs.oasis-open.org/odata/ns/edm">
+      <EntityType Name="Customer">
+        <Key>
+          <PropertyRef Name="Id" />
+        </Key>
+        <Property Name="Id" Type="Edm.Int32" Nullable="false">
+          <Annotation Term="Core.Computed" Bool="true" />
+        </Property>
+        <Property Name="Name" Type="Edm.String">
+          <Annotation Term="Core.Description" String="The full name" />
+          <Annotation Term="Core.Description" Qualifier="Short">
+            <String>Name</String>
+          </Annotation>
+        </Property>
+        <Annotation Term="self.Display">
+          <Record Type="self.DisplayType">
+            <PropertyValue Property="Order" Int="3" />
+            <PropertyValue Property="Weight" Float="2.5" />
+            <PropertyValue Property="Title">
+              <If>
+                <Gt>
+                  <Path>Age</Path>
+                  <Int>17</Int>
+                </Gt>
+                <Apply Function="odata.concat">
+                  <String>Adult </String>
+                  <Path>Name</Path>
+                </Apply>
+                <Null />
+              </If>
+            </PropertyValue>
+            <PropertyValue Property="Columns">
+              <Collection>
+                <PropertyPath>Name</PropertyPath>
+                <Cast Type="Edm.String">
+                  <Path>Id</Path>
+                </Cast>
+                <LabeledElement Name="Fallback" String="unknown" />
+                <Not>
+                  <Bool>false</Bool>
+                </Not>
+              </Collection>
+            </PropertyValue>
+          </Record>
+        </Annotation>
+      </EntityType>
+      <Annotations Target="self.Customer/Name">
+        <Annotation Term="Core.Immutable" Bool="true" />
+      </Annotations>
+    </Schema>
+  </edmx:DataServices>
+</edmx:Edmx>`
+
+func TestAnnotationExpressions(t *testing.T) {
+	metadata, err := ParseMetadata(bytes.NewReader([]byte(testAnnotationDocument)))
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	customer := metadata.DataServices.Schemas[0].EntityTypes[0]
+	id, name := customer.Properties[0], customer.Properties[1]
+	if computed, err := id.Annotations[0].Value.BoolValue(); err != nil || !computed {
+		t.Error("Core.Computed not parsed", err)
+	}
+	if name.Annotations[0].Value.Value != "The full name" || name.Annotations[1].Value.Kind != GoDataExpressionString {
+		t.Error("Core.Description not parsed")
+	}
+
+	record := customer.Annotations[0].Value
+	if record.Kind != GoDataExpressionRecord || record.Type != "self.DisplayType" {
+		t.Error("Record not parsed")
+		return
+	}
+	if order, err := record.PropertyValue("Order").IntValue(); err != nil || order != 3 {
+		t.Error("Int property value not parsed", err)
+	}
+	if weight, err := record.PropertyValue("Weight").FloatValue(); err != nil || weight != 2.5 {
+		t.Error("Float property value not parsed", err)
+	}
+	title := record.PropertyValue("Title")
+	if title.Kind != GoDataExpressionIf || len(title.Items) != 3 || title.Items[0].Kind != GoDataExpressionGt ||
+		title.Items[1].Function != "odata.concat" || title.Items[2].Kind != GoDataExpressionNull {
+		t.Error("If not parsed")
+	}
+	columns := record.PropertyValue("Columns").Items
+	if len(columns) != 4 || columns[1].Type != "Edm.String" || columns[2].Name != "Fallback" ||
+		columns[2].Items[0].Value != "unknown" || columns[3].Items[0].Kind != GoDataExpressionBool {
+		t.Error("Collection not parsed")
+	}
+
+	// the annotations survive a round trip through both CSDL formats
+	xmlBytes, err := metadata.Bytes()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	fromXml, err := ParseMetadata(bytes.NewReader(xmlBytes))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	jsonBytes, err := metadata.Json()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	fromJson, err := ParseMetadataJson(bytes.NewReader(jsonBytes))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for format, parsed := range map[string]*GoDataMetadata{"XML": fromXml, "JSON": fromJson} {
+		parsedCustomer := parsed.DataServices.Schemas[0].EntityTypes[0]
+		if !reflect.DeepEqual(parsedCustomer.Annotations[0].Value, record) {
+			t.Error("Record changed by a round trip through CSDL " + format)
+		}
+		for i, annotation := range parsedCustomer.Properties[1].Annotations {
+			original := name.Annotations[i]
+			if annotation.Term != original.Term || annotation.Qualifier != original.Qualifier ||
+				!reflect.DeepEqual(annotation.Value, original.Value) {
+				t.Error("Property annotations changed by a round trip through CSDL " + format)
+			}
+		}
+	}
+}
+
+func TestLookupAnnotation(t *testing.T) {
+	metadata, err := ParseMetadata(bytes.NewReader([]byte(testAnnotationDocument)))
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	service, err := BuildService(&builtProvider{metadata}, "http://localhost")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	short := service.LookupAnnotation("Store.Customer/Name", "Org.OData.Core.V1.Description", "Short")
+	if short == nil || short.Value.Value != "Name" {
+		t.Error("Qualified annotation not found")
+	}
+	if service.LookupAnnotation("self.Customer/Name", "Core.Immutable", "") == nil {
+		t.Error("External annotation not found")
+	}
+	if service.LookupAnnotation("Store.Customer", "Store.Display", "") == nil {
+		t.Error("Annotation of the entity type not found")
+	}
+	if service.LookupAnnotation("Store.Customer/Id", "Core.Description", "") != nil {
+		t.Error("Found an annotation the property does not have")
+	}
+	if len(service.LookupAnnotations("Store.Customer/Name")) != 3 {
+		t.Error("Expected 3 annotations of Name")
+	}
+}
@@ -0,0 +1,1221 @@
+package godata
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Serialize the metadata as a CSDL JSON document, the JSON representation of
+// CSDL defined by OData 4.01. It is generated from the same tree as the XML
+// returned by Bytes().
+func (t *GoDataMetadata) Json() ([]byte, error) {
+	root := &csdlObject{}
+
+	version := t.Version
+	if version == "" {
+		version = "4.01"
+	}
+	root.Set("$Version", version)
+
+	if t.DataServices != nil {
+		for _, schema := range t.DataServices.Schemas {
+			if len(schema.EntityContainers) > 0 {
+				root.Set("$EntityContainer", schema.Namespace+"."+schema.EntityContainers[0].Name)
+				break
+			}
+		}
+	}
+
+	if len(t.References) > 0 {
+		references := &csdlObject{}
+		for _, ref := range t.References {
+			references.Set(ref.Uri, csdlReference(ref))
+		}
+		root.Set("$Reference", references)
+	}
+
+	if t.DataServices != nil {
+		for _, schema := range t.DataServices.Schemas {
+			root.Set(schema.Namespace, csdlSchema(schema))
+		}
+	}
+
+	return json.MarshalIndent(root, "", "    ")
+}
+
+// Parse a CSDL JSON document into a GoDataMetadata tree, so a service can be
+// defined in either CSDL representation.
+func ParseMetadataJson(r io.Reader) (*GoDataMetadata, error) {
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+
+	value, err := decodeCsdlValue(decoder)
+	if err != nil {
+		return nil, errors.New("Invalid CSDL JSON document: " + err.Error())
+	}
+	root, ok := value.(*csdlObject)
+	if !ok {
+		return nil, errors.New("Invalid CSDL JSON document: expected an object.")
+	}
+
+	metadata := &GoDataMetadata{
+		XMLNamespace: EdmxNamespace,
+		Version:      root.String("$Version"),
+		DataServices: &GoDataServices{},
+	}
+
+	if references, ok := root.Get("$Reference").(*csdlObject); ok {
+		for _, uri := range references.Keys {
+			ref, ok := references.Values[uri].(*csdlObject)
+			if !ok {
+				return nil, errors.New("Invalid CSDL JSON document: reference " + uri + " is not an object.")
+			}
+			metadata.References = append(metadata.References, parseCsdlReference(uri, ref))
+		}
+	}
+
+	for _, key := range root.Keys {
+		if strings.HasPrefix(key, "$") || strings.HasPrefix(key, "@") {
+			continue
+		}
+		obj, ok := root.Values[key].(*csdlObject)
+		if !ok {
+			return nil, errors.New("Invalid CSDL JSON document: schema " + key + " is not an object.")
+		}
+		schema, err := parseCsdlSchema(key, obj)
+		if err != nil {
+			return nil, err
+		}
+		metadata.DataServices.Schemas = append(metadata.DataServices.Schemas, schema)
+	}
+
+	return metadata, nil
+}
+
+// An object in a CSDL JSON document. CSDL JSON relies on the order of object
+// members, e.g. for the order of properties, so documents are built from
+// ordered objects instead of maps.
+type csdlObject struct {
+	Keys   []string
+	Values map[string]interface{}
+}
+
+func (o *csdlObject) Set(key string, value interface{}) {
+	if o.Values == nil {
+		o.Values = map[string]interface{}{}
+	}
+	if _, ok := o.Values[key]; !ok {
+		o.Keys = append(o.Keys, key)
+	}
+	o.Values[key] = value
+}
+
+func (o *csdlObject) Get(key string) interface{} {
+	return o.Values[key]
+}
+
+// Return a string member, or an empty string if it is missing.
+func (o *csdlObject) String(key string) string {
+	s, _ := o.Values[key].(string)
+	return s
+}
+
+// Return a boolean member as the "true"/"false" strings used by the XML
+// model, or an empty string if it is missing.
+func (o *csdlObject) Bool(key string) string {
+	if b, ok := o.Values[key].(bool); ok {
+		return strconv.FormatBool(b)
+	}
+	return ""
+}
+
+// Return a member that is either a number or a symbolic string value, such
+// as the "variable" scale, as a string.
+func (o *csdlObject) Facet(key string) string {
+	switch v := o.Values[key].(type) {
+	case json.Number:
+		return v.String()
+	case string:
+		return v
+	}
+	return ""
+}
+
+func (o *csdlObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range o.Keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		v, err := json.Marshal(o.Values[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// Decode the next JSON value from the decoder, keeping the member order of
+// objects.
+func decodeCsdlValue(decoder *json.Decoder) (interface{}, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch token {
+	case json.Delim('{'):
+		obj := &csdlObject{}
+		for decoder.More() {
+			key, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := decodeCsdlValue(decoder)
+			if err != nil {
+				return nil, err
+			}
+			obj.Set(key.(string), value)
+		}
+		// consume the closing brace
+		if _, err := decoder.Token(); err != nil {
+			return nil, err
+		}
+		return obj, nil
+	case json.Delim('['):
+		list := []interface{}{}
+		for decoder.More() {
+			value, err := decodeCsdlValue(decoder)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		if _, err := decoder.Token(); err != nil {
+			return nil, err
+		}
+		return list, nil
+	}
+
+	return token, nil
+}
+
+func csdlReference(ref *GoDataReference) *csdlObject {
+	obj := &csdlObject{}
+	if len(ref.Includes) > 0 {
+		includes := []interface{}{}
+		for _, include := range ref.Includes {
+			i := &csdlObject{}
+			i.Set("$Namespace", include.Namespace)
+			if include.Alias != "" {
+				i.Set("$Alias", include.Alias)
+			}
+			includes = append(includes, i)
+		}
+		obj.Set("$Include", includes)
+	}
+	if len(ref.IncludeAnnotations) > 0 {
+		includes := []interface{}{}
+		for _, include := range ref.IncludeAnnotations {
+			i := &csdlObject{}
+			i.Set("$TermNamespace", include.TermNamespace)
+			if include.Qualifier != "" {
+				i.Set("$Qualifier", include.Qualifier)
+			}
+			if include.TargetNamespace != "" {
+				i.Set("$TargetNamespace", include.TargetNamespace)
+			}
+			includes = append(includes, i)
+		}
+		obj.Set("$IncludeAnnotations", includes)
+	}
+	csdlAnnotations(obj, "", ref.Annotations)
+	return obj
+}
+
+func csdlSchema(schema *GoDataSchema) *csdlObject {
+	obj := &csdlObject{}
+	if schema.Alias != "" {
+		obj.Set("$Alias", schema.Alias)
+	}
+	csdlAnnotations(obj, "", schema.Annotation)
+
+	for _, t := range schema.EntityTypes {
+		obj.Set(t.Name, csdlEntityType(t))
+	}
+	for _, t := range schema.ComplexTypes {
+		obj.Set(t.Name, csdlComplexType(t))
+	}
+	for _, t := range schema.EnumTypes {
+		obj.Set(t.Name, csdlEnumType(t))
+	}
+	for _, t := range schema.TypeDefinitions {
+		obj.Set(t.Name, csdlTypeDefinition(t))
+	}
+	for _, t := range schema.Terms {
+		obj.Set(t.Name, csdlTerm(t))
+	}
+
+	// actions and functions are arrays of their overloads
+	for _, action := range schema.Actions {
+		overloads, _ := obj.Get(action.Name).([]interface{})
+		obj.Set(action.Name, append(overloads, csdlAction(action)))
+	}
+	for _, function := range schema.Functions {
+		overloads, _ := obj.Get(function.Name).([]interface{})
+		obj.Set(function.Name, append(overloads, csdlFunction(function)))
+	}
+
+	for _, container := range schema.EntityContainers {
+		obj.Set(container.Name, csdlEntityContainer(container))
+	}
+
+	if len(schema.Annotations) > 0 {
+		targets := &csdlObject{}
+		for _, annotations := range schema.Annotations {
+			target, ok := targets.Get(annotations.Target).(*csdlObject)
+			if !ok {
+				target = &csdlObject{}
+			}
+			for _, annotation := range annotations.Annotations {
+				qualified := *annotation
+				if qualified.Qualifier == "" {
+					qualified.Qualifier = annotations.Qualifier
+				}
+				target.Set(csdlAnnotationKey("", &qualified), csdlAnnotationValue(&qualified))
+			}
+			targets.Set(annotations.Target, target)
+		}
+		obj.Set("$Annotations", targets)
+	}
+
+	return obj
+}
+
+func csdlEntityType(t *GoDataEntityType) *csdlObject {
+	obj := &csdlObject{}
+	obj.Set("$Kind", "EntityType")
+	if t.BaseType != "" {
+		obj.Set("$BaseType", t.BaseType)
+	}
+	csdlBool(obj, "$Abstract", t.Abstract)
+	csdlBool(obj, "$OpenType", t.OpenType)
+	csdlBool(obj, "$HasStream", t.HasStream)
+	if len(t.Key.Refs()) > 0 {
+		key := []interface{}{}
+		for _, ref := range t.Key.Refs() {
+			if ref.Alias != "" {
+				alias := &csdlObject{}
+				alias.Set(ref.Alias, ref.Name)
+				key = append(key, alias)
+			} else {
+				key = append(key, ref.Name)
+			}
+		}
+		obj.Set("$Key", key)
+	}
+	for _, prop := range t.Properties {
+		obj.Set(prop.Name, csdlProperty(prop))
+	}
+	for _, prop := range t.NavigationProperties {
+		obj.Set(prop.Name, csdlNavigationProperty(prop))
+	}
+	csdlAnnotations(obj, "", t.Annotations)
+	return obj
+}
+
+func csdlComplexType(t *GoDataComplexType) *csdlObject {
+	obj := &csdlObject{}
+	obj.Set("$Kind", "ComplexType")
+	if t.BaseType != "" {
+		obj.Set("$BaseType", t.BaseType)
+	}
+	csdlBool(obj, "$Abstract", t.Abstract)
+	csdlBool(obj, "$OpenType", t.OpenType)
+	for _, prop := range t.Properties {
+		obj.Set(prop.Name, csdlProperty(prop))
+	}
+	for _, prop := range t.NavigationProperties {
+		obj.Set(prop.Name, csdlNavigationProperty(prop))
+	}
+	csdlAnnotations(obj, "", t.Annotations)
+	return obj
+}
+
+func csdlProperty(prop *GoDataProperty) *csdlObject {
+	obj := &csdlObject{}
+	csdlType(obj, prop.Type)
+	if prop.Nullable != "false" {
+		obj.Set("$Nullable", true)
+	}
+	csdlFacets(obj, prop.MaxLength, prop.Precision, prop.Scale, prop.SRID)
+	if prop.Unicode == "false" {
+		obj.Set("$Unicode", false)
+	}
+	if prop.DefaultValue != "" {
+		obj.Set("$DefaultValue", prop.DefaultValue)
+	}
+	csdlAnnotations(obj, "", prop.Annotations)
+	return obj
+}
+
+func csdlNavigationProperty(prop *GoDataNavigationProperty) *csdlObject {
+	obj := &csdlObject{}
+	obj.Set("$Kind", "NavigationProperty")
+	collection := strings.HasPrefix(prop.Type, "Collection(")
+	if collection {
+		obj.Set("$Collection", true)
+		obj.Set("$Type", strings.TrimSuffix(strings.TrimPrefix(prop.Type, "Collection("), ")"))
+	} else {
+		obj.Set("$Type", prop.Type)
+		if prop.Nullable != "false" {
+			obj.Set("$Nullable", true)
+		}
+	}
+	if prop.Partner != "" {
+		obj.Set("$Partner", prop.Partner)
+	}
+	csdlBool(obj, "$ContainsTarget", prop.ContainsTarget)
+	if len(prop.ReferentialConstraints) > 0 {
+		constraints := &csdlObject{}
+		for _, c := range prop.ReferentialConstraints {
+			constraints.Set(c.Property, c.ReferencedProperty)
+			csdlAnnotations(constraints, c.Property, c.Annotations)
+		}
+		obj.Set("$ReferentialConstraint", constraints)
+	}
+	if prop.OnDelete != nil {
+		obj.Set("$OnDelete", prop.OnDelete.Action)
+		csdlAnnotations(obj, "$OnDelete", prop.OnDelete.Annotations)
+	}
+	csdlAnnotations(obj, "", prop.Annotations)
+	return obj
+}
+
+func csdlEnumType(t *GoDataEnumType) *csdlObject {
+	obj := &csdlObject{}
+	obj.Set("$Kind", "EnumType")
+	if t.UnderlyingType != "" && t.UnderlyingType != GoDataInt32 {
+		obj.Set("$UnderlyingType", t.UnderlyingType)
+	}
+	csdlBool(obj, "$IsFlags", t.IsFlags)
+	for i, member := range t.Members {
+		// members without a value are numbered by their position
+		value := json.Number(strconv.Itoa(i))
+		if member.Value != "" {
+			value = json.Number(member.Value)
+		}
+		obj.Set(member.Name, value)
+		csdlAnnotations(obj, member.Name, member.Annotations)
+	}
+	csdlAnnotations(obj, "", t.Annotations)
+	return obj
+}
+
+func csdlTypeDefinition(t *GoDataTypeDefinition) *csdlObject {
+	obj := &csdlObject{}
+	obj.Set("$Kind", "TypeDefinition")
+	obj.Set("$UnderlyingType", t.UnderlyingType)
+	csdlFacets(obj, t.MaxLength, t.Precision, t.Scale, t.SRID)
+	if t.Unicode == "false" {
+		obj.Set("$Unicode", false)
+	}
+	csdlAnnotations(obj, "", t.Annotations)
+	return obj
+}
+
+func csdlTerm(t *GoDataTerm) *csdlObject {
+	obj := &csdlObject{}
+	obj.Set("$Kind", "Term")
+	csdlType(obj, t.Type)
+	if t.BaseTerm != "" {
+		obj.Set("$BaseTerm", t.BaseTerm)
+	}
+	if t.Nullable != "false" {
+		obj.Set("$Nullable", true)
+	}
+	csdlFacets(obj, t.MaxLength, t.Precision, t.Scale, t.SRID)
+	if t.DefaultValue != "" {
+		obj.Set("$DefaultValue", t.DefaultValue)
+	}
+	if t.AppliesTo != "" {
+		appliesTo := []interface{}{}
+		for _, target := range strings.Fields(t.AppliesTo) {
+			appliesTo = append(appliesTo, target)
+		}
+		obj.Set("$AppliesTo", appliesTo)
+	}
+	csdlAnnotations(obj, "", t.Annotations)
+	return obj
+}
+
+func csdlAction(action *GoDataAction) *csdlObject {
+	obj := &csdlObject{}
+	obj.Set("$Kind", "Action")
+	csdlBool(obj, "$IsBound", action.IsBound)
+	if action.EntitySetPath != "" {
+		obj.Set("$EntitySetPath", action.EntitySetPath)
+	}
+	csdlOperation(obj, action.Parameters, action.ReturnType)
+	csdlAnnotations(obj, "", action.Annotations)
+	return obj
+}
+
+func csdlFunction(function *GoDataFunction) *csdlObject {
+	obj := &csdlObject{}
+	obj.Set("$Kind", "Function")
+	csdlBool(obj, "$IsBound", function.IsBound)
+	if function.EntitySetPath != "" {
+		obj.Set("$EntitySetPath", function.EntitySetPath)
+	}
+	csdlBool(obj, "$IsComposable", function.IsComposable)
+	csdlOperation(obj, function.Parameters, function.ReturnType)
+	csdlAnnotations(obj, "", function.Annotations)
+	return obj
+}
+
+func csdlOperation(obj *csdlObject, params []*GoDataParameter, returnType *GoDataReturnType) {
+	if len(params) > 0 {
+		list := []interface{}{}
+		for _, param := range params {
+			p := &csdlObject{}
+			p.Set("$Name", param.Name)
+			csdlType(p, param.Type)
+			if param.Nullable != "false" {
+				p.Set("$Nullable", true)
+			}
+			csdlFacets(p, param.MaxLength, param.Precision, param.Scale, param.SRID)
+			csdlAnnotations(p, "", param.Annotations)
+			list = append(list, p)
+		}
+		obj.Set("$Parameter", list)
+	}
+	if returnType != nil {
+		r := &csdlObject{}
+		csdlType(r, returnType.Type)
+		if returnType.Nullable != "false" {
+			r.Set("$Nullable", true)
+		}
+		csdlFacets(r, returnType.MaxLength, returnType.Precision, returnType.Scale, returnType.SRID)
+		csdlAnnotations(r, "", returnType.Annotations)
+		obj.Set("$ReturnType", r)
+	}
+}
+
+func csdlEntityContainer(container *GoDataEntityContainer) *csdlObject {
+	obj := &csdlObject{}
+	obj.Set("$Kind", "EntityContainer")
+	if container.Extends != "" {
+		obj.Set("$Extends", container.Extends)
+	}
+	for _, set := range container.EntitySets {
+		s := &csdlObject{}
+		s.Set("$Collection", true)
+		s.Set("$Type", set.EntityType)
+		if set.IncludeInServiceDocument == "false" {
+			s.Set("$IncludeInServiceDocument", false)
+		}
+		csdlBindings(s, set.NavigationPropertyBindings)
+		csdlAnnotations(s, "", set.Annotations)
+		obj.Set(set.Name, s)
+	}
+	for _, singleton := range container.Singletons {
+		s := &csdlObject{}
+		s.Set("$Type", singleton.Type)
+		csdlBindings(s, singleton.NavigationPropertyBindings)
+		csdlAnnotations(s, "", singleton.Annotations)
+		obj.Set(singleton.Name, s)
+	}
+	for _, imp := range container.ActionImports {
+		s := &csdlObject{}
+		s.Set("$Action", imp.Action)
+		if imp.EntitySet != "" {
+			s.Set("$EntitySet", imp.EntitySet)
+		}
+		csdlAnnotations(s, "", imp.Annotations)
+		obj.Set(imp.Name, s)
+	}
+	for _, imp := range container.FunctionImports {
+		s := &csdlObject{}
+		s.Set("$Function", imp.Function)
+		if imp.EntitySet != "" {
+			s.Set("$EntitySet", imp.EntitySet)
+		}
+		csdlBool(s, "$IncludeInServiceDocument", imp.IncludeInServiceDocument)
+		csdlAnnotations(s, "", imp.Annotations)
+		obj.Set(imp.Name, s)
+	}
+	csdlAnnotations(obj, "", container.Annotations)
+	return obj
+}
+
+func csdlBindings(obj *csdlObject, bindings []*GoDataNavigationPropertyBinding) {
+	if len(bindings) == 0 {
+		return
+	}
+	b := &csdlObject{}
+	for _, binding := range bindings {
+		b.Set(binding.Path, binding.Target)
+	}
+	obj.Set("$NavigationPropertyBinding", b)
+}
+
+// Set the $Type and $Collection members for a type name. Edm.String is the
+// default type and is left out.
+func csdlType(obj *csdlObject, t string) {
+	if strings.HasPrefix(t, "Collection(") {
+		obj.Set("$Collection", true)
+		t = strings.TrimSuffix(strings.TrimPrefix(t, "Collection("), ")")
+	}
+	if t != "" && t != GoDataString {
+		obj.Set("$Type", t)
+	}
+}
+
+// Set a boolean member from a "true"/"false" attribute of the XML model.
+// Members are only written when they differ from the default, false.
+func csdlBool(obj *csdlObject, key, value string) {
+	if value == "true" {
+		obj.Set(key, true)
+	}
+}
+
+func csdlFacets(obj *csdlObject, maxLength string, precision int, scale, srid string) {
+	// the symbolic "max" length is not allowed in CSDL JSON, and is left out
+	if maxLength != "" && maxLength != "max" {
+		obj.Set("$MaxLength", csdlNumberOrString(maxLength))
+	}
+	if precision > 0 {
+		obj.Set("$Precision", precision)
+	}
+	if scale != "" {
+		obj.Set("$Scale", csdlNumberOrString(scale))
+	}
+	if srid != "" {
+		obj.Set("$SRID", csdlNumberOrString(srid))
+	}
+}
+
+func csdlNumberOrString(value string) interface{} {
+	if _, err := strconv.Atoi(value); err == nil {
+		return json.Number(value)
+	}
+	return value
+}
+
+// Add annotations to an object. Annotations of a member of the object, e.g.
+// an enum member, are prefixed with the member name.
+func csdlAnnotations(obj *csdlObject, member string, annotations []*GoDataAnnotation) {
+	for _, annotation := range annotations {
+		obj.Set(csdlAnnotationKey(member, annotation), csdlAnnotationValue(annotation))
+	}
+}
+
+func csdlAnnotationKey(member string, annotation *GoDataAnnotation) string {
+	key := member + "@" + annotation.Term
+	if annotation.Qualifier != "" {
+		key += "#" + annotation.Qualifier
+	}
+	return key
+}
+
+// The value of an annotation in CSDL JSON. Annotations without a value apply
+// the default value of tagging terms, true.
+func csdlAnnotationValue(annotation *GoDataAnnotation) interface{} {
+	if annotation.Value == nil {
+		return true
+	}
+	return csdlExpression(annotation.Value)
+}
+
+func csdlExpression(e *GoDataExpression) interface{} {
+	switch e.Kind {
+	case GoDataExpressionBool:
+		return e.Value == "true"
+	case GoDataExpressionInt, GoDataExpressionFloat, GoDataExpressionDecimal:
+		// INF, -INF and NaN are strings in CSDL JSON
+		if !json.Valid([]byte(e.Value)) {
+			return e.Value
+		}
+		return json.Number(e.Value)
+	case GoDataExpressionNull:
+		return nil
+	case GoDataExpressionCollection:
+		items := []interface{}{}
+		for _, item := range e.Items {
+			items = append(items, csdlExpression(item))
+		}
+		return items
+	case GoDataExpressionRecord:
+		obj := &csdlObject{}
+		if e.Type != "" {
+			obj.Set("@type", "#"+e.Type)
+		}
+		for _, value := range e.PropertyValues {
+			obj.Set(value.Property, csdlExpression(value.Value))
+		}
+		return obj
+	}
+
+	if inlineExpressionKinds[e.Kind] && !strings.HasSuffix(e.Kind, "Path") {
+		// the other constants are strings, e.g. dates and enum members
+		return e.Value
+	}
+
+	// dynamic expressions are objects with a member named after the kind,
+	// e.g. {"$Path": "Name"} or {"$If": [...]}
+	obj := &csdlObject{}
+	switch {
+	case unaryExpressionKinds[e.Kind]:
+		var operand interface{}
+		if len(e.Items) > 0 {
+			operand = csdlExpression(e.Items[0])
+		}
+		obj.Set("$"+e.Kind, operand)
+	case naryExpressionKinds[e.Kind]:
+		operands := []interface{}{}
+		for _, item := range e.Items {
+			operands = append(operands, csdlExpression(item))
+		}
+		obj.Set("$"+e.Kind, operands)
+	default:
+		obj.Set("$"+e.Kind, e.Value)
+	}
+	if e.Function != "" {
+		obj.Set("$Function", e.Function)
+	}
+	if e.Type != "" {
+		obj.Set("$Type", e.Type)
+	}
+	if e.Name != "" {
+		obj.Set("$Name", e.Name)
+	}
+	return obj
+}
+
+// Read an annotation value from CSDL JSON. Strings are read as string
+// constants and numbers as Int or Float constants, since the other constants
+// can only be told apart by the type of the term.
+func parseCsdlExpression(value interface{}) *GoDataExpression {
+	switch v := value.(type) {
+	case bool:
+		return NewExpression(GoDataExpressionBool, strconv.FormatBool(v))
+	case json.Number:
+		if strings.ContainsAny(v.String(), ".eE") {
+			return NewExpression(GoDataExpressionFloat, v.String())
+		}
+		return NewExpression(GoDataExpressionInt, v.String())
+	case string:
+		return NewExpression(GoDataExpressionString, v)
+	case nil:
+		return NewExpression(GoDataExpressionNull, "")
+	case []interface{}:
+		collection := NewCollectionExpression()
+		for _, item := range v {
+			collection.Items = append(collection.Items, parseCsdlExpression(item))
+		}
+		return collection
+	case *csdlObject:
+		for _, key := range v.Keys {
+			kind := strings.TrimPrefix(key, "$")
+			if !strings.HasPrefix(key, "$") || key == "$Function" || key == "$Type" || key == "$Name" {
+				continue
+			}
+			e := &GoDataExpression{
+				Kind:     kind,
+				Function: v.String("$Function"),
+				Type:     v.String("$Type"),
+				Name:     v.String("$Name"),
+			}
+			switch operand := v.Values[key].(type) {
+			case string:
+				if !unaryExpressionKinds[kind] {
+					e.Value = operand
+					return e
+				}
+				e.Items = []*GoDataExpression{parseCsdlExpression(operand)}
+			case []interface{}:
+				if naryExpressionKinds[kind] {
+					for _, item := range operand {
+						e.Items = append(e.Items, parseCsdlExpression(item))
+					}
+					return e
+				}
+				e.Items = []*GoDataExpression{parseCsdlExpression(operand)}
+			default:
+				e.Items = []*GoDataExpression{parseCsdlExpression(operand)}
+			}
+			return e
+		}
+		record := NewRecordExpression()
+		record.Type = strings.TrimPrefix(v.String("@type"), "#")
+		for _, key := range v.Keys {
+			if strings.Contains(key, "@") {
+				continue
+			}
+			record.PropertyValues = append(record.PropertyValues,
+				&GoDataPropertyValue{Property: key, Value: parseCsdlExpression(v.Values[key])})
+		}
+		return record
+	}
+	return nil
+}
+
+func parseCsdlReference(uri string, obj *csdlObject) *GoDataReference {
+	ref := &GoDataReference{Uri: uri}
+	includes, _ := obj.Get("$Include").([]interface{})
+	for _, i := range includes {
+		if include, ok := i.(*csdlObject); ok {
+			ref.Includes = append(ref.Includes, &GoDataInclude{
+				Namespace: include.String("$Namespace"),
+				Alias:     include.String("$Alias"),
+			})
+		}
+	}
+	includeAnnotations, _ := obj.Get("$IncludeAnnotations").([]interface{})
+	for _, i := range includeAnnotations {
+		if include, ok := i.(*csdlObject); ok {
+			ref.IncludeAnnotations = append(ref.IncludeAnnotations, &GoDataIncludeAnnotations{
+				TermNamespace:   include.String("$TermNamespace"),
+				Qualifier:       include.String("$Qualifier"),
+				TargetNamespace: include.String("$TargetNamespace"),
+			})
+		}
+	}
+	ref.Annotations = parseCsdlAnnotations(obj, "")
+	return ref
+}
+
+func parseCsdlSchema(namespace string, obj *csdlObject) (*GoDataSchema, error) {
+	schema := &GoDataSchema{
+		XMLNamespace: EdmNamespace,
+		Namespace:    namespace,
+		Alias:        obj.String("$Alias"),
+		Annotation:   parseCsdlAnnotations(obj, ""),
+	}
+
+	for _, name := range obj.Keys {
+		if strings.HasPrefix(name, "$") || strings.Contains(name, "@") {
+			continue
+		}
+
+		switch value := obj.Values[name].(type) {
+		case []interface{}:
+			// overloads of an action or function
+			for _, o := range value {
+				overload, ok := o.(*csdlObject)
+				if !ok {
+					return nil, errors.New("Invalid CSDL JSON document: overload of " + name + " is not an object.")
+				}
+				switch overload.String("$Kind") {
+				case "Action":
+					schema.Actions = append(schema.Actions, parseCsdlAction(name, overload))
+				case "Function":
+					schema.Functions = append(schema.Functions, parseCsdlFunction(name, overload))
+				default:
+					return nil, errors.New("Invalid CSDL JSON document: " + name + " is not an action or function.")
+				}
+			}
+		case *csdlObject:
+			switch value.String("$Kind") {
+			case "EntityType":
+				schema.EntityTypes = append(schema.EntityTypes, parseCsdlEntityType(name, value))
+			case "ComplexType":
+				schema.ComplexTypes = append(schema.ComplexTypes, parseCsdlComplexType(name, value))
+			case "EnumType":
+				schema.EnumTypes = append(schema.EnumTypes, parseCsdlEnumType(name, value))
+			case "TypeDefinition":
+				schema.TypeDefinitions = append(schema.TypeDefinitions, parseCsdlTypeDefinition(name, value))
+			case "Term":
+				schema.Terms = append(schema.Terms, parseCsdlTerm(name, value))
+			case "EntityContainer":
+				schema.EntityContainers = append(schema.EntityContainers, parseCsdlEntityContainer(name, value))
+			default:
+				return nil, errors.New("Invalid CSDL JSON document: unknown kind of schema element " + name + ".")
+			}
+		default:
+			return nil, errors.New("Invalid CSDL JSON document: schema element " + name + " is not an object.")
+		}
+	}
+
+	if targets, ok := obj.Get("$Annotations").(*csdlObject); ok {
+		for _, target := range targets.Keys {
+			annotations, ok := targets.Values[target].(*csdlObject)
+			if !ok {
+				continue
+			}
+			schema.Annotations = append(schema.Annotations, &GoDataAnnotations{
+				Target:      target,
+				Annotations: parseCsdlAnnotations(annotations, ""),
+			})
+		}
+	}
+
+	return schema, nil
+}
+
+// Return the names of the members of a structured type or container that
+// are not keywords or annotations.
+func csdlMembers(obj *csdlObject) []string {
+	members := []string{}
+	for _, key := range obj.Keys {
+		if !strings.HasPrefix(key, "$") && !strings.Contains(key, "@") {
+			members = append(members, key)
+		}
+	}
+	return members
+}
+
+func parseCsdlEntityType(name string, obj *csdlObject) *GoDataEntityType {
+	t := &GoDataEntityType{
+		Name:        name,
+		BaseType:    obj.String("$BaseType"),
+		Abstract:    obj.Bool("$Abstract"),
+		OpenType:    obj.Bool("$OpenType"),
+		HasStream:   obj.Bool("$HasStream"),
+		Annotations: parseCsdlAnnotations(obj, ""),
+	}
+
+	if key, ok := obj.Get("$Key").([]interface{}); ok {
+		t.Key = &GoDataKey{}
+		for _, k := range key {
+			switch ref := k.(type) {
+			case string:
+				t.Key.PropertyRefs = append(t.Key.PropertyRefs, &GoDataPropertyRef{Name: ref})
+			case *csdlObject:
+				for _, alias := range ref.Keys {
+					t.Key.PropertyRefs = append(t.Key.PropertyRefs, &GoDataPropertyRef{
+						Name:  ref.String(alias),
+						Alias: alias,
+					})
+				}
+			}
+		}
+	}
+
+	t.Properties, t.NavigationProperties = parseCsdlProperties(obj)
+	return t
+}
+
+func parseCsdlComplexType(name string, obj *csdlObject) *GoDataComplexType {
+	t := &GoDataComplexType{
+		Name:        name,
+		BaseType:    obj.String("$BaseType"),
+		Abstract:    obj.Bool("$Abstract"),
+		OpenType:    obj.Bool("$OpenType"),
+		Annotations: parseCsdlAnnotations(obj, ""),
+	}
+	t.Properties, t.NavigationProperties = parseCsdlProperties(obj)
+	return t
+}
+
+func parseCsdlProperties(obj *csdlObject) ([]*GoDataProperty, []*GoDataNavigationProperty) {
+	props := []*GoDataProperty{}
+	navProps := []*GoDataNavigationProperty{}
+
+	for _, name := range csdlMembers(obj) {
+		p, ok := obj.Values[name].(*csdlObject)
+		if !ok {
+			continue
+		}
+		// annotations of a member may also be written next to it
+		annotations := append(parseCsdlAnnotations(obj, name), parseCsdlAnnotations(p, "")...)
+
+		if p.String("$Kind") == "NavigationProperty" {
+			navProp := &GoDataNavigationProperty{
+				Name:           name,
+				Type:           parseCsdlType(p),
+				Partner:        p.String("$Partner"),
+				ContainsTarget: p.Bool("$ContainsTarget"),
+				Annotations:    annotations,
+			}
+			if !strings.HasPrefix(navProp.Type, "Collection(") {
+				navProp.Nullable = parseCsdlNullable(p)
+			}
+			if constraints, ok := p.Get("$ReferentialConstraint").(*csdlObject); ok {
+				for _, prop := range csdlMembers(constraints) {
+					navProp.ReferentialConstraints = append(navProp.ReferentialConstraints,
+						&GoDataReferentialConstraint{
+							Property:           prop,
+							ReferencedProperty: constraints.String(prop),
+							Annotations:        parseCsdlAnnotations(constraints, prop),
+						})
+				}
+			}
+			if onDelete := p.String("$OnDelete"); onDelete != "" {
+				navProp.OnDelete = &GoDataOnDelete{
+					Action:      onDelete,
+					Annotations: parseCsdlAnnotations(p, "$OnDelete"),
+				}
+			}
+			navProps = append(navProps, navProp)
+		} else {
+			props = append(props, &GoDataProperty{
+				Name:         name,
+				Type:         parseCsdlType(p),
+				Nullable:     parseCsdlNullable(p),
+				MaxLength:    p.Facet("$MaxLength"),
+				Precision:    parseCsdlPrecision(p),
+				Scale:        p.Facet("$Scale"),
+				Unicode:      p.Bool("$Unicode"),
+				SRID:         p.Facet("$SRID"),
+				DefaultValue: p.String("$DefaultValue"),
+				Annotations:  annotations,
+			})
+		}
+	}
+
+	return props, navProps
+}
+
+func parseCsdlEnumType(name string, obj *csdlObject) *GoDataEnumType {
+	t := &GoDataEnumType{
+		Name:           name,
+		UnderlyingType: obj.String("$UnderlyingType"),
+		IsFlags:        obj.Bool("$IsFlags"),
+		Annotations:    parseCsdlAnnotations(obj, ""),
+	}
+	for _, member := range csdlMembers(obj) {
+		t.Members = append(t.Members, &GoDataMember{
+			Name:        member,
+			Value:       obj.Facet(member),
+			Annotations: parseCsdlAnnotations(obj, member),
+		})
+	}
+	return t
+}
+
+func parseCsdlTypeDefinition(name string, obj *csdlObject) *GoDataTypeDefinition {
+	return &GoDataTypeDefinition{
+		Name:           name,
+		UnderlyingType: obj.String("$UnderlyingType"),
+		MaxLength:      obj.Facet("$MaxLength"),
+		Precision:      parseCsdlPrecision(obj),
+		Scale:          obj.Facet("$Scale"),
+		Unicode:        obj.Bool("$Unicode"),
+		SRID:           obj.Facet("$SRID"),
+		Annotations:    parseCsdlAnnotations(obj, ""),
+	}
+}
+
+func parseCsdlTerm(name string, obj *csdlObject) *GoDataTerm {
+	t := &GoDataTerm{
+		Name:         name,
+		Type:         parseCsdlType(obj),
+		BaseTerm:     obj.String("$BaseTerm"),
+		DefaultValue: obj.String("$DefaultValue"),
+		Nullable:     parseCsdlNullable(obj),
+		MaxLength:    obj.Facet("$MaxLength"),
+		Precision:    parseCsdlPrecision(obj),
+		Scale:        obj.Facet("$Scale"),
+		SRID:         obj.Facet("$SRID"),
+		Annotations:  parseCsdlAnnotations(obj, ""),
+	}
+	if appliesTo, ok := obj.Get("$AppliesTo").([]interface{}); ok {
+		targets := []string{}
+		for _, target := range appliesTo {
+			if s, ok := target.(string); ok {
+				targets = append(targets, s)
+			}
+		}
+		t.AppliesTo = strings.Join(targets, " ")
+	}
+	return t
+}
+
+func parseCsdlAction(name string, obj *csdlObject) *GoDataAction {
+	action := &GoDataAction{
+		Name:          name,
+		IsBound:       obj.Bool("$IsBound"),
+		EntitySetPath: obj.String("$EntitySetPath"),
+		Annotations:   parseCsdlAnnotations(obj, ""),
+	}
+	action.Parameters, action.ReturnType = parseCsdlOperation(obj)
+	return action
+}
+
+func parseCsdlFunction(name string, obj *csdlObject) *GoDataFunction {
+	function := &GoDataFunction{
+		Name:          name,
+		IsBound:       obj.Bool("$IsBound"),
+		IsComposable:  obj.Bool("$IsComposable"),
+		EntitySetPath: obj.String("$EntitySetPath"),
+		Annotations:   parseCsdlAnnotations(obj, ""),
+	}
+	function.Parameters, function.ReturnType = parseCsdlOperation(obj)
+	return function
+}
+
+func parseCsdlOperation(obj *csdlObject) ([]*GoDataParameter, *GoDataReturnType) {
+	params := []*GoDataParameter{}
+	list, _ := obj.Get("$Parameter").([]interface{})
+	for _, p := range list {
+		param, ok := p.(*csdlObject)
+		if !ok {
+			continue
+		}
+		params = append(params, &GoDataParameter{
+			Name:        param.String("$Name"),
+			Type:        parseCsdlType(param),
+			Nullable:    parseCsdlNullable(param),
+			MaxLength:   param.Facet("$MaxLength"),
+			Precision:   parseCsdlPrecision(param),
+			Scale:       param.Facet("$Scale"),
+			SRID:        param.Facet("$SRID"),
+			Annotations: parseCsdlAnnotations(param, ""),
+		})
+	}
+
+	r, ok := obj.Get("$ReturnType").(*csdlObject)
+	if !ok {
+		return params, nil
+	}
+	return params, &GoDataReturnType{
+		Type:        parseCsdlType(r),
+		Nullable:    parseCsdlNullable(r),
+		MaxLength:   r.Facet("$MaxLength"),
+		Precision:   parseCsdlPrecision(r),
+		Scale:       r.Facet("$Scale"),
+		SRID:        r.Facet("$SRID"),
+		Annotations: parseCsdlAnnotations(r, ""),
+	}
+}
+
+func parseCsdlEntityContainer(name string, obj *csdlObject) *GoDataEntityContainer {
+	container := &GoDataEntityContainer{
+		Name:        name,
+		Extends:     obj.String("$Extends"),
+		Annotations: parseCsdlAnnotations(obj, ""),
+	}
+
+	for _, member := range csdlMembers(obj) {
+		child, ok := obj.Values[member].(*csdlObject)
+		if !ok {
+			continue
+		}
+		annotations := append(parseCsdlAnnotations(obj, member), parseCsdlAnnotations(child, "")...)
+
+		if child.Get("$Action") != nil {
+			container.ActionImports = append(container.ActionImports, &GoDataActionImport{
+				Name:        member,
+				Action:      child.String("$Action"),
+				EntitySet:   child.String("$EntitySet"),
+				Annotations: annotations,
+			})
+		} else if child.Get("$Function") != nil {
+			container.FunctionImports = append(container.FunctionImports, &GoDataFunctionImport{
+				Name:                     member,
+				Function:                 child.String("$Function"),
+				EntitySet:                child.String("$EntitySet"),
+				IncludeInServiceDocument: child.Bool("$IncludeInServiceDocument"),
+				Annotations:              annotations,
+			})
+		} else if child.Bool("$Collection") == "true" {
+			container.EntitySets = append(container.EntitySets, &GoDataEntitySet{
+				Name:                       member,
+				EntityType:                 child.String("$Type"),
+				IncludeInServiceDocument:   child.Bool("$IncludeInServiceDocument"),
+				NavigationPropertyBindings: parseCsdlBindings(child),
+				Annotations:                annotations,
+			})
+		} else {
+			container.Singletons = append(container.Singletons, &GoDataSingleton{
+				Name:                       member,
+				Type:                       child.String("$Type"),
+				NavigationPropertyBindings: parseCsdlBindings(child),
+				Annotations:                annotations,
+			})
+		}
+	}
+
+	return container
+}
+
+func parseCsdlBindings(obj *csdlObject) []*GoDataNavigationPropertyBinding {
+	bindings := []*GoDataNavigationPropertyBinding{}
+	b, ok := obj.Get("$NavigationPropertyBinding").(*csdlObject)
+	if !ok {
+		return bindings
+	}
+	for _, path := range b.Keys {
+		bindings = append(bindings, &GoDataNavigationPropertyBinding{
+			Path:   path,
+			Target: b.String(path),
+		})
+	}
+	return bindings
+}
+
+// Read the $Type and $Collection members into a type name. Edm.String is the
+// default type.
+func parseCsdlType(obj *csdlObject) string {
+	t := obj.String("$Type")
+	if t == "" {
+		t = GoDataString
+	}
+	if obj.Bool("$Collection") == "true" {
+		t = "Collection(" + t + ")"
+	}
+	return t
+}
+
+// CSDL JSON values are not nullable unless stated, while the XML model is
+// nullable unless stated, so the default has to be made explicit.
+func parseCsdlNullable(obj *csdlObject) string {
+	if obj.Bool("$Nullable") == "true" {
+		return "true"
+	}
+	return "false"
+}
+
+func parseCsdlPrecision(obj *csdlObject) int {
+	precision, _ := strconv.Atoi(obj.Facet("$Precision"))
+	return precision
+}
+
+// Read the annotations of an object, or of one of its members if a member
+// name is given.
+func parseCsdlAnnotations(obj *csdlObject, member string) []*GoDataAnnotation {
+	annotations := []*GoDataAnnotation{}
+	prefix := member + "@"
+	keys := []string{}
+	for _, key := range obj.Keys {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	for _, key := range keys {
+		term := strings.TrimPrefix(key, prefix)
+		if strings.Contains(term, "@") {
+			// an annotation of an annotation
+			continue
+		}
+		annotation := &GoDataAnnotation{Term: term}
+		if i := strings.Index(term, "#"); i >= 0 {
+			annotation.Term = term[:i]
+			annotation.Qualifier = term[i+1:]
+		}
+		if value, ok := obj.Values[key].(bool); !ok || !value {
+			// true is the default value of tagging terms
+			annotation.Value = parseCsdlExpression(obj.Values[key])
+		}
+		annotations = append(annotations, annotation)
+	}
+	if len(annotations) == 0 {
+		return nil
+	}
+	return annotations
+}
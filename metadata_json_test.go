@@ -0,0 +1,121 @@
+package godata
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestMetadataJson(t *testing.T) {
+	metadata, err := ParseMetadata(strings.NewReader(testCsdlDocument))
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	output, err := metadata.Json()
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	document := map[string]interface{}{}
+	if err := json.Unmarshal(output, &document); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if document["$Version"] != "4.0" || document["$EntityContainer"] != "Trippin.Container" {
+		t.Error("Document members not written:\n" + string(output))
+	}
+
+	schema, ok := document["Trippin"].(map[string]interface{})
+	if !ok {
+		t.Error("Schema not written:\n" + string(output))
+		return
+	}
+
+	person, ok := schema["Person"].(map[string]interface{})
+	if !ok || person["$Kind"] != "EntityType" {
+		t.Error("Entity type not written:\n" + string(output))
+		return
+	}
+	if _, ok := person["$Key"].([]interface{}); !ok {
+		t.Error("Key not written")
+	}
+
+	if _, ok := schema["GetFriendsTrips"].([]interface{}); !ok {
+		t.Error("Function overloads not written as an array")
+	}
+
+	// properties must be written in the order they are declared
+	first := strings.Index(string(output), "\"UserName\"")
+	second := strings.Index(string(output), "\"Budget\"")
+	if first < 0 || second < 0 || first > second {
+		t.Error("Property order not kept:\n" + string(output))
+	}
+}
+
+func TestMetadataJsonRoundTrip(t *testing.T) {
+	metadata, err := ParseMetadata(strings.NewReader(testCsdlDocument))
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	first, err := metadata.Json()
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	reparsed, err := ParseMetadataJson(bytes.NewReader(first))
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	second, err := reparsed.Json()
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if string(first) != string(second) {
+		t.Error("Metadata did not round trip:\n" + string(first) + "\n\n" + string(second))
+	}
+
+	schema := reparsed.DataServices.Schemas[0]
+	if len(schema.EntityTypes) != 2 || len(schema.EntityTypes[1].Key.PropertyRefs) != 2 {
+		t.Error("Entity types not parsed")
+	}
+	if len(schema.EntityContainers[0].EntitySets) == 0 || len(schema.EntityContainers[0].Singletons) != 1 {
+		t.Error("Entity container not parsed")
+	}
+
+	// the parsed tree must still serialize as CSDL XML
+	if _, err := reparsed.Bytes(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestParseInvalidMetadataJson(t *testing.T) {
+	_, err := ParseMetadataJson(strings.NewReader("{\"Trippin\": {\"Person\": {\"$Kind\": \"Nonsense\"}}}"))
+
+	if err == nil {
+		t.Error("Unknown schema element kind was accepted")
+	}
+
+	_, err = ParseMetadataJson(strings.NewReader("[]"))
+
+	if err == nil {
+		t.Error("Document that is not an object was accepted")
+	}
+}
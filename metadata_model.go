@@ -15,14 +15,29 @@ const (
 	GoDataTimeOfDay      = "Edm.TimeOfDay"
 	GoDataDate           = "Edm.Date"
 	GoDataDateTimeOffset = "Edm.DateTimeOffset"
+	GoDataByte           = "Edm.Byte"
+	GoDataSByte          = "Edm.SByte"
+	GoDataSingle         = "Edm.Single"
+	GoDataDouble         = "Edm.Double"
+	GoDataGuid           = "Edm.Guid"
+	GoDataDuration       = "Edm.Duration"
+	GoDataUntyped        = "Edm.Untyped"
+	GoDataStream         = "Edm.Stream"
+)
+
+const (
+	// The XML namespace of the edmx: elements wrapping a CSDL document
+	EdmxNamespace = "http://docs.oasis-open.org/odata/ns/edmx"
+	// The XML namespace of CSDL schemas
+	EdmNamespace = "http://docs.oasis-open.org/odata/ns/edm"
 )
 
 type GoDataMetadata struct {
-	XMLName      xml.Name `xml:"edmx:Edmx"`
-	XMLNamespace string   `xml:"xmlns:edmx,attr"`
-	Version      string   `xml:"Version,attr"`
+	XMLName      xml.Name           `xml:"edmx:Edmx"`
+	XMLNamespace string             `xml:"xmlns:edmx,attr"`
+	Version      string             `xml:"Version,attr"`
+	References   []*GoDataReference `xml:"edmx:Reference"`
 	DataServices *GoDataServices
-	References   []*GoDataReference
 }
 
 func (t *GoDataMetadata) Bytes() ([]byte, error) {
@@ -35,10 +50,11 @@ func (t *GoDataMetadata) Bytes() ([]byte, error) {
 }
 
 type GoDataReference struct {
-	XMLName            xml.Name `xml:"edmx:Reference"`
-	Uri                string   `xml:"Uri,attr"`
-	Includes           []*GoDataInclude
-	IncludeAnnotations []*GoDataIncludeAnnotations
+	XMLName            xml.Name                    `xml:"edmx:Reference"`
+	Uri                string                      `xml:"Uri,attr"`
+	Includes           []*GoDataInclude            `xml:"edmx:Include"`
+	IncludeAnnotations []*GoDataIncludeAnnotations `xml:"edmx:IncludeAnnotations"`
+	Annotations        []*GoDataAnnotation         `xml:"Annotation"`
 }
 
 type GoDataInclude struct {
@@ -55,66 +71,85 @@ type GoDataIncludeAnnotations struct {
 }
 
 type GoDataServices struct {
-	XMLName xml.Name `xml:"edmx:DataServices"`
-	Schemas []*GoDataSchema
+	XMLName xml.Name        `xml:"edmx:DataServices"`
+	Schemas []*GoDataSchema `xml:"Schema"`
 }
 
 type GoDataSchema struct {
-	XMLName          xml.Name `xml:"Schema"`
-	Namespace        string   `xml:"Namespace,attr"`
-	Alias            string   `xml:"Alias,attr,omitempty"`
-	Actions          []*GoDataAction
-	Annotations      []*GoDataAnnotations
-	Annotation       []*GoDataAnnotation
-	ComplexTypes     []*GoDataComplexType
-	EntityContainers []*GoDataEntityContainer
-	EntityTypes      []*GoDataEntityType
-	EnumTypes        []*GoDataEnumType
-	Functions        []*GoDataFunction
-	Terms            []*GoDataTerm
-	TypeDefinitions  []*GoDataTypeDefinition
+	XMLName          xml.Name                 `xml:"Schema"`
+	XMLNamespace     string                   `xml:"xmlns,attr,omitempty"`
+	Namespace        string                   `xml:"Namespace,attr"`
+	Alias            string                   `xml:"Alias,attr,omitempty"`
+	Actions          []*GoDataAction          `xml:"Action"`
+	Annotations      []*GoDataAnnotations     `xml:"Annotations"`
+	Annotation       []*GoDataAnnotation      `xml:"Annotation"`
+	ComplexTypes     []*GoDataComplexType     `xml:"ComplexType"`
+	EntityContainers []*GoDataEntityContainer `xml:"EntityContainer"`
+	EntityTypes      []*GoDataEntityType      `xml:"EntityType"`
+	EnumTypes        []*GoDataEnumType        `xml:"EnumType"`
+	Functions        []*GoDataFunction        `xml:"Function"`
+	Terms            []*GoDataTerm            `xml:"Term"`
+	TypeDefinitions  []*GoDataTypeDefinition  `xml:"TypeDefinition"`
 }
 
 type GoDataAction struct {
-	XMLName       xml.Name `xml:"Action"`
-	Name          string   `xml:"Name,attr"`
-	IsBound       string   `xml:"IsBound,attr,omitempty"`
-	EntitySetPath string   `xml:"EntitySetPath,attr,omitempty"`
-	Parameters    []*GoDataParameter
+	XMLName       xml.Name           `xml:"Action"`
+	Name          string             `xml:"Name,attr"`
+	IsBound       string             `xml:"IsBound,attr,omitempty"`
+	EntitySetPath string             `xml:"EntitySetPath,attr,omitempty"`
+	Parameters    []*GoDataParameter `xml:"Parameter"`
 	ReturnType    *GoDataReturnType
+	Annotations   []*GoDataAnnotation `xml:"Annotation"`
 }
 
 type GoDataAnnotations struct {
-	XMLName     xml.Name `xml:"Annotations"`
-	Target      string   `xml:"Target,attr"`
-	Qualifier   string   `xml:"Qualifier,attr,omitempty"`
-	Annotations []*GoDataAnnotation
+	XMLName     xml.Name            `xml:"Annotations"`
+	Target      string              `xml:"Target,attr"`
+	Qualifier   string              `xml:"Qualifier,attr,omitempty"`
+	Annotations []*GoDataAnnotation `xml:"Annotation"`
 }
 
 type GoDataAnnotation struct {
 	XMLName   xml.Name `xml:"Annotation"`
 	Term      string   `xml:"Term,attr"`
 	Qualifier string   `xml:"Qualifier,attr,omitempty"`
+	// The value of the annotation, or nil for the default value of the
+	// term, e.g. true for tagging terms.
+	Value *GoDataExpression `xml:"-"`
 }
 
 type GoDataComplexType struct {
-	XMLName              xml.Name `xml:"ComplexType"`
-	Name                 string   `xml:"Name,attr"`
-	BaseType             string   `xml:"BaseType,attr,omitempty"`
-	Abstract             string   `xml:"Abstract,attr,omitempty"`
-	OpenType             string   `xml:"OpenType,attr,omitempty"`
-	Properties           []*GoDataProperty
-	NavigationProperties []*GoDataNavigationProperty
+	XMLName              xml.Name                    `xml:"ComplexType"`
+	Name                 string                      `xml:"Name,attr"`
+	BaseType             string                      `xml:"BaseType,attr,omitempty"`
+	Abstract             string                      `xml:"Abstract,attr,omitempty"`
+	OpenType             string                      `xml:"OpenType,attr,omitempty"`
+	Properties           []*GoDataProperty           `xml:"Property"`
+	NavigationProperties []*GoDataNavigationProperty `xml:"NavigationProperty"`
+	Annotations          []*GoDataAnnotation         `xml:"Annotation"`
+}
+
+// Check whether this entity type is a media entity, i.e. whether each entity
+// has binary content that is read and written through its $value segment.
+func (t *GoDataEntityType) IsMediaEntity() bool {
+	return t.HasStream == "true"
+}
+
+// Check whether this complex type declares itself as open, which allows
+// instances to carry dynamic properties that are not part of the metadata.
+func (t *GoDataComplexType) IsOpenType() bool {
+	return t.OpenType == "true"
 }
 
 type GoDataEntityContainer struct {
-	XMLName         xml.Name `xml:"EntityContainer"`
-	Name            string   `xml:"Name,attr"`
-	Extends         string   `xml:"Extends,attr,omitempty"`
-	EntitySets      []*GoDataEntitySet
-	Singletons      []*GoDataSingleton
-	ActionImports   []*GoDataActionImport
-	FunctionImports []*GoDataFunctionImport
+	XMLName         xml.Name                `xml:"EntityContainer"`
+	Name            string                  `xml:"Name,attr"`
+	Extends         string                  `xml:"Extends,attr,omitempty"`
+	EntitySets      []*GoDataEntitySet      `xml:"EntitySet"`
+	Singletons      []*GoDataSingleton      `xml:"Singleton"`
+	ActionImports   []*GoDataActionImport   `xml:"ActionImport"`
+	FunctionImports []*GoDataFunctionImport `xml:"FunctionImport"`
+	Annotations     []*GoDataAnnotation     `xml:"Annotation"`
 }
 
 type GoDataEntityType struct {
@@ -125,83 +160,107 @@ type GoDataEntityType struct {
 	OpenType             string   `xml:"OpenType,attr,omitempty"`
 	HasStream            string   `xml:"HasStream,attr,omitempty"`
 	Key                  *GoDataKey
-	Properties           []*GoDataProperty
-	NavigationProperties []*GoDataNavigationProperty
+	Properties           []*GoDataProperty           `xml:"Property"`
+	NavigationProperties []*GoDataNavigationProperty `xml:"NavigationProperty"`
+	Annotations          []*GoDataAnnotation         `xml:"Annotation"`
+}
+
+// Check whether this entity type declares itself as open, which allows
+// instances to carry dynamic properties that are not part of the metadata.
+func (t *GoDataEntityType) IsOpenType() bool {
+	return t.OpenType == "true"
 }
 
 type GoDataEnumType struct {
-	XMLName        xml.Name `xml:"EnumType"`
-	Name           string   `xml:"Name,attr"`
-	UnderlyingType string   `xml:"UnderlyingType,attr,omitempty"`
-	IsFlags        string   `xml:"IsFlags,attr,omitempty"`
-	Members        []*GoDataMember
+	XMLName        xml.Name            `xml:"EnumType"`
+	Name           string              `xml:"Name,attr"`
+	UnderlyingType string              `xml:"UnderlyingType,attr,omitempty"`
+	IsFlags        string              `xml:"IsFlags,attr,omitempty"`
+	Members        []*GoDataMember     `xml:"Member"`
+	Annotations    []*GoDataAnnotation `xml:"Annotation"`
 }
 
 type GoDataFunction struct {
-	XMLName       xml.Name `xml:"Function"`
-	Name          string   `xml:"Name,attr"`
-	IsBound       string   `xml:"IsBound,attr,omitempty"`
-	IsComposable  string   `xml:"IsComposable,attr,omitempty"`
-	EntitySetPath string   `xml:"EntitySetPath,attr,omitempty"`
-	Parameters    []*GoDataParameter
+	XMLName       xml.Name           `xml:"Function"`
+	Name          string             `xml:"Name,attr"`
+	IsBound       string             `xml:"IsBound,attr,omitempty"`
+	IsComposable  string             `xml:"IsComposable,attr,omitempty"`
+	EntitySetPath string             `xml:"EntitySetPath,attr,omitempty"`
+	Parameters    []*GoDataParameter `xml:"Parameter"`
 	ReturnType    *GoDataReturnType
+	Annotations   []*GoDataAnnotation `xml:"Annotation"`
 }
 
 type GoDataTypeDefinition struct {
-	XMLName        xml.Name `xml:"TypeDefinition"`
-	Name           string   `xml:"Name,attr"`
-	UnderlyingType string   `xml:"UnderlyingTypeattr,omitempty"`
-	Annotations    []*GoDataAnnotation
+	XMLName        xml.Name            `xml:"TypeDefinition"`
+	Name           string              `xml:"Name,attr"`
+	UnderlyingType string              `xml:"UnderlyingType,attr,omitempty"`
+	MaxLength      string              `xml:"MaxLength,attr,omitempty"`
+	Precision      int                 `xml:"Precision,attr,omitempty"`
+	Scale          string              `xml:"Scale,attr,omitempty"`
+	Unicode        string              `xml:"Unicode,attr,omitempty"`
+	SRID           string              `xml:"SRID,attr,omitempty"`
+	Annotations    []*GoDataAnnotation `xml:"Annotation"`
 }
 
+// MaxLength and Scale are strings, not ints, on properties, parameters, return
+// types and type definitions, because CSDL also allows the values "max",
+// "variable" and "floating". Use strconv.Itoa to set a numeric facet.
 type GoDataProperty struct {
-	XMLName      xml.Name `xml:"Property"`
-	Name         string   `xml:"Name,attr"`
-	Type         string   `xml:"Type,attr"`
-	Nullable     string   `xml:"Nullable,attr,omitempty"`
-	MaxLength    int      `xml:"MaxLength,attr,omitempty"`
-	Precision    int      `xml:"Precision, attr,omitempty"`
-	Scale        int      `xml:"Scale,attr,omitempty"`
-	Unicode      string   `xml:"Unicode,attr,omitempty"`
-	SRID         string   `xml:"SRID,attr,omitempty"`
-	DefaultValue string   `xml:"DefaultValue,attr,omitempty"`
+	XMLName      xml.Name            `xml:"Property"`
+	Name         string              `xml:"Name,attr"`
+	Type         string              `xml:"Type,attr"`
+	Nullable     string              `xml:"Nullable,attr,omitempty"`
+	MaxLength    string              `xml:"MaxLength,attr,omitempty"`
+	Precision    int                 `xml:"Precision,attr,omitempty"`
+	Scale        string              `xml:"Scale,attr,omitempty"`
+	Unicode      string              `xml:"Unicode,attr,omitempty"`
+	SRID         string              `xml:"SRID,attr,omitempty"`
+	DefaultValue string              `xml:"DefaultValue,attr,omitempty"`
+	Annotations  []*GoDataAnnotation `xml:"Annotation"`
 }
 
 type GoDataNavigationProperty struct {
-	XMLName                xml.Name `xml:"NavigationProperty"`
-	Name                   string   `xml:"Name,attr"`
-	Type                   string   `xml:"Type,attr"`
-	Nullable               string   `xml:"Nullable,attr,omitempty"`
-	Partner                string   `xml:"Partner,attr,omitempty"`
-	ContainsTarget         string   `xml:"ContainsTarget,attr,omitempty"`
-	ReferentialConstraints []*GoDataReferentialConstraint
+	XMLName                xml.Name                       `xml:"NavigationProperty"`
+	Name                   string                         `xml:"Name,attr"`
+	Type                   string                         `xml:"Type,attr"`
+	Nullable               string                         `xml:"Nullable,attr,omitempty"`
+	Partner                string                         `xml:"Partner,attr,omitempty"`
+	ContainsTarget         string                         `xml:"ContainsTarget,attr,omitempty"`
+	ReferentialConstraints []*GoDataReferentialConstraint `xml:"ReferentialConstraint"`
+	OnDelete               *GoDataOnDelete
+	Annotations            []*GoDataAnnotation `xml:"Annotation"`
 }
 
 type GoDataReferentialConstraint struct {
-	XMLName            xml.Name        `xml:"ReferentialConstraint"`
-	Property           string          `xml:"Property,attr"`
-	ReferencedProperty string          `xml:"ReferencedProperty,attr"`
-	OnDelete           *GoDataOnDelete `xml:"OnDelete,omitempty"`
+	XMLName            xml.Name            `xml:"ReferentialConstraint"`
+	Property           string              `xml:"Property,attr"`
+	ReferencedProperty string              `xml:"ReferencedProperty,attr"`
+	OnDelete           *GoDataOnDelete     `xml:"OnDelete,omitempty"`
+	Annotations        []*GoDataAnnotation `xml:"Annotation"`
 }
 
 type GoDataOnDelete struct {
-	XMLName xml.Name `xml:"OnDelete"`
-	Action  string   `xml:"Action,attr"`
+	XMLName     xml.Name            `xml:"OnDelete"`
+	Action      string              `xml:"Action,attr"`
+	Annotations []*GoDataAnnotation `xml:"Annotation"`
 }
 
 type GoDataEntitySet struct {
-	XMLName                    xml.Name `xml:"EntitySet"`
-	Name                       string   `xml:"Name,attr"`
-	EntityType                 string   `xml:"EntityType,attr"`
-	IncludeInServiceDocument   string   `xml:"IncludeInServiceDocument,attr,omitempty"`
-	NavigationPropertyBindings []*GoDataNavigationPropertyBinding
+	XMLName                    xml.Name                           `xml:"EntitySet"`
+	Name                       string                             `xml:"Name,attr"`
+	EntityType                 string                             `xml:"EntityType,attr"`
+	IncludeInServiceDocument   string                             `xml:"IncludeInServiceDocument,attr,omitempty"`
+	NavigationPropertyBindings []*GoDataNavigationPropertyBinding `xml:"NavigationPropertyBinding"`
+	Annotations                []*GoDataAnnotation                `xml:"Annotation"`
 }
 
 type GoDataSingleton struct {
-	XMLName                    xml.Name `xml:"Singleton"`
-	Name                       string   `xml:"Name,attr"`
-	Type                       string   `xml:"Type,attr"`
-	NavigationPropertyBindings []*GoDataNavigationPropertyBinding
+	XMLName                    xml.Name                           `xml:"Singleton"`
+	Name                       string                             `xml:"Name,attr"`
+	Type                       string                             `xml:"Type,attr"`
+	NavigationPropertyBindings []*GoDataNavigationPropertyBinding `xml:"NavigationPropertyBinding"`
+	Annotations                []*GoDataAnnotation                `xml:"Annotation"`
 }
 
 type GoDataNavigationPropertyBinding struct {
@@ -211,63 +270,100 @@ type GoDataNavigationPropertyBinding struct {
 }
 
 type GoDataActionImport struct {
-	XMLName   xml.Name `xml:"ActionImport"`
-	Name      string   `xml:"Name,attr"`
-	Action    string   `xml:"Action,attr"`
-	EntitySet string   `xml:"EntitySet,attr,omitempty"`
+	XMLName     xml.Name            `xml:"ActionImport"`
+	Name        string              `xml:"Name,attr"`
+	Action      string              `xml:"Action,attr"`
+	EntitySet   string              `xml:"EntitySet,attr,omitempty"`
+	Annotations []*GoDataAnnotation `xml:"Annotation"`
 }
 
 type GoDataFunctionImport struct {
-	XMLName                  xml.Name `xml:"FunctionImport"`
-	Name                     string   `xml:"Name,attr"`
-	Function                 string   `xml:"Function,attr"`
-	EntitySet                string   `xml:"EntitySet,attr,omitempty"`
-	IncludeInServiceDocument string   `xml:"IncludeInServiceDocument,attr,omitempty"`
+	XMLName                  xml.Name            `xml:"FunctionImport"`
+	Name                     string              `xml:"Name,attr"`
+	Function                 string              `xml:"Function,attr"`
+	EntitySet                string              `xml:"EntitySet,attr,omitempty"`
+	IncludeInServiceDocument string              `xml:"IncludeInServiceDocument,attr,omitempty"`
+	Annotations              []*GoDataAnnotation `xml:"Annotation"`
 }
 
 type GoDataKey struct {
-	XMLName     xml.Name `xml:"Key"`
-	PropertyRef *GoDataPropertyRef
+	XMLName      xml.Name             `xml:"Key"`
+	PropertyRefs []*GoDataPropertyRef `xml:"PropertyRef"`
+	// Deprecated: use PropertyRefs, which can hold composite keys. Still used
+	// as the key when PropertyRefs is empty.
+	PropertyRef *GoDataPropertyRef `xml:"-"`
+}
+
+// Get the properties that make up the key, falling back to the deprecated
+// PropertyRef field. Returns nil if there is no key.
+func (k *GoDataKey) Refs() []*GoDataPropertyRef {
+	if k == nil {
+		return nil
+	}
+	if len(k.PropertyRefs) == 0 && k.PropertyRef != nil {
+		return []*GoDataPropertyRef{k.PropertyRef}
+	}
+	return k.PropertyRefs
+}
+
+// Serialize the key with the properties returned by Refs, so keys that only
+// set the deprecated PropertyRef field are written out as well.
+func (k *GoDataKey) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	type key GoDataKey
+	refs := key(*k)
+	refs.PropertyRefs = k.Refs()
+	return e.EncodeElement(refs, start)
 }
 
 type GoDataPropertyRef struct {
 	XMLName xml.Name `xml:"PropertyRef"`
 	Name    string   `xml:"Name,attr"`
+	Alias   string   `xml:"Alias,attr,omitempty"`
 }
 
 type GoDataParameter struct {
-	XMLName   xml.Name `xml:"Parameter"`
-	Name      string   `xml:"Name,attr"`
-	Type      string   `xml:"Type,attr"`
-	Nullable  string   `xml:"Nullable,attr,omitempty"`
-	MaxLength int      `xml:"MaxLength,attr,omitempty"`
-	Precision int      `xml:"Precision,attr,omitempty"`
-	Scale     int      `xml:"Scale,attr,omitempty"`
-	SRID      string   `xml:"SRID,attr,omitempty"`
+	XMLName     xml.Name            `xml:"Parameter"`
+	Name        string              `xml:"Name,attr"`
+	Type        string              `xml:"Type,attr"`
+	Nullable    string              `xml:"Nullable,attr,omitempty"`
+	MaxLength   string              `xml:"MaxLength,attr,omitempty"`
+	Precision   int                 `xml:"Precision,attr,omitempty"`
+	Scale       string              `xml:"Scale,attr,omitempty"`
+	SRID        string              `xml:"SRID,attr,omitempty"`
+	Annotations []*GoDataAnnotation `xml:"Annotation"`
 }
 
 type GoDataReturnType struct {
-	XMLName   xml.Name `xml:"ReturnType"`
-	Name      string   `xml:"Name,attr"`
-	Type      string   `xml:"Type,attr"`
-	Nullable  string   `xml:"Nullable,attr,omitempty"`
-	MaxLength int      `xml:"MaxLength,attr,omitempty"`
-	Precision int      `xml:"Precision,attr,omitempty"`
-	Scale     int      `xml:"Scale,attr,omitempty"`
-	SRID      string   `xml:"SRID,attr,omitempty"`
+	XMLName xml.Name `xml:"ReturnType"`
+	// Deprecated: return types have no name in CSDL, so it is not serialized.
+	Name        string              `xml:"-"`
+	Type        string              `xml:"Type,attr"`
+	Nullable    string              `xml:"Nullable,attr,omitempty"`
+	MaxLength   string              `xml:"MaxLength,attr,omitempty"`
+	Precision   int                 `xml:"Precision,attr,omitempty"`
+	Scale       string              `xml:"Scale,attr,omitempty"`
+	SRID        string              `xml:"SRID,attr,omitempty"`
+	Annotations []*GoDataAnnotation `xml:"Annotation"`
 }
 
 type GoDataMember struct {
-	XMLName xml.Name `xml:"Member"`
-	Name    string   `xml:"Name,attr"`
-	Value   string   `xml:"Value,attr,omitempty"`
+	XMLName     xml.Name            `xml:"Member"`
+	Name        string              `xml:"Name,attr"`
+	Value       string              `xml:"Value,attr,omitempty"`
+	Annotations []*GoDataAnnotation `xml:"Annotation"`
 }
 
 type GoDataTerm struct {
-	XMLName      xml.Name `xml:"Term"`
-	Name         string   `xml:"Name,attr"`
-	Type         string   `xml:"Type,attr"`
-	BaseTerm     string   `xml:"BaseTerm,attr,omitempty"`
-	DefaultValue string   `xml:"DefaultValue,attr,omitempty"`
-	AppliesTo    string   `xml:"AppliesTo,attr,omitempty"`
+	XMLName      xml.Name            `xml:"Term"`
+	Name         string              `xml:"Name,attr"`
+	Type         string              `xml:"Type,attr"`
+	BaseTerm     string              `xml:"BaseTerm,attr,omitempty"`
+	DefaultValue string              `xml:"DefaultValue,attr,omitempty"`
+	AppliesTo    string              `xml:"AppliesTo,attr,omitempty"`
+	Nullable     string              `xml:"Nullable,attr,omitempty"`
+	MaxLength    string              `xml:"MaxLength,attr,omitempty"`
+	Precision    int                 `xml:"Precision,attr,omitempty"`
+	Scale        string              `xml:"Scale,attr,omitempty"`
+	SRID         string              `xml:"SRID,attr,omitempty"`
+	Annotations  []*GoDataAnnotation `xml:"Annotation"`
 }
@@ -57,3 +57,62 @@ func TestSimpleMetadata(t *testing.T) {
 		t.Error("Expected: \n"+expected, "\n\nGot: \n"+string(actual))
 	}
 }
+
+func TestDeprecatedMetadataFields(t *testing.T) {
+
+	entity := GoDataEntityType{
+		Name: "TestEntity1",
+		Key:  &GoDataKey{PropertyRef: &GoDataPropertyRef{Name: "Id"}},
+		Properties: []*GoDataProperty{
+			&GoDataProperty{Name: "Id", Type: "Edm.Int32"},
+		},
+	}
+
+	function := GoDataFunction{
+		Name:       "TestFunction",
+		ReturnType: &GoDataReturnType{Name: "Ignored", Type: "Edm.Int32"},
+	}
+
+	root := GoDataMetadata{
+		XMLNamespace: "http://docs.oasis-open.org/odata/ns/edmx",
+		Version:      "4.0",
+		DataServices: &GoDataServices{
+			Schemas: []*GoDataSchema{&GoDataSchema{
+				Namespace:   "TestSchema",
+				EntityTypes: []*GoDataEntityType{&entity},
+				Functions:   []*GoDataFunction{&function},
+			}},
+		},
+	}
+
+	expected := "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n"
+	expected += "<edmx:Edmx xmlns:edmx=\"http://docs.oasis-open.org/odata/ns/edmx\" Version=\"4.0\">\n"
+	expected += "    <edmx:DataServices>\n"
+	expected += "        <Schema Namespace=\"TestSchema\">\n"
+	expected += "            <EntityType Name=\"TestEntity1\">\n"
+	expected += "                <Key>\n"
+	expected += "                    <PropertyRef Name=\"Id\"></PropertyRef>\n"
+	expected += "                </Key>\n"
+	expected += "                <Property Name=\"Id\" Type=\"Edm.Int32\"></Property>\n"
+	expected += "            </EntityType>\n"
+	expected += "            <Function Name=\"TestFunction\">\n"
+	expected += "                <ReturnType Type=\"Edm.Int32\"></ReturnType>\n"
+	expected += "            </Function>\n"
+	expected += "        </Schema>\n"
+	expected += "    </edmx:DataServices>\n"
+	expected += "</edmx:Edmx>"
+
+	actual, err := root.Bytes()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(actual) != expected {
+		t.Error("Expected: \n"+expected, "\n\nGot: \n"+string(actual))
+	}
+
+	if err := ValidateMetadata(&root); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,78 @@
+package godata
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+)
+
+// Parse a CSDL XML document, e.g. the $metadata of an OData service or a
+// service definition kept in a .xml file, into a GoDataMetadata tree that can
+// be returned by a provider.
+func ParseMetadata(r io.Reader) (*GoDataMetadata, error) {
+	decoder := xml.NewTokenDecoder(&metadataTokenReader{xml.NewDecoder(r)})
+
+	metadata := &GoDataMetadata{}
+	if err := decoder.Decode(metadata); err != nil {
+		return nil, errors.New("Invalid CSDL document: " + err.Error())
+	}
+
+	if metadata.DataServices == nil {
+		return nil, errors.New("Invalid CSDL document: missing edmx:DataServices element.")
+	}
+
+	return metadata, nil
+}
+
+// The metadata model names its elements with the literal prefixes it writes,
+// e.g. "edmx:Edmx", which encoding/xml does not match against namespaced
+// elements when unmarshaling. This reader renames the elements of a CSDL
+// document to the names used by the model, and hides elements and attributes
+// of other namespaces, so they are skipped instead of mistaken for CSDL.
+type metadataTokenReader struct {
+	decoder *xml.Decoder
+}
+
+func (r *metadataTokenReader) Token() (xml.Token, error) {
+	token, err := r.decoder.Token()
+	if err != nil {
+		return token, err
+	}
+
+	switch t := token.(type) {
+	case xml.StartElement:
+		t.Name = metadataName(t.Name)
+		attrs := make([]xml.Attr, 0, len(t.Attr))
+		for _, attr := range t.Attr {
+			attrs = append(attrs, xml.Attr{Name: metadataAttrName(attr.Name), Value: attr.Value})
+		}
+		t.Attr = attrs
+		return t, nil
+	case xml.EndElement:
+		t.Name = metadataName(t.Name)
+		return t, nil
+	}
+
+	return token, nil
+}
+
+func metadataName(name xml.Name) xml.Name {
+	switch name.Space {
+	case EdmxNamespace:
+		return xml.Name{Local: "edmx:" + name.Local}
+	case EdmNamespace, "":
+		return xml.Name{Local: name.Local}
+	}
+	// keep foreign elements from matching elements of the model
+	return xml.Name{Local: name.Space + ":" + name.Local}
+}
+
+func metadataAttrName(name xml.Name) xml.Name {
+	switch name.Space {
+	case "":
+		return name
+	case "xmlns":
+		return xml.Name{Local: "xmlns:" + name.Local}
+	}
+	return xml.Name{Local: name.Space + ":" + name.Local}
+}
@@ -0,0 +1,205 @@
+package godata
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const testCsdlDocument = `<?xml version="1.0" encoding="utf-8"?>
+<edmx:Edmx Version="4.0" xmlns:edmx="http://docs.oasis-open.org/odata/ns/edmx">
+  <edmx:Reference Uri="https://oasis-tcs.github.io/odata-vocabularies/vocabularies/Org.OData.Core.V1.xml">
+    <edmx:Include Namespace="Org.OData.Core.V1" Alias="Core" />
+    <edmx:IncludeAnnotations TermNamespace="Org.OData.Capabilities.V1" />
+  </edmx:Reference>
+  <edmx:DataServices>
+    <Schema Namespace="Trippin" xmlns="http://docs.oasis-open.org/odata/ns/edm">
+      <EnumType Name="PersonGender" UnderlyingType="Edm.Int32">
+        <Member Name="Male" Value="0" />
+        <Member Name="Female" Value="1" />
+      </EnumType>
+      <ComplexType Name="Location" OpenType="true">
+        <Property Name="Address" Type="Edm.String" MaxLength="max" />
+      </ComplexType>
+      <EntityType Name="Person">
+        <Key>
+          <PropertyRef Name="UserName" />
+        </Key>
+        <Property Name="UserName" Type="Edm.String" Nullable="false">
+          <Annotation Term="Core.Permissions" />
+        </Property>
+        <Property Name="Gender" Type="Trippin.PersonGender" />
+        <Property Name="Budget" Type="Edm.Decimal" Precision="10" Scale="variable" />
+        <Property Name="AddressInfo" Type="Collection(Trippin.Location)" />
+        <NavigationProperty Name="Friends" Type="Collection(Trippin.Person)" />
+        <NavigationProperty Name="BestFriend" Type="Trippin.Person">
+          <OnDelete Action="SetNull" />
+        </NavigationProperty>
+        <Annotation Term="Core.Description" Qualifier="Short" />
+      </EntityType>
+      <EntityType Name="Membership">
+        <Key>
+          <PropertyRef Name="GroupId" />
+          <PropertyRef Name="UserName" />
+        </Key>
+        <Property Name="GroupId" Type="Edm.Int32" Nullable="false" />
+        <Property Name="UserName" Type="Edm.String" Nullable="false" />
+      </EntityType>
+      <TypeDefinition Name="Email" UnderlyingType="Edm.String" MaxLength="256" />
+      <Term Name="Tag" Type="Edm.String" AppliesTo="Property EntityType" />
+      <Function Name="GetFriendsTrips" IsBound="true">
+        <Parameter Name="person" Type="Trippin.Person" />
+        <Parameter Name="userName" Type="Edm.String" Nullable="false" />
+        <ReturnType Type="Collection(Trippin.Person)" />
+      </Function>
+      <Action Name="ResetDataSource" />
+      <EntityContainer Name="Container">
+        <EntitySet Name="People" EntityType="Trippin.Person">
+          <NavigationPropertyBinding Path="Friends" Target="People" />
+          <Annotation Term="Core.OptimisticConcurrency" />
+        </EntitySet>
+        <Singleton Name="Me" Type="Trippin.Person" />
+        <FunctionImport Name="GetNearestAirport" Function="Trippin.GetNearestAirport" />
+        <ActionImport Name="ResetDataSource" Action="Trippin.ResetDataSource" />
+      </EntityContainer>
+      <Annotations Target="Trippin.Person/UserName">
+        <Annotation Term="Core.Immutable" />
+      </Annotations>
+      <foo:Property Name="NotCsdl" Type="Edm.String" xmlns:foo="http://example.com/foo" />
+    </Schema>
+  </edmx:DataServices>
+</edmx:Edmx>`
+
+func TestParseMetadata(t *testing.T) {
+	metadata, err := ParseMetadata(strings.NewReader(testCsdlDocument))
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if metadata.Version != "4.0" || metadata.XMLNamespace != EdmxNamespace {
+		t.Error("Edmx attributes not parsed")
+	}
+
+	if len(metadata.References) != 1 || metadata.References[0].Includes[0].Alias != "Core" {
+		t.Error("References not parsed")
+		return
+	}
+	if metadata.References[0].IncludeAnnotations[0].TermNamespace != "Org.OData.Capabilities.V1" {
+		t.Error("Included annotations not parsed")
+	}
+
+	schema := metadata.DataServices.Schemas[0]
+	if schema.Namespace != "Trippin" || schema.XMLNamespace != EdmNamespace {
+		t.Error("Schema attributes not parsed")
+	}
+
+	if len(schema.EnumTypes) != 1 || len(schema.EnumTypes[0].Members) != 2 {
+		t.Error("Enum types not parsed")
+	}
+	if len(schema.ComplexTypes) != 1 || schema.ComplexTypes[0].Properties[0].MaxLength != "max" {
+		t.Error("Complex types not parsed")
+	}
+
+	if len(schema.EntityTypes) != 2 {
+		t.Error("Expected 2 entity types, got", len(schema.EntityTypes))
+		return
+	}
+	person := schema.EntityTypes[0]
+	if len(person.Properties) != 4 || len(person.NavigationProperties) != 2 {
+		t.Error("Person properties not parsed")
+		return
+	}
+	if person.Properties[0].Annotations[0].Term != "Core.Permissions" {
+		t.Error("Property annotation not parsed")
+	}
+	if person.Properties[2].Scale != "variable" || person.Properties[2].Precision != 10 {
+		t.Error("Property facets not parsed")
+	}
+	if person.NavigationProperties[1].OnDelete.Action != "SetNull" {
+		t.Error("OnDelete not parsed")
+	}
+	if person.Annotations[0].Qualifier != "Short" {
+		t.Error("Entity type annotation not parsed")
+	}
+
+	membership := schema.EntityTypes[1]
+	if len(membership.Key.PropertyRefs) != 2 {
+		t.Error("Composite key not parsed")
+	}
+
+	if schema.TypeDefinitions[0].UnderlyingType != GoDataString {
+		t.Error("Type definition not parsed")
+	}
+	if schema.Terms[0].AppliesTo != "Property EntityType" {
+		t.Error("Term not parsed")
+	}
+	if len(schema.Functions[0].Parameters) != 2 || schema.Functions[0].ReturnType == nil {
+		t.Error("Function not parsed")
+	}
+	if len(schema.Actions) != 1 {
+		t.Error("Action not parsed")
+	}
+
+	container := schema.EntityContainers[0]
+	if container.EntitySets[0].NavigationPropertyBindings[0].Target != "People" {
+		t.Error("Navigation property bindings not parsed")
+	}
+	if container.EntitySets[0].Annotations[0].Term != "Core.OptimisticConcurrency" {
+		t.Error("Entity set annotation not parsed")
+	}
+	if len(container.Singletons) != 1 || len(container.FunctionImports) != 1 || len(container.ActionImports) != 1 {
+		t.Error("Container children not parsed")
+	}
+
+	if schema.Annotations[0].Target != "Trippin.Person/UserName" {
+		t.Error("External annotations not parsed")
+	}
+}
+
+func TestMetadataRoundTrip(t *testing.T) {
+	metadata, err := ParseMetadata(strings.NewReader(testCsdlDocument))
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	first, err := metadata.Bytes()
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	reparsed, err := ParseMetadata(bytes.NewReader(first))
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	second, err := reparsed.Bytes()
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if string(first) != string(second) {
+		t.Error("Metadata did not round trip:\n" + string(first) + "\n\n" + string(second))
+	}
+
+	if strings.Contains(string(first), "NotCsdl") {
+		t.Error("Element from a foreign namespace was parsed as CSDL")
+	}
+}
+
+func TestParseInvalidMetadata(t *testing.T) {
+	_, err := ParseMetadata(strings.NewReader("<edmx:Edmx xmlns:edmx=\"" + EdmxNamespace + "\"></edmx:Edmx>"))
+
+	if err == nil {
+		t.Error("Document without DataServices was accepted")
+	}
+}
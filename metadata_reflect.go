@@ -0,0 +1,475 @@
+package godata
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Go types that are used as enum types implement this interface, returning
+// the members of the enum in the order they should be declared, e.g.
+//
+//	type Gender int
+//
+//	func (Gender) EnumMembers() []*GoDataMember {
+//		return []*GoDataMember{{Name: "Male", Value: "0"}, {Name: "Female", Value: "1"}}
+//	}
+type GoDataEnum interface {
+	EnumMembers() []*GoDataMember
+}
+
+var (
+	goDataEnumType = reflect.TypeOf((*GoDataEnum)(nil)).Elem()
+	timeType       = reflect.TypeOf(time.Time{})
+	durationType   = reflect.TypeOf(time.Duration(0))
+)
+
+// Builds a schema from Go structs, so the model of a service can be declared
+// next to the types that hold its data. Struct fields are described with an
+// odata tag, a comma separated list of options:
+//
+//	key              the property is part of the entity key
+//	name=Id          the name of the property, the field name by default
+//	type=Edm.Int64   the type of the property, inferred from the field type
+//	                 by default
+//	nullable=false   whether the property can be null. Pointers, slices,
+//	                 maps and interfaces are nullable by default, other
+//	                 values are not
+//	maxlength=256, precision=10, scale=2
+//	                 facets of the property
+//	partner=Orders   the partner of a navigation property
+//	dynamic          a map[string]interface{} field holding the dynamic
+//	                 properties of an open type
+//	-                the field is not part of the model
+//
+// Structs that have a key, or embed a struct that has one, become entity
+// types, other structs become complex types. Fields of an entity type
+// become navigation properties. An embedded struct becomes the base type
+// of the struct that embeds it, and named integer types implementing
+// GoDataEnum become enum types.
+type GoDataStructReflector struct {
+	Namespace string
+	schema    *GoDataSchema
+	// qualified type names by the Go types they were built from
+	types map[reflect.Type]string
+	// Go types by the type names they were given, to detect clashes
+	names map[string]reflect.Type
+	// the Go types that were built as entity types
+	entities map[reflect.Type]bool
+}
+
+func NewStructReflector(namespace string) *GoDataStructReflector {
+	return &GoDataStructReflector{
+		Namespace: namespace,
+		schema:    &GoDataSchema{Namespace: namespace},
+		types:     map[reflect.Type]string{},
+		names:     map[string]reflect.Type{},
+		entities:  map[reflect.Type]bool{},
+	}
+}
+
+// Build a schema from the types of the given values, and every type they
+// refer to.
+func ReflectSchema(namespace string, values ...interface{}) (*GoDataSchema, error) {
+	reflector := NewStructReflector(namespace)
+	for _, value := range values {
+		if _, err := reflector.Reflect(value); err != nil {
+			return nil, err
+		}
+	}
+	return reflector.Schema(), nil
+}
+
+// Add the type of a value to the schema, along with every type it refers to,
+// and return its qualified name. The value may be a struct, a pointer to a
+// struct or a reflect.Type.
+func (r *GoDataStructReflector) Reflect(value interface{}) (string, error) {
+	t, ok := value.(reflect.Type)
+	if !ok {
+		t = reflect.TypeOf(value)
+	}
+	if t == nil {
+		return "", errors.New("Cannot reflect the type of a nil value.")
+	}
+	t = derefType(t)
+	if t.Kind() != reflect.Struct {
+		return "", errors.New("Cannot reflect " + t.String() + ", it is not a struct.")
+	}
+	return r.reflectStruct(t, r.isEntity(t))
+}
+
+// The schema built from all reflected types.
+func (r *GoDataStructReflector) Schema() *GoDataSchema {
+	return r.schema
+}
+
+// Return the qualified name of the type built from a Go type, if it has been
+// reflected.
+func (r *GoDataStructReflector) TypeName(t reflect.Type) (string, bool) {
+	name, ok := r.types[derefType(t)]
+	return name, ok
+}
+
+func derefType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+// Check if a struct is an entity type, i.e. it has a key field, or embeds a
+// struct that has one.
+func (r *GoDataStructReflector) isEntity(t reflect.Type) bool {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		options, err := parseStructTag(field)
+		if err != nil || options == nil {
+			continue
+		}
+		if options.key {
+			return true
+		}
+		if ft := derefType(field.Type); field.Anonymous && ft.Kind() == reflect.Struct && ft != timeType {
+			if r.isEntity(ft) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Claim a type name for a Go type, making sure that two Go types from
+// different packages do not end up with the same name.
+func (r *GoDataStructReflector) register(t reflect.Type) (string, error) {
+	if other, ok := r.names[t.Name()]; ok && other != t {
+		return "", errors.New("Type name " + t.Name() + " is used by both " + other.String() +
+			" and " + t.String() + ".")
+	}
+	if t.Name() == "" {
+		return "", errors.New("Cannot reflect " + t.String() + ", only named types are supported.")
+	}
+	name := r.Namespace + "." + t.Name()
+	r.names[t.Name()] = t
+	r.types[t] = name
+	return name, nil
+}
+
+func (r *GoDataStructReflector) reflectStruct(t reflect.Type, entity bool) (string, error) {
+	if name, ok := r.types[t]; ok {
+		if entity && !r.entities[t] {
+			return "", errors.New(t.String() + " is used both as a complex type and as an entity type.")
+		}
+		return name, nil
+	}
+
+	name, err := r.register(t)
+	if err != nil {
+		return "", err
+	}
+
+	// add the type before its fields are reflected, so types are declared in
+	// the order they are found and types can refer to each other
+	var entityType *GoDataEntityType
+	var complexType *GoDataComplexType
+	if entity {
+		r.entities[t] = true
+		entityType = &GoDataEntityType{Name: t.Name()}
+		r.schema.EntityTypes = append(r.schema.EntityTypes, entityType)
+	} else {
+		complexType = &GoDataComplexType{Name: t.Name()}
+		r.schema.ComplexTypes = append(r.schema.ComplexTypes, complexType)
+	}
+
+	var baseType string
+	var open bool
+	var keys []*GoDataPropertyRef
+	props := []*GoDataProperty{}
+	navProps := []*GoDataNavigationProperty{}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		options, err := parseStructTag(field)
+		if err != nil {
+			return "", errors.New(t.String() + "." + field.Name + ": " + err.Error())
+		}
+		if options == nil {
+			// unexported or excluded
+			continue
+		}
+
+		ft := derefType(field.Type)
+		if field.Anonymous && ft.Kind() == reflect.Struct && ft != timeType {
+			if baseType != "" {
+				return "", errors.New(t.String() + " embeds more than one struct, but a type can only have one base type.")
+			}
+			baseType, err = r.reflectStruct(ft, entity)
+			if err != nil {
+				return "", err
+			}
+			continue
+		}
+
+		if options.dynamic {
+			if ft.Kind() != reflect.Map || ft.Key().Kind() != reflect.String {
+				return "", errors.New(t.String() + "." + field.Name + ": dynamic properties must be held in a map with string keys.")
+			}
+			open = true
+			continue
+		}
+
+		propType, nav, err := r.reflectFieldType(field.Type)
+		if err != nil {
+			return "", errors.New(t.String() + "." + field.Name + ": " + err.Error())
+		}
+		if options.typeName != "" {
+			collection := strings.HasPrefix(propType, "Collection(")
+			propType = options.typeName
+			if collection && !strings.HasPrefix(propType, "Collection(") {
+				propType = "Collection(" + propType + ")"
+			}
+		}
+
+		nullable := options.nullable
+		if nullable == "" && !isNullableType(field.Type) {
+			nullable = "false"
+		}
+
+		if nav {
+			if !entity {
+				return "", errors.New(t.String() + "." + field.Name + ": only entity types can have navigation properties.")
+			}
+			navProp := &GoDataNavigationProperty{
+				Name:    options.name,
+				Type:    propType,
+				Partner: options.partner,
+			}
+			if !strings.HasPrefix(propType, "Collection(") {
+				navProp.Nullable = nullable
+			}
+			navProps = append(navProps, navProp)
+			continue
+		}
+
+		if options.key {
+			nullable = "false"
+			keys = append(keys, &GoDataPropertyRef{Name: options.name})
+		}
+		props = append(props, &GoDataProperty{
+			Name:      options.name,
+			Type:      propType,
+			Nullable:  nullable,
+			MaxLength: options.maxLength,
+			Precision: options.precision,
+			Scale:     options.scale,
+		})
+	}
+
+	if !entity {
+		complexType.BaseType = baseType
+		complexType.Properties = props
+		if open {
+			complexType.OpenType = "true"
+		}
+		return name, nil
+	}
+
+	entityType.BaseType = baseType
+	entityType.Properties = props
+	entityType.NavigationProperties = navProps
+	if len(keys) > 0 {
+		entityType.Key = &GoDataKey{PropertyRefs: keys}
+	} else if baseType == "" {
+		// a base type that leaves the key to the types deriving from it
+		entityType.Abstract = "true"
+	}
+	if open {
+		entityType.OpenType = "true"
+	}
+	return name, nil
+}
+
+// Find the type name of a field type, and whether it is a navigation
+// property.
+func (r *GoDataStructReflector) reflectFieldType(t reflect.Type) (string, bool, error) {
+	t = derefType(t)
+
+	if t.Kind() == reflect.Slice && t.Elem().Kind() != reflect.Uint8 || t.Kind() == reflect.Array {
+		elem := derefType(t.Elem())
+		if elem.Kind() == reflect.Slice && elem.Elem().Kind() != reflect.Uint8 {
+			return "", false, errors.New("collections of collections are not supported.")
+		}
+		name, nav, err := r.reflectFieldType(elem)
+		if err != nil {
+			return "", false, err
+		}
+		return "Collection(" + name + ")", nav, nil
+	}
+
+	if t.Implements(goDataEnumType) || reflect.PtrTo(t).Implements(goDataEnumType) {
+		name, err := r.reflectEnum(t)
+		return name, false, err
+	}
+
+	switch t {
+	case timeType:
+		return GoDataDateTimeOffset, false, nil
+	case durationType:
+		return GoDataDuration, false, nil
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return GoDataString, false, nil
+	case reflect.Bool:
+		return GoDataBoolean, false, nil
+	case reflect.Int8:
+		return GoDataSByte, false, nil
+	case reflect.Uint8:
+		return GoDataByte, false, nil
+	case reflect.Int16:
+		return GoDataInt16, false, nil
+	case reflect.Uint16, reflect.Int32:
+		return GoDataInt32, false, nil
+	case reflect.Uint32, reflect.Int, reflect.Int64:
+		return GoDataInt64, false, nil
+	case reflect.Uint, reflect.Uint64:
+		return GoDataDecimal, false, nil
+	case reflect.Float32:
+		return GoDataSingle, false, nil
+	case reflect.Float64:
+		return GoDataDouble, false, nil
+	case reflect.Slice:
+		// []byte
+		return GoDataBinary, false, nil
+	case reflect.Interface:
+		return GoDataUntyped, false, nil
+	case reflect.Struct:
+		entity := r.isEntity(t)
+		name, err := r.reflectStruct(t, entity)
+		return name, entity, err
+	}
+
+	return "", false, errors.New("type " + t.String() + " has no Edm equivalent.")
+}
+
+func (r *GoDataStructReflector) reflectEnum(t reflect.Type) (string, error) {
+	if name, ok := r.types[t]; ok {
+		return name, nil
+	}
+
+	var underlyingType string
+	switch t.Kind() {
+	case reflect.Int8:
+		underlyingType = GoDataSByte
+	case reflect.Uint8:
+		underlyingType = GoDataByte
+	case reflect.Int16:
+		underlyingType = GoDataInt16
+	case reflect.Uint16, reflect.Int32:
+		underlyingType = GoDataInt32
+	case reflect.Uint32, reflect.Int, reflect.Int64:
+		underlyingType = GoDataInt64
+	default:
+		return "", errors.New("enum type " + t.String() + " must be an integer type.")
+	}
+
+	name, err := r.register(t)
+	if err != nil {
+		return "", err
+	}
+
+	var enum GoDataEnum
+	if t.Implements(goDataEnumType) {
+		enum = reflect.Zero(t).Interface().(GoDataEnum)
+	} else {
+		enum = reflect.New(t).Interface().(GoDataEnum)
+	}
+
+	r.schema.EnumTypes = append(r.schema.EnumTypes, &GoDataEnumType{
+		Name:           t.Name(),
+		UnderlyingType: underlyingType,
+		Members:        enum.EnumMembers(),
+	})
+	return name, nil
+}
+
+// Values of these types can be nil.
+func isNullableType(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice:
+		return true
+	}
+	return false
+}
+
+type structTagOptions struct {
+	name      string
+	typeName  string
+	nullable  string
+	maxLength string
+	precision int
+	scale     string
+	partner   string
+	key       bool
+	dynamic   bool
+}
+
+// Parse the odata tag of a struct field. Returns nil for fields that are not
+// part of the model.
+func parseStructTag(field reflect.StructField) (*structTagOptions, error) {
+	tag := field.Tag.Get("odata")
+	if tag == "-" || (field.PkgPath != "" && !field.Anonymous) {
+		return nil, nil
+	}
+
+	options := &structTagOptions{name: field.Name}
+	if tag == "" {
+		return options, nil
+	}
+
+	for _, option := range strings.Split(tag, ",") {
+		option = strings.TrimSpace(option)
+		value := ""
+		if i := strings.Index(option, "="); i >= 0 {
+			option, value = option[:i], option[i+1:]
+		}
+
+		switch option {
+		case "key":
+			options.key = true
+		case "dynamic":
+			options.dynamic = true
+		case "name":
+			options.name = value
+		case "type":
+			options.typeName = value
+		case "nullable":
+			if value != "true" && value != "false" {
+				return nil, errors.New("nullable must be true or false.")
+			}
+			options.nullable = value
+		case "maxlength":
+			options.maxLength = value
+		case "precision":
+			precision, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, errors.New("precision must be a number.")
+			}
+			options.precision = precision
+		case "scale":
+			options.scale = value
+		case "partner":
+			options.partner = value
+		case "":
+		default:
+			return nil, errors.New("unknown odata tag option " + option + ".")
+		}
+	}
+
+	if options.name == "" {
+		return nil, errors.New("the property name can not be empty.")
+	}
+	return options, nil
+}
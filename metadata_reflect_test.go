@@ -0,0 +1,146 @@
+package godata
+
+import (
+	"testing"
+	"time"
+)
+
+type reflectGender int
+
+func (reflectGender) EnumMembers() []*GoDataMember {
+	return []*GoDataMember{
+		&GoDataMember{Name: "Male", Value: "0"},
+		&GoDataMember{Name: "Female", Value: "1"},
+	}
+}
+
+type reflectAddress struct {
+	Street string `odata:"maxlength=128"`
+	City   *string
+}
+
+type reflectPerson struct {
+	Id        int64  `odata:"key,name=ID"`
+	Name      string `odata:"nullable=true"`
+	Gender    reflectGender
+	Born      time.Time
+	Addresses []reflectAddress
+	Photo     []byte
+	Extra     map[string]interface{} `odata:"dynamic"`
+	internal  string
+	Ignored   string `odata:"-"`
+}
+
+type reflectCustomer struct {
+	reflectPerson
+	Orders []*reflectOrder `odata:"partner=Customer"`
+}
+
+type reflectOrder struct {
+	Id       string           `odata:"key"`
+	Total    float64          `odata:"type=Edm.Decimal,precision=10,scale=2"`
+	Customer *reflectCustomer `odata:"partner=Orders"`
+}
+
+func TestReflectSchema(t *testing.T) {
+	schema, err := ReflectSchema("Store", reflectCustomer{})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(schema.EntityTypes) != 3 || len(schema.ComplexTypes) != 1 || len(schema.EnumTypes) != 1 {
+		t.Error("Unexpected number of types", len(schema.EntityTypes), len(schema.ComplexTypes), len(schema.EnumTypes))
+		return
+	}
+
+	customer := schema.EntityTypes[0]
+	if customer.Name != "reflectCustomer" || customer.BaseType != "Store.reflectPerson" {
+		t.Error("Embedded struct not reflected as base type", customer.Name, customer.BaseType)
+	}
+	if customer.Key != nil || len(customer.NavigationProperties) != 1 {
+		t.Error("Derived entity type not reflected")
+		return
+	}
+	if customer.NavigationProperties[0].Type != "Collection(Store.reflectOrder)" {
+		t.Error("Navigation property type is", customer.NavigationProperties[0].Type)
+	}
+
+	person := schema.EntityTypes[1]
+	if person.Key == nil || person.Key.PropertyRefs[0].Name != "ID" || person.OpenType != "true" {
+		t.Error("Base entity type not reflected")
+		return
+	}
+
+	expected := []struct {
+		name     string
+		t        string
+		nullable string
+	}{
+		{"ID", GoDataInt64, "false"},
+		{"Name", GoDataString, "true"},
+		{"Gender", "Store.reflectGender", "false"},
+		{"Born", GoDataDateTimeOffset, "false"},
+		{"Addresses", "Collection(Store.reflectAddress)", ""},
+		{"Photo", GoDataBinary, ""},
+	}
+	if len(person.Properties) != len(expected) {
+		t.Error("Expected", len(expected), "properties, got", len(person.Properties))
+		return
+	}
+	for i, e := range expected {
+		prop := person.Properties[i]
+		if prop.Name != e.name || prop.Type != e.t || prop.Nullable != e.nullable {
+			t.Error("Expected property", e, "got", prop.Name, prop.Type, prop.Nullable)
+		}
+	}
+
+	order := schema.EntityTypes[2]
+	if order.Properties[1].Type != GoDataDecimal || order.Properties[1].Precision != 10 || order.Properties[1].Scale != "2" {
+		t.Error("Tag facets not reflected")
+	}
+	if order.NavigationProperties[0].Partner != "Orders" {
+		t.Error("Partner not reflected")
+	}
+
+	if schema.ComplexTypes[0].Properties[0].MaxLength != "128" || schema.ComplexTypes[0].Properties[1].Nullable != "" {
+		t.Error("Complex type not reflected")
+	}
+	if schema.EnumTypes[0].UnderlyingType != GoDataInt64 || len(schema.EnumTypes[0].Members) != 2 {
+		t.Error("Enum type not reflected")
+	}
+
+	schema.EntityContainers = []*GoDataEntityContainer{
+		&GoDataEntityContainer{
+			Name: "Container",
+			EntitySets: []*GoDataEntitySet{
+				&GoDataEntitySet{Name: "Customers", EntityType: "Store.reflectCustomer"},
+			},
+		},
+	}
+	metadata := &GoDataMetadata{DataServices: &GoDataServices{Schemas: []*GoDataSchema{schema}}}
+	if err := ValidateMetadata(metadata); err != nil {
+		t.Error(err)
+	}
+}
+
+type reflectBadTag struct {
+	Id int `odata:"key,primary"`
+}
+
+type reflectComplexWithEntity struct {
+	Order reflectOrder
+}
+
+func TestReflectSchemaErrors(t *testing.T) {
+	if _, err := ReflectSchema("Store", reflectBadTag{}); err == nil {
+		t.Error("Unknown tag option was accepted")
+	}
+	if _, err := ReflectSchema("Store", reflectComplexWithEntity{}); err == nil {
+		t.Error("Navigation property on a complex type was accepted")
+	}
+	if _, err := ReflectSchema("Store", 42); err == nil {
+		t.Error("Non-struct value was accepted")
+	}
+}
@@ -0,0 +1,671 @@
+package godata
+
+import (
+	"strconv"
+	"strings"
+)
+
+// The primitive types defined by the Edm namespace, including the abstract
+// types that may be used in vocabularies.
+var edmPrimitiveTypes = map[string]bool{
+	GoDataBinary:         true,
+	GoDataBoolean:        true,
+	GoDataByte:           true,
+	GoDataDate:           true,
+	GoDataDateTimeOffset: true,
+	GoDataDecimal:        true,
+	GoDataDouble:         true,
+	GoDataDuration:       true,
+	GoDataGuid:           true,
+	GoDataInt16:          true,
+	GoDataInt32:          true,
+	GoDataInt64:          true,
+	GoDataSByte:          true,
+	GoDataSingle:         true,
+	GoDataStream:         true,
+	GoDataString:         true,
+	GoDataTimeOfDay:      true,
+	GoDataUntyped:        true,
+
+	"Edm.Geography":                    true,
+	"Edm.GeographyPoint":               true,
+	"Edm.GeographyLineString":          true,
+	"Edm.GeographyPolygon":             true,
+	"Edm.GeographyMultiPoint":          true,
+	"Edm.GeographyMultiLineString":     true,
+	"Edm.GeographyMultiPolygon":        true,
+	"Edm.GeographyCollection":          true,
+	"Edm.Geometry":                     true,
+	"Edm.GeometryPoint":                true,
+	"Edm.GeometryLineString":           true,
+	"Edm.GeometryPolygon":              true,
+	"Edm.GeometryMultiPoint":           true,
+	"Edm.GeometryMultiLineString":      true,
+	"Edm.GeometryMultiPolygon":         true,
+	"Edm.GeometryCollection":           true,
+	"Edm.PrimitiveType":                true,
+	"Edm.ComplexType":                  true,
+	"Edm.EntityType":                   true,
+	"Edm.AnnotationPath":               true,
+	"Edm.PropertyPath":                 true,
+	"Edm.NavigationPropertyPath":       true,
+	"Edm.AnyPropertyPath":              true,
+	"Edm.ModelElementPath":             true,
+	"Edm.ModelElementPathWithTermCast": true,
+}
+
+// The types an enum type may be based on.
+var edmEnumUnderlyingTypes = map[string]bool{
+	GoDataByte:  true,
+	GoDataSByte: true,
+	GoDataInt16: true,
+	GoDataInt32: true,
+	GoDataInt64: true,
+}
+
+// A problem found in the metadata of a service. The location is the path of
+// the model element, e.g. "Store.Customer/Orders" for a navigation property
+// or "Store.Container/Customers" for an entity set.
+type GoDataMetadataProblem struct {
+	Location string
+	Message  string
+}
+
+// Returned by ValidateMetadata and BuildService when the metadata of a
+// provider is not a valid model. It lists every problem that was found, so
+// they can all be fixed at once.
+type GoDataMetadataError struct {
+	Problems []*GoDataMetadataProblem
+}
+
+func (err *GoDataMetadataError) Error() string {
+	lines := []string{"Invalid metadata, found " + strconv.Itoa(len(err.Problems)) + " problem(s):"}
+	for _, problem := range err.Problems {
+		lines = append(lines, "  "+problem.Location+": "+problem.Message)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Check that the metadata describes a consistent model: every type name
+// resolves, entity types have keys made of their own properties, navigation
+// properties and their partners agree with each other, navigation property
+// bindings lead to entity sets, and names are unique. Returns a
+// *GoDataMetadataError listing all problems, or nil if there are none.
+func ValidateMetadata(metadata *GoDataMetadata) error {
+	v := &metadataValidator{
+		entityTypes:  map[string]*GoDataEntityType{},
+		complexTypes: map[string]*GoDataComplexType{},
+		enumTypes:    map[string]*GoDataEnumType{},
+		definitions:  map[string]*GoDataTypeDefinition{},
+		actions:      map[string]bool{},
+		functions:    map[string]bool{},
+		containers:   map[string]*GoDataEntityContainer{},
+		aliases:      map[string]string{},
+		external:     map[string]bool{},
+	}
+
+	if metadata == nil || metadata.DataServices == nil {
+		v.problem("$metadata", "the metadata has no data services.")
+		return v.result()
+	}
+
+	v.index(metadata)
+
+	for _, schema := range metadata.DataServices.Schemas {
+		v.validateSchema(schema)
+	}
+
+	return v.result()
+}
+
+type metadataValidator struct {
+	problems []*GoDataMetadataProblem
+
+	// model elements by their namespace qualified names
+	entityTypes  map[string]*GoDataEntityType
+	complexTypes map[string]*GoDataComplexType
+	enumTypes    map[string]*GoDataEnumType
+	definitions  map[string]*GoDataTypeDefinition
+	actions      map[string]bool
+	functions    map[string]bool
+	containers   map[string]*GoDataEntityContainer
+	// schema aliases mapped to their namespaces
+	aliases map[string]string
+	// namespaces and aliases included from referenced documents, whose types
+	// can not be checked
+	external map[string]bool
+}
+
+func (v *metadataValidator) problem(location, message string) {
+	v.problems = append(v.problems, &GoDataMetadataProblem{location, message})
+}
+
+func (v *metadataValidator) result() error {
+	if len(v.problems) == 0 {
+		return nil
+	}
+	return &GoDataMetadataError{v.problems}
+}
+
+// Index every named element of the model by its qualified name, reporting
+// names that are declared twice.
+func (v *metadataValidator) index(metadata *GoDataMetadata) {
+	for _, ref := range metadata.References {
+		for _, include := range ref.Includes {
+			v.external[include.Namespace] = true
+			if include.Alias != "" {
+				v.external[include.Alias] = true
+			}
+		}
+	}
+
+	namespaces := map[string]bool{}
+	for _, schema := range metadata.DataServices.Schemas {
+		if schema.Namespace == "" {
+			v.problem("Schema", "the schema has no namespace.")
+			continue
+		}
+		if namespaces[schema.Namespace] {
+			v.problem(schema.Namespace, "the namespace is declared by more than one schema.")
+		}
+		namespaces[schema.Namespace] = true
+		if schema.Alias != "" {
+			v.aliases[schema.Alias] = schema.Namespace
+		}
+
+		// types, terms and containers share one set of names, while actions
+		// and functions may be overloaded among themselves
+		names := map[string]bool{}
+		declare := func(name string) {
+			if name == "" {
+				v.problem(schema.Namespace, "an element of the schema has no name.")
+			} else if names[name] {
+				v.problem(schema.Namespace+"."+name, "the name is declared more than once.")
+			}
+			names[name] = true
+		}
+
+		for _, t := range schema.EntityTypes {
+			declare(t.Name)
+			v.entityTypes[schema.Namespace+"."+t.Name] = t
+		}
+		for _, t := range schema.ComplexTypes {
+			declare(t.Name)
+			v.complexTypes[schema.Namespace+"."+t.Name] = t
+		}
+		for _, t := range schema.EnumTypes {
+			declare(t.Name)
+			v.enumTypes[schema.Namespace+"."+t.Name] = t
+		}
+		for _, t := range schema.TypeDefinitions {
+			declare(t.Name)
+			v.definitions[schema.Namespace+"."+t.Name] = t
+		}
+		for _, t := range schema.Terms {
+			declare(t.Name)
+		}
+		for _, c := range schema.EntityContainers {
+			declare(c.Name)
+			v.containers[schema.Namespace+"."+c.Name] = c
+		}
+
+		for _, a := range schema.Actions {
+			if names[a.Name] {
+				v.problem(schema.Namespace+"."+a.Name, "the name is declared more than once.")
+			}
+			v.actions[schema.Namespace+"."+a.Name] = true
+		}
+		for _, f := range schema.Functions {
+			if names[f.Name] || v.actions[schema.Namespace+"."+f.Name] {
+				v.problem(schema.Namespace+"."+f.Name, "the name is declared more than once.")
+			}
+			v.functions[schema.Namespace+"."+f.Name] = true
+		}
+	}
+}
+
+// Replace the alias of a qualified name with the namespace it stands for.
+func (v *metadataValidator) qualify(name string) string {
+	i := strings.LastIndex(name, ".")
+	if i < 0 {
+		return name
+	}
+	if namespace, ok := v.aliases[name[:i]]; ok {
+		return namespace + name[i:]
+	}
+	return name
+}
+
+// Check if a qualified name belongs to a referenced document.
+func (v *metadataValidator) isExternal(name string) bool {
+	i := strings.LastIndex(name, ".")
+	return i > 0 && v.external[name[:i]]
+}
+
+// Check that a type name, possibly a collection, resolves to a primitive or
+// schema type.
+func (v *metadataValidator) validateType(location, t string) {
+	name := strings.TrimSuffix(strings.TrimPrefix(t, "Collection("), ")")
+	if name == "" {
+		v.problem(location, "the type is missing.")
+		return
+	}
+	if strings.HasPrefix(name, "Edm.") {
+		if !edmPrimitiveTypes[name] {
+			v.problem(location, name+" is not an Edm primitive type.")
+		}
+		return
+	}
+
+	name = v.qualify(name)
+	if v.entityTypes[name] != nil || v.complexTypes[name] != nil ||
+		v.enumTypes[name] != nil || v.definitions[name] != nil || v.isExternal(name) {
+		return
+	}
+	v.problem(location, "type "+name+" does not exist.")
+}
+
+func (v *metadataValidator) lookupEntityType(name string) *GoDataEntityType {
+	name = strings.TrimSuffix(strings.TrimPrefix(name, "Collection("), ")")
+	return v.entityTypes[v.qualify(name)]
+}
+
+func (v *metadataValidator) lookupComplexType(name string) *GoDataComplexType {
+	name = strings.TrimSuffix(strings.TrimPrefix(name, "Collection("), ")")
+	return v.complexTypes[v.qualify(name)]
+}
+
+// Find a structural property of an entity type, including the properties it
+// inherits.
+func (v *metadataValidator) findProperty(entity *GoDataEntityType, name string) *GoDataProperty {
+	seen := map[*GoDataEntityType]bool{}
+	for entity != nil && !seen[entity] {
+		seen[entity] = true
+		for _, prop := range entity.Properties {
+			if prop.Name == name {
+				return prop
+			}
+		}
+		entity = v.lookupEntityType(entity.BaseType)
+	}
+	return nil
+}
+
+// Find a navigation property of an entity type, including the navigation
+// properties it inherits.
+func (v *metadataValidator) findNavigationProperty(entity *GoDataEntityType, name string) *GoDataNavigationProperty {
+	seen := map[*GoDataEntityType]bool{}
+	for entity != nil && !seen[entity] {
+		seen[entity] = true
+		for _, prop := range entity.NavigationProperties {
+			if prop.Name == name {
+				return prop
+			}
+		}
+		entity = v.lookupEntityType(entity.BaseType)
+	}
+	return nil
+}
+
+// Check if an entity type is, or derives from, another.
+func (v *metadataValidator) derivesFrom(entity, base *GoDataEntityType) bool {
+	seen := map[*GoDataEntityType]bool{}
+	for entity != nil && !seen[entity] {
+		if entity == base {
+			return true
+		}
+		seen[entity] = true
+		entity = v.lookupEntityType(entity.BaseType)
+	}
+	return false
+}
+
+// Check if an entity type has a key, either its own or an inherited one.
+func (v *metadataValidator) hasKey(entity *GoDataEntityType) bool {
+	seen := map[*GoDataEntityType]bool{}
+	for entity != nil && !seen[entity] {
+		if len(entity.Key.Refs()) > 0 {
+			return true
+		}
+		seen[entity] = true
+		entity = v.lookupEntityType(entity.BaseType)
+	}
+	return false
+}
+
+func (v *metadataValidator) validateSchema(schema *GoDataSchema) {
+	for _, t := range schema.EntityTypes {
+		v.validateEntityType(schema.Namespace+"."+t.Name, t)
+	}
+	for _, t := range schema.ComplexTypes {
+		location := schema.Namespace + "." + t.Name
+		if t.BaseType != "" && v.lookupComplexType(t.BaseType) == nil && !v.isExternal(t.BaseType) {
+			v.problem(location, "base type "+t.BaseType+" is not a complex type.")
+		}
+		v.validateProperties(location, t.Properties, t.NavigationProperties)
+		for _, prop := range t.NavigationProperties {
+			v.validateNavigationProperty(location+"/"+prop.Name, nil, prop)
+		}
+	}
+	for _, t := range schema.EnumTypes {
+		location := schema.Namespace + "." + t.Name
+		if t.UnderlyingType != "" && !edmEnumUnderlyingTypes[t.UnderlyingType] {
+			v.problem(location, t.UnderlyingType+" is not a valid underlying type for an enum type.")
+		}
+		members := map[string]bool{}
+		for _, member := range t.Members {
+			if members[member.Name] {
+				v.problem(location+"/"+member.Name, "the member is declared more than once.")
+			}
+			members[member.Name] = true
+		}
+	}
+	for _, t := range schema.TypeDefinitions {
+		if !edmPrimitiveTypes[t.UnderlyingType] {
+			v.problem(schema.Namespace+"."+t.Name, "the underlying type "+t.UnderlyingType+" is not an Edm primitive type.")
+		}
+	}
+	for _, t := range schema.Terms {
+		v.validateType(schema.Namespace+"."+t.Name, t.Type)
+	}
+	for _, a := range schema.Actions {
+		v.validateOperation(schema.Namespace+"."+a.Name, a.Parameters, a.ReturnType)
+	}
+	for _, f := range schema.Functions {
+		location := schema.Namespace + "." + f.Name
+		if f.ReturnType == nil {
+			v.problem(location, "the function has no return type.")
+		}
+		v.validateOperation(location, f.Parameters, f.ReturnType)
+	}
+	for _, c := range schema.EntityContainers {
+		v.validateContainer(schema.Namespace+"."+c.Name, c)
+	}
+}
+
+func (v *metadataValidator) validateEntityType(location string, entity *GoDataEntityType) {
+	if entity.BaseType != "" {
+		base := v.lookupEntityType(entity.BaseType)
+		if base == nil && !v.isExternal(entity.BaseType) {
+			v.problem(location, "base type "+entity.BaseType+" is not an entity type.")
+		} else if base != nil && v.derivesFrom(base, entity) {
+			v.problem(location, "the type derives from itself.")
+		}
+	}
+
+	if len(entity.Key.Refs()) > 0 {
+		if entity.BaseType != "" && v.hasKey(v.lookupEntityType(entity.BaseType)) {
+			v.problem(location, "the type declares a key, but its base type already has one.")
+		}
+		for _, ref := range entity.Key.Refs() {
+			v.validateKeyProperty(location, entity, ref)
+		}
+	} else if entity.Abstract != "true" && !v.hasKey(entity) && !v.isExternal(entity.BaseType) {
+		v.problem(location, "the entity type has no key.")
+	}
+
+	v.validateProperties(location, entity.Properties, entity.NavigationProperties)
+	for _, prop := range entity.NavigationProperties {
+		v.validateNavigationProperty(location+"/"+prop.Name, entity, prop)
+	}
+}
+
+// Check that a key property exists and is of a type that can be used in a
+// key. Keys may refer to properties of complex properties with a path.
+func (v *metadataValidator) validateKeyProperty(location string, entity *GoDataEntityType, ref *GoDataPropertyRef) {
+	segments := strings.Split(ref.Name, "/")
+	if len(segments) > 1 && ref.Alias == "" {
+		v.problem(location, "key property "+ref.Name+" needs an alias.")
+	}
+
+	prop := v.findProperty(entity, segments[0])
+	for _, segment := range segments[1:] {
+		if prop == nil {
+			break
+		}
+		complexType := v.lookupComplexType(prop.Type)
+		prop = nil
+		if complexType != nil {
+			for _, p := range complexType.Properties {
+				if p.Name == segment {
+					prop = p
+				}
+			}
+		}
+	}
+
+	if prop == nil {
+		v.problem(location, "key property "+ref.Name+" does not exist.")
+		return
+	}
+	if strings.HasPrefix(prop.Type, "Collection(") || prop.Type == GoDataStream ||
+		v.lookupComplexType(prop.Type) != nil {
+		v.problem(location, "key property "+ref.Name+" must be of a primitive or enum type.")
+	}
+}
+
+func (v *metadataValidator) validateProperties(
+	location string,
+	props []*GoDataProperty,
+	navProps []*GoDataNavigationProperty,
+) {
+	names := map[string]bool{}
+	for _, prop := range props {
+		if names[prop.Name] {
+			v.problem(location+"/"+prop.Name, "the property is declared more than once.")
+		}
+		names[prop.Name] = true
+		v.validateType(location+"/"+prop.Name, prop.Type)
+	}
+	for _, prop := range navProps {
+		if names[prop.Name] {
+			v.problem(location+"/"+prop.Name, "the property is declared more than once.")
+		}
+		names[prop.Name] = true
+	}
+}
+
+// Check that a navigation property leads to an entity type, and that its
+// partner, if any, leads back to it.
+func (v *metadataValidator) validateNavigationProperty(
+	location string,
+	entity *GoDataEntityType,
+	prop *GoDataNavigationProperty,
+) {
+	target := v.lookupEntityType(prop.Type)
+	if target == nil {
+		if !v.isExternal(strings.TrimSuffix(strings.TrimPrefix(prop.Type, "Collection("), ")")) {
+			v.problem(location, "type "+prop.Type+" is not an entity type.")
+		}
+		return
+	}
+
+	for _, constraint := range prop.ReferentialConstraints {
+		if entity != nil && v.findProperty(entity, constraint.Property) == nil {
+			v.problem(location, "referential constraint property "+constraint.Property+" does not exist.")
+		}
+		if v.findProperty(target, constraint.ReferencedProperty) == nil {
+			v.problem(location, "referenced property "+constraint.ReferencedProperty+" does not exist on "+prop.Type+".")
+		}
+	}
+
+	if prop.Partner == "" || entity == nil {
+		return
+	}
+	partner := v.findNavigationProperty(target, prop.Partner)
+	if partner == nil {
+		v.problem(location, "partner "+prop.Partner+" does not exist on "+prop.Type+".")
+		return
+	}
+	if partnerType := v.lookupEntityType(partner.Type); partnerType == nil || !v.derivesFrom(entity, partnerType) {
+		v.problem(location, "partner "+prop.Partner+" does not lead back to this type.")
+	}
+	if partner.Partner != "" && partner.Partner != prop.Name {
+		v.problem(location, "partner "+prop.Partner+" names "+partner.Partner+" as its partner.")
+	}
+}
+
+func (v *metadataValidator) validateOperation(location string, params []*GoDataParameter, returnType *GoDataReturnType) {
+	names := map[string]bool{}
+	for _, param := range params {
+		if names[param.Name] {
+			v.problem(location+"/"+param.Name, "the parameter is declared more than once.")
+		}
+		names[param.Name] = true
+		v.validateType(location+"/"+param.Name, param.Type)
+	}
+	if returnType != nil {
+		v.validateType(location+"/$ReturnType", returnType.Type)
+	}
+}
+
+func (v *metadataValidator) validateContainer(location string, container *GoDataEntityContainer) {
+	names := map[string]bool{}
+	declare := func(name string) {
+		if names[name] {
+			v.problem(location+"/"+name, "the name is declared more than once.")
+		}
+		names[name] = true
+	}
+
+	for _, set := range container.EntitySets {
+		declare(set.Name)
+		entity := v.lookupEntityType(set.EntityType)
+		if entity == nil {
+			v.problem(location+"/"+set.Name, "entity type "+set.EntityType+" does not exist.")
+			continue
+		}
+		v.validateBindings(location+"/"+set.Name, container, entity, set.NavigationPropertyBindings)
+	}
+	for _, singleton := range container.Singletons {
+		declare(singleton.Name)
+		entity := v.lookupEntityType(singleton.Type)
+		if entity == nil {
+			v.problem(location+"/"+singleton.Name, "entity type "+singleton.Type+" does not exist.")
+			continue
+		}
+		v.validateBindings(location+"/"+singleton.Name, container, entity, singleton.NavigationPropertyBindings)
+	}
+	for _, imp := range container.ActionImports {
+		declare(imp.Name)
+		if !v.actions[v.qualify(imp.Action)] && !v.isExternal(imp.Action) {
+			v.problem(location+"/"+imp.Name, "action "+imp.Action+" does not exist.")
+		}
+		if imp.EntitySet != "" && !v.hasEntitySet(container, imp.EntitySet) {
+			v.problem(location+"/"+imp.Name, "entity set "+imp.EntitySet+" does not exist.")
+		}
+	}
+	for _, imp := range container.FunctionImports {
+		declare(imp.Name)
+		if !v.functions[v.qualify(imp.Function)] && !v.isExternal(imp.Function) {
+			v.problem(location+"/"+imp.Name, "function "+imp.Function+" does not exist.")
+		}
+		if imp.EntitySet != "" && !v.hasEntitySet(container, imp.EntitySet) {
+			v.problem(location+"/"+imp.Name, "entity set "+imp.EntitySet+" does not exist.")
+		}
+	}
+}
+
+// Check that each binding path ends in a navigation property, and that its
+// target is an entity set or singleton.
+func (v *metadataValidator) validateBindings(
+	location string,
+	container *GoDataEntityContainer,
+	entity *GoDataEntityType,
+	bindings []*GoDataNavigationPropertyBinding,
+) {
+	for _, binding := range bindings {
+		if !v.validBindingPath(entity, binding.Path) {
+			v.problem(location, "binding path "+binding.Path+" does not lead to a navigation property.")
+		}
+		if !v.hasEntitySet(container, binding.Target) {
+			v.problem(location, "binding target "+binding.Target+" for "+binding.Path+" does not exist.")
+		}
+	}
+}
+
+// A binding path is made of complex properties and type casts, and ends with
+// a navigation property.
+func (v *metadataValidator) validBindingPath(entity *GoDataEntityType, path string) bool {
+	segments := strings.Split(path, "/")
+	var complexType *GoDataComplexType
+
+	for i, segment := range segments {
+		last := i == len(segments)-1
+
+		if strings.Contains(segment, ".") {
+			// type cast to a derived type
+			if last {
+				return false
+			}
+			if derived := v.lookupEntityType(segment); derived != nil && complexType == nil {
+				entity = derived
+			} else if derived := v.lookupComplexType(segment); derived != nil && complexType != nil {
+				complexType = derived
+			} else {
+				return false
+			}
+			continue
+		}
+
+		var navProps []*GoDataNavigationProperty
+		var prop *GoDataProperty
+		if complexType != nil {
+			navProps = complexType.NavigationProperties
+			for _, p := range complexType.Properties {
+				if p.Name == segment {
+					prop = p
+				}
+			}
+		} else if navProp := v.findNavigationProperty(entity, segment); navProp != nil {
+			navProps = []*GoDataNavigationProperty{navProp}
+		} else {
+			prop = v.findProperty(entity, segment)
+		}
+
+		if last {
+			for _, navProp := range navProps {
+				if navProp.Name == segment {
+					return true
+				}
+			}
+			return false
+		}
+
+		if prop == nil {
+			// only complex properties may be traversed
+			return false
+		}
+		complexType = v.lookupComplexType(prop.Type)
+		if complexType == nil {
+			return false
+		}
+	}
+
+	return false
+}
+
+// Check if a binding target names an entity set or singleton, either of the
+// given container or, qualified by its container, of another.
+func (v *metadataValidator) hasEntitySet(container *GoDataEntityContainer, target string) bool {
+	if i := strings.LastIndex(target, "/"); i >= 0 {
+		other, ok := v.containers[v.qualify(target[:i])]
+		if !ok {
+			return v.isExternal(target[:i])
+		}
+		container = other
+		target = target[i+1:]
+	}
+
+	for _, set := range container.EntitySets {
+		if set.Name == target {
+			return true
+		}
+	}
+	for _, singleton := range container.Singletons {
+		if singleton.Name == target {
+			return true
+		}
+	}
+	return false
+}
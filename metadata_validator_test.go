@@ -0,0 +1,105 @@
+package godata
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateMetadata(t *testing.T) {
+	if err := ValidateMetadata((&DummyProvider{}).GetMetadata()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestValidateParsedMetadata(t *testing.T) {
+	metadata, err := ParseMetadata(strings.NewReader(testCsdlDocument))
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = ValidateMetadata(metadata)
+
+	metadataErr, ok := err.(*GoDataMetadataError)
+	if !ok || len(metadataErr.Problems) != 1 {
+		t.Error("Expected exactly one problem, got", err)
+		return
+	}
+	if metadataErr.Problems[0].Location != "Trippin.Container/GetNearestAirport" {
+		t.Error("Unexpected problem location", metadataErr.Problems[0].Location)
+	}
+}
+
+func TestValidateInvalidMetadata(t *testing.T) {
+	metadata := (&DummyProvider{}).GetMetadata()
+	schema := metadata.DataServices.Schemas[0]
+
+	customer := schema.EntityTypes[0]
+	customer.Key = nil
+	customer.Properties[1].Type = "Edm.Int"
+	customer.NavigationProperties[0].Partner = "Buyer"
+
+	product := schema.EntityTypes[2]
+	product.Key.PropertyRefs[0].Name = "Code"
+
+	schema.EntityTypes = append(schema.EntityTypes, &GoDataEntityType{
+		Name: "Photo",
+		Key:  &GoDataKey{PropertyRefs: []*GoDataPropertyRef{&GoDataPropertyRef{Name: "Id"}}},
+		Properties: []*GoDataProperty{
+			&GoDataProperty{Name: "Id", Type: GoDataInt32},
+		},
+	})
+
+	sets := schema.EntityContainers[0].EntitySets
+	sets[0].NavigationPropertyBindings[0].Path = "Order"
+	sets[1].NavigationPropertyBindings[0].Target = "Buyers"
+	sets[2].EntityType = "Store.Prodcut"
+
+	err := ValidateMetadata(metadata)
+
+	metadataErr, ok := err.(*GoDataMetadataError)
+	if !ok {
+		t.Error("Expected a metadata error, got", err)
+		return
+	}
+
+	expected := []string{
+		"Store.Photo: the name is declared more than once.",
+		"Store.Customer: the entity type has no key.",
+		"Store.Customer/Age: Edm.Int is not an Edm primitive type.",
+		"Store.Customer/Orders: partner Buyer does not exist on Collection(Store.Order).",
+		"Store.Order/Customer: partner Orders names Buyer as its partner.",
+		"Store.Product: key property Code does not exist.",
+		"Store.Collections/Customers: binding path Order does not lead to a navigation property.",
+		"Store.Collections/Orders: binding target Buyers for Customer does not exist.",
+		"Store.Collections/Products: entity type Store.Prodcut does not exist.",
+	}
+
+	for _, e := range expected {
+		if !strings.Contains(err.Error(), e) {
+			t.Error("Expected problem \"" + e + "\" in:\n" + err.Error())
+		}
+	}
+	if len(metadataErr.Problems) != len(expected) {
+		t.Error("Expected", len(expected), "problems, got:\n"+err.Error())
+	}
+}
+
+func TestBuildServiceRejectsInvalidMetadata(t *testing.T) {
+	_, err := BuildService(&invalidMetadataProvider{}, "http://localhost")
+
+	if _, ok := err.(*GoDataMetadataError); !ok {
+		t.Error("Expected a metadata error, got", err)
+	}
+}
+
+type invalidMetadataProvider struct {
+	DummyProvider
+}
+
+func (*invalidMetadataProvider) GetMetadata() *GoDataMetadata {
+	metadata := (&DummyProvider{}).GetMetadata()
+	metadata.DataServices.Schemas[0].EntityContainers[0].EntitySets[0].EntityType = "Store.Customr"
+	return metadata
+}
@@ -10,46 +10,125 @@ const (
 )
 
 type OrderByItem struct {
+	// The root token of the expression, e.g. the property of Name desc.
 	Field *Token
-	Order string
+	// The parse tree of the expression, e.g. tolower(Name) or Orders/$count.
+	Tree *ParseNode
+	// The typed expression built from the tree when the query is
+	// semanticized.
+	Expression FilterExpression
+	Order      string
 }
 
 func ParseOrderByString(orderby string) (*GoDataOrderByQuery, error) {
-	items := strings.Split(orderby, ",")
+	return ParseOrderByStringWithAliases(orderby, nil)
+}
+
+// Parse an $orderby whose items may be parameter aliases, e.g. @p desc. The
+// alias is replaced with its value, given by name including the @.
+func ParseOrderByStringWithAliases(orderby string, aliases map[string]string) (*GoDataOrderByQuery, error) {
+	return ParseOrderByStringWithFunctions(orderby, aliases, GlobalFilterFunctions)
+}
+
+// Parse an $orderby whose items are expressions followed by an optional
+// direction, e.g. tolower(Name) desc. The expressions are parsed with the
+// filter grammar, so they may refer to parameter aliases and call the
+// functions in the given table.
+func ParseOrderByStringWithFunctions(orderby string, aliases map[string]string, functions *FilterFunctionTable) (*GoDataOrderByQuery, error) {
+	items, err := splitTopLevel(orderby, ',')
+	if err != nil {
+		return nil, err
+	}
 
 	result := make([]*OrderByItem, 0)
 
 	for _, v := range items {
-		parts := strings.Split(v, " ")
-		field := &Token{Value: parts[0]}
+		expression := strings.TrimSpace(v)
 		var order string = ASC
-		if len(parts) > 1 {
-			if strings.ToLower(parts[1]) == ASC {
-				order = ASC
-			} else if strings.ToLower(parts[1]) == DESC {
-				order = DESC
-			} else {
-				return nil, BadRequestError("Could not parse orderby query.")
-			}
+		lower := strings.ToLower(expression)
+		if strings.HasSuffix(lower, " "+ASC) {
+			expression = expression[:len(expression)-len(ASC)]
+		} else if strings.HasSuffix(lower, " "+DESC) {
+			expression = expression[:len(expression)-len(DESC)]
+			order = DESC
+		}
+		if strings.TrimSpace(expression) == "" {
+			return nil, BadRequestError("Could not parse orderby query.")
 		}
-		result = append(result, &OrderByItem{field, order})
+
+		filter, err := functions.ParseFilter(expression, aliases)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, &OrderByItem{Field: filter.Tree.Token, Tree: filter.Tree, Order: order})
 	}
 
 	return &GoDataOrderByQuery{result}, nil
 }
 
+// A deep copy of an unsemanticized $orderby.
+func cloneOrderByQuery(orderby *GoDataOrderByQuery) *GoDataOrderByQuery {
+	if orderby == nil {
+		return nil
+	}
+	copied := &GoDataOrderByQuery{OrderByItems: make([]*OrderByItem, len(orderby.OrderByItems))}
+	for i, item := range orderby.OrderByItems {
+		tree := cloneParseNode(item.Tree)
+		copied.OrderByItems[i] = &OrderByItem{Field: tree.Token, Tree: tree, Order: item.Order}
+	}
+	return copied
+}
+
 func SemanticizeOrderByQuery(orderby *GoDataOrderByQuery, service *GoDataService, entity *GoDataEntityType) error {
+	return SemanticizeOrderByQueryWithCompute(orderby, service, entity, nil)
+}
+
+// Check an $orderby that may refer to the properties computed by a $compute.
+func SemanticizeOrderByQueryWithCompute(
+	orderby *GoDataOrderByQuery,
+	service *GoDataService,
+	entity *GoDataEntityType,
+	compute *GoDataComputeQuery,
+) error {
+
+	return semanticizeOrderByInScope(orderby, service, entity, &applyScope{computed: compute.properties()})
+}
+
+// Check an $orderby of the set produced by an $apply.
+func semanticizeOrderByInScope(
+	orderby *GoDataOrderByQuery,
+	service *GoDataService,
+	entity *GoDataEntityType,
+	scope *applyScope,
+) error {
+
 	if orderby == nil {
 		return nil
 	}
 
+	return semanticizeOrderBy(orderby, &filterChecker{
+		service:   service,
+		entity:    entity,
+		open:      service.IsOpenType(entity),
+		computed:  scope.computed,
+		remaining: scope.remaining,
+	})
+}
+
+// Type each item of an $orderby, and check that its values can be ordered.
+func semanticizeOrderBy(orderby *GoDataOrderByQuery, checker *filterChecker) error {
 	for _, item := range orderby.OrderByItems {
-		if prop, ok := service.PropertyLookup[entity][item.Field.Value]; ok {
-			item.Field.SemanticType = SemanticTypeProperty
-			item.Field.SemanticReference = prop
-		} else {
-			return BadRequestError("No property " + item.Field.Value + " for entity " + entity.Name)
+		expr, err := checker.check(item.Tree)
+		if err != nil {
+			return err
+		}
+		t := checker.underlyingType(expr.EdmType())
+		entityType, complexType, _ := checker.lookupStructuredType(t)
+		if isUnorderedType(t) || entityType != nil || complexType != nil {
+			return BadRequestError("Can not order by '" + filterNodeString(item.Tree) + "' of type " +
+				describeType(t) + ".")
 		}
+		item.Expression = expr
 	}
 
 	return nil
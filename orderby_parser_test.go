@@ -0,0 +1,79 @@
+package godata
+
+import (
+	"strings"
+	"testing"
+)
+
+func checkTestOrderBy(orderby string) (*GoDataOrderByQuery, error) {
+	service, err := BuildService(&DummyProvider{}, "http://localhost")
+	if err != nil {
+		return nil, err
+	}
+	entity, err := service.LookupEntityType("Customer")
+	if err != nil {
+		return nil, err
+	}
+	query, err := ParseOrderByString(orderby)
+	if err != nil {
+		return nil, err
+	}
+	return query, SemanticizeOrderByQuery(query, service, entity)
+}
+
+func TestOrderByExpressions(t *testing.T) {
+	input := "tolower(Name) desc,Orders/$count  DESC, concat(Name,', ') asc,Age"
+
+	output, err := checkTestOrderBy(input)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	items := output.OrderByItems
+	if len(items) != 4 {
+		t.Error("Expected 4 items, got", len(items))
+		return
+	}
+
+	if items[0].Order != DESC || items[0].Field.Value != "tolower" ||
+		items[0].Expression.(*FilterFunctionExpression).EdmType() != GoDataString {
+		t.Error("tolower(Name) desc not parsed correctly")
+	}
+	count, ok := items[1].Expression.(*FilterPropertyExpression)
+	if !ok || items[1].Order != DESC || count.EdmType() != GoDataInt64 || len(count.Segments) != 2 {
+		t.Error("Orders/$count desc not parsed correctly")
+	}
+	if items[2].Order != ASC || len(items[2].Tree.Children) != 2 {
+		t.Error("concat(Name,', ') asc not parsed correctly")
+	}
+	if items[3].Order != ASC || items[3].Field.SemanticType != SemanticTypeProperty {
+		t.Error("Age not parsed correctly")
+	}
+}
+
+func TestOrderByErrors(t *testing.T) {
+	testCases := []struct {
+		orderby string
+		message string
+	}{
+		{"Orders", "Can not order by 'Orders'"},
+		{"Name up", "Expected an operator"},
+		{"Missing desc", "No property found Missing"},
+		{"Name/$count", "$count must follow a collection"},
+		{"Name,,Age", "Could not parse orderby query"},
+	}
+
+	for _, testCase := range testCases {
+		_, err := checkTestOrderBy(testCase.orderby)
+
+		if err == nil {
+			t.Error("$orderby " + testCase.orderby + " was accepted")
+			continue
+		}
+		if !strings.Contains(err.Error(), testCase.message) {
+			t.Error("Expected \"" + testCase.message + "\", got \"" + err.Error() + "\"")
+		}
+	}
+}
@@ -2,6 +2,9 @@ package godata
 
 import (
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 const (
@@ -34,6 +37,11 @@ type Token struct {
 	// context of the GoDataService.
 	SemanticType      int
 	SemanticReference interface{}
+	// The byte offset of the token in the input it was read from.
+	Offset int
+	// The Go value of a literal token, e.g. an int64 for 42, set by
+	// DecodeFilterLiteral.
+	Literal interface{}
 }
 
 func (t *Tokenizer) Add(pattern string, token int) {
@@ -50,15 +58,17 @@ func (t *Tokenizer) Ignore(pattern string, token int) {
 
 func (t *Tokenizer) TokenizeBytes(target []byte) ([]*Token, error) {
 	result := make([]*Token, 0)
+	offset := 0
 	match := true // false when no match is found
 	for len(target) > 0 && match {
 		match = false
 		for _, m := range t.TokenMatchers {
 			token := m.Re.Find(target)
 			if len(token) > 0 {
-				parsed := Token{Value: string(token), Type: m.Token}
+				parsed := Token{Value: string(token), Type: m.Token, Offset: offset}
 				result = append(result, &parsed)
 				target = target[len(token):] // remove the token from the input
+				offset += len(token)
 				match = true
 				break
 			}
@@ -68,13 +78,14 @@ func (t *Tokenizer) TokenizeBytes(target []byte) ([]*Token, error) {
 			if len(token) > 0 {
 				match = true
 				target = target[len(token):] // remove the token from the input
+				offset += len(token)
 				break
 			}
 		}
 	}
 
 	if len(target) > 0 && !match {
-		return result, BadRequestError("No matching token for " + string(target))
+		return result, &ParseError{Offset: offset, Message: "Unexpected '" + string(target[:1]) + "'"}
 	}
 
 	return result, nil
@@ -103,8 +114,22 @@ type Operator struct {
 
 type Function struct {
 	Token string
-	// The number of parameters this function accepts
+	// Deprecated: use MinParams and MaxParams. A function that sets neither
+	// accepts exactly Params arguments.
 	Params int
+	// The least and the most number of arguments this function accepts. A
+	// negative MaxParams means there is no limit.
+	MinParams int
+	MaxParams int
+}
+
+// Get the least and the most number of arguments the function accepts,
+// falling back to the deprecated Params field.
+func (f *Function) arity() (int, int) {
+	if f.MinParams == 0 && f.MaxParams == 0 {
+		return f.Params, f.Params
+	}
+	return f.MinParams, f.MaxParams
 }
 
 type ParseNode struct {
@@ -113,6 +138,30 @@ type ParseNode struct {
 	Children []*ParseNode
 }
 
+// A deep copy of a parse tree, whose tokens can be semanticized apart from
+// the original ones.
+func cloneParseNode(node *ParseNode) *ParseNode {
+	if node == nil {
+		return nil
+	}
+	token := *node.Token
+	copied := &ParseNode{Token: &token, Children: make([]*ParseNode, len(node.Children))}
+	for i, child := range node.Children {
+		copied.Children[i] = cloneParseNode(child)
+		copied.Children[i].Parent = copied
+	}
+	return copied
+}
+
+func cloneTokens(tokens []*Token) []*Token {
+	copied := make([]*Token, len(tokens))
+	for i, token := range tokens {
+		t := *token
+		copied[i] = &t
+	}
+	return copied
+}
+
 func EmptyParser() *Parser {
 	return &Parser{make(map[string]*Operator, 0), make(map[string]*Function)}
 }
@@ -125,7 +174,33 @@ func (p *Parser) DefineOperator(token string, operands, assoc, precedence int) {
 
 // Add a function to the language
 func (p *Parser) DefineFunction(token string, params int) {
-	p.Functions[token] = &Function{token, params}
+	p.Functions[token] = &Function{token, params, params, params}
+}
+
+// Add a function that accepts between min and max arguments to the language.
+// Use a negative max for functions that accept any number of arguments from
+// min on.
+func (p *Parser) DefineVariadicFunction(token string, min, max int) {
+	p.Functions[token] = &Function{token, min, min, max}
+}
+
+// Describe the number of arguments a function accepts, e.g. "2 or 3
+// arguments".
+func (f *Function) describeParams() string {
+	min, max := f.arity()
+	noun := " arguments"
+	if max == 1 {
+		noun = " argument"
+	}
+	switch {
+	case max < 0:
+		return "at least " + strconv.Itoa(min) + " arguments"
+	case min == max:
+		return strconv.Itoa(min) + noun
+	case min+1 == max:
+		return strconv.Itoa(min) + " or " + strconv.Itoa(max) + noun
+	}
+	return "between " + strconv.Itoa(min) + " and " + strconv.Itoa(max) + noun
 }
 
 // Parse the input string of tokens using the given definitions of operators
@@ -134,23 +209,57 @@ func (p *Parser) DefineFunction(token string, params int) {
 func (p *Parser) InfixToPostfix(tokens []*Token) (*tokenQueue, error) {
 	queue := tokenQueue{}
 	stack := tokenStack{}
+	// whether the last token ended an operand, so an operator must follow
+	operand := false
+	// the open parentheses, and the number of arguments given so far if the
+	// parenthesis opens the arguments of a function
+	calls := []*functionCall{}
 
 	for len(tokens) > 0 {
 		token := tokens[0]
 		tokens = tokens[1:]
 
-		if _, ok := p.Functions[token.Value]; ok {
-			// push functions onto the stack
+		_, isOperator := p.Operators[token.Value]
+		if operand && !isOperator && token.Value != "," && token.Value != ")" {
+			words := []string{}
+			for word := range p.Operators {
+				words = append(words, word)
+			}
+			return nil, &ParseError{
+				Offset:      token.Offset,
+				Message:     "Expected an operator before '" + token.Value + "'",
+				Suggestions: closestWords(token.Value, words),
+			}
+		}
+		operand = !isOperator && token.Value != "," && token.Value != "("
+		if len(calls) > 0 && token.Value != ")" && token.Value != "," {
+			calls[len(calls)-1].empty = false
+			calls[len(calls)-1].emptyArg = false
+		}
+
+		if _, ok := p.Functions[token.Value]; ok && len(tokens) > 0 && tokens[0].Value == "(" {
+			// push functions onto the stack, a function name that is not
+			// followed by its arguments is a literal
 			stack.Push(token)
+			operand = false
+			calls = append(calls, &functionCall{function: token, empty: true, emptyArg: true})
+			// the parenthesis opening the arguments belongs to the call
+			stack.Push(tokens[0])
+			tokens = tokens[1:]
 		} else if token.Value == "," {
 			// function parameter separator, pop off stack until we see a "("
 			for !stack.Empty() && stack.Peek().Value != "(" {
 				queue.Enqueue(stack.Pop())
 			}
 			// there was an error parsing
-			if stack.Empty() {
-				return nil, BadRequestError("Parse error")
+			if stack.Empty() || len(calls) == 0 || calls[len(calls)-1].function == nil {
+				return nil, &ParseError{Offset: token.Offset, Message: "Unexpected ','"}
 			}
+			if calls[len(calls)-1].emptyArg {
+				return nil, &ParseError{Offset: token.Offset, Message: "Expected an expression before ','"}
+			}
+			calls[len(calls)-1].args++
+			calls[len(calls)-1].emptyArg = true
 		} else if o1, ok := p.Operators[token.Value]; ok {
 			// push operators onto stack according to precedence
 			if !stack.Empty() {
@@ -169,6 +278,7 @@ func (p *Parser) InfixToPostfix(tokens []*Token) (*tokenQueue, error) {
 		} else if token.Value == "(" {
 			// push open parens onto the stack
 			stack.Push(token)
+			calls = append(calls, &functionCall{empty: true})
 		} else if token.Value == ")" {
 			// if we find a close paren, pop things off the stack
 			for !stack.Empty() && stack.Peek().Value != "(" {
@@ -176,15 +286,26 @@ func (p *Parser) InfixToPostfix(tokens []*Token) (*tokenQueue, error) {
 			}
 			// there was an error parsing
 			if stack.Empty() {
-				return nil, BadRequestError("Parse error. Mismatched parenthesis.")
+				return nil, &ParseError{Offset: token.Offset, Message: "Unexpected ')' without a matching '('"}
 			}
 			// pop off open paren
 			stack.Pop()
-			// if next token is a function, move it to the queue
-			if !stack.Empty() {
-				if _, ok := p.Functions[stack.Peek().Value]; ok {
-					queue.Enqueue(stack.Pop())
+			call := calls[len(calls)-1]
+			calls = calls[:len(calls)-1]
+			// if the paren closes the arguments of a function, move the
+			// function to the queue with the number of arguments
+			if call.function != nil {
+				if call.emptyArg && !call.empty {
+					// the last argument is missing, e.g. f(a,)
+					return nil, &ParseError{Offset: token.Offset, Message: "Expected an expression before ')'"}
+				}
+				args := call.args + 1
+				if call.empty {
+					args = 0
 				}
+				queue.EnqueueCall(stack.Pop(), args)
+			} else if call.empty {
+				return nil, &ParseError{Offset: token.Offset, Message: "Expected an expression before ')'"}
 			}
 		} else {
 			// Token is a literal -- put it in the queue
@@ -195,7 +316,7 @@ func (p *Parser) InfixToPostfix(tokens []*Token) (*tokenQueue, error) {
 	// pop off the remaining operators onto the queue
 	for !stack.Empty() {
 		if stack.Peek().Value == "(" || stack.Peek().Value == ")" {
-			return nil, BadRequestError("parse error. Mismatched parenthesis.")
+			return nil, &ParseError{Offset: stack.Peek().Offset, Message: "'(' is not closed"}
 		}
 		queue.Enqueue(stack.Pop())
 	}
@@ -215,15 +336,29 @@ func (p *Parser) PostfixToTree(queue *tokenQueue) (*ParseNode, error) {
 
 	for !queue.Empty() {
 		// push the token onto the stack as a tree node
+		call, args := queue.Head.Call, queue.Head.Args
 		currNode = &ParseNode{queue.Dequeue(), nil, make([]*ParseNode, 0)}
 		stack.Push(currNode)
 
-		if _, ok := p.Functions[stack.Peek().Token.Value]; ok {
+		if _, ok := p.Functions[stack.Peek().Token.Value]; ok && call {
 			// if the top of the stack is a function
 			node := stack.Pop()
 			f := p.Functions[node.Token.Value]
+			if min, max := f.arity(); args < min || (max >= 0 && args > max) {
+				given := strconv.Itoa(args) + " were given"
+				if args == 1 {
+					given = "1 was given"
+				}
+				return nil, &ParseError{
+					Offset:  node.Token.Offset,
+					Message: "Function " + node.Token.Value + " takes " + f.describeParams() + ", but " + given,
+				}
+			}
 			// pop off function parameters
-			for i := 0; i < f.Params; i++ {
+			for i := 0; i < args; i++ {
+				if stack.Empty() {
+					return nil, &ParseError{Offset: node.Token.Offset, Message: "Missing arguments of " + node.Token.Value}
+				}
 				// prepend children so they get added in the right order
 				node.Children = append([]*ParseNode{stack.Pop()}, node.Children...)
 			}
@@ -234,6 +369,9 @@ func (p *Parser) PostfixToTree(queue *tokenQueue) (*ParseNode, error) {
 			o := p.Operators[node.Token.Value]
 			// pop off operands
 			for i := 0; i < o.Operands; i++ {
+				if stack.Empty() {
+					return nil, &ParseError{Offset: node.Token.Offset, Message: "Missing operands of " + node.Token.Value}
+				}
 				// prepend children so they get added in the right order
 				node.Children = append([]*ParseNode{stack.Pop()}, node.Children...)
 			}
@@ -241,7 +379,28 @@ func (p *Parser) PostfixToTree(queue *tokenQueue) (*ParseNode, error) {
 		}
 	}
 
-	return currNode, nil
+	if stack.Empty() {
+		return nil, &ParseError{Message: "The expression is empty"}
+	}
+	// operands that are left over were not joined by an operator
+	root := stack.Pop()
+	if !stack.Empty() {
+		extra := root
+		for !stack.Empty() {
+			root, extra = stack.Pop(), root
+		}
+		words := []string{}
+		for word := range p.Operators {
+			words = append(words, word)
+		}
+		return nil, &ParseError{
+			Offset:      extra.Token.Offset,
+			Message:     "Expected an operator before '" + extra.Token.Value + "'",
+			Suggestions: closestWords(extra.Token.Value, words),
+		}
+	}
+
+	return root, nil
 }
 
 type tokenStack struct {
@@ -296,10 +455,23 @@ type tokenQueueNode struct {
 	Token *Token
 	Prev  *tokenQueueNode
 	Next  *tokenQueueNode
+	// Whether the token is a function that is called, rather than a literal
+	// with the name of a function, and the number of arguments it is called
+	// with.
+	Call bool
+	Args int
+}
+
+// Enqueue a function that is called with the given number of arguments
+// before it.
+func (q *tokenQueue) EnqueueCall(t *Token, args int) {
+	q.Enqueue(t)
+	q.Tail.Call = true
+	q.Tail.Args = args
 }
 
 func (q *tokenQueue) Enqueue(t *Token) {
-	node := tokenQueueNode{t, q.Tail, nil}
+	node := tokenQueueNode{t, q.Tail, nil, false, 0}
 	//fmt.Println(t.Value)
 
 	if q.Tail == nil {
@@ -337,6 +509,19 @@ func (q *tokenQueue) String() string {
 	return result
 }
 
+// A parenthesis that is open while converting to postfix.
+type functionCall struct {
+	// The function the parenthesis opens the arguments of, nil for
+	// parentheses that group an expression.
+	function *Token
+	// The number of commas between the arguments so far.
+	args int
+	// Whether there is nothing after the parenthesis yet.
+	empty bool
+	// Whether there is nothing in the current argument yet.
+	emptyArg bool
+}
+
 type nodeStack struct {
 	Head *nodeStackNode
 }
@@ -364,3 +549,112 @@ func (s *nodeStack) Peek() *ParseNode {
 func (s *nodeStack) Empty() bool {
 	return s.Head == nil
 }
+
+// An error in the syntax of a parsed input, at a byte offset in the input.
+// Use DescribeParseError to turn it into a 400 that shows where the error is.
+type ParseError struct {
+	Offset  int
+	Message string
+	// Valid alternatives to what was found at the offset.
+	Suggestions []string
+}
+
+func (err *ParseError) Error() string {
+	return err.Message + " at column " + strconv.Itoa(err.Offset+1) + "."
+}
+
+// Describe a parse error as a 400 showing the column of the error, the text
+// around it and the suggested alternatives, e.g.
+//
+//	Expected an operator before 'eqq' at column 6 in "Name eqq 'Bob'". Did you mean eq?
+//
+// Other errors are returned as they are.
+func DescribeParseError(input string, err error) error {
+	parseErr, ok := err.(*ParseError)
+	if !ok {
+		return err
+	}
+
+	start, end := parseErr.Offset-20, parseErr.Offset+20
+	snippet := ""
+	if start > 0 {
+		snippet += "..."
+	} else {
+		start = 0
+	}
+	if end > len(input) {
+		end = len(input)
+	}
+	if start < end {
+		snippet += input[start:end]
+	}
+	if end < len(input) {
+		snippet += "..."
+	}
+
+	message := parseErr.Message + " at column " + strconv.Itoa(parseErr.Offset+1) + " in \"" + snippet + "\"."
+	if len(parseErr.Suggestions) > 0 {
+		message += " Did you mean " + strings.Join(parseErr.Suggestions, " or ") + "?"
+	}
+	return BadRequestError(message)
+}
+
+// Find the words closest to a word, e.g. eq for eqq. Words of up to four
+// characters may be one edit away, longer words two. At most two words are
+// suggested, and words that are no more than one character long never are.
+func closestWords(word string, words []string) []string {
+	maxDistance := 1
+	if len(word) > 4 {
+		maxDistance = 2
+	}
+	best := maxDistance
+	result := []string{}
+	for _, candidate := range words {
+		if len(candidate) < 2 {
+			continue
+		}
+		d := editDistance(strings.ToLower(word), strings.ToLower(candidate))
+		if d > maxDistance || d >= len(word) {
+			// too far away, or nothing of the word is left
+			continue
+		}
+		if d < best {
+			best = d
+			result = []string{candidate}
+		} else if d == best {
+			result = append(result, candidate)
+		}
+	}
+	sort.Strings(result)
+	if len(result) > 2 {
+		result = result[:2]
+	}
+	return result
+}
+
+// The Levenshtein distance between two strings.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = prev[j-1] + cost
+			if prev[j]+1 < curr[j] {
+				curr[j] = prev[j] + 1
+			}
+			if curr[j-1]+1 < curr[j] {
+				curr[j] = curr[j-1] + 1
+			}
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
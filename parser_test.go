@@ -2,6 +2,7 @@ package godata
 
 import (
 	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -298,3 +299,142 @@ func BenchmarkBuildTree(b *testing.B) {
 		parser.PostfixToTree(result)
 	}
 }
+
+func TestVariadicFunc(t *testing.T) {
+	parser := EmptyParser()
+	parser.DefineVariadicFunction("max", 1, -1)
+	parser.DefineVariadicFunction("round", 1, 2)
+	parser.DefineOperator("+", 2, OpAssociationLeft, 4)
+
+	// max(1, round(2), round(3, 4) + 5)
+	tokens := []*Token{
+		&Token{Value: "max"},
+		&Token{Value: "("},
+		&Token{Value: "1"},
+		&Token{Value: ","},
+		&Token{Value: "round"},
+		&Token{Value: "("},
+		&Token{Value: "2"},
+		&Token{Value: ")"},
+		&Token{Value: ","},
+		&Token{Value: "round"},
+		&Token{Value: "("},
+		&Token{Value: "3"},
+		&Token{Value: ","},
+		&Token{Value: "4"},
+		&Token{Value: ")"},
+		&Token{Value: "+"},
+		&Token{Value: "5"},
+		&Token{Value: ")"},
+	}
+
+	postfix, err := parser.InfixToPostfix(tokens)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	tree, err := parser.PostfixToTree(postfix)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if tree.Token.Value != "max" || len(tree.Children) != 3 {
+		t.Error("max does not have 3 arguments")
+		return
+	}
+	if len(tree.Children[1].Children) != 1 {
+		t.Error("round(2) does not have 1 argument")
+	}
+	if len(tree.Children[2].Children[0].Children) != 2 {
+		t.Error("round(3, 4) does not have 2 arguments")
+	}
+
+	// round(1, 2, 3)
+	tokens = []*Token{
+		&Token{Value: "round"},
+		&Token{Value: "("},
+		&Token{Value: "1"},
+		&Token{Value: ","},
+		&Token{Value: "2"},
+		&Token{Value: ","},
+		&Token{Value: "3"},
+		&Token{Value: ")"},
+	}
+	postfix, err = parser.InfixToPostfix(tokens)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_, err = parser.PostfixToTree(postfix)
+	if err == nil || err.Error() != "Function round takes 1 or 2 arguments, but 3 were given at column 1." {
+		t.Error("round(1, 2, 3) was not rejected:", err)
+	}
+}
+
+func TestClosestWords(t *testing.T) {
+	words := []string{"eq", "ne", "gt", "ge", "lt", "le", "and", "or", "not", "has", "in",
+		"add", "sub", "mul", "div", "divby", "mod", "contains", "endswith", "startswith"}
+
+	testCases := map[string]string{
+		"eqq":      "eq",
+		"nd":       "and ne",
+		"qe":       "ge le",
+		"contians": "contains",
+		"xyz":      "",
+		"eqxx":     "",
+		"andxxx":   "",
+		"a":        "",
+		"banana":   "",
+	}
+
+	for word, expect := range testCases {
+		suggestions := strings.Join(closestWords(word, words), " ")
+		if suggestions != expect {
+			t.Error("Suggestions for " + word + " are '" + suggestions + "' not '" + expect + "'")
+		}
+	}
+}
+
+func TestDeprecatedFunctionParams(t *testing.T) {
+	parser := EmptyParser()
+	parser.Functions["legacy"] = &Function{Token: "legacy", Params: 2}
+
+	tokens := []*Token{
+		&Token{Value: "legacy"},
+		&Token{Value: "("},
+		&Token{Value: "1"},
+		&Token{Value: ","},
+		&Token{Value: "2"},
+		&Token{Value: ")"},
+	}
+	postfix, err := parser.InfixToPostfix(tokens)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	tree, err := parser.PostfixToTree(postfix)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(tree.Children) != 2 {
+		t.Error("legacy(1, 2) does not have 2 arguments")
+	}
+
+	tokens = []*Token{
+		&Token{Value: "legacy"},
+		&Token{Value: "("},
+		&Token{Value: "1"},
+		&Token{Value: ")"},
+	}
+	postfix, err = parser.InfixToPostfix(tokens)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_, err = parser.PostfixToTree(postfix)
+	if err == nil || err.Error() != "Function legacy takes 2 arguments, but 1 was given at column 1." {
+		t.Error("legacy(1) was not rejected:", err)
+	}
+}
@@ -9,11 +9,6 @@ import (
 	//"strings"
 )
 
-const (
-	XMLNamespace string = "http://docs.oasis-open.org/odata/ns/edmx"
-	ODataVersion string = "4.0"
-)
-
 var MySQLPrepareMap = map[string]string{
 	// wrap the input string in wildcard characters for LIKE clauses
 	"contains":   "%?%",
@@ -85,13 +80,14 @@ type MySQLConnectionParams struct {
 
 // A provider for GoData using a MySQL backend. Reads requests, converts them
 // to MySQL queries, and creates a response object to send back to the client.
+// The OData model is declared with a GoDataSchemaBuilder, while the provider
+// keeps the mapping from the model to tables and columns.
 type MySQLGoDataProvider struct {
 	ConnectionParams *MySQLConnectionParams
 	Namespace        string
+	Schema           *GoDataSchemaBuilder
 	Entities         map[string]*MySQLGoDataEntity
 	EntitySets       map[string]*MySQLGoDataEntitySet
-	Actions          map[string]*GoDataAction
-	Functions        map[string]*GoDataFunction
 	Metadata         *GoDataMetadata
 }
 
@@ -100,12 +96,12 @@ type MySQLGoDataEntity struct {
 	KeyType    string
 	PropColMap map[string]string
 	ColPropMap map[string]string
-	EntityType *GoDataEntityType
+	EntityType *GoDataEntityTypeBuilder
 }
 
 type MySQLGoDataEntitySet struct {
 	Entity    *MySQLGoDataEntity
-	EntitySet *GoDataEntitySet
+	EntitySet *GoDataEntitySetBuilder
 }
 
 // Build an empty MySQL provider. Provide the connection parameters and the
@@ -113,6 +109,8 @@ type MySQLGoDataEntitySet struct {
 func BuildMySQLProvider(cxnParams *MySQLConnectionParams, namespace string) *MySQLGoDataProvider {
 	return &MySQLGoDataProvider{
 		ConnectionParams: cxnParams,
+		Namespace:        namespace,
+		Schema:           NewSchemaBuilder(namespace, cxnParams.Database),
 		Entities:         make(map[string]*MySQLGoDataEntity),
 		EntitySets:       make(map[string]*MySQLGoDataEntitySet),
 	}
@@ -198,51 +196,22 @@ func (p *MySQLGoDataProvider) Response(r *GoDataRequest) *GoDataResponse {
 // Build the $metadata file from the entities in the builder. It creates a
 // schema with the given namespace name.
 func (builder *MySQLGoDataProvider) BuildMetadata() *GoDataMetadata {
-	// convert maps to slices for the metadata
-	entitySets := make([]*GoDataEntitySet, len(builder.EntitySets))
-	for _, v := range builder.EntitySets {
-		entitySets = append(entitySets, v.EntitySet)
-	}
-	entityTypes := make([]*GoDataEntityType, len(builder.Entities))
-	for _, v := range builder.Entities {
-		entityTypes = append(entityTypes, v.EntityType)
-	}
-	// build the schema
-	container := GoDataEntityContainer{
-		Name:       builder.ConnectionParams.Database,
-		EntitySets: entitySets,
-	}
-	schema := GoDataSchema{
-		Namespace:        builder.Namespace,
-		EntityTypes:      entityTypes,
-		EntityContainers: []*GoDataEntityContainer{&container},
-	}
-	services := GoDataServices{
-		Schemas: []*GoDataSchema{&schema},
-	}
-
-	root := GoDataMetadata{
-		XMLNamespace: XMLNamespace,
-		Version:      ODataVersion,
-		DataServices: &services,
-	}
-
-	return &root
+	builder.Metadata = builder.Schema.Metadata()
+	return builder.Metadata
 }
 
 // Expose a table in the MySQL database as an entity with the given name in the
 // OData service.
 func (builder *MySQLGoDataProvider) ExposeEntity(tblname, entityname string) *MySQLGoDataEntity {
-	entitytype := GoDataEntityType{Name: entityname}
-	myentity := &MySQLGoDataEntity{tblname, "", map[string]string{}, map[string]string{}, &entitytype}
+	myentity := &MySQLGoDataEntity{tblname, "", map[string]string{}, map[string]string{},
+		builder.Schema.EntityType(entityname)}
 	builder.Entities[entityname] = myentity
 	return myentity
 }
 
 // Expose a queryable collection of entities
 func (builder *MySQLGoDataProvider) ExposeEntitySet(entity *MySQLGoDataEntity, setname string) *MySQLGoDataEntitySet {
-	entityset := &GoDataEntitySet{Name: setname, EntityType: builder.Namespace + "." + entity.EntityType.Name}
-	myset := &MySQLGoDataEntitySet{entity, entityset}
+	myset := &MySQLGoDataEntitySet{entity, builder.Schema.EntitySet(setname, entity.EntityType)}
 	builder.EntitySets[setname] = myset
 	return myset
 }
@@ -252,10 +221,7 @@ func (builder *MySQLGoDataProvider) ExposeEntitySet(entity *MySQLGoDataEntity, s
 // property name must be provided for each entity. The columns must be foreign
 // keys corresponding to the primary key in the opposite table.
 func (builder *MySQLGoDataProvider) ExposeOneToOne(a, b *MySQLGoDataEntity, acol, bcol, aprop, bprop string) {
-	prop := GoDataNavigationProperty{Name: aprop, Type: builder.Namespace + "." + b.EntityType.Name, Partner: bprop}
-	a.EntityType.NavigationProperties = append(a.EntityType.NavigationProperties, &prop)
-	prop2 := GoDataNavigationProperty{Name: bprop, Type: builder.Namespace + "." + a.EntityType.Name, Partner: aprop}
-	b.EntityType.NavigationProperties = append(b.EntityType.NavigationProperties, &prop2)
+	builder.Schema.OneToOne(a.EntityType, b.EntityType, aprop, bprop)
 	a.PropColMap[aprop] = acol
 	a.ColPropMap[acol] = aprop
 	b.PropColMap[bprop] = bcol
@@ -267,18 +233,13 @@ func (builder *MySQLGoDataProvider) ExposeOneToOne(a, b *MySQLGoDataEntity, acol
 // which will map to the key in entity b. A reverse property will be added to
 // entity b to map back to entity a, and does not need an explicit column.
 func (builder *MySQLGoDataProvider) ExposeManyToOne(a, b *MySQLGoDataEntity, acol, aprop, bprop string) {
-	prop := GoDataNavigationProperty{Name: aprop, Type: builder.Namespace + "." + b.EntityType.Name, Partner: bprop}
-	a.EntityType.NavigationProperties = append(a.EntityType.NavigationProperties, &prop)
-	prop2 := GoDataNavigationProperty{Name: bprop, Type: "Collection(" + builder.Namespace + "." + a.EntityType.Name + ")", Partner: aprop}
-	b.EntityType.NavigationProperties = append(b.EntityType.NavigationProperties, &prop2)
 	// the property name corresponding to the column in a will be given the same name
 	// as the key property in b so that it does not conflict with the property name
-	// given by aprop. A referential constraint will be added to the NavigationProperty
-	// in b that links back to this property in a.
-	constrainedProp := b.EntityType.Key.PropertyRef.Name
+	// given by aprop. A referential constraint on the navigation property in a
+	// links this property to the key of b.
+	constrainedProp := b.EntityType.EntityType.Key.PropertyRefs[0].Name
 	a.ExposeProperty(acol, constrainedProp, b.KeyType)
-	constraint := GoDataReferentialConstraint{Property: constrainedProp, ReferencedProperty: constrainedProp}
-	prop2.ReferentialConstraints = append(prop2.ReferentialConstraints, &constraint)
+	builder.Schema.ManyToOne(a.EntityType, b.EntityType, aprop, bprop).Constraint(constrainedProp, constrainedProp)
 	a.PropColMap[aprop] = acol
 	a.ColPropMap[acol] = aprop
 }
@@ -288,20 +249,17 @@ func (builder *MySQLGoDataProvider) ExposeManyToOne(a, b *MySQLGoDataEntity, aco
 // foreign key mappings to the primary keys in both a & b. Both entities will
 // be given a reference to each other with the given names in aprop & bprop.
 func (builder *MySQLGoDataProvider) ExposeManyToMany(a, b *MySQLGoDataEntity, tblname, aprop, bprop string) {
-	prop := GoDataNavigationProperty{Name: aprop, Type: "Collection(" + builder.Namespace + "." + b.EntityType.Name + ")", Partner: bprop}
-	a.EntityType.NavigationProperties = append(a.EntityType.NavigationProperties, &prop)
-	prop2 := GoDataNavigationProperty{Name: bprop, Type: "Collection(" + builder.Namespace + "." + a.EntityType.Name + ")", Partner: aprop}
-	b.EntityType.NavigationProperties = append(b.EntityType.NavigationProperties, &prop2)
+	builder.Schema.ManyToMany(a.EntityType, b.EntityType, aprop, bprop)
 }
 
 // Adds a NavigationPropertyBinding to two entity sets that are mapped together
 // by a relationship. This SHOULD be done for any entity sets for whom their
 // entities contain a NavigationProperty.
 func (builder *MySQLGoDataProvider) BindProperty(a, b *MySQLGoDataEntitySet, apath, atarget, bpath, btarget string) {
-	bind := GoDataNavigationPropertyBinding{Path: apath, Target: atarget}
-	a.EntitySet.NavigationPropertyBindings = append(a.EntitySet.NavigationPropertyBindings, &bind)
-	bind2 := GoDataNavigationPropertyBinding{Path: bpath, Target: btarget}
-	b.EntitySet.NavigationPropertyBindings = append(b.EntitySet.NavigationPropertyBindings, &bind2)
+	a.EntitySet.EntitySet.NavigationPropertyBindings = append(a.EntitySet.EntitySet.NavigationPropertyBindings,
+		&GoDataNavigationPropertyBinding{Path: apath, Target: atarget})
+	b.EntitySet.EntitySet.NavigationPropertyBindings = append(b.EntitySet.EntitySet.NavigationPropertyBindings,
+		&GoDataNavigationPropertyBinding{Path: bpath, Target: btarget})
 }
 
 // Expose a key on an entity returned by MySQLGoDataProvider.ExposeEntity.
@@ -309,9 +267,10 @@ func (builder *MySQLGoDataProvider) BindProperty(a, b *MySQLGoDataEntitySet, apa
 // database to map to the property name in the OData entity, and the OData
 // type.
 func (entity *MySQLGoDataEntity) ExposeKey(colname, propname, t string) {
-	entity.EntityType.Key = &GoDataKey{PropertyRef: &GoDataPropertyRef{Name: propname}}
+	entity.EntityType.Key(propname, t)
 	entity.KeyType = t
-	entity.ExposePrimitive(colname, propname, t)
+	entity.PropColMap[propname] = colname
+	entity.ColPropMap[colname] = propname
 }
 
 // Expose an OData primitive property on an entity. You must provide a
@@ -323,7 +282,7 @@ func (entity *MySQLGoDataEntity) ExposePrimitive(colname, propname, t string) {
 // Expose an OData property on an entity. You must provide a
 // corresponding table column in the database.
 func (entity *MySQLGoDataEntity) ExposeProperty(colname, propname, t string) {
-	entity.EntityType.Properties = append(entity.EntityType.Properties, &GoDataProperty{Name: propname, Type: t})
+	entity.EntityType.Property(propname, t)
 	entity.PropColMap[propname] = colname
 	entity.ColPropMap[colname] = propname
 }
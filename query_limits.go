@@ -0,0 +1,325 @@
+package godata
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Limits on the complexity of the requests a service accepts, which protect
+// providers from queries that are too expensive to answer. A zero value
+// leaves the corresponding limit unchecked.
+type GoDataQueryLimits struct {
+	// The maximum length of the request URI, including the query string.
+	MaxUrlLength int
+	// The maximum nesting of $expand, after $levels have been expanded.
+	MaxExpandDepth int
+	// The maximum number of items in a single $expand, after wildcards have
+	// been replaced with the navigation properties they expand.
+	MaxExpandBreadth int
+	// The maximum number of nodes in all the expressions of a request that
+	// select entities or produce values together: $filter, the filter,
+	// aggregate and groupby expressions of $apply, and the filters nested in
+	// $expand and $select.
+	MaxFilterNodes int
+	// The maximum value of $top, including the $top nested in $expand and
+	// $select.
+	MaxTop int
+	// The maximum number of items in an $orderby, including the $orderby
+	// nested in $expand and $select.
+	MaxOrderByItems int
+	// The functions that may be called in the expressions of a request to an
+	// entity set, by entity set name. The set a request addresses through a
+	// navigation path, e.g. Orders(1)/Products, and the sets its $expand
+	// items are bound to use their own list. Requests to the entity sets that
+	// are not listed may call every function.
+	AllowedFunctions map[string][]string
+}
+
+// Check a semanticized request to a service against the limits. The request
+// URI is the one the client sent, e.g. http.Request.RequestURI. A nil set of
+// limits accepts every request.
+func (limits *GoDataQueryLimits) Check(req *GoDataRequest, service *GoDataService, requestUri string) error {
+	if limits == nil {
+		return nil
+	}
+
+	if limits.MaxUrlLength > 0 && len(requestUri) > limits.MaxUrlLength {
+		return limitError("The request URI is "+strconv.Itoa(len(requestUri))+" characters long", "MaxUrlLength",
+			limits.MaxUrlLength)
+	}
+
+	set := requestEntitySet(req)
+	checker := &limitChecker{limits: limits, service: service, allowed: limits.allowedFunctions(set, nil)}
+	query := req.Query
+	if err := checker.checkApply(query.Apply, set); err != nil {
+		return err
+	}
+	return checker.check(set, query.Filter, query.OrderBy, query.Top, query.Compute, query.Select, query.Expand, 0)
+}
+
+// The functions that may be called in the expressions of a request to an
+// entity set, or the given ones if the set is unknown. Nil if every function
+// may be called.
+func (limits *GoDataQueryLimits) allowedFunctions(set *GoDataEntitySet, inherited map[string]bool) map[string]bool {
+	if set == nil {
+		return inherited
+	}
+	functions, ok := limits.AllowedFunctions[set.Name]
+	if !ok {
+		return nil
+	}
+	allowed := map[string]bool{}
+	for _, name := range functions {
+		allowed[name] = true
+	}
+	return allowed
+}
+
+// The entity set a request addresses, e.g. Products for
+// Orders(1)/Products/$count. The navigation properties of the path have
+// been resolved to the sets they are bound to. Nil if the request doesn't
+// address an entity set.
+func requestEntitySet(req *GoDataRequest) *GoDataEntitySet {
+	for segment := req.LastSegment; segment != nil; segment = segment.Prev {
+		if set, ok := segment.SemanticReference.(*GoDataEntitySet); ok {
+			return set
+		}
+	}
+	return nil
+}
+
+// The entity set a navigation property path of the entities in a set is
+// bound to, or nil if it isn't bound.
+func boundEntitySet(service *GoDataService, set *GoDataEntitySet, path string) *GoDataEntitySet {
+	if service == nil || set == nil {
+		return nil
+	}
+	for _, binding := range set.NavigationPropertyBindings {
+		if binding.Path != path {
+			continue
+		}
+		target, err := service.LookupEntitySet(binding.Target[strings.LastIndex(binding.Target, "/")+1:])
+		if err == nil {
+			return target
+		}
+	}
+	return nil
+}
+
+// Accumulates the counts of a request while its expand tree is walked.
+type limitChecker struct {
+	limits  *GoDataQueryLimits
+	service *GoDataService
+	// The functions that may be called in the entity set being checked, or
+	// nil if every function may be called.
+	allowed     map[string]bool
+	filterNodes int
+}
+
+// Check the options of a request to an entity set, or of an item nested in
+// its $expand at the given depth.
+func (c *limitChecker) check(
+	set *GoDataEntitySet,
+	filter *GoDataFilterQuery,
+	orderby *GoDataOrderByQuery,
+	top *GoDataTopQuery,
+	compute *GoDataComputeQuery,
+	sel *GoDataSelectQuery,
+	expand *GoDataExpandQuery,
+	depth int,
+) error {
+
+	limits := c.limits
+
+	if err := c.checkExpression(filter); err != nil {
+		return err
+	}
+
+	if orderby != nil {
+		if limits.MaxOrderByItems > 0 && len(orderby.OrderByItems) > limits.MaxOrderByItems {
+			return limitError("The $orderby has "+strconv.Itoa(len(orderby.OrderByItems))+" items",
+				"MaxOrderByItems", limits.MaxOrderByItems)
+		}
+		for _, item := range orderby.OrderByItems {
+			if err := c.checkFunctions(item.Tree); err != nil {
+				return err
+			}
+		}
+	}
+
+	if top != nil && limits.MaxTop > 0 && int(*top) > limits.MaxTop {
+		return limitError("The $top is "+strconv.Itoa(int(*top)), "MaxTop", limits.MaxTop)
+	}
+
+	if compute != nil {
+		for _, item := range compute.ComputeItems {
+			if err := c.checkFunctions(item.Expression.Tree); err != nil {
+				return err
+			}
+		}
+	}
+
+	if sel != nil {
+		for _, item := range sel.SelectItems {
+			err := c.check(set, item.Filter, item.OrderBy, item.Top, nil, item.Select, nil, depth)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if expand == nil || len(expand.ExpandItems) == 0 {
+		return nil
+	}
+	if limits.MaxExpandDepth > 0 && depth+1 > limits.MaxExpandDepth {
+		return limitError("The $expand is nested more than "+strconv.Itoa(limits.MaxExpandDepth)+" levels deep",
+			"MaxExpandDepth", limits.MaxExpandDepth)
+	}
+	if limits.MaxExpandBreadth > 0 && len(expand.ExpandItems) > limits.MaxExpandBreadth {
+		return limitError("The $expand has "+strconv.Itoa(len(expand.ExpandItems))+" items",
+			"MaxExpandBreadth", limits.MaxExpandBreadth)
+	}
+	allowed := c.allowed
+	for _, item := range expand.ExpandItems {
+		// the options of an expanded navigation property apply to the set
+		// it is bound to
+		target := boundEntitySet(c.service, set, expandItemPath(item))
+		c.allowed = limits.allowedFunctions(target, allowed)
+		err := c.check(target, item.Filter, item.OrderBy, item.Top, item.Compute, item.Select, item.Expand, depth+1)
+		c.allowed = allowed
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check the transformations of an $apply to an entity set.
+func (c *limitChecker) checkApply(apply *GoDataApplyQuery, set *GoDataEntitySet) error {
+	if apply == nil {
+		return nil
+	}
+	return c.checkTransformations(apply.Transformations, set)
+}
+
+func (c *limitChecker) checkTransformations(transformations []ApplyTransformation, set *GoDataEntitySet) error {
+	for _, transformation := range transformations {
+		var err error
+		switch t := transformation.(type) {
+		case *ApplyAggregate:
+			for _, aggregate := range t.Aggregates {
+				if err = c.checkExpression(aggregate.Expression); err != nil {
+					break
+				}
+			}
+		case *ApplyGroupBy:
+			for _, path := range t.Paths {
+				if err = c.checkExpression(path); err != nil {
+					break
+				}
+			}
+			if err == nil {
+				err = c.checkTransformations(t.Transformations, set)
+			}
+		case *ApplyFilter:
+			err = c.checkExpression(t.Filter)
+		case *ApplyCompute:
+			for _, item := range t.ComputeItems {
+				if err = c.checkFunctions(item.Expression.Tree); err != nil {
+					break
+				}
+			}
+		case *ApplyTop:
+			if err = c.checkFunctions(t.Amount.Tree); err == nil {
+				err = c.checkFunctions(t.Value.Tree)
+			}
+		case *ApplyConcat:
+			for _, sequence := range t.Sequences {
+				if err = c.checkTransformations(sequence, set); err != nil {
+					break
+				}
+			}
+		case *ApplyExpand:
+			err = c.checkApplyExpand(t, set)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check the filters of an expand transformation against the set its
+// navigation property is bound to.
+func (c *limitChecker) checkApplyExpand(expand *ApplyExpand, set *GoDataEntitySet) error {
+	allowed := c.allowed
+	defer func() { c.allowed = allowed }()
+
+	target := boundEntitySet(c.service, set, expand.Path)
+	c.allowed = c.limits.allowedFunctions(target, allowed)
+	if err := c.checkExpression(expand.Filter); err != nil {
+		return err
+	}
+	for _, nested := range expand.Expand {
+		if err := c.checkApplyExpand(nested, target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Count the nodes of an expression that selects entities or produces values
+// towards MaxFilterNodes, and check the functions it calls.
+func (c *limitChecker) checkExpression(expression *GoDataFilterQuery) error {
+	if expression == nil {
+		return nil
+	}
+	limits := c.limits
+	c.filterNodes += countParseNodes(expression.Tree)
+	if limits.MaxFilterNodes > 0 && c.filterNodes > limits.MaxFilterNodes {
+		return limitError("The filter expressions have "+strconv.Itoa(c.filterNodes)+" nodes",
+			"MaxFilterNodes", limits.MaxFilterNodes)
+	}
+	return c.checkFunctions(expression.Tree)
+}
+
+// The navigation property path of an expand item, e.g. Orders or
+// Address/Country, as it appears in a navigation property binding.
+func expandItemPath(item *ExpandItem) string {
+	names := make([]string, 0, len(item.Path))
+	for _, token := range item.Path {
+		names = append(names, token.Value)
+	}
+	return strings.Join(names, "/")
+}
+
+// Check that every function called in an expression is allowed.
+func (c *limitChecker) checkFunctions(node *ParseNode) error {
+	if node == nil || c.allowed == nil {
+		return nil
+	}
+	if node.Token.Type == FilterTokenFunc && !c.allowed[node.Token.Value] {
+		return BadRequestError("The function " + node.Token.Value + " is not in AllowedFunctions for this entity set.")
+	}
+	for _, child := range node.Children {
+		if err := c.checkFunctions(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func countParseNodes(node *ParseNode) int {
+	if node == nil {
+		return 0
+	}
+	count := 1
+	for _, child := range node.Children {
+		count += countParseNodes(child)
+	}
+	return count
+}
+
+func limitError(problem, limit string, value int) error {
+	return BadRequestError(problem + ", which exceeds " + limit + " of " + strconv.Itoa(value) + ".")
+}
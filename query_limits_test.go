@@ -0,0 +1,164 @@
+package godata
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func checkTestLimits(testUrl string, limits *GoDataQueryLimits) error {
+	return checkTestProviderLimits(&DummyProvider{}, testUrl, limits)
+}
+
+func checkTestProviderLimits(provider GoDataProvider, testUrl string, limits *GoDataQueryLimits) error {
+	parsedUrl, err := url.Parse(testUrl)
+	if err != nil {
+		return err
+	}
+	request, err := ParseRequest(parsedUrl.Path, parsedUrl.Query())
+	if err != nil {
+		return err
+	}
+	service, err := BuildService(provider, "http://localhost")
+	if err != nil {
+		return err
+	}
+	err = SemanticizeRequest(request, service)
+	if err != nil {
+		return err
+	}
+	return limits.Check(request, service, testUrl)
+}
+
+func TestQueryLimits(t *testing.T) {
+	limits := &GoDataQueryLimits{
+		MaxUrlLength:     200,
+		MaxExpandDepth:   2,
+		MaxExpandBreadth: 1,
+		MaxFilterNodes:   7,
+		MaxTop:           100,
+		MaxOrderByItems:  1,
+		AllowedFunctions: map[string][]string{"Customers": []string{"contains"}, "Orders": []string{"tolower"}},
+	}
+
+	valid := []string{
+		"Customers?$filter=contains(Name,'a')&$expand=Orders($expand=Customer;$top=10)&$orderby=Age&$top=100",
+		"Customers?$expand=Orders($filter=tolower(Id)%20eq%20'a')",
+		"Customers('Bob')/Orders?$filter=tolower(Id)%20eq%20'a'",
+		"Customers/$count?$filter=contains(Name,'a')",
+		"Customers?$apply=filter(contains(Name,'a'))/groupby((Name))",
+		"Orders('1')/Customer?$compute=contains(Name,'a')%20as%20A",
+	}
+	for _, testUrl := range valid {
+		if err := checkTestLimits(testUrl, limits); err != nil {
+			t.Error("Failed to accept " + testUrl + ": " + err.Error())
+		}
+	}
+	if err := checkTestLimits("Customers?$expand=*($levels=4)&$top=1000", nil); err != nil {
+		t.Error("Nil limits rejected a request:", err)
+	}
+
+	testCases := []struct {
+		url     string
+		message string
+	}{
+		{"Customers?$filter=Name%20eq%20'" + strings.Repeat("a", 200) + "'", "exceeds MaxUrlLength of 200"},
+		{"Customers?$expand=Orders($expand=Customer($expand=Orders))", "exceeds MaxExpandDepth of 2"},
+		{"Customers?$expand=Orders($expand=*($expand=*))", "exceeds MaxExpandDepth of 2"},
+		{"Customers?$expand=Orders,Orders", "The $expand has 2 items, which exceeds MaxExpandBreadth of 1"},
+		{"Customers?$filter=Age%20gt%201%20and%20Age%20lt%202%20and%20Age%20ne%203", "exceeds MaxFilterNodes of 7"},
+		{"Customers?$filter=Age%20gt%201%20and%20Age%20lt%202&$expand=Orders($filter=Id%20eq%20'1')",
+			"exceeds MaxFilterNodes of 7"},
+		{"Customers?$top=101", "The $top is 101, which exceeds MaxTop of 100"},
+		{"Customers?$expand=Orders($top=101)", "exceeds MaxTop of 100"},
+		{"Customers?$orderby=Age,Name", "The $orderby has 2 items, which exceeds MaxOrderByItems of 1"},
+		{"Customers?$filter=startswith(Name,'a')", "The function startswith is not in AllowedFunctions"},
+		{"Customers?$orderby=tolower(Name)", "The function tolower is not in AllowedFunctions"},
+		{"Customers/$count?$filter=tolower(Name)%20eq%20'a'", "The function tolower is not in AllowedFunctions"},
+		{"Customers('Bob')/Orders?$filter=contains(Id,'a')", "The function contains is not in AllowedFunctions"},
+		{"Customers?$expand=Orders($filter=contains(Id,'a'))", "The function contains is not in AllowedFunctions"},
+		{"Orders('1')/Customer?$compute=tolower(Name)%20as%20N", "The function tolower is not in AllowedFunctions"},
+		{"Customers?$expand=Orders($expand=Customer($filter=tolower(Name)%20eq%20'a'))",
+			"The function tolower is not in AllowedFunctions"},
+		{"Customers?$apply=filter(startswith(Name,'a'))", "The function startswith is not in AllowedFunctions"},
+		{"Customers?$apply=filter(Age%20gt%201%20and%20Age%20lt%202%20and%20Age%20ne%203)", "exceeds MaxFilterNodes of 7"},
+		{"Customers?$apply=filter(Age%20gt%201%20and%20Age%20lt%202)/aggregate(Age%20add%20Age%20with%20sum%20as%20Total)",
+			"exceeds MaxFilterNodes of 7"},
+	}
+	for _, testCase := range testCases {
+		err := checkTestLimits(testCase.url, limits)
+
+		if err == nil {
+			t.Error(testCase.url + " was accepted")
+			continue
+		}
+		if goDataErr, ok := err.(*GoDataError); !ok || goDataErr.ResponseCode != 400 {
+			t.Error("Expected a 400 for " + testCase.url + ", got " + err.Error())
+		}
+		if !strings.Contains(err.Error(), testCase.message) {
+			t.Error("Expected \"" + testCase.message + "\", got \"" + err.Error() + "\"")
+		}
+	}
+}
+
+func TestQueryLimitsOfSelectOptions(t *testing.T) {
+	metadata, err := testSelectMetadata()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	provider := &builtProvider{metadata}
+	limits := &GoDataQueryLimits{
+		MaxFilterNodes:   3,
+		MaxTop:           10,
+		MaxOrderByItems:  1,
+		AllowedFunctions: map[string][]string{"Customers": []string{"contains"}},
+	}
+
+	valid := "Customers?$select=Addresses($filter=contains(City,'O');$orderby=Street;$top=10)"
+	if err := checkTestProviderLimits(provider, valid, limits); err != nil {
+		t.Error(err)
+	}
+
+	testCases := []struct {
+		url     string
+		message string
+	}{
+		{"Customers?$filter=Name%20eq%20'a'&$select=Addresses($filter=City%20eq%20'Oslo')",
+			"exceeds MaxFilterNodes of 3"},
+		{"Customers?$select=Addresses($filter=startswith(City,'O'))", "The function startswith is not in AllowedFunctions"},
+		{"Customers?$select=Addresses($orderby=Street,City)", "exceeds MaxOrderByItems of 1"},
+		{"Customers?$select=Addresses($orderby=tolower(Street))", "The function tolower is not in AllowedFunctions"},
+		{"Customers?$select=Addresses($top=11)", "exceeds MaxTop of 10"},
+	}
+	for _, testCase := range testCases {
+		err := checkTestProviderLimits(provider, testCase.url, limits)
+
+		if err == nil {
+			t.Error(testCase.url + " was accepted")
+			continue
+		}
+		if !strings.Contains(err.Error(), testCase.message) {
+			t.Error("Expected \"" + testCase.message + "\", got \"" + err.Error() + "\"")
+		}
+	}
+}
+
+func TestQueryLimitsInHandler(t *testing.T) {
+	service, err := BuildService(&openTypeProvider{}, "http://localhost")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	service.Limits = &GoDataQueryLimits{MaxUrlLength: 10}
+
+	recorder := httptest.NewRecorder()
+	service.GoDataHTTPHandler(recorder, httptest.NewRequest("GET", "/Products(1)?$select=Name", nil))
+	if recorder.Code != http.StatusBadRequest || !strings.Contains(recorder.Body.String(), "MaxUrlLength") {
+		t.Error("Response code is " + strconv.Itoa(recorder.Code) + ": " + recorder.Body.String())
+	}
+}
@@ -0,0 +1,101 @@
+package godata
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// The system query options defined by OData, by their lower case name. Strict
+// validation rejects any other query option starting with $. ParseUrlQuery
+// parses the first twelve; the paging, delta, entity id, schema version and
+// index options are left to the provider.
+var systemQueryOptions = map[string]bool{
+	"$filter":        true,
+	"$apply":         true,
+	"$compute":       true,
+	"$expand":        true,
+	"$select":        true,
+	"$orderby":       true,
+	"$top":           true,
+	"$skip":          true,
+	"$count":         true,
+	"$inlinecount":   true,
+	"$search":        true,
+	"$format":        true,
+	"$skiptoken":     true,
+	"$deltatoken":    true,
+	"$id":            true,
+	"$schemaversion": true,
+	"$index":         true,
+}
+
+// The system query options that apply to each kind of resource. Requests of
+// a kind that is not listed may use every system query option, and
+// $schemaversion applies to every request.
+var requestKindQueryOptions = map[int]struct {
+	resource string
+	options  map[string]bool
+}{
+	RequestKindEntity: {"a single entity", map[string]bool{
+		"$expand": true, "$select": true, "$compute": true, "$format": true,
+	}},
+	RequestKindSingleton: {"a singleton", map[string]bool{
+		"$expand": true, "$select": true, "$compute": true, "$format": true,
+	}},
+	RequestKindCount: {"a count", map[string]bool{
+		"$filter": true, "$search": true, "$apply": true,
+	}},
+	RequestKindRef: {"a reference", map[string]bool{
+		"$filter": true, "$search": true, "$orderby": true, "$top": true, "$skip": true,
+		"$count": true, "$inlinecount": true, "$format": true, "$skiptoken": true, "$id": true,
+	}},
+	RequestKindPropertyValue: {"a raw value", map[string]bool{}},
+	RequestKindMediaResource: {"a media resource", map[string]bool{}},
+	RequestKindMetadata: {"the metadata document", map[string]bool{
+		"$format": true,
+	}},
+	RequestKindService: {"the service document", map[string]bool{
+		"$format": true,
+	}},
+}
+
+// Strictly validate the query options of a semanticized request. Every query
+// option starting with $ must be a known system query option that applies to
+// the requested resource, and no query option may be given more than once.
+// System query option names are case-insensitive, so $top and $TOP are the
+// same option. ParseUrlQuery on its own ignores the options it doesn't
+// understand.
+func ValidateQueryOptions(req *GoDataRequest, query url.Values) error {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	given := map[string]bool{}
+	for _, key := range keys {
+		name := key
+		if strings.HasPrefix(key, "$") {
+			name = strings.ToLower(key)
+		}
+		if len(query[key]) > 1 || given[name] {
+			return BadRequestError("The query option " + key + " is given more than once.")
+		}
+		given[name] = true
+		if !strings.HasPrefix(key, "$") {
+			continue
+		}
+		if !systemQueryOptions[name] {
+			return BadRequestError("Unknown system query option " + key + ".")
+		}
+		if name == "$schemaversion" {
+			continue
+		}
+		if kind, ok := requestKindQueryOptions[req.RequestKind]; ok && !kind.options[name] {
+			return BadRequestError("The system query option " + key + " does not apply to " + kind.resource + ".")
+		}
+	}
+
+	return nil
+}
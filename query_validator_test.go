@@ -0,0 +1,120 @@
+package godata
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func checkTestQueryOptions(testUrl string) error {
+	parsedUrl, err := url.Parse(testUrl)
+	if err != nil {
+		return err
+	}
+	request, err := ParseRequest(parsedUrl.Path, parsedUrl.Query())
+	if err != nil {
+		return err
+	}
+	service, err := BuildService(&DummyProvider{}, "http://localhost")
+	if err != nil {
+		return err
+	}
+	err = SemanticizeRequest(request, service)
+	if err != nil {
+		return err
+	}
+	return ValidateQueryOptions(request, parsedUrl.Query())
+}
+
+func TestValidateQueryOptions(t *testing.T) {
+	valid := []string{
+		"Customers?$filter=Age%20gt%201&$top=2&$skip=1&$count=true&debug=true&@p=1",
+		"Customers('Bob')?$expand=Orders&$select=Name",
+		"$metadata?$format=json",
+		"Customers?$TOP=2&$Filter=Age%20gt%201",
+		"Customers?$skiptoken=abc&$deltatoken=def",
+		"Customers?$index=1",
+		"Customers('Bob')?$schemaversion=1.0",
+		"$metadata?$schemaversion=1.0",
+	}
+	for _, testUrl := range valid {
+		if err := checkTestQueryOptions(testUrl); err != nil {
+			t.Error("Failed to validate " + testUrl + ": " + err.Error())
+		}
+	}
+
+	testCases := []struct {
+		url     string
+		message string
+	}{
+		{"Customers?$foo=1", "Unknown system query option $foo"},
+		{"Customers?$top=1&$top=2", "The query option $top is given more than once"},
+		{"Customers?$top=1&$TOP=2", "is given more than once"},
+		{"Customers?$FOO=1", "Unknown system query option $FOO"},
+		{"Customers('Bob')?$Top=1", "$Top does not apply to a single entity"},
+		{"Customers('Bob')?$skiptoken=abc", "$skiptoken does not apply to a single entity"},
+		{"Customers?debug=1&debug=2", "The query option debug is given more than once"},
+		{"Customers?$top=-1", "$top must be a non-negative integer"},
+		{"Customers?$skip=x", "$skip must be a non-negative integer"},
+		{"Customers('Bob')?$filter=Age%20gt%201", "$filter does not apply to a single entity"},
+		{"Customers('Bob')?$top=1", "$top does not apply to a single entity"},
+		{"$metadata?$top=1", "$top does not apply to the metadata document"},
+	}
+	for _, testCase := range testCases {
+		err := checkTestQueryOptions(testCase.url)
+
+		if err == nil {
+			t.Error(testCase.url + " was accepted")
+			continue
+		}
+		if goDataErr, ok := err.(*GoDataError); !ok || goDataErr.ResponseCode != 400 {
+			t.Error("Expected a 400 for " + testCase.url + ", got " + err.Error())
+		}
+		if !strings.Contains(err.Error(), testCase.message) {
+			t.Error("Expected \"" + testCase.message + "\", got \"" + err.Error() + "\"")
+		}
+	}
+}
+
+func TestStrictQueryValidation(t *testing.T) {
+	service, err := BuildService(&openTypeProvider{}, "http://localhost")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	recorder := httptest.NewRecorder()
+	service.GoDataHTTPHandler(recorder, httptest.NewRequest("GET", "/Products(1)?$foo=1", nil))
+	if recorder.Code != http.StatusOK {
+		t.Error("Lenient response code is " + strconv.Itoa(recorder.Code) + ": " + recorder.Body.String())
+	}
+
+	service.StrictQueryValidation = true
+	recorder = httptest.NewRecorder()
+	service.GoDataHTTPHandler(recorder, httptest.NewRequest("GET", "/Products(1)?$foo=1", nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Error("Strict response code is " + strconv.Itoa(recorder.Code) + ": " + recorder.Body.String())
+	}
+}
+
+func TestCaseInsensitiveQueryOptions(t *testing.T) {
+	query, err := ParseUrlQuery(url.Values{"$TOP": {"2"}, "$Filter": {"Age gt 1"}, "debug": {"1"}})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if query.Top == nil || int(*query.Top) != 2 {
+		t.Error("$TOP was not parsed as $top")
+	}
+	if query.Filter == nil {
+		t.Error("$Filter was not parsed as $filter")
+	}
+	if query.CustomOptions["debug"] != "1" {
+		t.Error("Custom option debug is missing")
+	}
+}
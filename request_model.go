@@ -1,5 +1,7 @@
 package godata
 
+import "strings"
+
 type GoDataIdentifier map[string]string
 
 const (
@@ -13,6 +15,7 @@ const (
 	RequestKindPropertyValue
 	RequestKindRef
 	RequestKindCount
+	RequestKindMediaResource
 )
 
 const (
@@ -27,6 +30,9 @@ const (
 	SemanticTypeRef
 	SemanticTypeCount
 	SemanticTypeMetadata
+	SemanticTypeDynamicProperty
+	SemanticTypeValue
+	SemanticTypeDerivedComplex
 )
 
 type GoDataRequest struct {
@@ -57,15 +63,32 @@ type GoDataSegment struct {
 	// identifier, it will be nil.
 	Identifier *GoDataIdentifier
 
+	// The navigation property the segment follows from the entity addressed
+	// by the segment before it, e.g. Customer in Orders(10)/Customer. Its
+	// SemanticReference is the entity set the property is bound to. Nil for
+	// other segments.
+	NavigationProperty *GoDataNavigationProperty
+
 	// The next segment in the path.
 	Next *GoDataSegment
 	// The previous segment in the path.
 	Prev *GoDataSegment
 }
 
+// Whether an entity set segment addresses a collection of entities, rather
+// than a single entity by its key or through a single-valued navigation
+// property.
+func (segment *GoDataSegment) addressesCollection() bool {
+	if segment.Identifier != nil {
+		return false
+	}
+	return segment.NavigationProperty == nil || strings.HasPrefix(segment.NavigationProperty.Type, "Collection(")
+}
+
 type GoDataQuery struct {
 	Filter      *GoDataFilterQuery
 	Apply       *GoDataApplyQuery
+	Compute     *GoDataComputeQuery
 	Expand      *GoDataExpandQuery
 	Select      *GoDataSelectQuery
 	OrderBy     *GoDataOrderByQuery
@@ -75,6 +98,12 @@ type GoDataQuery struct {
 	InlineCount *GoDataInlineCountQuery
 	Search      *GoDataSearchQuery
 	Format      *GoDataFormatQuery
+	// The parameter aliases given in the query string, e.g. @p=10, by name
+	// including the @.
+	Aliases map[string]string
+	// The custom query options given in the query string, i.e. the options
+	// that start with neither $ nor @, for the provider to interpret.
+	CustomOptions map[string]string
 }
 
 // Stores a parsed version of the filter query string. Can be used by
@@ -82,9 +111,22 @@ type GoDataQuery struct {
 // is stored as a parse tree that can be traversed.
 type GoDataFilterQuery struct {
 	Tree *ParseNode
+	// The typed expression built from the tree when the filter is
+	// semanticized.
+	Expression FilterExpression
+}
+
+// Stores a parsed $apply as the pipeline of transformations it applies to the
+// set, in order.
+type GoDataApplyQuery struct {
+	Transformations []ApplyTransformation
 }
 
-type GoDataApplyQuery string
+// Stores the computed properties of a $compute, e.g. Price mul Quantity as
+// Total. Providers compute the values and return them with the entities.
+type GoDataComputeQuery struct {
+	ComputeItems []*ComputeItem
+}
 
 type GoDataExpandQuery struct {
 	ExpandItems []*ExpandItem
@@ -111,6 +153,10 @@ type GoDataSearchQuery struct {
 }
 
 type GoDataFormatQuery struct {
+	// The media type of the response, e.g. "application/json".
+	MediaType string
+	// Media type parameters, e.g. "odata.metadata" => "minimal".
+	Parameters map[string]string
 }
 
 // Check if this identifier has more than one key/value pair.
@@ -2,7 +2,9 @@ package godata
 
 import (
 	"bytes"
+	"io"
 	"strconv"
+	"time"
 )
 
 // A response is a dictionary of keys to their corresponding fields. This will
@@ -30,18 +32,45 @@ type GoDataResponseField struct {
 }
 
 // Convert the response field to a JSON serialized form. If the type is not
-// string, []byte, int, float64, map[string]*GoDataResponseField, or
-// []*GoDataResponseField, then an error will be thrown.
+// nil, string, []byte, bool, an integer or float type, time.Time,
+// map[string]*GoDataResponseField, or []*GoDataResponseField, then an error
+// will be thrown.
 func (f *GoDataResponseField) Json() ([]byte, error) {
 	switch f.Value.(type) {
+	case nil:
+		return []byte("null"), nil
 	case string:
 		return prepareJsonString([]byte(f.Value.(string)))
 	case []byte:
 		return prepareJsonString(f.Value.([]byte))
+	case bool:
+		return []byte(strconv.FormatBool(f.Value.(bool))), nil
 	case int:
 		return []byte(strconv.Itoa(f.Value.(int))), nil
+	case int8:
+		return []byte(strconv.FormatInt(int64(f.Value.(int8)), 10)), nil
+	case int16:
+		return []byte(strconv.FormatInt(int64(f.Value.(int16)), 10)), nil
+	case int32:
+		return []byte(strconv.FormatInt(int64(f.Value.(int32)), 10)), nil
+	case int64:
+		return []byte(strconv.FormatInt(f.Value.(int64), 10)), nil
+	case uint:
+		return []byte(strconv.FormatUint(uint64(f.Value.(uint)), 10)), nil
+	case uint8:
+		return []byte(strconv.FormatUint(uint64(f.Value.(uint8)), 10)), nil
+	case uint16:
+		return []byte(strconv.FormatUint(uint64(f.Value.(uint16)), 10)), nil
+	case uint32:
+		return []byte(strconv.FormatUint(uint64(f.Value.(uint32)), 10)), nil
+	case uint64:
+		return []byte(strconv.FormatUint(f.Value.(uint64), 10)), nil
+	case float32:
+		return []byte(strconv.FormatFloat(float64(f.Value.(float32)), 'f', -1, 32)), nil
 	case float64:
 		return []byte(strconv.FormatFloat(f.Value.(float64), 'f', -1, 64)), nil
+	case time.Time:
+		return prepareJsonString([]byte(f.Value.(time.Time).Format(time.RFC3339Nano)))
 	case map[string]*GoDataResponseField:
 		return prepareJsonDict(f.Value.(map[string]*GoDataResponseField))
 	case []*GoDataResponseField:
@@ -51,6 +80,41 @@ func (f *GoDataResponseField) Json() ([]byte, error) {
 	}
 }
 
+// Return the Edm type that a response field value is serialized as. Used to
+// annotate values whose type is not declared in the metadata, such as the
+// dynamic properties of open types. Returns an empty string if the type is
+// not a primitive.
+func (f *GoDataResponseField) EdmType() string {
+	switch f.Value.(type) {
+	case string:
+		return GoDataString
+	case []byte:
+		return GoDataBinary
+	case bool:
+		return GoDataBoolean
+	case uint8:
+		return GoDataByte
+	case int8:
+		return GoDataSByte
+	case int16:
+		return GoDataInt16
+	case int32, uint16:
+		return GoDataInt32
+	case int, int64, uint32:
+		return GoDataInt64
+	case uint, uint64:
+		// may not fit in an Int64
+		return GoDataDecimal
+	case float32:
+		return GoDataSingle
+	case float64:
+		return GoDataDouble
+	case time.Time:
+		return GoDataDateTimeOffset
+	}
+	return ""
+}
+
 func prepareJsonString(s []byte) ([]byte, error) {
 	// escape double quotes
 	s = bytes.Replace(s, []byte("\""), []byte("\\\""), -1)
@@ -102,3 +166,21 @@ func prepareJsonList(l []*GoDataResponseField) ([]byte, error) {
 	buf.WriteByte(']')
 	return buf.Bytes(), nil
 }
+
+// The binary content of a media entity or stream property, returned by a
+// GoDataMediaProvider. The content is streamed to the client and closed
+// afterwards, so large resources are never held in memory.
+type GoDataMediaResource struct {
+	// The binary content. If it also implements io.Seeker, range and
+	// conditional requests are handled by seeking.
+	Content io.ReadCloser
+	// The MIME type of the content. Defaults to application/octet-stream.
+	ContentType string
+	// The size of the content in bytes, or 0 if it is not known. Needed to
+	// answer range requests when the content cannot seek.
+	Size int64
+	// The time the content was last modified, if known.
+	ModTime time.Time
+	// An entity tag for the content, if any.
+	ETag string
+}
@@ -89,3 +89,33 @@ func TestResponseWriter(t *testing.T) {
 	}
 
 }
+
+func TestResponseUnsignedIntegers(t *testing.T) {
+	testCases := []struct {
+		Value  interface{}
+		Expect string
+		Type   string
+	}{
+		{uint(7), "7", GoDataDecimal},
+		{uint8(255), "255", GoDataByte},
+		{uint16(65535), "65535", GoDataInt32},
+		{uint32(4294967295), "4294967295", GoDataInt64},
+		{uint64(18446744073709551615), "18446744073709551615", GoDataDecimal},
+	}
+
+	for _, testCase := range testCases {
+		field := &GoDataResponseField{Value: testCase.Value}
+		written, err := field.Json()
+
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if string(written) != testCase.Expect {
+			t.Error("Value is serialized as", string(written), "not", testCase.Expect)
+		}
+		if field.EdmType() != testCase.Type {
+			t.Error(testCase.Expect, "is annotated as", field.EdmType(), "not", testCase.Type)
+		}
+	}
+}
@@ -0,0 +1,431 @@
+package godata
+
+import (
+	"strings"
+)
+
+// The OData version of the metadata documents built by a GoDataSchemaBuilder.
+const ODataVersion = "4.0"
+
+// A fluent builder for the metadata of a service, so providers can declare
+// their model without writing GoDataMetadata by hand. The builder only deals
+// with the OData model; providers keep their own mapping from the model to
+// their storage, e.g. tables and columns, next to it.
+//
+//	schema := NewSchemaBuilder("Store", "Container")
+//	customer := schema.EntityType("Customer").Key("Id", GoDataInt32).Property("Name", GoDataString)
+//	order := schema.EntityType("Order").Key("Id", GoDataInt32).Property("CustomerId", GoDataInt32)
+//	schema.ManyToOne(order, customer, "Customer", "Orders").Constraint("CustomerId", "Id")
+//	schema.BindProperty(schema.EntitySet("Orders", order), schema.EntitySet("Customers", customer),
+//		"Customer", "Orders")
+//	metadata := schema.Metadata()
+type GoDataSchemaBuilder struct {
+	schema    *GoDataSchema
+	container *GoDataEntityContainer
+	// references to other CSDL documents, e.g. vocabularies
+	references []*GoDataReference
+}
+
+type GoDataEntityTypeBuilder struct {
+	builder    *GoDataSchemaBuilder
+	EntityType *GoDataEntityType
+}
+
+type GoDataEntitySetBuilder struct {
+	builder   *GoDataSchemaBuilder
+	EntitySet *GoDataEntitySet
+	entity    *GoDataEntityTypeBuilder
+}
+
+type GoDataNavigationPropertyBuilder struct {
+	NavigationProperty *GoDataNavigationProperty
+}
+
+type GoDataFunctionBuilder struct {
+	builder  *GoDataSchemaBuilder
+	Function *GoDataFunction
+}
+
+type GoDataActionBuilder struct {
+	builder *GoDataSchemaBuilder
+	Action  *GoDataAction
+}
+
+// Create a builder for a schema with the given namespace, whose entity sets,
+// singletons and operation imports are added to an entity container with the
+// given name.
+func NewSchemaBuilder(namespace, containerName string) *GoDataSchemaBuilder {
+	container := &GoDataEntityContainer{Name: containerName}
+	return &GoDataSchemaBuilder{
+		schema: &GoDataSchema{
+			XMLNamespace:     EdmNamespace,
+			Namespace:        namespace,
+			EntityContainers: []*GoDataEntityContainer{container},
+		},
+		container: container,
+	}
+}
+
+// Add the entity, complex and enum types of another schema with the same
+// namespace, e.g. one built by ReflectSchema, so they can be used with the
+// builder.
+func (b *GoDataSchemaBuilder) Include(schema *GoDataSchema) *GoDataSchemaBuilder {
+	b.schema.EntityTypes = append(b.schema.EntityTypes, schema.EntityTypes...)
+	b.schema.ComplexTypes = append(b.schema.ComplexTypes, schema.ComplexTypes...)
+	b.schema.EnumTypes = append(b.schema.EnumTypes, schema.EnumTypes...)
+	b.schema.TypeDefinitions = append(b.schema.TypeDefinitions, schema.TypeDefinitions...)
+	return b
+}
+
+// Reference the terms of a vocabulary, so they can be used in annotations
+// with the given alias, e.g. "Core" for "Org.OData.Core.V1".
+func (b *GoDataSchemaBuilder) Reference(uri, namespace, alias string) *GoDataSchemaBuilder {
+	b.references = append(b.references, &GoDataReference{
+		Uri:      uri,
+		Includes: []*GoDataInclude{&GoDataInclude{Namespace: namespace, Alias: alias}},
+	})
+	return b
+}
+
+// The qualified name of a type in this schema.
+func (b *GoDataSchemaBuilder) QualifiedName(name string) string {
+	return b.schema.Namespace + "." + name
+}
+
+// Return the entity type with the given name, creating it if it does not
+// exist yet.
+func (b *GoDataSchemaBuilder) EntityType(name string) *GoDataEntityTypeBuilder {
+	for _, entity := range b.schema.EntityTypes {
+		if entity.Name == name {
+			return &GoDataEntityTypeBuilder{b, entity}
+		}
+	}
+	entity := &GoDataEntityType{Name: name}
+	b.schema.EntityTypes = append(b.schema.EntityTypes, entity)
+	return &GoDataEntityTypeBuilder{b, entity}
+}
+
+// Add an entity set of the given entity type to the entity container.
+func (b *GoDataSchemaBuilder) EntitySet(name string, entity *GoDataEntityTypeBuilder) *GoDataEntitySetBuilder {
+	set := &GoDataEntitySet{Name: name, EntityType: entity.QualifiedName()}
+	b.container.EntitySets = append(b.container.EntitySets, set)
+	return &GoDataEntitySetBuilder{b, set, entity}
+}
+
+// Add a singleton of the given entity type to the entity container.
+func (b *GoDataSchemaBuilder) Singleton(name string, entity *GoDataEntityTypeBuilder) *GoDataSchemaBuilder {
+	b.container.Singletons = append(b.container.Singletons, &GoDataSingleton{
+		Name: name,
+		Type: entity.QualifiedName(),
+	})
+	return b
+}
+
+// Add navigation properties for a one-to-one relationship between a and b,
+// which are each other's partners. Returns the navigation property of a.
+func (b *GoDataSchemaBuilder) OneToOne(a, other *GoDataEntityTypeBuilder, aprop, bprop string) *GoDataNavigationPropertyBuilder {
+	prop := a.addNavigationProperty(aprop, other.QualifiedName(), bprop)
+	other.addNavigationProperty(bprop, a.QualifiedName(), aprop)
+	return &GoDataNavigationPropertyBuilder{prop}
+}
+
+// Add navigation properties for a many-to-one relationship, where many a
+// refer to one b. Returns the single-valued navigation property of a, which
+// is where referential constraints of the relationship belong.
+func (b *GoDataSchemaBuilder) ManyToOne(a, other *GoDataEntityTypeBuilder, aprop, bprop string) *GoDataNavigationPropertyBuilder {
+	prop := a.addNavigationProperty(aprop, other.QualifiedName(), bprop)
+	other.addNavigationProperty(bprop, "Collection("+a.QualifiedName()+")", aprop)
+	return &GoDataNavigationPropertyBuilder{prop}
+}
+
+// Add navigation properties for a many-to-many relationship between a and b.
+// Returns the navigation property of a.
+func (b *GoDataSchemaBuilder) ManyToMany(a, other *GoDataEntityTypeBuilder, aprop, bprop string) *GoDataNavigationPropertyBuilder {
+	prop := a.addNavigationProperty(aprop, "Collection("+other.QualifiedName()+")", bprop)
+	other.addNavigationProperty(bprop, "Collection("+a.QualifiedName()+")", aprop)
+	return &GoDataNavigationPropertyBuilder{prop}
+}
+
+// Bind the navigation properties of a relationship between two entity sets in
+// both directions: apath of the entities in a leads to b, and bpath of the
+// entities in b leads back to a.
+func (b *GoDataSchemaBuilder) BindProperty(a, other *GoDataEntitySetBuilder, apath, bpath string) *GoDataSchemaBuilder {
+	a.Bind(apath, other)
+	other.Bind(bpath, a)
+	return b
+}
+
+// Add a function to the schema.
+func (b *GoDataSchemaBuilder) Function(name string) *GoDataFunctionBuilder {
+	function := &GoDataFunction{Name: name}
+	b.schema.Functions = append(b.schema.Functions, function)
+	return &GoDataFunctionBuilder{b, function}
+}
+
+// Add an action to the schema.
+func (b *GoDataSchemaBuilder) Action(name string) *GoDataActionBuilder {
+	action := &GoDataAction{Name: name}
+	b.schema.Actions = append(b.schema.Actions, action)
+	return &GoDataActionBuilder{b, action}
+}
+
+// Annotate a model element from outside of it, e.g. "Store.Customer/Name".
+func (b *GoDataSchemaBuilder) Annotate(target, term, qualifier string) *GoDataSchemaBuilder {
+	annotation := &GoDataAnnotation{Term: term, Qualifier: qualifier}
+	for _, annotations := range b.schema.Annotations {
+		if annotations.Target == target && annotations.Qualifier == "" {
+			annotations.Annotations = append(annotations.Annotations, annotation)
+			return b
+		}
+	}
+	b.schema.Annotations = append(b.schema.Annotations, &GoDataAnnotations{
+		Target:      target,
+		Annotations: []*GoDataAnnotation{annotation},
+	})
+	return b
+}
+
+// The schema built so far.
+func (b *GoDataSchemaBuilder) Schema() *GoDataSchema {
+	return b.schema
+}
+
+// Build a metadata document holding the schema, to be returned by
+// GoDataProvider.GetMetadata.
+func (b *GoDataSchemaBuilder) Metadata() *GoDataMetadata {
+	return &GoDataMetadata{
+		XMLNamespace: EdmxNamespace,
+		Version:      ODataVersion,
+		References:   b.references,
+		DataServices: &GoDataServices{
+			Schemas: []*GoDataSchema{b.schema},
+		},
+	}
+}
+
+// The qualified name of the entity type.
+func (e *GoDataEntityTypeBuilder) QualifiedName() string {
+	return e.builder.QualifiedName(e.EntityType.Name)
+}
+
+// Add a key property to the entity type. Keys made of several properties are
+// declared by calling Key once for each of them.
+func (e *GoDataEntityTypeBuilder) Key(name, t string) *GoDataEntityTypeBuilder {
+	if e.EntityType.Key == nil {
+		e.EntityType.Key = &GoDataKey{}
+	}
+	e.EntityType.Key.PropertyRefs = append(e.EntityType.Key.PropertyRefs, &GoDataPropertyRef{Name: name})
+	e.EntityType.Properties = append(e.EntityType.Properties, &GoDataProperty{
+		Name:     name,
+		Type:     t,
+		Nullable: "false",
+	})
+	return e
+}
+
+// Add a structural property to the entity type.
+func (e *GoDataEntityTypeBuilder) Property(name, t string) *GoDataEntityTypeBuilder {
+	e.EntityType.Properties = append(e.EntityType.Properties, &GoDataProperty{Name: name, Type: t})
+	return e
+}
+
+// Add a structural property that can not be null.
+func (e *GoDataEntityTypeBuilder) RequiredProperty(name, t string) *GoDataEntityTypeBuilder {
+	e.EntityType.Properties = append(e.EntityType.Properties, &GoDataProperty{
+		Name:     name,
+		Type:     t,
+		Nullable: "false",
+	})
+	return e
+}
+
+// Derive the entity type from another one.
+func (e *GoDataEntityTypeBuilder) BaseType(base *GoDataEntityTypeBuilder) *GoDataEntityTypeBuilder {
+	e.EntityType.BaseType = base.QualifiedName()
+	return e
+}
+
+// Declare the entity type abstract.
+func (e *GoDataEntityTypeBuilder) Abstract() *GoDataEntityTypeBuilder {
+	e.EntityType.Abstract = "true"
+	return e
+}
+
+// Declare the entity type open, so its entities can have dynamic properties.
+func (e *GoDataEntityTypeBuilder) Open() *GoDataEntityTypeBuilder {
+	e.EntityType.OpenType = "true"
+	return e
+}
+
+// Declare the entity type a media entity type.
+func (e *GoDataEntityTypeBuilder) HasStream() *GoDataEntityTypeBuilder {
+	e.EntityType.HasStream = "true"
+	return e
+}
+
+// Add a navigation property that is not part of a relationship declared with
+// the schema builder, e.g. a unidirectional one.
+func (e *GoDataEntityTypeBuilder) NavigationProperty(name string, target *GoDataEntityTypeBuilder, collection bool) *GoDataNavigationPropertyBuilder {
+	t := target.QualifiedName()
+	if collection {
+		t = "Collection(" + t + ")"
+	}
+	return &GoDataNavigationPropertyBuilder{e.addNavigationProperty(name, t, "")}
+}
+
+// Annotate the entity type.
+func (e *GoDataEntityTypeBuilder) Annotate(term, qualifier string) *GoDataEntityTypeBuilder {
+	e.EntityType.Annotations = append(e.EntityType.Annotations, &GoDataAnnotation{Term: term, Qualifier: qualifier})
+	return e
+}
+
+func (e *GoDataEntityTypeBuilder) addNavigationProperty(name, t, partner string) *GoDataNavigationProperty {
+	prop := &GoDataNavigationProperty{Name: name, Type: t, Partner: partner}
+	e.EntityType.NavigationProperties = append(e.EntityType.NavigationProperties, prop)
+	return prop
+}
+
+// Constrain the navigation property: the value of property of the entity
+// declaring it must equal referencedProperty of the entity it leads to.
+func (n *GoDataNavigationPropertyBuilder) Constraint(property, referencedProperty string) *GoDataNavigationPropertyBuilder {
+	n.NavigationProperty.ReferentialConstraints = append(n.NavigationProperty.ReferentialConstraints,
+		&GoDataReferentialConstraint{Property: property, ReferencedProperty: referencedProperty})
+	return n
+}
+
+// Declare what happens to the entities the navigation property leads to when
+// the entity declaring it is deleted: Cascade, None, SetNull or SetDefault.
+func (n *GoDataNavigationPropertyBuilder) OnDelete(action string) *GoDataNavigationPropertyBuilder {
+	n.NavigationProperty.OnDelete = &GoDataOnDelete{Action: action}
+	return n
+}
+
+// Declare that the navigation property can not be null. Only applies to
+// single-valued navigation properties.
+func (n *GoDataNavigationPropertyBuilder) Required() *GoDataNavigationPropertyBuilder {
+	if !strings.HasPrefix(n.NavigationProperty.Type, "Collection(") {
+		n.NavigationProperty.Nullable = "false"
+	}
+	return n
+}
+
+// Annotate the navigation property.
+func (n *GoDataNavigationPropertyBuilder) Annotate(term, qualifier string) *GoDataNavigationPropertyBuilder {
+	n.NavigationProperty.Annotations = append(n.NavigationProperty.Annotations,
+		&GoDataAnnotation{Term: term, Qualifier: qualifier})
+	return n
+}
+
+// Bind a navigation property of the entities in the set to the set its
+// entities are found in.
+func (s *GoDataEntitySetBuilder) Bind(path string, target *GoDataEntitySetBuilder) *GoDataEntitySetBuilder {
+	s.EntitySet.NavigationPropertyBindings = append(s.EntitySet.NavigationPropertyBindings,
+		&GoDataNavigationPropertyBinding{Path: path, Target: target.EntitySet.Name})
+	return s
+}
+
+// Leave the entity set out of the service document.
+func (s *GoDataEntitySetBuilder) Hidden() *GoDataEntitySetBuilder {
+	s.EntitySet.IncludeInServiceDocument = "false"
+	return s
+}
+
+// Annotate the entity set.
+func (s *GoDataEntitySetBuilder) Annotate(term, qualifier string) *GoDataEntitySetBuilder {
+	s.EntitySet.Annotations = append(s.EntitySet.Annotations, &GoDataAnnotation{Term: term, Qualifier: qualifier})
+	return s
+}
+
+// Restrict what clients may do with the entity set, e.g. with
+// &GoDataSortRestrictions{NonSortableProperties: []string{"Photo"}}. The
+// restrictions are published as Capabilities annotations, and enforced by
+// the service.
+func (s *GoDataEntitySetBuilder) Restrict(restrictions ...GoDataRestrictions) *GoDataEntitySetBuilder {
+	for _, r := range restrictions {
+		s.EntitySet.Annotations = append(s.EntitySet.Annotations, r.Annotation())
+	}
+	for _, reference := range s.builder.references {
+		if reference.Uri == CapabilitiesVocabularyUri {
+			return s
+		}
+	}
+	s.builder.Reference(CapabilitiesVocabularyUri, CapabilitiesNamespace, "Capabilities")
+	return s
+}
+
+// The entity type of the entities in the set.
+func (s *GoDataEntitySetBuilder) EntityType() *GoDataEntityTypeBuilder {
+	return s.entity
+}
+
+// Bind the function to a type, which is passed as its first parameter.
+func (f *GoDataFunctionBuilder) Bound(name, t string) *GoDataFunctionBuilder {
+	f.Function.IsBound = "true"
+	f.Function.Parameters = append([]*GoDataParameter{&GoDataParameter{Name: name, Type: t}}, f.Function.Parameters...)
+	return f
+}
+
+// Allow further path segments or query options to be applied to the result.
+func (f *GoDataFunctionBuilder) Composable() *GoDataFunctionBuilder {
+	f.Function.IsComposable = "true"
+	return f
+}
+
+func (f *GoDataFunctionBuilder) Parameter(name, t string) *GoDataFunctionBuilder {
+	f.Function.Parameters = append(f.Function.Parameters, &GoDataParameter{Name: name, Type: t})
+	return f
+}
+
+func (f *GoDataFunctionBuilder) Returns(t string) *GoDataFunctionBuilder {
+	f.Function.ReturnType = &GoDataReturnType{Type: t}
+	return f
+}
+
+// Expose an unbound function in the entity container. The entity set may be
+// empty if the function does not return entities.
+func (f *GoDataFunctionBuilder) Import(name, entitySet string) *GoDataFunctionBuilder {
+	f.builder.container.FunctionImports = append(f.builder.container.FunctionImports, &GoDataFunctionImport{
+		Name:      name,
+		Function:  f.builder.QualifiedName(f.Function.Name),
+		EntitySet: entitySet,
+	})
+	return f
+}
+
+func (f *GoDataFunctionBuilder) Annotate(term, qualifier string) *GoDataFunctionBuilder {
+	f.Function.Annotations = append(f.Function.Annotations, &GoDataAnnotation{Term: term, Qualifier: qualifier})
+	return f
+}
+
+// Bind the action to a type, which is passed as its first parameter.
+func (a *GoDataActionBuilder) Bound(name, t string) *GoDataActionBuilder {
+	a.Action.IsBound = "true"
+	a.Action.Parameters = append([]*GoDataParameter{&GoDataParameter{Name: name, Type: t}}, a.Action.Parameters...)
+	return a
+}
+
+func (a *GoDataActionBuilder) Parameter(name, t string) *GoDataActionBuilder {
+	a.Action.Parameters = append(a.Action.Parameters, &GoDataParameter{Name: name, Type: t})
+	return a
+}
+
+func (a *GoDataActionBuilder) Returns(t string) *GoDataActionBuilder {
+	a.Action.ReturnType = &GoDataReturnType{Type: t}
+	return a
+}
+
+// Expose an unbound action in the entity container. The entity set may be
+// empty if the action does not return entities.
+func (a *GoDataActionBuilder) Import(name, entitySet string) *GoDataActionBuilder {
+	a.builder.container.ActionImports = append(a.builder.container.ActionImports, &GoDataActionImport{
+		Name:      name,
+		Action:    a.builder.QualifiedName(a.Action.Name),
+		EntitySet: entitySet,
+	})
+	return a
+}
+
+func (a *GoDataActionBuilder) Annotate(term, qualifier string) *GoDataActionBuilder {
+	a.Action.Annotations = append(a.Action.Annotations, &GoDataAnnotation{Term: term, Qualifier: qualifier})
+	return a
+}
@@ -0,0 +1,129 @@
+package godata
+
+import (
+	"testing"
+)
+
+func TestSchemaBuilder(t *testing.T) {
+	schema := NewSchemaBuilder("Store", "Container")
+	schema.Reference("https://oasis-tcs.github.io/odata-vocabularies/vocabularies/Org.OData.Core.V1.xml",
+		"Org.OData.Core.V1", "Core")
+
+	customer := schema.EntityType("Customer").
+		Key("Id", GoDataInt32).
+		RequiredProperty("Name", GoDataString).
+		Annotate("Core.Description", "")
+	order := schema.EntityType("Order").
+		Key("Id", GoDataInt32).
+		Property("CustomerId", GoDataInt32)
+	product := schema.EntityType("Product").
+		Key("Id", GoDataInt32).
+		Open()
+
+	schema.ManyToOne(order, customer, "Customer", "Orders").
+		Constraint("CustomerId", "Id").
+		OnDelete("Cascade")
+	schema.ManyToMany(order, product, "Products", "Orders")
+
+	customers := schema.EntitySet("Customers", customer)
+	orders := schema.EntitySet("Orders", order).Annotate("Core.OptimisticConcurrency", "")
+	products := schema.EntitySet("Products", product)
+	schema.BindProperty(orders, customers, "Customer", "Orders")
+	schema.BindProperty(orders, products, "Products", "Orders")
+	schema.Singleton("Me", customer)
+
+	schema.Function("TopProducts").
+		Parameter("count", GoDataInt32).
+		Returns("Collection(Store.Product)").
+		Import("TopProducts", "Products")
+	schema.Function("OrderTotal").
+		Bound("order", "Store.Order").
+		Returns(GoDataDecimal)
+	schema.Action("Reset").Import("Reset", "")
+	schema.Annotate("Store.Customer/Name", "Core.Immutable", "")
+
+	metadata := schema.Metadata()
+
+	if err := ValidateMetadata(metadata); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if metadata.Version != ODataVersion || len(metadata.References) != 1 {
+		t.Error("Metadata document not built")
+	}
+
+	s := metadata.DataServices.Schemas[0]
+	if len(s.EntityTypes) != 3 {
+		t.Error("Expected 3 entity types, got", len(s.EntityTypes))
+		return
+	}
+	if schema.EntityType("Customer").EntityType != s.EntityTypes[0] || len(s.EntityTypes) != 3 {
+		t.Error("Existing entity type not returned by the builder")
+	}
+
+	nav := s.EntityTypes[1].NavigationProperties[0]
+	if nav.Type != "Store.Customer" || nav.Partner != "Orders" || nav.ReferentialConstraints[0].Property != "CustomerId" {
+		t.Error("Many-to-one navigation property not built", nav.Type, nav.Partner)
+	}
+	reverse := s.EntityTypes[0].NavigationProperties[0]
+	if reverse.Type != "Collection(Store.Order)" || reverse.Partner != "Customer" {
+		t.Error("Reverse navigation property not built", reverse.Type, reverse.Partner)
+	}
+
+	container := s.EntityContainers[0]
+	if len(container.EntitySets) != 3 || len(container.Singletons) != 1 ||
+		len(container.FunctionImports) != 1 || len(container.ActionImports) != 1 {
+		t.Error("Entity container not built")
+	}
+	if len(container.EntitySets[1].NavigationPropertyBindings) != 2 {
+		t.Error("Bindings not built")
+	}
+	if s.Functions[1].Parameters[0].Name != "order" || s.Functions[1].IsBound != "true" {
+		t.Error("Bound function not built")
+	}
+
+	if _, err := BuildService(&builtProvider{metadata}, "http://localhost"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSchemaBuilderInclude(t *testing.T) {
+	reflected, err := ReflectSchema("Store", reflectOrder{})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	schema := NewSchemaBuilder("Store", "Container").Include(reflected)
+	schema.EntitySet("Orders", schema.EntityType("reflectOrder"))
+	schema.EntitySet("Customers", schema.EntityType("reflectCustomer"))
+
+	if len(schema.Schema().EntityTypes) != 3 {
+		t.Error("Reflected types were not reused")
+	}
+	if err := ValidateMetadata(schema.Metadata()); err != nil {
+		t.Error(err)
+	}
+}
+
+type builtProvider struct {
+	metadata *GoDataMetadata
+}
+
+func (*builtProvider) GetEntity(*GoDataRequest) (*GoDataResponseField, error) {
+	return nil, NotImplementedError("Not implemented.")
+}
+
+func (*builtProvider) GetEntityCollection(*GoDataRequest) (*GoDataResponseField, error) {
+	return nil, NotImplementedError("Not implemented.")
+}
+
+func (*builtProvider) GetCount(*GoDataRequest) (int, error) {
+	return 0, NotImplementedError("Not implemented.")
+}
+
+func (p *builtProvider) GetMetadata() *GoDataMetadata {
+	return p.metadata
+}
@@ -16,19 +16,26 @@ var GlobalSearchParser = SearchParser()
 func ParseSearchString(filter string) (*GoDataSearchQuery, error) {
 	tokens, err := GlobalSearchTokenizer.Tokenize(filter)
 	if err != nil {
-		return nil, err
+		return nil, DescribeParseError(filter, err)
 	}
 	postfix, err := GlobalSearchParser.InfixToPostfix(tokens)
 	if err != nil {
-		return nil, err
+		return nil, DescribeParseError(filter, err)
 	}
 	tree, err := GlobalSearchParser.PostfixToTree(postfix)
 	if err != nil {
-		return nil, err
+		return nil, DescribeParseError(filter, err)
 	}
 	return &GoDataSearchQuery{tree}, nil
 }
 
+func cloneSearchQuery(search *GoDataSearchQuery) *GoDataSearchQuery {
+	if search == nil {
+		return nil
+	}
+	return &GoDataSearchQuery{Tree: cloneParseNode(search.Tree)}
+}
+
 // Create a tokenizer capable of tokenizing filter statements
 func SearchTokenizer() *Tokenizer {
 	t := Tokenizer{}
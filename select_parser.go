@@ -1,31 +1,165 @@
 package godata
 
 import (
-	"errors"
 	"strings"
 )
 
 type SelectItem struct {
 	Segments []*Token
+	// The options of a selected collection, e.g.
+	// Addresses($filter=City eq 'Oslo';$top=1).
+	Filter  *GoDataFilterQuery
+	Search  *GoDataSearchQuery
+	OrderBy *GoDataOrderByQuery
+	Skip    *GoDataSkipQuery
+	Top     *GoDataTopQuery
+	Count   *GoDataCountQuery
+	Select  *GoDataSelectQuery
 }
 
 func ParseSelectString(sel string) (*GoDataSelectQuery, error) {
-	items := strings.Split(sel, ",")
+	return ParseSelectStringWithFunctions(sel, nil, GlobalFilterFunctions)
+}
+
+// Parse a $select whose items are paths, e.g. Address/City, optionally
+// followed by options in parentheses. The expressions in the options may
+// refer to parameter aliases and call the functions in the given table.
+func ParseSelectStringWithFunctions(sel string, aliases map[string]string, functions *FilterFunctionTable) (*GoDataSelectQuery, error) {
+	items, err := splitTopLevel(sel, ',')
+	if err != nil {
+		return nil, err
+	}
 
 	result := []*SelectItem{}
 
 	for _, item := range items {
+		path := strings.TrimSpace(item)
+		options := ""
+		if open := strings.Index(path, "("); open >= 0 {
+			if !strings.HasSuffix(path, ")") {
+				return nil, BadRequestError("Invalid select item '" + path + "'.")
+			}
+			path, options = path[:open], path[open+1:len(path)-1]
+		}
+
 		segments := []*Token{}
-		for _, val := range strings.Split(item, "/") {
+		for _, val := range strings.Split(path, "/") {
+			val = strings.TrimSpace(val)
+			if val == "" {
+				return nil, BadRequestError("Invalid select item '" + strings.TrimSpace(item) + "'.")
+			}
 			segments = append(segments, &Token{Value: val})
 		}
-		result = append(result, &SelectItem{segments})
+		selectItem := &SelectItem{Segments: segments}
+
+		if options != "" {
+			err := parseSelectOptions(options, selectItem, aliases, functions)
+			if err != nil {
+				return nil, err
+			}
+		}
+		result = append(result, selectItem)
 	}
 
 	return &GoDataSelectQuery{result}, nil
 }
 
+// A deep copy of an unsemanticized $select.
+func cloneSelectQuery(sel *GoDataSelectQuery) *GoDataSelectQuery {
+	if sel == nil {
+		return nil
+	}
+	copied := &GoDataSelectQuery{SelectItems: make([]*SelectItem, len(sel.SelectItems))}
+	for i, item := range sel.SelectItems {
+		c := *item
+		c.Segments = cloneTokens(item.Segments)
+		c.Filter = cloneFilterQuery(item.Filter)
+		c.Search = cloneSearchQuery(item.Search)
+		c.OrderBy = cloneOrderByQuery(item.OrderBy)
+		c.Select = cloneSelectQuery(item.Select)
+		copied.SelectItems[i] = &c
+	}
+	return copied
+}
+
+// Parse the options of a select item, separated by semicolons, e.g.
+// $filter=City eq 'Oslo';$top=1.
+func parseSelectOptions(options string, item *SelectItem, aliases map[string]string, functions *FilterFunctionTable) error {
+	parts, err := splitTopLevel(options, ';')
+	if err != nil {
+		return err
+	}
+
+	for _, part := range parts {
+		eq := strings.Index(part, "=")
+		if eq < 0 {
+			return BadRequestError("Invalid select option '" + part + "'.")
+		}
+		name, body := strings.TrimSpace(part[:eq]), part[eq+1:]
+
+		switch name {
+		case "$filter":
+			item.Filter, err = functions.ParseFilter(body, aliases)
+		case "$search":
+			item.Search, err = ParseSearchString(body)
+		case "$orderby":
+			item.OrderBy, err = ParseOrderByStringWithFunctions(body, aliases, functions)
+		case "$skip":
+			item.Skip, err = ParseSkipString(body)
+		case "$top":
+			item.Top, err = ParseTopString(body)
+		case "$count":
+			item.Count, err = ParseCountString(body)
+		case "$select":
+			item.Select, err = ParseSelectStringWithFunctions(body, aliases, functions)
+		default:
+			return BadRequestError("Unknown select option " + name + ".")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Whether the item has options that only apply to collections of complex
+// instances.
+func (item *SelectItem) hasComplexOptions() bool {
+	return item.Filter != nil || item.Search != nil || item.OrderBy != nil || item.Select != nil
+}
+
+func (item *SelectItem) hasOptions() bool {
+	return item.hasComplexOptions() || item.Skip != nil || item.Top != nil || item.Count != nil
+}
+
 func SemanticizeSelectQuery(sel *GoDataSelectQuery, service *GoDataService, entity *GoDataEntityType) error {
+	return SemanticizeSelectQueryWithCompute(sel, service, entity, nil)
+}
+
+// Check a $select that may select the properties computed by a $compute.
+// The wildcard selects the computed properties too.
+func SemanticizeSelectQueryWithCompute(
+	sel *GoDataSelectQuery,
+	service *GoDataService,
+	entity *GoDataEntityType,
+	compute *GoDataComputeQuery,
+) error {
+
+	return semanticizeSelect(sel, service, entity, nil, &applyScope{computed: compute.properties()})
+}
+
+// Resolve the items of a $select against an entity type, or against a
+// complex type for the $select option of a selected complex collection. The
+// scope holds the properties computed by $apply and $compute, and after
+// aggregating only the properties left can be selected.
+func semanticizeSelect(
+	sel *GoDataSelectQuery,
+	service *GoDataService,
+	entity *GoDataEntityType,
+	complexType *GoDataComplexType,
+	scope *applyScope,
+) error {
+
 	if sel == nil {
 		return nil
 	}
@@ -34,14 +168,21 @@ func SemanticizeSelectQuery(sel *GoDataSelectQuery, service *GoDataService, enti
 
 	// replace wildcards with every property of the entity
 	for _, item := range sel.SelectItems {
-		// TODO: allow multiple path segments
-		if len(item.Segments) > 1 {
-			return NotImplementedError("Multiple path segments in select clauses are not yet supported.")
-		}
-
-		if item.Segments[0].Value == "*" {
-			for _, prop := range service.PropertyLookup[entity] {
-				newItems = append(newItems, &SelectItem{[]*Token{&Token{Value: prop.Name}}})
+		if len(item.Segments) == 1 && item.Segments[0].Value == "*" {
+			if entity != nil {
+				for _, prop := range service.PropertyLookup[entity] {
+					if scope.remaining != nil && !scope.remaining[prop.Name] {
+						continue
+					}
+					newItems = append(newItems, &SelectItem{Segments: []*Token{&Token{Value: prop.Name}}})
+				}
+			} else {
+				for _, prop := range complexType.Properties {
+					newItems = append(newItems, &SelectItem{Segments: []*Token{&Token{Value: prop.Name}}})
+				}
+			}
+			for name := range scope.computed {
+				newItems = append(newItems, &SelectItem{Segments: []*Token{&Token{Value: name}}})
 			}
 		} else {
 			newItems = append(newItems, item)
@@ -51,13 +192,188 @@ func SemanticizeSelectQuery(sel *GoDataSelectQuery, service *GoDataService, enti
 	sel.SelectItems = newItems
 
 	for _, item := range sel.SelectItems {
-		if prop, ok := service.PropertyLookup[entity][item.Segments[0].Value]; ok {
-			item.Segments[0].SemanticType = SemanticTypeProperty
-			item.Segments[0].SemanticReference = prop
+		err := semanticizeSelectItem(item, service, entity, complexType, scope)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Resolve each segment of a select item, and check its options against the
+// type of the selected property.
+func semanticizeSelectItem(
+	item *SelectItem,
+	service *GoDataService,
+	entity *GoDataEntityType,
+	complexType *GoDataComplexType,
+	scope *applyScope,
+) error {
+
+	var prop *GoDataProperty
+	open := (entity != nil && service.IsOpenType(entity)) || (complexType != nil && complexType.IsOpenType())
+
+	for i, segment := range item.Segments {
+		name := segment.Value
+		last := i == len(item.Segments)-1
+		if prop != nil {
+			// the previous segment must be a complex property
+			complexType = service.LookupComplexType(prop.Type)
+			if complexType == nil {
+				return BadRequestError("Property " + prop.Name + " of type " + prop.Type +
+					" has no property " + name + ".")
+			}
+			entity, open, prop = nil, complexType.IsOpenType(), nil
+		}
+
+		if name == "*" && last {
+			segment.SemanticType = SemanticTypeProperty
+			segment.SemanticReference = complexType
+			continue
+		}
+
+		if strings.Contains(name, ".") {
+			if !last || entity == nil {
+				return BadRequestError("Only the last segment of a $select of an entity can be an action " +
+					"or a function, but " + name + " is not.")
+			}
+			return semanticizeSelectOperation(segment, service, entity)
+		}
+
+		var nav *GoDataNavigationProperty
+		if computedProp, ok := scope.computed[name]; ok && i == 0 {
+			prop = computedProp
+		} else if scope.remaining != nil && !scope.remaining[name] && i == 0 {
+			return BadRequestError(name + " is neither grouped nor aggregated, so it can not be selected.")
+		} else if entity != nil {
+			prop = service.PropertyLookup[entity][name]
+			nav = service.NavigationPropertyLookup[entity][name]
 		} else {
-			return errors.New("Entity " + entity.Name + " has no property " + item.Segments[0].Value)
+			for _, p := range complexType.Properties {
+				if p.Name == name {
+					prop = p
+				}
+			}
+			for _, p := range complexType.NavigationProperties {
+				if p.Name == name {
+					nav = p
+				}
+			}
+		}
+
+		if nav != nil {
+			if !last {
+				return BadRequestError("Navigation property " + name + " must be the last segment of a " +
+					"$select, use $expand to select its properties.")
+			}
+			if item.hasOptions() {
+				return BadRequestError("Navigation property " + name + " can not have select options, " +
+					"use $expand instead.")
+			}
+			segment.SemanticType = SemanticTypeEntity
+			segment.SemanticReference = nav
+			return nil
+		}
+
+		if prop != nil {
+			segment.SemanticType = SemanticTypeProperty
+			segment.SemanticReference = prop
+		} else if open && last {
+			segment.SemanticType = SemanticTypeDynamicProperty
+			segment.SemanticReference = &GoDataProperty{
+				Name: name,
+				Type: GoDataUntyped,
+			}
+		} else if entity != nil {
+			return BadRequestError("Entity " + entity.Name + " has no property " + name)
+		} else {
+			return BadRequestError("Complex type " + complexType.Name + " has no property " + name)
+		}
+	}
+
+	if !item.hasOptions() {
+		return nil
+	}
+	if prop == nil || !strings.HasPrefix(prop.Type, "Collection(") {
+		return BadRequestError("Only collections can have select options, but " +
+			item.Segments[len(item.Segments)-1].Value + " is not a collection.")
+	}
+	element := service.LookupComplexType(prop.Type[len("Collection(") : len(prop.Type)-1])
+	if element == nil {
+		if item.hasComplexOptions() {
+			return BadRequestError("Only $top, $skip and $count can be applied to " + prop.Name + ".")
+		}
+		return nil
+	}
+
+	checker := &filterChecker{service: service, complexType: element, open: element.IsOpenType()}
+	if item.Filter != nil {
+		expr, err := checker.checkFilter(item.Filter.Tree)
+		if err != nil {
+			return err
+		}
+		item.Filter.Expression = expr
+	}
+	if item.OrderBy != nil {
+		if err := semanticizeOrderBy(item.OrderBy, checker); err != nil {
+			return err
 		}
 	}
+	if item.Select != nil {
+		return semanticizeSelect(item.Select, service, nil, element, &applyScope{})
+	}
+	return nil
+}
+
+// Resolve a qualified name in a $select, which is either an action or a
+// function bound to the entity type, or every operation in a namespace, e.g.
+// Store.*.
+func semanticizeSelectOperation(segment *Token, service *GoDataService, entity *GoDataEntityType) error {
+	name := segment.Value
 
+	if strings.HasSuffix(name, ".*") {
+		namespace := strings.TrimSuffix(name, ".*")
+		schemas := []*GoDataSchema{}
+		if service.Metadata != nil && service.Metadata.DataServices != nil {
+			schemas = service.Metadata.DataServices.Schemas
+		}
+		for _, schema := range schemas {
+			if schema.Namespace == namespace || schema.Alias == namespace {
+				segment.SemanticType = SemanticTypeAction
+				segment.SemanticReference = schema
+				return nil
+			}
+		}
+		return BadRequestError("No namespace " + namespace + " for " + name + " in $select.")
+	}
+
+	bound := func(isBound string, params []*GoDataParameter) bool {
+		if isBound != "true" || len(params) == 0 {
+			return false
+		}
+		t := params[0].Type
+		return t == entity.Name || t == service.qualifiedEntityTypeName(entity)
+	}
+	found := false
+	service.eachSchema(name, func(schema *GoDataSchema, local string) {
+		for _, action := range schema.Actions {
+			if action.Name == local && bound(action.IsBound, action.Parameters) {
+				segment.SemanticType = SemanticTypeAction
+				segment.SemanticReference = action
+				found = true
+			}
+		}
+		for _, function := range schema.Functions {
+			if function.Name == local && bound(function.IsBound, function.Parameters) {
+				segment.SemanticType = SemanticTypeFunction
+				segment.SemanticReference = function
+				found = true
+			}
+		}
+	})
+	if !found {
+		return BadRequestError("No action or function " + name + " is bound to entity " + entity.Name + ".")
+	}
 	return nil
 }
@@ -0,0 +1,164 @@
+package godata
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type selectCustomer struct {
+	Id        int64 `odata:"key"`
+	Name      string
+	Addresses []reflectAddress
+	Friends   []*selectCustomer
+}
+
+func testSelectMetadata() (*GoDataMetadata, error) {
+	reflected, err := ReflectSchema("Store", selectCustomer{})
+	if err != nil {
+		return nil, err
+	}
+	schema := NewSchemaBuilder("Store", "Container").Include(reflected)
+	schema.EntitySet("Customers", schema.EntityType("selectCustomer"))
+	schema.Function("Greet").
+		Bound("customer", "Store.selectCustomer").
+		Returns(GoDataString)
+	return schema.Metadata(), nil
+}
+
+func checkTestSelect(sel string) (*GoDataSelectQuery, error) {
+	metadata, err := testSelectMetadata()
+	if err != nil {
+		return nil, err
+	}
+	service, err := BuildService(&builtProvider{metadata}, "http://localhost")
+	if err != nil {
+		return nil, err
+	}
+	entity, err := service.LookupEntityType("selectCustomer")
+	if err != nil {
+		return nil, err
+	}
+	query, err := ParseSelectString(sel)
+	if err != nil {
+		return nil, err
+	}
+	return query, SemanticizeSelectQuery(query, service, entity)
+}
+
+func TestSelectPathsAndOptions(t *testing.T) {
+	input := "Name, Addresses($filter=City eq 'Oslo';$orderby=Street desc;$top=1;$select=City)," +
+		"Friends,Store.Greet,Store.*"
+
+	output, err := checkTestSelect(input)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	items := output.SelectItems
+	if len(items) != 5 {
+		t.Error("Expected 5 items, got", len(items))
+		return
+	}
+
+	addresses := items[1]
+	if addresses.Segments[0].SemanticType != SemanticTypeProperty || int(*addresses.Top) != 1 {
+		t.Error("Addresses not parsed correctly")
+	}
+	if addresses.Filter.Expression.EdmType() != GoDataBoolean {
+		t.Error("$filter of Addresses not checked")
+	}
+	if addresses.OrderBy.OrderByItems[0].Order != DESC || addresses.OrderBy.OrderByItems[0].Expression == nil {
+		t.Error("$orderby of Addresses not checked")
+	}
+	if addresses.Select.SelectItems[0].Segments[0].SemanticReference.(*GoDataProperty).Name != "City" {
+		t.Error("$select of Addresses not checked")
+	}
+
+	if _, ok := items[2].Segments[0].SemanticReference.(*GoDataNavigationProperty); !ok {
+		t.Error("Friends is not a navigation property")
+	}
+	if items[3].Segments[0].SemanticType != SemanticTypeFunction {
+		t.Error("Store.Greet is not a function")
+	}
+	if items[4].Segments[0].SemanticType != SemanticTypeAction {
+		t.Error("Store.* does not select the operations of Store")
+	}
+}
+
+func TestSelectErrors(t *testing.T) {
+	testCases := []struct {
+		sel     string
+		message string
+	}{
+		{"Friends($top=1)", "Navigation property Friends can not have select options"},
+		{"Friends/Id", "Navigation property Friends must be the last segment"},
+		{"Name($top=1)", "Only collections can have select options"},
+		{"Addresses($filter=Missing eq 1)", "No property found Missing"},
+		{"Addresses($levels=1)", "Unknown select option $levels"},
+		{"Name/Length", "Property Name of type Edm.String has no property Length"},
+		{"Store.Missing", "No action or function Store.Missing is bound to entity selectCustomer"},
+		{"Missing", "Entity selectCustomer has no property Missing"},
+		{"Name,", "Invalid select item"},
+	}
+
+	for _, testCase := range testCases {
+		_, err := checkTestSelect(testCase.sel)
+
+		if err == nil {
+			t.Error("$select " + testCase.sel + " was accepted")
+			continue
+		}
+		if !strings.Contains(err.Error(), testCase.message) {
+			t.Error("Expected \"" + testCase.message + "\", got \"" + err.Error() + "\"")
+		}
+	}
+}
+
+type selectRecordingProvider struct {
+	builtProvider
+	Request *GoDataRequest
+}
+
+func (p *selectRecordingProvider) GetEntity(req *GoDataRequest) (*GoDataResponseField, error) {
+	p.Request = req
+	return &GoDataResponseField{Value: map[string]*GoDataResponseField{
+		"Id": &GoDataResponseField{Value: int64(1)},
+	}}, nil
+}
+
+func TestSelectOptionsOverHttp(t *testing.T) {
+	metadata, err := testSelectMetadata()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	provider := &selectRecordingProvider{builtProvider: builtProvider{metadata}}
+	service, err := BuildService(provider, "http://localhost")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	recorder := httptest.NewRecorder()
+	service.GoDataHTTPHandler(recorder, httptest.NewRequest("GET",
+		"/Customers(1)?$select=Addresses($filter=City%20eq%20%27Oslo%27;$top=1)", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Error("Response code is", recorder.Code, recorder.Body.String())
+		return
+	}
+
+	sel := provider.Request.Query.Select
+	if sel == nil || len(sel.SelectItems) != 1 {
+		t.Error("$select with a literal ; was dropped")
+		return
+	}
+	item := sel.SelectItems[0]
+	if item.Filter == nil || item.Filter.Expression == nil || item.Top == nil || int(*item.Top) != 1 {
+		t.Error("The options of Addresses were not parsed and checked")
+	}
+}
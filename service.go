@@ -1,15 +1,24 @@
 package godata
 
 import (
+	"io"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const (
 	ODataFieldContext string = "@odata.context"
 	ODataFieldCount   string = "@odata.count"
 	ODataFieldValue   string = "value"
+	ODataFieldType    string = "@odata.type"
+	ODataFieldId      string = "@odata.id"
+
+	ODataFieldMediaReadLink    string = "@odata.mediaReadLink"
+	ODataFieldMediaContentType string = "@odata.mediaContentType"
+	ODataFieldNavigationLink   string = "@odata.navigationLink"
 )
 
 // The basic interface for a GoData provider. All providers must implement
@@ -22,13 +31,60 @@ type GoDataProvider interface {
 	// response field that contains the value of a slice of every entity in the
 	// collection filtered by the request query parameters.
 	GetEntityCollection(*GoDataRequest) (*GoDataResponseField, error)
-	// Request the number of entities in a collection, disregarding any filter
-	// query parameters.
+	// Request the number of entities in a collection that match the $filter
+	// and $search of the request, disregarding $top and $skip.
 	GetCount(*GoDataRequest) (int, error)
 	// Get the object model representation from the provider.
 	GetMetadata() *GoDataMetadata
 }
 
+// Providers that accept writes also implement this interface. The service
+// checks for it when a POST, PUT, PATCH or DELETE request is received, and
+// responds with 405 Method Not Allowed if the provider is read-only.
+type GoDataWriteProvider interface {
+	// Create a new entity in the collection addressed by the request. Should
+	// return the created entity the same way GetEntity does.
+	CreateEntity(*GoDataRequest, *GoDataEntityBody) (*GoDataResponseField, error)
+	// Update the entity addressed by the request with the properties in the
+	// body, leaving all other properties untouched (PATCH). Should return
+	// the updated entity.
+	UpdateEntity(*GoDataRequest, *GoDataEntityBody) (*GoDataResponseField, error)
+	// Replace the entity addressed by the request with the body, resetting
+	// every property missing from the body to its default (PUT). Should
+	// return the replaced entity.
+	ReplaceEntity(*GoDataRequest, *GoDataEntityBody) (*GoDataResponseField, error)
+	// Delete the entity addressed by the request.
+	DeleteEntity(*GoDataRequest) error
+}
+
+// Providers that serve media entities (entity types with HasStream) or stream
+// properties (properties of type Edm.Stream) also implement this interface.
+// The content type of each media entity and stream property is annotated as
+// @odata.mediaContentType and <Property>@odata.mediaContentType. It is taken
+// from the annotation if the provider already included it in the fields
+// returned by GetEntity and GetEntityCollection, from the ContentType of a
+// GoDataMediaResource returned as the value of a stream property, or from a
+// GoDataMediaTypeProvider, and is application/octet-stream otherwise.
+type GoDataMediaProvider interface {
+	// Open the binary content of the media entity or stream property addressed
+	// by the request. The service closes the content once it has been sent, so
+	// it can be streamed straight from its source.
+	GetMediaResource(*GoDataRequest) (*GoDataMediaResource, error)
+	// Replace the binary content of the media entity or stream property
+	// addressed by the request with the given body, which has the given
+	// content type.
+	UpdateMediaResource(*GoDataRequest, string, io.Reader) error
+}
+
+// Media providers that know the content type of a media resource without
+// opening it can also implement this interface.
+type GoDataMediaTypeProvider interface {
+	// Get the content type of a media entity from its fields, or of its stream
+	// property with the given name if the name is not empty. Returns an empty
+	// string if the content type is not known.
+	GetMediaContentType(entity *GoDataEntityType, property string, fields map[string]*GoDataResponseField) string
+}
+
 // A GoDataService will spawn an HTTP listener, which will connect GoData
 // requests with a backend provider given to it.
 type GoDataService struct {
@@ -56,6 +112,18 @@ type GoDataService struct {
 	// A lookup for navigational properties if an entity type is given,
 	// lookup navigational properties by name
 	NavigationPropertyLookup map[*GoDataEntityType]map[string]*GoDataNavigationProperty
+	// The functions that may be called in a $filter of a request to this
+	// service, including the custom functions registered on it
+	FilterFunctions *FilterFunctionTable
+	// The number of levels $levels=max expands to in an $expand, and the
+	// most levels a request may ask for
+	MaxExpandLevels int
+	// Whether to reject requests with unknown, duplicated or inapplicable
+	// system query options instead of ignoring them
+	StrictQueryValidation bool
+	// The limits on the complexity of requests, or nil to accept requests
+	// of any complexity
+	Limits *GoDataQueryLimits
 }
 
 type providerChannelResponse struct {
@@ -67,10 +135,16 @@ type providerChannelResponse struct {
 // all parts of the data model, so constant time lookups can be performed. This
 // step only happens once when the server starts up, so the overall cost is
 // minimal. The given url will be treated as the base URL for all service
-// requests, and used for building context URLs, etc.
+// requests, and used for building context URLs, etc. The metadata is
+// validated first, and a *GoDataMetadataError is returned if the model is
+// inconsistent.
 func BuildService(provider GoDataProvider, serviceUrl string) (*GoDataService, error) {
 	metadata := provider.GetMetadata()
 
+	if err := ValidateMetadata(metadata); err != nil {
+		return nil, err
+	}
+
 	// build the lookups from the metadata
 	schemaLookup := map[string]*GoDataSchema{}
 	entityLookup := map[string]map[string]*GoDataEntityType{}
@@ -136,17 +210,38 @@ func BuildService(provider GoDataProvider, serviceUrl string) (*GoDataService, e
 		entitySetLookup,
 		propertyLookup,
 		navPropLookup,
+		NewFilterFunctionTable(),
+		DefaultMaxExpandLevels,
+		false,
+		nil,
 	}, nil
 }
 
+// Register a custom function that may be called in a $filter of a request to
+// this service.
+func (service *GoDataService) RegisterFilterFunction(fn *GoDataFilterFunction) error {
+	return service.FilterFunctions.Register(fn)
+}
+
 // The default handler for parsing requests as GoDataRequests, passing them
 // to a GoData provider, and then building a response.
 func (service *GoDataService) GoDataHTTPHandler(w http.ResponseWriter, r *http.Request) {
 
-	request, err := ParseRequest(r.URL.Path, r.URL.Query())
+	path := strings.TrimPrefix(r.URL.Path, service.BaseUrl.Path)
+	path = strings.Trim(path, "/")
+
+	query, err := ParseQueryValues(r.URL.RawQuery)
+
+	if err != nil {
+		service.writeError(w, err)
+		return
+	}
+
+	request, err := ParseRequestWithFunctions(path, query, service.FilterFunctions)
 
 	if err != nil {
-		panic(err) // TODO: return proper error
+		service.writeError(w, err)
+		return
 	}
 
 	// Semanticize all tokens in the request, connecting them with their
@@ -154,39 +249,316 @@ func (service *GoDataService) GoDataHTTPHandler(w http.ResponseWriter, r *http.R
 	err = SemanticizeRequest(request, service)
 
 	if err != nil {
-		panic(err) // TODO: return proper error
+		service.writeError(w, err)
+		return
+	}
+
+	if service.StrictQueryValidation {
+		err = ValidateQueryOptions(request, query)
+		if err != nil {
+			service.writeError(w, err)
+			return
+		}
+	}
+
+	err = service.Limits.Check(request, service, r.URL.RequestURI())
+
+	if err != nil {
+		service.writeError(w, err)
+		return
+	}
+
+	if request.RequestKind == RequestKindMediaResource {
+		// media is streamed to the client instead of built in memory
+		err = service.serveMediaResource(w, r, request)
+		if err != nil {
+			service.writeError(w, err)
+		}
+		return
+	}
+
+	if request.Query.Format == nil && request.RequestKind == RequestKindMetadata {
+		// everything else is only served as JSON, whatever the client accepts
+		request.Query.Format = ParseAcceptHeader(r.Header.Get("Accept"), MediaTypeXml, MediaTypeJson)
+	}
+	mediaType, err := service.responseMediaType(request)
+	if err != nil {
+		service.writeError(w, err)
+		return
 	}
 
-	// TODO: differentiate GET and POST requests
 	var response []byte = []byte{}
+	status := http.StatusOK
+	switch r.Method {
+	case http.MethodPost:
+		response, err = service.buildCreateResponse(request, r.Body)
+		status = http.StatusCreated
+	case http.MethodPut, http.MethodPatch:
+		response, err = service.buildUpdateResponse(request, r.Body, r.Method == http.MethodPut)
+	case http.MethodDelete:
+		err = service.deleteEntity(request)
+		status = http.StatusNoContent
+	default:
+		response, err = service.buildReadResponse(request)
+	}
+
+	if err != nil {
+		service.writeError(w, err)
+		return
+	}
+
+	if status != http.StatusNoContent {
+		w.Header().Set("Content-Type", mediaType)
+	}
+	w.WriteHeader(status)
+	w.Write(response)
+}
+
+// Choose the media type of the response from the requested format. Metadata
+// is served as CSDL XML unless JSON is asked for, everything else only as
+// JSON. A $format the resource cannot be served in is not acceptable.
+func (service *GoDataService) responseMediaType(request *GoDataRequest) (string, error) {
+	format := request.Query.Format
+	if request.RequestKind == RequestKindMetadata {
+		if format != nil && format.IsJson() {
+			return MediaTypeJson, nil
+		}
+		if format == nil || format.MediaType == MediaTypeXml {
+			return MediaTypeXml, nil
+		}
+	} else if format == nil || format.IsJson() {
+		return MediaTypeJson, nil
+	}
+	return "", NotAcceptableError("Format " + format.MediaType + " is not supported.")
+}
+
+func (service *GoDataService) buildReadResponse(request *GoDataRequest) ([]byte, error) {
 	if request.RequestKind == RequestKindMetadata {
-		response, err = service.buildMetadataResponse(request)
+		return service.buildMetadataResponse(request)
 	} else if request.RequestKind == RequestKindService {
-		response, err = service.buildServiceResponse(request)
+		return service.buildServiceResponse(request)
 	} else if request.RequestKind == RequestKindCollection {
-		response, err = service.buildCollectionResponse(request)
+		return service.buildCollectionResponse(request)
 	} else if request.RequestKind == RequestKindEntity {
-		response, err = service.buildEntityResponse(request)
+		return service.buildEntityResponse(request)
 	} else if request.RequestKind == RequestKindProperty {
-		response, err = service.buildPropertyResponse(request)
+		return service.buildPropertyResponse(request)
 	} else if request.RequestKind == RequestKindPropertyValue {
-		response, err = service.buildPropertyValueResponse(request)
+		return service.buildPropertyValueResponse(request)
 	} else if request.RequestKind == RequestKindCount {
-		response, err = service.buildCountResponse(request)
+		return service.buildCountResponse(request)
 	} else if request.RequestKind == RequestKindRef {
-		response, err = service.buildRefResponse(request)
-	} else {
-		err = NotImplementedError("Request type not understood.")
+		return service.buildRefResponse(request)
+	}
+	return nil, NotImplementedError("Request type not understood.")
+}
+
+// Write an error to the client in the OData JSON error format. Errors that
+// are not GoDataErrors are reported as internal server errors.
+func (service *GoDataService) writeError(w http.ResponseWriter, err error) {
+	goDataErr, ok := err.(*GoDataError)
+	if !ok {
+		goDataErr = InternalServerError(err.Error())
+	}
+
+	response := &GoDataResponse{Fields: map[string]*GoDataResponseField{
+		"error": &GoDataResponseField{Value: map[string]*GoDataResponseField{
+			"code":    &GoDataResponseField{Value: strconv.Itoa(goDataErr.ResponseCode)},
+			"message": &GoDataResponseField{Value: goDataErr.Message},
+		}},
+	}}
+	body, _ := response.Json()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(goDataErr.ResponseCode)
+	w.Write(body)
+}
+
+// Read or replace the media resource addressed by the request. Content is
+// copied straight from the provider, and single byte ranges are supported.
+func (service *GoDataService) serveMediaResource(
+	w http.ResponseWriter,
+	r *http.Request,
+	request *GoDataRequest,
+) error {
+
+	media, ok := service.Provider.(GoDataMediaProvider)
+	if !ok {
+		return NotImplementedError("The provider does not serve media resources.")
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		resource, err := media.GetMediaResource(request)
+		if err != nil {
+			return err
+		}
+		defer resource.Content.Close()
+
+		contentType := resource.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		w.Header().Set("Content-Type", contentType)
+		if resource.ETag != "" {
+			w.Header().Set("ETag", resource.ETag)
+		}
+
+		if seeker, ok := resource.Content.(io.ReadSeeker); ok {
+			// the standard library handles ranges and conditional requests
+			http.ServeContent(w, r, "", resource.ModTime, seeker)
+			return nil
+		}
+
+		serveMediaStream(w, r, resource)
+		return nil
+	case http.MethodPut:
+		err := media.UpdateMediaResource(request, r.Header.Get("Content-Type"), r.Body)
+		if err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	default:
+		return MethodNotAllowedError("Media resources can only be read or replaced.")
 	}
+}
 
+// Copy a media resource that cannot seek to the client. If the size of the
+// resource is known, a single byte range is served by skipping over the start
+// of the stream, otherwise the whole resource is sent.
+func serveMediaStream(w http.ResponseWriter, r *http.Request, resource *GoDataMediaResource) {
+	if !resource.ModTime.IsZero() {
+		w.Header().Set("Last-Modified", resource.ModTime.UTC().Format(http.TimeFormat))
+	}
+
+	if mediaNotModified(r, resource) {
+		w.Header().Del("Content-Type")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if resource.Size <= 0 {
+		w.WriteHeader(http.StatusOK)
+		if r.Method != http.MethodHead {
+			io.Copy(w, resource.Content)
+		}
+		return
+	}
+
+	w.Header().Set("Accept-Ranges", "bytes")
+	start, length, status := parseByteRange(r.Header.Get("Range"), resource.Size)
+
+	switch status {
+	case http.StatusRequestedRangeNotSatisfiable:
+		w.Header().Set("Content-Range", "bytes */"+strconv.FormatInt(resource.Size, 10))
+		w.WriteHeader(status)
+		return
+	case http.StatusPartialContent:
+		w.Header().Set("Content-Range", "bytes "+strconv.FormatInt(start, 10)+"-"+
+			strconv.FormatInt(start+length-1, 10)+"/"+strconv.FormatInt(resource.Size, 10))
+	}
+
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	w.WriteHeader(status)
+
+	if r.Method == http.MethodHead {
+		return
+	}
+	if start > 0 {
+		if _, err := io.CopyN(io.Discard, resource.Content, start); err != nil {
+			return
+		}
+	}
+	io.CopyN(w, resource.Content, length)
+}
+
+// Check the If-None-Match and If-Modified-Since headers of a request against
+// a media resource, the same way http.ServeContent does for resources that
+// can seek. If-Modified-Since is ignored when If-None-Match is given.
+func mediaNotModified(r *http.Request, resource *GoDataMediaResource) bool {
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		if resource.ETag == "" {
+			return false
+		}
+		for _, tag := range strings.Split(match, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(resource.ETag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	since := r.Header.Get("If-Modified-Since")
+	if since == "" || resource.ModTime.IsZero() {
+		return false
+	}
+	t, err := http.ParseTime(since)
 	if err != nil {
-		panic(err) // TODO: return proper error
+		return false
 	}
+	// the header only has a precision of seconds
+	return !resource.ModTime.Truncate(time.Second).After(t)
+}
 
-	w.Write(response)
+// Resolve the Range header of a request against a resource of the given size.
+// Returns the first byte and the number of bytes to send, with the status
+// code to send them with. Headers with several ranges or invalid syntax are
+// ignored, and the whole resource is sent.
+func parseByteRange(header string, size int64) (int64, int64, int) {
+	if !strings.HasPrefix(header, "bytes=") || strings.Contains(header, ",") {
+		return 0, size, http.StatusOK
+	}
+
+	spec := strings.TrimSpace(strings.TrimPrefix(header, "bytes="))
+	dash := strings.Index(spec, "-")
+	if dash < 0 {
+		return 0, size, http.StatusOK
+	}
+
+	first, last := spec[:dash], spec[dash+1:]
+	var start, end int64
+
+	if first == "" {
+		// a suffix range: the last n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, size, http.StatusOK
+		}
+		if n > size {
+			n = size
+		}
+		start, end = size-n, size-1
+	} else {
+		var err error
+		start, err = strconv.ParseInt(first, 10, 64)
+		if err != nil || start < 0 {
+			return 0, size, http.StatusOK
+		}
+		end = size - 1
+		if last != "" {
+			end, err = strconv.ParseInt(last, 10, 64)
+			if err != nil || end < start {
+				return 0, size, http.StatusOK
+			}
+			if end > size-1 {
+				end = size - 1
+			}
+		}
+	}
+
+	if start >= size {
+		return 0, 0, http.StatusRequestedRangeNotSatisfiable
+	}
+
+	return start, end - start + 1, http.StatusPartialContent
 }
 
 func (service *GoDataService) buildMetadataResponse(request *GoDataRequest) ([]byte, error) {
+	if request.Query.Format != nil && request.Query.Format.IsJson() {
+		return service.Metadata.Json()
+	}
 	return service.Metadata.Bytes()
 }
 
@@ -205,7 +577,7 @@ func (service *GoDataService) buildCollectionResponse(request *GoDataRequest) ([
 		close(responses)
 	}()
 
-	if bool(*request.Query.Count) {
+	if request.Query.Count != nil && bool(*request.Query.Count) {
 		// if count is true, also include the count result
 		counts := make(chan *providerChannelResponse)
 
@@ -238,6 +610,20 @@ func (service *GoDataService) buildCollectionResponse(request *GoDataRequest) ([
 		return nil, r.Error
 	}
 
+	entitySet := request.LastSegment.SemanticReference.(*GoDataEntitySet)
+	entityType, err := service.LookupEntityType(entitySet.EntityType)
+	if err != nil {
+		return nil, err
+	}
+
+	if list, ok := r.Field.Value.([]*GoDataResponseField); ok {
+		for _, entity := range list {
+			if fields, ok := entity.Value.(map[string]*GoDataResponseField); ok {
+				service.annotateEntity(entitySet, entityType, fields, request.Query)
+			}
+		}
+	}
+
 	response.Fields[ODataFieldValue] = r.Field
 
 	return response.Json()
@@ -252,33 +638,387 @@ func (service *GoDataService) buildEntityResponse(request *GoDataRequest) ([]byt
 		close(responses)
 	}()
 
+	// wait for a response from the provider
+	r := <-responses
+
+	if r.Error != nil {
+		return nil, r.Error
+	}
+
+	return service.buildEntityJson(request, r.Field, "GetEntity()")
+}
+
+// Add the context URL and control information to an entity returned by the
+// provider and serialize it. The source is the provider method that produced
+// the entity, which is used for reporting errors.
+func (service *GoDataService) buildEntityJson(
+	request *GoDataRequest,
+	field *GoDataResponseField,
+	source string,
+) ([]byte, error) {
+
 	// build context URL
-	context := request.LastSegment.SemanticReference.(*GoDataEntitySet).Name
-	path, err := url.Parse("./$metadata#" + context + "/$entity")
+	entitySet := request.LastSegment.SemanticReference.(*GoDataEntitySet)
+	path, err := url.Parse("./$metadata#" + entitySet.Name + "/$entity")
 	if err != nil {
 		return nil, err
 	}
 	contextUrl := service.BaseUrl.ResolveReference(path).String()
 
-	// wait for a response from the provider
-	r := <-responses
-
-	if r.Error != nil {
-		return nil, r.Error
+	entityType, err := service.LookupEntityType(entitySet.EntityType)
+	if err != nil {
+		return nil, err
 	}
 
 	// Add context field to result and create the response
-	switch r.Field.Value.(type) {
+	switch field.Value.(type) {
 	case map[string]*GoDataResponseField:
-		fields := r.Field.Value.(map[string]*GoDataResponseField)
+		fields := field.Value.(map[string]*GoDataResponseField)
 		fields[ODataFieldContext] = &GoDataResponseField{Value: contextUrl}
+		service.annotateEntity(entitySet, entityType, fields, request.Query)
 		response := &GoDataResponse{Fields: fields}
 
 		return response.Json()
 	default:
 		return nil, InternalServerError("Provider did not return a valid response" +
-			" from GetEntity()")
+			" from " + source)
+	}
+}
+
+// Add control information to an entity returned by the provider.
+func (service *GoDataService) annotateEntity(
+	set *GoDataEntitySet,
+	entity *GoDataEntityType,
+	fields map[string]*GoDataResponseField,
+	query *GoDataQuery,
+) {
+	service.annotateComputedProperties(query.Compute, fields)
+	service.annotateDynamicProperties(entity, fields)
+	service.annotateMediaLinks(set, entity, fields)
+	service.annotateNavigationLinks(set, entity, fields, query.Select)
+}
+
+// Add @odata.navigationLink control information for each navigation property
+// selected by a $select, unless the provider returned it expanded.
+func (service *GoDataService) annotateNavigationLinks(
+	set *GoDataEntitySet,
+	entity *GoDataEntityType,
+	fields map[string]*GoDataResponseField,
+	sel *GoDataSelectQuery,
+) {
+
+	if sel == nil {
+		return
+	}
+
+	var entityUrl string
+	for _, item := range sel.SelectItems {
+		nav, ok := item.Segments[0].SemanticReference.(*GoDataNavigationProperty)
+		if !ok || len(item.Segments) > 1 {
+			continue
+		}
+		if _, ok := fields[nav.Name]; ok {
+			continue
+		}
+		if entityUrl == "" {
+			if entityUrl, ok = service.buildEntityUrl(set, entity, fields); !ok {
+				return
+			}
+		}
+		fields[nav.Name+ODataFieldNavigationLink] = &GoDataResponseField{Value: entityUrl + "/" + nav.Name}
+	}
+}
+
+// Add @odata.type control information to the values of computed properties
+// returned by the provider, using the type of the computed expression.
+func (service *GoDataService) annotateComputedProperties(
+	compute *GoDataComputeQuery,
+	fields map[string]*GoDataResponseField,
+) {
+
+	if compute == nil {
+		return
+	}
+
+	for _, item := range compute.ComputeItems {
+		if _, ok := fields[item.Alias]; !ok {
+			continue
+		}
+		if _, ok := fields[item.Alias+ODataFieldType]; ok {
+			continue
+		}
+		t := item.Type
+		if t == "" || t == GoDataUntyped || t == GoDataString || t == GoDataBoolean {
+			continue
+		}
+		fields[item.Alias+ODataFieldType] = &GoDataResponseField{
+			Value: "#" + strings.TrimPrefix(t, "Edm."),
+		}
+	}
+}
+
+// Add @odata.type control information to the dynamic properties of an open
+// entity, so clients know their types. Strings and booleans need no
+// annotation, and annotations already set by the provider are kept.
+func (service *GoDataService) annotateDynamicProperties(
+	entity *GoDataEntityType,
+	fields map[string]*GoDataResponseField,
+) {
+
+	if !service.IsOpenType(entity) {
+		return
+	}
+
+	dynamic := []string{}
+	for name := range fields {
+		if strings.Contains(name, "@") {
+			continue
+		}
+		if _, ok := service.PropertyLookup[entity][name]; ok {
+			continue
+		}
+		if _, ok := service.NavigationPropertyLookup[entity][name]; ok {
+			continue
+		}
+		dynamic = append(dynamic, name)
+	}
+
+	for _, name := range dynamic {
+		if _, ok := fields[name+ODataFieldType]; ok {
+			continue
+		}
+		t := fields[name].EdmType()
+		if t == "" || t == GoDataString || t == GoDataBoolean {
+			continue
+		}
+		fields[name+ODataFieldType] = &GoDataResponseField{
+			Value: "#" + strings.TrimPrefix(t, "Edm."),
+		}
+	}
+}
+
+// Add @odata.mediaReadLink control information to a media entity and to each
+// of its stream properties. Streams are never sent inline, so any value the
+// provider returned for a stream property is replaced by its link.
+func (service *GoDataService) annotateMediaLinks(
+	set *GoDataEntitySet,
+	entity *GoDataEntityType,
+	fields map[string]*GoDataResponseField,
+) {
+
+	streams := []*GoDataProperty{}
+	for _, prop := range entity.Properties {
+		if prop.Type == GoDataStream {
+			streams = append(streams, prop)
+		}
+	}
+
+	if !entity.IsMediaEntity() && len(streams) == 0 {
+		return
+	}
+
+	entityUrl, ok := service.buildEntityUrl(set, entity, fields)
+	if !ok {
+		return
+	}
+
+	if entity.IsMediaEntity() {
+		fields[ODataFieldMediaReadLink] = &GoDataResponseField{Value: entityUrl + "/$value"}
+		if _, ok := fields[ODataFieldMediaContentType]; !ok {
+			fields[ODataFieldMediaContentType] = &GoDataResponseField{
+				Value: service.mediaContentType(entity, "", fields),
+			}
+		}
+	}
+
+	for _, prop := range streams {
+		if _, ok := fields[prop.Name+ODataFieldMediaContentType]; !ok {
+			fields[prop.Name+ODataFieldMediaContentType] = &GoDataResponseField{
+				Value: service.mediaContentType(entity, prop.Name, fields),
+			}
+		}
+		delete(fields, prop.Name)
+		fields[prop.Name+ODataFieldMediaReadLink] = &GoDataResponseField{
+			Value: entityUrl + "/" + prop.Name,
+		}
+	}
+}
+
+// Find the content type of a media entity, or of one of its stream properties
+// if the property name is not empty, when the provider did not annotate it.
+func (service *GoDataService) mediaContentType(
+	entity *GoDataEntityType,
+	property string,
+	fields map[string]*GoDataResponseField,
+) string {
+
+	if field, ok := fields[property]; ok && property != "" {
+		if resource, ok := field.Value.(*GoDataMediaResource); ok {
+			// the resource is only used for its content type
+			if resource.Content != nil {
+				resource.Content.Close()
+			}
+			if resource.ContentType != "" {
+				return resource.ContentType
+			}
+		}
+	}
+
+	if media, ok := service.Provider.(GoDataMediaTypeProvider); ok {
+		if contentType := media.GetMediaContentType(entity, property, fields); contentType != "" {
+			return contentType
+		}
+	}
+
+	return "application/octet-stream"
+}
+
+// Build the canonical URL of an entity from the key values in its fields.
+// Returns false if the entity type has no key or the key value is missing.
+func (service *GoDataService) buildEntityUrl(
+	set *GoDataEntitySet,
+	entity *GoDataEntityType,
+	fields map[string]*GoDataResponseField,
+) (string, bool) {
+
+	refs := entity.Key.Refs()
+	if len(refs) == 0 {
+		return "", false
+	}
+
+	values := []string{}
+	for _, ref := range refs {
+		field, ok := fields[ref.Name]
+		if !ok {
+			return "", false
+		}
+
+		var value string
+		if v, ok := field.Value.(string); ok {
+			value = "'" + strings.Replace(v, "'", "''", -1) + "'"
+		} else {
+			v, err := field.Json()
+			if err != nil {
+				return "", false
+			}
+			value = string(v)
+		}
+
+		if len(refs) > 1 {
+			// composite keys name each of their values
+			value = ref.Name + "=" + value
+		}
+		values = append(values, value)
+	}
+	key := strings.Join(values, ",")
+
+	path, err := url.Parse("./" + set.Name + "(" + url.PathEscape(key) + ")")
+	if err != nil {
+		return "", false
+	}
+
+	return service.BaseUrl.ResolveReference(path).String(), true
+}
+
+// Create an entity from the body of a POST request to a collection.
+func (service *GoDataService) buildCreateResponse(request *GoDataRequest, body io.Reader) ([]byte, error) {
+	writer, ok := service.Provider.(GoDataWriteProvider)
+	if !ok {
+		return nil, MethodNotAllowedError("The provider does not accept writes.")
+	}
+	if request.RequestKind != RequestKindCollection {
+		return nil, MethodNotAllowedError("Entities can only be created in a collection.")
+	}
+
+	payload, err := service.parseEntityBody(request, body)
+	if err != nil {
+		return nil, err
+	}
+	err = service.checkInsertCapabilities(request.LastSegment.SemanticReference.(*GoDataEntitySet), payload)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := writer.CreateEntity(request, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return service.buildEntityJson(request, result, "CreateEntity()")
+}
+
+// Update or replace an entity from the body of a PATCH or PUT request.
+func (service *GoDataService) buildUpdateResponse(
+	request *GoDataRequest,
+	body io.Reader,
+	replace bool,
+) ([]byte, error) {
+
+	writer, ok := service.Provider.(GoDataWriteProvider)
+	if !ok {
+		return nil, MethodNotAllowedError("The provider does not accept writes.")
+	}
+	if request.RequestKind != RequestKindEntity {
+		return nil, MethodNotAllowedError("Only single entities can be updated.")
+	}
+
+	payload, err := service.parseEntityBody(request, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if replace {
+		result, err := writer.ReplaceEntity(request, payload)
+		if err != nil {
+			return nil, err
+		}
+		return service.buildEntityJson(request, result, "ReplaceEntity()")
 	}
+
+	result, err := writer.UpdateEntity(request, payload)
+	if err != nil {
+		return nil, err
+	}
+	return service.buildEntityJson(request, result, "UpdateEntity()")
+}
+
+func (service *GoDataService) deleteEntity(request *GoDataRequest) error {
+	writer, ok := service.Provider.(GoDataWriteProvider)
+	if !ok {
+		return MethodNotAllowedError("The provider does not accept writes.")
+	}
+	if request.RequestKind != RequestKindEntity {
+		return MethodNotAllowedError("Only single entities can be deleted.")
+	}
+
+	return writer.DeleteEntity(request)
+}
+
+// Read the body of a write request and check it against the entity type of
+// the entity set it is written to.
+func (service *GoDataService) parseEntityBody(request *GoDataRequest, body io.Reader) (*GoDataEntityBody, error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := ParseEntityBody(data)
+	if err != nil {
+		return nil, err
+	}
+
+	entityType, err := service.LookupEntityType(
+		request.LastSegment.SemanticReference.(*GoDataEntitySet).EntityType)
+	if err != nil {
+		return nil, err
+	}
+
+	err = SemanticizeEntityBody(payload, service, entityType)
+	if err != nil {
+		return nil, err
+	}
+
+	return payload, nil
 }
 
 func (service *GoDataService) buildPropertyResponse(request *GoDataRequest) ([]byte, error) {
@@ -365,6 +1105,267 @@ func (service *GoDataService) LookupEntityType(name string) (*GoDataEntityType,
 	return nil, BadRequestError("No schema lookup found for entity " + name)
 }
 
+// Lookup a complex type by its qualified name, or its name if it is
+// unambiguous. Returns nil if there is no such complex type.
+func (service *GoDataService) LookupComplexType(name string) *GoDataComplexType {
+	var result *GoDataComplexType
+	service.eachSchema(name, func(schema *GoDataSchema, local string) {
+		for _, t := range schema.ComplexTypes {
+			if t.Name == local {
+				result = t
+			}
+		}
+	})
+	return result
+}
+
+// Lookup an enum type by its qualified name, or its name if it is
+// unambiguous. Returns nil if there is no such enum type.
+func (service *GoDataService) LookupEnumType(name string) *GoDataEnumType {
+	var result *GoDataEnumType
+	service.eachSchema(name, func(schema *GoDataSchema, local string) {
+		for _, t := range schema.EnumTypes {
+			if t.Name == local {
+				result = t
+			}
+		}
+	})
+	return result
+}
+
+// Lookup a type definition by its qualified name, or its name if it is
+// unambiguous. Returns nil if there is no such type definition.
+func (service *GoDataService) LookupTypeDefinition(name string) *GoDataTypeDefinition {
+	var result *GoDataTypeDefinition
+	service.eachSchema(name, func(schema *GoDataSchema, local string) {
+		for _, t := range schema.TypeDefinitions {
+			if t.Name == local {
+				result = t
+			}
+		}
+	})
+	return result
+}
+
+// Lookup the annotations of a model element given by its target path, e.g.
+// Store.Customer, Store.Customer/Name or Store.Container/Customers. The
+// annotations of the element are followed by the annotations targeting it
+// from outside, e.g. <Annotations Target="Store.Customer/Name">.
+func (service *GoDataService) LookupAnnotations(target string) []*GoDataAnnotation {
+	annotations := []*GoDataAnnotation{}
+	if service.Metadata == nil || service.Metadata.DataServices == nil {
+		return annotations
+	}
+
+	name, member := target, ""
+	if i := strings.Index(target, "/"); i >= 0 {
+		name, member = target[:i], target[i+1:]
+	}
+	add := func(found []*GoDataAnnotation) {
+		annotations = append(annotations, found...)
+	}
+	service.eachSchema(name, func(schema *GoDataSchema, local string) {
+		for _, t := range schema.EntityTypes {
+			if t.Name != local {
+				continue
+			}
+			if member == "" {
+				add(t.Annotations)
+			}
+			for _, p := range t.Properties {
+				if p.Name == member {
+					add(p.Annotations)
+				}
+			}
+			for _, p := range t.NavigationProperties {
+				if p.Name == member {
+					add(p.Annotations)
+				}
+			}
+		}
+		for _, t := range schema.ComplexTypes {
+			if t.Name != local {
+				continue
+			}
+			if member == "" {
+				add(t.Annotations)
+			}
+			for _, p := range t.Properties {
+				if p.Name == member {
+					add(p.Annotations)
+				}
+			}
+			for _, p := range t.NavigationProperties {
+				if p.Name == member {
+					add(p.Annotations)
+				}
+			}
+		}
+		for _, t := range schema.EnumTypes {
+			if t.Name != local {
+				continue
+			}
+			if member == "" {
+				add(t.Annotations)
+			}
+			for _, m := range t.Members {
+				if m.Name == member {
+					add(m.Annotations)
+				}
+			}
+		}
+		for _, c := range schema.EntityContainers {
+			if c.Name != local {
+				continue
+			}
+			if member == "" {
+				add(c.Annotations)
+			}
+			for _, s := range c.EntitySets {
+				if s.Name == member {
+					add(s.Annotations)
+				}
+			}
+			for _, s := range c.Singletons {
+				if s.Name == member {
+					add(s.Annotations)
+				}
+			}
+		}
+	})
+
+	target = service.normalizeTarget(target)
+	for _, schema := range service.Metadata.DataServices.Schemas {
+		for _, external := range schema.Annotations {
+			if service.normalizeTarget(external.Target) == target {
+				add(external.Annotations)
+			}
+		}
+	}
+	return annotations
+}
+
+// Lookup the annotation of a model element with the given term and
+// qualifier, where the term may be qualified with either the namespace or an
+// alias of its vocabulary, e.g. Core.Description. Returns nil if the element
+// has no such annotation.
+func (service *GoDataService) LookupAnnotation(target, term, qualifier string) *GoDataAnnotation {
+	term = service.normalizeTarget(term)
+	for _, annotation := range service.LookupAnnotations(target) {
+		if service.normalizeTarget(annotation.Term) == term && annotation.Qualifier == qualifier {
+			return annotation
+		}
+	}
+	return nil
+}
+
+// Replace the alias qualifying a name or a target path with the namespace it
+// stands for, e.g. Core.Description with Org.OData.Core.V1.Description.
+func (service *GoDataService) normalizeTarget(target string) string {
+	name, rest := target, ""
+	if i := strings.Index(target, "/"); i >= 0 {
+		name, rest = target[:i], target[i:]
+	}
+	i := strings.LastIndex(name, ".")
+	if i < 0 {
+		return target
+	}
+	return service.resolveNamespace(name[:i]) + name[i:] + rest
+}
+
+// The namespace an alias stands for, either in a schema of the service or in
+// a referenced document, or the name itself if it is not an alias.
+func (service *GoDataService) resolveNamespace(alias string) string {
+	if service.Metadata == nil {
+		return alias
+	}
+	if service.Metadata.DataServices != nil {
+		for _, schema := range service.Metadata.DataServices.Schemas {
+			if schema.Alias == alias {
+				return schema.Namespace
+			}
+		}
+	}
+	for _, reference := range service.Metadata.References {
+		for _, include := range reference.Includes {
+			if include.Alias == alias {
+				return include.Namespace
+			}
+		}
+	}
+	return alias
+}
+
+// Call f for each schema a type name may belong to, i.e. the schema whose
+// namespace or alias qualifies the name, or every schema if the name is not
+// qualified. Names of primitive types belong to no schema.
+func (service *GoDataService) eachSchema(name string, f func(*GoDataSchema, string)) {
+	if strings.HasPrefix(name, "Edm.") || strings.HasPrefix(name, "Collection(") ||
+		service.Metadata == nil || service.Metadata.DataServices == nil {
+		return
+	}
+	namespace, local := "", name
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		namespace, local = name[:i], name[i+1:]
+	}
+	for _, schema := range service.Metadata.DataServices.Schemas {
+		if namespace == "" || schema.Namespace == namespace || schema.Alias == namespace {
+			f(schema, local)
+		}
+	}
+}
+
+// Check whether an entity type is open, either because it is declared open or
+// because it derives from an open type.
+func (service *GoDataService) IsOpenType(entity *GoDataEntityType) bool {
+	for entity != nil {
+		if entity.IsOpenType() {
+			return true
+		}
+		if entity.BaseType == "" {
+			return false
+		}
+		base, err := service.LookupEntityType(entity.BaseType)
+		if err != nil {
+			return false
+		}
+		entity = base
+	}
+	return false
+}
+
+// Check whether an entity type is the given base type or derives from it.
+func (service *GoDataService) derivesFromEntityType(entity, base *GoDataEntityType) bool {
+	for entity != nil {
+		if entity == base {
+			return true
+		}
+		if entity.BaseType == "" {
+			return false
+		}
+		next, err := service.LookupEntityType(entity.BaseType)
+		if err != nil {
+			return false
+		}
+		entity = next
+	}
+	return false
+}
+
+// Check whether a complex type is the given base type or derives from it.
+func (service *GoDataService) derivesFromComplexType(complexType, base *GoDataComplexType) bool {
+	for complexType != nil {
+		if complexType == base {
+			return true
+		}
+		if complexType.BaseType == "" {
+			return false
+		}
+		complexType = service.LookupComplexType(complexType.BaseType)
+	}
+	return false
+}
+
 // Lookup an entity set from the service metadata. Accepts a fully qualified
 // name, e.g., ODataService.ContainerName.EntitySetName,
 // ContainerName.EntitySetName or, if unambiguous, accepts a  simple identifier,
@@ -434,3 +1435,31 @@ func (service *GoDataService) LookupEntitySet(name string) (*GoDataEntitySet, er
 	}
 	return nil, BadRequestError("Entity set " + name + " not found.")
 }
+
+// The qualified name of an entity type, e.g. ODataService.EntityTypeName.
+func (service *GoDataService) qualifiedEntityTypeName(entity *GoDataEntityType) string {
+	for namespace, e := range service.EntityTypeLookup[entity.Name] {
+		if e == entity {
+			return namespace + "." + entity.Name
+		}
+	}
+	return entity.Name
+}
+
+// Lookup a singleton by name in any entity container. Returns nil if there is
+// no such singleton.
+func (service *GoDataService) lookupSingleton(name string) *GoDataSingleton {
+	if service.Metadata == nil || service.Metadata.DataServices == nil {
+		return nil
+	}
+	for _, schema := range service.Metadata.DataServices.Schemas {
+		for _, container := range schema.EntityContainers {
+			for _, singleton := range container.Singletons {
+				if singleton.Name == name {
+					return singleton
+				}
+			}
+		}
+	}
+	return nil
+}
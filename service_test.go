@@ -1,8 +1,17 @@
 package godata
 
 import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 type DummyProvider struct {
@@ -30,6 +39,7 @@ func (*DummyProvider) GetMetadata() *GoDataMetadata {
 					EntityTypes: []*GoDataEntityType{
 						&GoDataEntityType{
 							Name: "Customer",
+							Key:  &GoDataKey{PropertyRefs: []*GoDataPropertyRef{&GoDataPropertyRef{Name: "Name"}}},
 							Properties: []*GoDataProperty{
 								&GoDataProperty{
 									Name: "Name",
@@ -50,6 +60,7 @@ func (*DummyProvider) GetMetadata() *GoDataMetadata {
 						},
 						&GoDataEntityType{
 							Name: "Order",
+							Key:  &GoDataKey{PropertyRefs: []*GoDataPropertyRef{&GoDataPropertyRef{Name: "Id"}}},
 							Properties: []*GoDataProperty{
 								&GoDataProperty{
 									Name: "Id",
@@ -64,6 +75,36 @@ func (*DummyProvider) GetMetadata() *GoDataMetadata {
 								},
 							},
 						},
+						&GoDataEntityType{
+							Name:     "Product",
+							OpenType: "true",
+							Key:      &GoDataKey{PropertyRefs: []*GoDataPropertyRef{&GoDataPropertyRef{Name: "Id"}}},
+							Properties: []*GoDataProperty{
+								&GoDataProperty{
+									Name: "Id",
+									Type: GoDataInt32,
+								},
+								&GoDataProperty{
+									Name: "Name",
+									Type: GoDataString,
+								},
+							},
+						},
+						&GoDataEntityType{
+							Name:      "Photo",
+							HasStream: "true",
+							Key:       &GoDataKey{PropertyRefs: []*GoDataPropertyRef{&GoDataPropertyRef{Name: "Id"}}},
+							Properties: []*GoDataProperty{
+								&GoDataProperty{
+									Name: "Id",
+									Type: GoDataInt32,
+								},
+								&GoDataProperty{
+									Name: "Thumbnail",
+									Type: GoDataStream,
+								},
+							},
+						},
 					},
 					EntityContainers: []*GoDataEntityContainer{
 						&GoDataEntityContainer{
@@ -85,10 +126,18 @@ func (*DummyProvider) GetMetadata() *GoDataMetadata {
 									NavigationPropertyBindings: []*GoDataNavigationPropertyBinding{
 										&GoDataNavigationPropertyBinding{
 											Path:   "Customer",
-											Target: "Customer",
+											Target: "Customers",
 										},
 									},
 								},
+								&GoDataEntitySet{
+									Name:       "Products",
+									EntityType: "Store.Product",
+								},
+								&GoDataEntitySet{
+									Name:       "Photos",
+									EntityType: "Store.Photo",
+								},
 							},
 						},
 					},
@@ -236,6 +285,679 @@ func TestSemanticizeRequestWildcard(t *testing.T) {
 
 }
 
+func TestSemanticizeOpenTypeRequest(t *testing.T) {
+	provider := &DummyProvider{}
+
+	testUrl := "Products?$filter=Color eq 'Red' and Weight gt 2.5&$select=Name,Color&$orderby=Weight"
+
+	url, err := url.Parse(testUrl)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	req, err := ParseRequest(url.Path, url.Query())
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	service, err := BuildService(provider, "http://localhost")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = SemanticizeRequest(req, service)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	color := req.Query.Filter.Tree.Children[0].Children[0].Token
+	if color.SemanticType != SemanticTypeDynamicProperty {
+		t.Error("Color is not a dynamic property")
+		return
+	}
+	if color.SemanticReference.(*GoDataProperty).Type != GoDataString {
+		t.Error("Color type is '" + color.SemanticReference.(*GoDataProperty).Type + "' not Edm.String")
+	}
+
+	weight := req.Query.Filter.Tree.Children[1].Children[0].Token
+	if weight.SemanticReference.(*GoDataProperty).Type != GoDataDouble {
+		t.Error("Weight type is '" + weight.SemanticReference.(*GoDataProperty).Type + "' not Edm.Double")
+	}
+
+	if req.Query.Select.SelectItems[1].Segments[0].SemanticType != SemanticTypeDynamicProperty {
+		t.Error("Selected Color is not a dynamic property")
+	}
+
+	if req.Query.OrderBy.OrderByItems[0].Field.SemanticType != SemanticTypeDynamicProperty {
+		t.Error("Ordered Weight is not a dynamic property")
+	}
+}
+
+func TestSemanticizeClosedTypeRejectsDynamicProperty(t *testing.T) {
+	provider := &DummyProvider{}
+
+	url, err := url.Parse("Customers?$filter=Color eq 'Red'")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	req, err := ParseRequest(url.Path, url.Query())
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	service, err := BuildService(provider, "http://localhost")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = SemanticizeRequest(req, service)
+
+	if err == nil {
+		t.Error("Filter on an undeclared property of a closed type did not fail")
+	}
+}
+
+type openTypeProvider struct {
+	DummyProvider
+}
+
+func (*openTypeProvider) GetEntity(*GoDataRequest) (*GoDataResponseField, error) {
+	return &GoDataResponseField{Value: map[string]*GoDataResponseField{
+		"Id":     &GoDataResponseField{Value: int32(1)},
+		"Name":   &GoDataResponseField{Value: "Lamp"},
+		"Color":  &GoDataResponseField{Value: "Red"},
+		"Weight": &GoDataResponseField{Value: 2.5},
+		"Stock":  &GoDataResponseField{Value: int64(40)},
+	}}, nil
+}
+
+func TestDynamicPropertyAnnotations(t *testing.T) {
+	service, err := BuildService(&openTypeProvider{}, "http://localhost")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	recorder := httptest.NewRecorder()
+	service.GoDataHTTPHandler(recorder, httptest.NewRequest("GET", "/Products(1)", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Error("Response code is " + strconv.Itoa(recorder.Code) + ": " + recorder.Body.String())
+		return
+	}
+
+	result := map[string]interface{}{}
+	err = json.Unmarshal(recorder.Body.Bytes(), &result)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if result["Weight@odata.type"] != "#Double" {
+		t.Error("Weight is not annotated as #Double")
+	}
+	if result["Stock@odata.type"] != "#Int64" {
+		t.Error("Stock is not annotated as #Int64")
+	}
+	if _, ok := result["Color@odata.type"]; ok {
+		t.Error("String dynamic property Color should not be annotated")
+	}
+	if _, ok := result["Id@odata.type"]; ok {
+		t.Error("Declared property Id should not be annotated")
+	}
+}
+
+type computeProvider struct {
+	DummyProvider
+}
+
+func (*computeProvider) GetEntity(req *GoDataRequest) (*GoDataResponseField, error) {
+	fields := map[string]*GoDataResponseField{
+		"Name": &GoDataResponseField{Value: "Bob"},
+		"Age":  &GoDataResponseField{Value: int32(41)},
+	}
+	if req.Query.Compute != nil {
+		for _, item := range req.Query.Compute.ComputeItems {
+			fields[item.Alias] = &GoDataResponseField{Value: 20.5}
+		}
+	}
+	return &GoDataResponseField{Value: fields}, nil
+}
+
+func TestComputedProperties(t *testing.T) {
+	service, err := BuildService(&computeProvider{}, "http://localhost")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	url, err := url.Parse("Customers?$compute=Age div 2.0 as Half,tolower(Name) as Lower" +
+		"&$filter=Half gt 10 and Lower eq 'bob'&$orderby=Half desc&$select=Name,Lower")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	req, err := ParseRequest(url.Path, url.Query())
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = SemanticizeRequest(req, service)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	half := req.Query.Compute.ComputeItems[0]
+	if half.Type != GoDataDouble || req.Query.Compute.ComputeItems[1].Type != GoDataString {
+		t.Error("Computed properties are not typed")
+	}
+	if req.Query.OrderBy.OrderByItems[0].Field.SemanticReference != half.Property {
+		t.Error("$orderby does not refer to the computed property")
+	}
+	if req.Query.Select.SelectItems[1].Segments[0].SemanticReference != req.Query.Compute.ComputeItems[1].Property {
+		t.Error("$select does not refer to the computed property")
+	}
+
+	recorder := httptest.NewRecorder()
+	service.GoDataHTTPHandler(recorder, httptest.NewRequest("GET",
+		"/Customers('Bob')?$compute=Age%20div%202.0%20as%20Half", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Error("Response code is " + strconv.Itoa(recorder.Code) + ": " + recorder.Body.String())
+		return
+	}
+
+	result := map[string]interface{}{}
+	err = json.Unmarshal(recorder.Body.Bytes(), &result)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if result["Half"] != 20.5 || result["Half@odata.type"] != "#Double" {
+		t.Error("Computed property Half is not serialized as #Double", recorder.Body.String())
+	}
+
+	for _, compute := range []string{"Age as Name", "Missing add 1 as X", "Age mul 2"} {
+		query, err := ParseComputeString(compute)
+		if err == nil {
+			entity, _ := service.LookupEntityType("Customer")
+			err = SemanticizeComputeQuery(query, service, entity)
+		}
+		if err == nil {
+			t.Error("$compute " + compute + " was accepted")
+		}
+	}
+}
+
+type selectProvider struct {
+	DummyProvider
+}
+
+func (*selectProvider) GetEntity(*GoDataRequest) (*GoDataResponseField, error) {
+	return &GoDataResponseField{Value: map[string]*GoDataResponseField{
+		"Name": &GoDataResponseField{Value: "Bob"},
+	}}, nil
+}
+
+func TestSelectNavigationLinks(t *testing.T) {
+	service, err := BuildService(&selectProvider{}, "http://localhost")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	recorder := httptest.NewRecorder()
+	service.GoDataHTTPHandler(recorder, httptest.NewRequest("GET", "/Customers('Bob')?$select=Name,Orders", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Error("Response code is " + strconv.Itoa(recorder.Code) + ": " + recorder.Body.String())
+		return
+	}
+
+	result := map[string]interface{}{}
+	err = json.Unmarshal(recorder.Body.Bytes(), &result)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if result["Orders"+ODataFieldNavigationLink] != "http://localhost/Customers(%27Bob%27)/Orders" {
+		t.Error("Selected navigation property Orders has no navigation link", recorder.Body.String())
+	}
+}
+
+type collectionProvider struct {
+	DummyProvider
+}
+
+func (*collectionProvider) GetEntityCollection(*GoDataRequest) (*GoDataResponseField, error) {
+	return &GoDataResponseField{Value: []*GoDataResponseField{
+		&GoDataResponseField{Value: map[string]*GoDataResponseField{
+			"Name": &GoDataResponseField{Value: "Bob"},
+		}},
+	}}, nil
+}
+
+func (*collectionProvider) GetCount(req *GoDataRequest) (int, error) {
+	if req.Query.Filter != nil {
+		if req.Query.Filter.Tree.Children[0].Token.SemanticType != SemanticTypeProperty {
+			return 0, BadRequestError("The filter was not semanticized.")
+		}
+		return 0, nil
+	}
+	return 1, nil
+}
+
+func TestCollectionWithoutCount(t *testing.T) {
+	service, err := BuildService(&collectionProvider{}, "http://localhost")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	recorder := httptest.NewRecorder()
+	service.GoDataHTTPHandler(recorder, httptest.NewRequest("GET", "/Customers", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Error("Response code is " + strconv.Itoa(recorder.Code) + ": " + recorder.Body.String())
+		return
+	}
+
+	result := map[string]interface{}{}
+	err = json.Unmarshal(recorder.Body.Bytes(), &result)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, ok := result[ODataFieldCount]; ok {
+		t.Error("Collection without $count includes a count", recorder.Body.String())
+	}
+}
+
+func TestCountEntitySet(t *testing.T) {
+	service, err := BuildService(&collectionProvider{}, "http://localhost")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	testCases := map[string]string{
+		"/Customers/$count": "1",
+		"/Customers/$count?$filter=Name%20eq%20%27Alice%27": "0",
+	}
+
+	for path, expect := range testCases {
+		recorder := httptest.NewRecorder()
+		service.GoDataHTTPHandler(recorder, httptest.NewRequest("GET", path, nil))
+
+		if recorder.Code != http.StatusOK {
+			t.Error(path + " response code is " + strconv.Itoa(recorder.Code) + ": " + recorder.Body.String())
+			continue
+		}
+		if recorder.Body.String() != expect {
+			t.Error(path + " counted " + recorder.Body.String() + " not " + expect)
+		}
+	}
+}
+
+// Remembers the last request it was given.
+type recordingProvider struct {
+	DummyProvider
+	Request *GoDataRequest
+}
+
+func (p *recordingProvider) GetEntity(req *GoDataRequest) (*GoDataResponseField, error) {
+	p.Request = req
+	return &GoDataResponseField{Value: map[string]*GoDataResponseField{
+		"Name": &GoDataResponseField{Value: "Bob"},
+	}}, nil
+}
+
+func TestNestedOptionsWithLiteralSemicolons(t *testing.T) {
+	provider := &recordingProvider{}
+	service, err := BuildService(provider, "http://localhost")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	recorder := httptest.NewRecorder()
+	service.GoDataHTTPHandler(recorder, httptest.NewRequest("GET",
+		"/Customers('Bob')?$expand=Orders($filter=Id%20ne%20%27x%27;$select=Id)", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Error("Response code is " + strconv.Itoa(recorder.Code) + ": " + recorder.Body.String())
+		return
+	}
+
+	expand := provider.Request.Query.Expand
+	if expand == nil || len(expand.ExpandItems) != 1 {
+		t.Error("$expand with a literal ; was dropped")
+		return
+	}
+	if expand.ExpandItems[0].Filter == nil || expand.ExpandItems[0].Select == nil {
+		t.Error("The nested options of Orders were not parsed")
+	}
+
+	recorder = httptest.NewRecorder()
+	service.GoDataHTTPHandler(recorder, httptest.NewRequest("GET", "/Customers('Bob')?$filter=%zz", nil))
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Error("Invalid query escape response code is " + strconv.Itoa(recorder.Code))
+	}
+}
+
+type mediaProvider struct {
+	DummyProvider
+	Content     []byte
+	ContentType string
+	Seekable    bool
+	ETag        string
+	ModTime     time.Time
+}
+
+type nopSeekCloser struct {
+	*bytes.Reader
+}
+
+func (nopSeekCloser) Close() error {
+	return nil
+}
+
+func (*mediaProvider) GetEntity(*GoDataRequest) (*GoDataResponseField, error) {
+	return &GoDataResponseField{Value: map[string]*GoDataResponseField{
+		"Id":                       &GoDataResponseField{Value: 1},
+		"Thumbnail":                &GoDataResponseField{Value: &GoDataMediaResource{ContentType: "image/jpeg"}},
+		ODataFieldMediaContentType: &GoDataResponseField{Value: "image/png"},
+	}}, nil
+}
+
+func (p *mediaProvider) GetMediaResource(*GoDataRequest) (*GoDataMediaResource, error) {
+	var content io.ReadCloser = ioutil.NopCloser(bytes.NewReader(p.Content))
+	if p.Seekable {
+		content = nopSeekCloser{bytes.NewReader(p.Content)}
+	}
+	return &GoDataMediaResource{
+		Content:     content,
+		ContentType: p.ContentType,
+		Size:        int64(len(p.Content)),
+		ETag:        p.ETag,
+		ModTime:     p.ModTime,
+	}, nil
+}
+
+func (p *mediaProvider) UpdateMediaResource(req *GoDataRequest, contentType string, body io.Reader) error {
+	content, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	p.Content = content
+	p.ContentType = contentType
+	return nil
+}
+
+func TestMediaEntityLinks(t *testing.T) {
+	service, err := BuildService(&mediaProvider{}, "http://localhost")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	recorder := httptest.NewRecorder()
+	service.GoDataHTTPHandler(recorder, httptest.NewRequest("GET", "/Photos(1)", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Error("Response code is " + strconv.Itoa(recorder.Code) + ": " + recorder.Body.String())
+		return
+	}
+
+	result := map[string]interface{}{}
+	err = json.Unmarshal(recorder.Body.Bytes(), &result)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if result[ODataFieldMediaReadLink] != "http://localhost/Photos(1)/$value" {
+		t.Error("Media read link is", result[ODataFieldMediaReadLink])
+	}
+	if result[ODataFieldMediaContentType] != "image/png" {
+		t.Error("Media content type is", result[ODataFieldMediaContentType])
+	}
+	if result["Thumbnail"+ODataFieldMediaReadLink] != "http://localhost/Photos(1)/Thumbnail" {
+		t.Error("Stream property read link is", result["Thumbnail"+ODataFieldMediaReadLink])
+	}
+	if result["Thumbnail"+ODataFieldMediaContentType] != "image/jpeg" {
+		t.Error("Stream property content type is", result["Thumbnail"+ODataFieldMediaContentType])
+	}
+	if _, ok := result["Thumbnail"]; ok {
+		t.Error("Stream property value should not be sent inline")
+	}
+}
+
+type mediaTypeProvider struct {
+	mediaProvider
+}
+
+func (*mediaTypeProvider) GetEntity(*GoDataRequest) (*GoDataResponseField, error) {
+	return &GoDataResponseField{Value: map[string]*GoDataResponseField{
+		"Id": &GoDataResponseField{Value: 1},
+	}}, nil
+}
+
+func (*mediaTypeProvider) GetMediaContentType(
+	entity *GoDataEntityType,
+	property string,
+	fields map[string]*GoDataResponseField,
+) string {
+	if property == "" {
+		return "image/gif"
+	}
+	return ""
+}
+
+func TestMediaContentTypes(t *testing.T) {
+	service, err := BuildService(&mediaTypeProvider{}, "http://localhost")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	recorder := httptest.NewRecorder()
+	service.GoDataHTTPHandler(recorder, httptest.NewRequest("GET", "/Photos(1)", nil))
+
+	result := map[string]interface{}{}
+	err = json.Unmarshal(recorder.Body.Bytes(), &result)
+
+	if err != nil {
+		t.Error(err, recorder.Body.String())
+		return
+	}
+
+	if result[ODataFieldMediaContentType] != "image/gif" {
+		t.Error("Media content type is", result[ODataFieldMediaContentType])
+	}
+	if result["Thumbnail"+ODataFieldMediaContentType] != "application/octet-stream" {
+		t.Error("Stream property content type is", result["Thumbnail"+ODataFieldMediaContentType])
+	}
+}
+
+func TestMediaResourceRanges(t *testing.T) {
+	for _, seekable := range []bool{false, true} {
+		provider := &mediaProvider{
+			Content:     []byte("0123456789"),
+			ContentType: "text/plain",
+			Seekable:    seekable,
+		}
+		service, err := BuildService(provider, "http://localhost")
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		tests := map[string]string{
+			"":            "0123456789",
+			"bytes=2-4":   "234",
+			"bytes=7-":    "789",
+			"bytes=-2":    "89",
+			"bytes=8-100": "89",
+		}
+
+		for header, expect := range tests {
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest("GET", "/Photos(1)/$value", nil)
+			if header != "" {
+				request.Header.Set("Range", header)
+			}
+			service.GoDataHTTPHandler(recorder, request)
+
+			expectCode := http.StatusPartialContent
+			if header == "" {
+				expectCode = http.StatusOK
+			}
+			if recorder.Code != expectCode {
+				t.Error("Range '"+header+"' response code is", recorder.Code, recorder.Body.String())
+				continue
+			}
+			if recorder.Body.String() != expect {
+				t.Error("Range '" + header + "' returned '" + recorder.Body.String() + "' not '" + expect + "'")
+			}
+			if recorder.Header().Get("Content-Type") != "text/plain" {
+				t.Error("Content type is " + recorder.Header().Get("Content-Type"))
+			}
+		}
+
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "/Photos(1)/Thumbnail", nil)
+		request.Header.Set("Range", "bytes=20-")
+		service.GoDataHTTPHandler(recorder, request)
+
+		if recorder.Code != http.StatusRequestedRangeNotSatisfiable {
+			t.Error("Unsatisfiable range response code is", recorder.Code)
+		}
+	}
+}
+
+func TestMediaResourceConditionalRequests(t *testing.T) {
+	modified := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	for _, seekable := range []bool{false, true} {
+		provider := &mediaProvider{
+			Content:     []byte("0123456789"),
+			ContentType: "text/plain",
+			Seekable:    seekable,
+			ETag:        "\"v1\"",
+			ModTime:     modified,
+		}
+		service, err := BuildService(provider, "http://localhost")
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		testCases := []struct {
+			Header string
+			Value  string
+			Code   int
+		}{
+			{"If-None-Match", "\"v1\"", http.StatusNotModified},
+			{"If-None-Match", "W/\"v0\", \"v1\"", http.StatusNotModified},
+			{"If-None-Match", "\"v0\"", http.StatusOK},
+			{"If-Modified-Since", modified.Format(http.TimeFormat), http.StatusNotModified},
+			{"If-Modified-Since", modified.Add(-time.Hour).Format(http.TimeFormat), http.StatusOK},
+		}
+
+		for _, testCase := range testCases {
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest("GET", "/Photos(1)/$value", nil)
+			request.Header.Set(testCase.Header, testCase.Value)
+			service.GoDataHTTPHandler(recorder, request)
+
+			if recorder.Code != testCase.Code {
+				t.Error(testCase.Header+": "+testCase.Value+" response code is", recorder.Code,
+					"when seekable is", seekable)
+			}
+		}
+	}
+}
+
+func TestReplaceMediaResource(t *testing.T) {
+	provider := &mediaProvider{}
+	service, err := BuildService(provider, "http://localhost")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("PUT", "/Photos(1)/$value", strings.NewReader("new content"))
+	request.Header.Set("Content-Type", "text/plain")
+	service.GoDataHTTPHandler(recorder, request)
+
+	if recorder.Code != http.StatusNoContent {
+		t.Error("Response code is", recorder.Code, recorder.Body.String())
+		return
+	}
+	if string(provider.Content) != "new content" || provider.ContentType != "text/plain" {
+		t.Error("Media resource was not replaced")
+	}
+}
+
+func TestValueOfNonMediaEntity(t *testing.T) {
+	service, err := BuildService(&mediaProvider{}, "http://localhost")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	recorder := httptest.NewRecorder()
+	service.GoDataHTTPHandler(recorder, httptest.NewRequest("GET", "/Customers('Bob')/$value", nil))
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Error("Response code is", recorder.Code, recorder.Body.String())
+	}
+}
+
 func BenchmarkBuildProvider(b *testing.B) {
 	for n := 0; n < b.N; n++ {
 		provider := &DummyProvider{}
@@ -322,3 +1044,82 @@ func BenchmarkWildcardParseSemanticizeRequest(b *testing.B) {
 		}
 	}
 }
+
+func TestMetadataFormats(t *testing.T) {
+	service, err := BuildService(&DummyProvider{}, "http://localhost")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	testCases := []struct {
+		url         string
+		accept      string
+		status      int
+		contentType string
+	}{
+		{"/$metadata", "", http.StatusOK, MediaTypeXml},
+		{"/$metadata", "text/html,*/*;q=0.8", http.StatusOK, MediaTypeXml},
+		{"/$metadata?$format=json", "", http.StatusOK, MediaTypeJson},
+		{"/$metadata", "application/json", http.StatusOK, MediaTypeJson},
+		{"/$metadata", "application/xml;q=0.5,application/json", http.StatusOK, MediaTypeJson},
+		{"/$metadata?$format=xml", "application/json", http.StatusOK, MediaTypeXml},
+		{"/$metadata?$format=atom", "", http.StatusNotAcceptable, "application/json"},
+		{"/$metadata", "application/*", http.StatusOK, MediaTypeXml},
+		{"/$metadata", "application/json;q=0.9,*/*;q=0.1", http.StatusOK, MediaTypeJson},
+		{"/$metadata", "text/html", http.StatusOK, MediaTypeXml},
+		{"/Customers?$format=xml", "", http.StatusNotAcceptable, "application/json"},
+	}
+
+	for _, testCase := range testCases {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", testCase.url, nil)
+		if testCase.accept != "" {
+			request.Header.Set("Accept", testCase.accept)
+		}
+		service.GoDataHTTPHandler(recorder, request)
+
+		if recorder.Code != testCase.status {
+			t.Error(testCase.url, testCase.accept, "response code is", recorder.Code, recorder.Body.String())
+			continue
+		}
+		if recorder.Header().Get("Content-Type") != testCase.contentType {
+			t.Error(testCase.url, testCase.accept, "content type is", recorder.Header().Get("Content-Type"))
+			continue
+		}
+		if testCase.contentType == MediaTypeJson && testCase.status == http.StatusOK {
+			if _, err := ParseMetadataJson(recorder.Body); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+}
+
+func TestEntityFormats(t *testing.T) {
+	service, err := BuildService(&openTypeProvider{}, "http://localhost")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, accept := range []string{
+		"application/xml",
+		"application/*",
+		"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
+	} {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "/Products(1)", nil)
+		request.Header.Set("Accept", accept)
+		service.GoDataHTTPHandler(recorder, request)
+
+		if recorder.Code != http.StatusOK {
+			t.Error(accept, "response code is", recorder.Code, recorder.Body.String())
+			continue
+		}
+		if recorder.Header().Get("Content-Type") != MediaTypeJson {
+			t.Error(accept, "content type is", recorder.Header().Get("Content-Type"))
+		}
+	}
+}
@@ -5,13 +5,21 @@ import (
 )
 
 func ParseTopString(top string) (*GoDataTopQuery, error) {
-	i, err := strconv.Atoi(top)
+	i, err := parseNonNegativeInt("$top", top)
 	result := GoDataTopQuery(i)
 	return &result, err
 }
 
 func ParseSkipString(skip string) (*GoDataSkipQuery, error) {
-	i, err := strconv.Atoi(skip)
+	i, err := parseNonNegativeInt("$skip", skip)
 	result := GoDataSkipQuery(i)
 	return &result, err
 }
+
+func parseNonNegativeInt(option, value string) (int, error) {
+	i, err := strconv.Atoi(value)
+	if err != nil || i < 0 {
+		return 0, BadRequestError(option + " must be a non-negative integer, not '" + value + "'.")
+	}
+	return i, nil
+}
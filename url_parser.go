@@ -8,19 +8,56 @@ import (
 // Parse a request from the HTTP server and format it into a GoDaataRequest type
 // to be passed to a provider to produce a result.
 func ParseRequest(path string, query url.Values) (*GoDataRequest, error) {
+	return ParseRequestWithFunctions(path, query, GlobalFilterFunctions)
+}
 
+// Parse a request whose $filter may call the functions in the given table,
+// e.g. the custom functions registered on a service.
+func ParseRequestWithFunctions(path string, query url.Values, functions *FilterFunctionTable) (*GoDataRequest, error) {
 	firstSegment, lastSegment, err := ParseUrlPath(path)
 	if err != nil {
 		return nil, err
 	}
-	parsedQuery, err := ParseUrlQuery(query)
+	parsedQuery, err := ParseUrlQueryWithFunctions(query, functions)
 	if err != nil {
 		return nil, err
 	}
+	for segment := firstSegment; segment != nil; segment = segment.Next {
+		if err := substituteIdentifierAliases(segment.Identifier, parsedQuery.Aliases); err != nil {
+			return nil, err
+		}
+	}
 
 	return &GoDataRequest{firstSegment, lastSegment, parsedQuery, RequestKindUnknown}, nil
 }
 
+// Parse the raw query string of a URL into its query options. Unlike
+// url.ParseQuery, only & separates the options, since a literal ; separates
+// the nested options of $expand and $select, e.g.
+// $expand=Orders($filter=Amount gt 5;$select=Amount).
+func ParseQueryValues(rawQuery string) (url.Values, error) {
+	values := url.Values{}
+	for _, option := range strings.Split(rawQuery, "&") {
+		if option == "" {
+			continue
+		}
+		key, value := option, ""
+		if i := strings.Index(option, "="); i >= 0 {
+			key, value = option[:i], option[i+1:]
+		}
+		key, err := url.QueryUnescape(key)
+		if err != nil {
+			return nil, BadRequestError("Invalid query option " + option + ".")
+		}
+		value, err = url.QueryUnescape(value)
+		if err != nil {
+			return nil, BadRequestError("Invalid value of query option " + key + ".")
+		}
+		values[key] = append(values[key], value)
+	}
+	return values, nil
+}
+
 // Compare a request to a given service, and validate the semantics and update
 // the request with semantics included
 func SemanticizeRequest(req *GoDataRequest, service *GoDataService) error {
@@ -40,7 +77,17 @@ func SemanticizeRequest(req *GoDataRequest, service *GoDataService) error {
 		if err != nil {
 			return err
 		}
-		err = SemanticizeFilterQuery(req.Query.Filter, service, entityType)
+		// $apply is evaluated first, and the other options apply to the set
+		// it produces, along with the properties computed by $compute
+		scope, err := semanticizeApply(req.Query.Apply, service, entityType)
+		if err != nil {
+			return err
+		}
+		scope, err = semanticizeCompute(req.Query.Compute, service, entityType, scope)
+		if err != nil {
+			return err
+		}
+		err = semanticizeFilterInScope(req.Query.Filter, service, entityType, scope)
 		if err != nil {
 			return err
 		}
@@ -48,19 +95,52 @@ func SemanticizeRequest(req *GoDataRequest, service *GoDataService) error {
 		if err != nil {
 			return err
 		}
-		err = SemanticizeSelectQuery(req.Query.Select, service, entityType)
+		err = semanticizeSelect(req.Query.Select, service, entityType, nil, scope)
+		if err != nil {
+			return err
+		}
+		err = semanticizeOrderByInScope(req.Query.OrderBy, service, entityType, scope)
 		if err != nil {
 			return err
 		}
-		err = SemanticizeOrderByQuery(req.Query.OrderBy, service, entityType)
+		err = service.checkCapabilities(req, entitySet)
 		if err != nil {
 			return err
 		}
 		// TODO: disallow invalid query params
+	case *GoDataSegment:
+		// the $count of an entity set counts the entities matching its filter
+		prev := req.LastSegment.SemanticReference.(*GoDataSegment)
+		entitySet, ok := prev.SemanticReference.(*GoDataEntitySet)
+		if !ok || req.LastSegment.SemanticType != SemanticTypeCount || !prev.addressesCollection() {
+			break
+		}
+		entityType, err := service.LookupEntityType(entitySet.EntityType)
+		if err != nil {
+			return err
+		}
+		scope, err := semanticizeApply(req.Query.Apply, service, entityType)
+		if err != nil {
+			return err
+		}
+		err = semanticizeFilterInScope(req.Query.Filter, service, entityType, scope)
+		if err != nil {
+			return err
+		}
+		err = service.checkCapabilities(req, entitySet)
+		if err != nil {
+			return err
+		}
 	case *GoDataEntityType:
 		entityType := req.LastSegment.SemanticReference.(*GoDataEntityType)
-		SemanticizeExpandQuery(req.Query.Expand, service, entityType)
-		SemanticizeSelectQuery(req.Query.Select, service, entityType)
+		err := SemanticizeExpandQuery(req.Query.Expand, service, entityType)
+		if err != nil {
+			return err
+		}
+		err = SemanticizeSelectQuery(req.Query.Select, service, entityType)
+		if err != nil {
+			return err
+		}
 	}
 
 	if req.LastSegment.SemanticType == SemanticTypeMetadata {
@@ -68,13 +148,26 @@ func SemanticizeRequest(req *GoDataRequest, service *GoDataService) error {
 	} else if req.LastSegment.SemanticType == SemanticTypeRef {
 		req.RequestKind = RequestKindRef
 	} else if req.LastSegment.SemanticType == SemanticTypeEntitySet {
-		if req.LastSegment.Identifier == nil {
+		if req.LastSegment.addressesCollection() {
 			req.RequestKind = RequestKindCollection
 		} else {
 			req.RequestKind = RequestKindEntity
 		}
 	} else if req.LastSegment.SemanticType == SemanticTypeCount {
 		req.RequestKind = RequestKindCount
+	} else if req.LastSegment.SemanticType == SemanticTypeProperty {
+		if req.LastSegment.SemanticReference.(*GoDataProperty).Type == GoDataStream {
+			req.RequestKind = RequestKindMediaResource
+		} else {
+			req.RequestKind = RequestKindProperty
+		}
+	} else if req.LastSegment.SemanticType == SemanticTypeValue {
+		if req.LastSegment.Prev.SemanticType == SemanticTypeProperty &&
+			req.LastSegment.Prev.SemanticReference.(*GoDataProperty).Type != GoDataStream {
+			req.RequestKind = RequestKindPropertyValue
+		} else {
+			req.RequestKind = RequestKindMediaResource
+		}
 	} else if req.FirstSegment == nil && req.LastSegment == nil {
 		req.RequestKind = RequestKindService
 	}
@@ -146,7 +239,43 @@ func SemanticizePathSegment(segment *GoDataSegment, service *GoDataService) erro
 		return nil
 	}
 
-	if _, ok := service.EntitySetLookup[segment.Name]; ok {
+	if segment.RawValue == "$value" {
+		// this is the raw value of a property, or the media resource of an entity
+		if segment.Next != nil {
+			return BadRequestError("A $value segment must be last.")
+		}
+		if segment.Prev == nil {
+			return BadRequestError("A $value segment must be preceded by something.")
+		}
+
+		if segment.Prev.SemanticType == SemanticTypeEntitySet {
+			if segment.Prev.addressesCollection() {
+				return BadRequestError("A $value segment must follow a single entity.")
+			}
+			set := segment.Prev.SemanticReference.(*GoDataEntitySet)
+			entity, err := service.LookupEntityType(set.EntityType)
+			if err != nil {
+				return err
+			}
+			if !entity.IsMediaEntity() {
+				return BadRequestError("Entity type " + entity.Name + " is not a media entity.")
+			}
+		} else if segment.Prev.SemanticType != SemanticTypeProperty {
+			return BadRequestError("A $value segment must follow an entity or a property.")
+		}
+
+		segment.SemanticType = SemanticTypeValue
+		segment.SemanticReference = segment.Prev
+		return nil
+	}
+
+	if segment.Prev != nil && segment.Prev.SemanticType == SemanticTypeEntitySet {
+		if nav, err := semanticizeNavigationSegment(segment, service); nav || err != nil {
+			return err
+		}
+	}
+
+	if _, ok := service.EntitySetLookup[segment.Name]; ok && segment.Prev == nil {
 		// this is an entity set
 		segment.SemanticType = SemanticTypeEntitySet
 		segment.SemanticReference, err = service.LookupEntitySet(segment.Name)
@@ -154,30 +283,16 @@ func SemanticizePathSegment(segment *GoDataSegment, service *GoDataService) erro
 			return err
 		}
 
-		if segment.Prev == nil {
-			// this is the first segment
-			if segment.Next == nil {
-				// this is the only segment
-				return nil
-			} else {
-				// there is at least one more segment
-				if segment.Identifier != nil {
-					return BadRequestError("An entity set must be the last segment.")
-				}
-				// if it has an identifier, it is allowed
-				return nil
-			}
-		} else if segment.Next == nil {
-			// this is the last segment in a sequence of more than one
-			return nil
-		} else {
-			// this is a middle segment
-			if segment.Identifier != nil {
-				return BadRequestError("An entity set must be the last segment.")
-			}
-			// if it has an identifier, it is allowed
+		if segment.Next == nil {
+			// this is the only segment
 			return nil
 		}
+		// there is at least one more segment
+		if segment.Identifier == nil && segment.Next.RawValue != "$count" {
+			return BadRequestError("An entity set must be the last segment.")
+		}
+		// if it has an identifier or is counted, it is allowed
+		return nil
 	}
 
 	if segment.Prev != nil && segment.Prev.SemanticType == SemanticTypeEntitySet {
@@ -192,6 +307,9 @@ func SemanticizePathSegment(segment *GoDataSegment, service *GoDataService) erro
 
 		for _, p := range entity.Properties {
 			if p.Name == segment.Name {
+				if p.Type == GoDataStream && segment.Prev.addressesCollection() {
+					return BadRequestError("A stream property must follow a single entity.")
+				}
 				segment.SemanticType = SemanticTypeProperty
 				segment.SemanticReference = p
 				return nil
@@ -204,9 +322,58 @@ func SemanticizePathSegment(segment *GoDataSegment, service *GoDataService) erro
 	return BadRequestError("Invalid segment " + segment.RawValue)
 }
 
+// Resolve a segment following a single entity as a navigation property of
+// its entity type, e.g. Customer in Orders(10)/Customer. The segment refers
+// to the entity set the property is bound to. Returns false if the entity
+// type has no such navigation property.
+func semanticizeNavigationSegment(segment *GoDataSegment, service *GoDataService) (bool, error) {
+	prev := segment.Prev
+	set := prev.SemanticReference.(*GoDataEntitySet)
+	entity, err := service.LookupEntityType(set.EntityType)
+	if err != nil {
+		return false, err
+	}
+	nav, ok := service.NavigationPropertyLookup[entity][segment.Name]
+	if !ok {
+		return false, nil
+	}
+
+	if prev.addressesCollection() {
+		return true, BadRequestError("The navigation property " + segment.Name +
+			" must follow a single entity.")
+	}
+	target := boundEntitySet(service, set, segment.Name)
+	if target == nil {
+		return true, BadRequestError("The navigation property " + segment.Name + " of entity set " + set.Name +
+			" is not bound to an entity set.")
+	}
+	segment.SemanticType = SemanticTypeEntitySet
+	segment.SemanticReference = target
+	segment.NavigationProperty = nav
+
+	collection := strings.HasPrefix(nav.Type, "Collection(")
+	if segment.Identifier != nil && !collection {
+		return true, BadRequestError("The navigation property " + segment.Name +
+			" is not a collection, it can not be followed by a key.")
+	}
+	if segment.Next != nil && segment.addressesCollection() && segment.Next.RawValue != "$count" {
+		return true, BadRequestError("A collection-valued navigation property must be the last segment, " +
+			"unless it is followed by a key or $count.")
+	}
+	return true, nil
+}
+
 func ParseUrlQuery(query url.Values) (*GoDataQuery, error) {
+	return ParseUrlQueryWithFunctions(query, GlobalFilterFunctions)
+}
+
+// Parse the query options of a request, where $filter may call the functions
+// in the given table.
+func ParseUrlQueryWithFunctions(query url.Values, functions *FilterFunctionTable) (*GoDataQuery, error) {
+	query = normalizeSystemQueryOptions(query)
 	filter := query.Get("$filter")
 	apply := query.Get("$apply")
+	compute := query.Get("$compute")
 	expand := query.Get("$expand")
 	sel := query.Get("$select")
 	orderby := query.Get("$orderby")
@@ -217,35 +384,41 @@ func ParseUrlQuery(query url.Values) (*GoDataQuery, error) {
 	search := query.Get("$search")
 	format := query.Get("$format")
 
-	result := &GoDataQuery{}
+	result := &GoDataQuery{Aliases: ParseAliases(query), CustomOptions: ParseCustomOptions(query)}
 
 	var err error = nil
 	if filter != "" {
-		result.Filter, err = ParseFilterString(filter)
+		result.Filter, err = functions.ParseFilter(filter, result.Aliases)
 	}
 	if err != nil {
 		return nil, err
 	}
 	if apply != "" {
-		result.Apply, err = ParseApplyString(apply)
+		result.Apply, err = ParseApplyStringWithFunctions(apply, result.Aliases, functions)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if compute != "" {
+		result.Compute, err = ParseComputeStringWithFunctions(compute, result.Aliases, functions)
 	}
 	if err != nil {
 		return nil, err
 	}
 	if expand != "" {
-		result.Expand, err = ParseExpandString(expand)
+		result.Expand, err = ParseExpandStringWithFunctions(expand, result.Aliases, functions)
 	}
 	if err != nil {
 		return nil, err
 	}
 	if sel != "" {
-		result.Select, err = ParseSelectString(sel)
+		result.Select, err = ParseSelectStringWithFunctions(sel, result.Aliases, functions)
 	}
 	if err != nil {
 		return nil, err
 	}
 	if orderby != "" {
-		result.OrderBy, err = ParseOrderByString(orderby)
+		result.OrderBy, err = ParseOrderByStringWithFunctions(orderby, result.Aliases, functions)
 	}
 	if err != nil {
 		return nil, err
@@ -281,7 +454,7 @@ func ParseUrlQuery(query url.Values) (*GoDataQuery, error) {
 		return nil, err
 	}
 	if format != "" {
-		err = NotImplementedError("Format is not supported")
+		result.Format, err = ParseFormatString(format)
 	}
 	if err != nil {
 		return nil, err
@@ -312,6 +485,62 @@ func ParseIdentifiers(segment string) *GoDataIdentifier {
 	return &result
 }
 
+// Collect the parameter aliases from a query string. Aliases are query
+// options starting with @, e.g. @p=10.
+func ParseAliases(query url.Values) map[string]string {
+	aliases := map[string]string{}
+	for key := range query {
+		if strings.HasPrefix(key, "@") {
+			aliases[key] = query.Get(key)
+		}
+	}
+	return aliases
+}
+
+// Lower the case of the system query option names, which are
+// case-insensitive, so that e.g. $TOP is looked up as $top.
+func normalizeSystemQueryOptions(query url.Values) url.Values {
+	normalized := url.Values{}
+	for key, values := range query {
+		if strings.HasPrefix(key, "$") {
+			key = strings.ToLower(key)
+		}
+		normalized[key] = append(normalized[key], values...)
+	}
+	return normalized
+}
+
+// Collect the custom query options from a query string, which are the
+// options that are neither system query options nor aliases, e.g. debug=true.
+func ParseCustomOptions(query url.Values) map[string]string {
+	options := map[string]string{}
+	for key := range query {
+		if !strings.HasPrefix(key, "$") && !strings.HasPrefix(key, "@") {
+			options[key] = query.Get(key)
+		}
+	}
+	return options
+}
+
+// Replace the aliases used as function parameters in a path segment, e.g.
+// GetNearestAirport(lat=@lat,lon=@lon), with their values.
+func substituteIdentifierAliases(identifier *GoDataIdentifier, aliases map[string]string) error {
+	if identifier == nil {
+		return nil
+	}
+	for key, value := range *identifier {
+		if !strings.HasPrefix(value, "@") {
+			continue
+		}
+		alias, ok := aliases[value]
+		if !ok {
+			return BadRequestError("Parameter alias " + value + " is not defined.")
+		}
+		(*identifier)[key] = alias
+	}
+	return nil
+}
+
 func ParseName(segment string) string {
 	if strings.Contains(segment, "(") {
 		return segment[:strings.LastIndex(segment, "(")]
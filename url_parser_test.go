@@ -34,3 +34,134 @@ func TestUrlParser(t *testing.T) {
 		return
 	}
 }
+
+func TestUrlParserAliases(t *testing.T) {
+	testUrl := "GetNearestAirport(lat=@lat,lon=10)?$filter=Price%20gt%20@p%20and%20contains(Name,@n)" +
+		"&$orderby=@o%20desc&@p=10&@n='Milk'&@o=Name&@lat=5&@unused=1"
+	parsedUrl, err := url.Parse(testUrl)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	request, err := ParseRequest(parsedUrl.Path, parsedUrl.Query())
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if (*request.FirstSegment.Identifier)["lat"] != "5" {
+		t.Error("Function parameter lat is", (*request.FirstSegment.Identifier)["lat"])
+	}
+
+	gt := request.Query.Filter.Tree.Children[0]
+	if gt.Children[1].Token.Value != "10" || gt.Children[1].Token.Type != FilterTokenInteger {
+		t.Error("@p was not replaced with the integer 10")
+	}
+	contains := request.Query.Filter.Tree.Children[1]
+	if contains.Children[1].Token.Value != "'Milk'" || contains.Children[1].Token.Type != FilterTokenString {
+		t.Error("@n was not replaced with the string 'Milk'")
+	}
+
+	item := request.Query.OrderBy.OrderByItems[0]
+	if item.Field.Value != "Name" || item.Order != DESC {
+		t.Error("@o was not replaced with Name")
+	}
+
+	parsedUrl, _ = url.Parse("Customers?$filter=Price%20gt%20@p")
+	_, err = ParseRequest(parsedUrl.Path, parsedUrl.Query())
+	if goDataErr, ok := err.(*GoDataError); !ok || goDataErr.ResponseCode != 400 {
+		t.Error("An undefined alias was not rejected with a 400:", err)
+	}
+}
+
+func TestUrlParserCustomOptions(t *testing.T) {
+	parsedUrl, err := url.Parse("Customers?$top=1&debug=true&@p=1&trace=")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	request, err := ParseRequest(parsedUrl.Path, parsedUrl.Query())
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	options := request.Query.CustomOptions
+	if len(options) != 2 || options["debug"] != "true" || options["trace"] != "" {
+		t.Error("Custom options not collected:", options)
+	}
+}
+
+func TestUrlParserNavigationSegments(t *testing.T) {
+	schema := NewSchemaBuilder("Store", "Container")
+	customer := schema.EntityType("Customer").Key("Id", GoDataInt32).Property("Name", GoDataString)
+	order := schema.EntityType("Order").Key("Id", GoDataInt32)
+	customer.NavigationProperty("Orders", order, true)
+	order.NavigationProperty("Buyer", customer, false)
+	customers := schema.EntitySet("Customers", customer)
+	orders := schema.EntitySet("Orders", order)
+	archive := schema.EntitySet("Archive", order)
+	// the Orders of a customer are bound to the archive, not to the set
+	// named Orders
+	customers.Bind("Orders", archive)
+	orders.Bind("Buyer", customers)
+	archive.Bind("Buyer", customers)
+
+	service, err := BuildService(&builtProvider{schema.Metadata()}, "http://localhost")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	testCases := []struct {
+		url  string
+		set  string
+		kind int
+	}{
+		{"Orders(1)/Buyer", "Customers", RequestKindEntity},
+		{"Customers(1)/Orders", "Archive", RequestKindCollection},
+		{"Customers(1)/Orders(2)", "Archive", RequestKindEntity},
+		{"Customers(1)/Orders(2)/Buyer", "Customers", RequestKindEntity},
+		{"Orders(1)/Buyer/Name", "", RequestKindProperty},
+		{"Customers(1)/Orders/$count", "", RequestKindCount},
+	}
+	for _, testCase := range testCases {
+		request, err := ParseRequest(testCase.url, url.Values{})
+		if err == nil {
+			err = SemanticizeRequest(request, service)
+		}
+		if err != nil {
+			t.Error(testCase.url + ": " + err.Error())
+			continue
+		}
+		if request.RequestKind != testCase.kind {
+			t.Error(testCase.url+" is of request kind", request.RequestKind)
+		}
+		if set, ok := request.LastSegment.SemanticReference.(*GoDataEntitySet); ok && set.Name != testCase.set {
+			t.Error(testCase.url + " refers to entity set " + set.Name + ", expected " + testCase.set)
+		}
+	}
+
+	invalid := []string{
+		"Customers/Orders",
+		"Orders(1)/Buyer(1)",
+		"Customers(1)/Orders/Buyer",
+		"Customers(1)/Archive",
+		"Customers(1)/Missing",
+	}
+	for _, testUrl := range invalid {
+		request, err := ParseRequest(testUrl, url.Values{})
+		if err == nil {
+			err = SemanticizeRequest(request, service)
+		}
+		if goDataErr, ok := err.(*GoDataError); !ok || goDataErr.ResponseCode != 400 {
+			t.Error(testUrl+" was not rejected with a 400:", err)
+		}
+	}
+}